@@ -1,32 +1,49 @@
-// cmd_client.go contains the core of the VPN-client
+// cmd_client.go contains the sub-command which launches the VPN-client,
+// the core of which lives in pkg/client.
 
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
-	"net/url"
 	"os"
-	"os/exec"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 
 	"github.com/google/subcommands"
-	"github.com/gorilla/websocket"
 	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/client"
 	"github.com/skx/simple-vpn/shared"
-	"github.com/songgao/water"
 )
 
 // clientCmd is the structure for this sub-command.
 //
 type clientCmd struct {
-	// The configuration file
-	config *config.Reader
+	// netns is the network namespace to create our device within.
+	netns string
+
+	// bootstrap is the provisioning URL we download our configuration
+	// from, if it isn't already present.
+	bootstrap string
+
+	// bootstrapKey is the fingerprint of the key which must have signed
+	// the configuration we download.
+	bootstrapKey string
+
+	// importConfig is a configuration exported by the server, which
+	// we save as our configuration file.
+	importConfig string
+
+	// jsonErrors is true if we report the error we fail with as JSON.
+	jsonErrors bool
+
+	// force is true if we should start despite a weak key.
+	force bool
+
+	// fips is true if our TLS connections may only use FIPS-approved
+	// cipher suites.
+	fips bool
 }
 
 //
@@ -37,347 +54,116 @@ func (*clientCmd) Synopsis() string { return "Start the VPN-client." }
 func (*clientCmd) Usage() string {
 	return `client :
   Launch the VPN-client.
-`
-}
 
-//
-// Flag setup
-//
-func (p *clientCmd) SetFlags(f *flag.FlagSet) {
-}
+  With -netns the client's device is created within the given network
+  namespace, such as that of a container, while the client itself runs
+  outside it.  The namespace may be given by name, PID, or path:
 
-func (p *clientCmd) configureClient(dev *water.Interface, ip string, subnet string, mtu int, gateway string) error {
+    simple-vpn client -netns /proc/$(docker inspect -f '{{.State.Pid}}' app)/ns/net client.cfg
 
-	//
-	// The MTU/Device as a string
-	//
-	mtuStr := fmt.Sprintf("%d", mtu)
-	devStr := dev.Name()
+  With -bootstrap the configuration file is downloaded from the given
+  provisioning URL, if it doesn't already exist, and verified against the
+  fingerprint of the server's provisioning key:
 
-	//
-	// Ensure we have the right mask for the client IP
-	//
-	fmt.Printf("Client IP is %s\n", ip)
-	if strings.Contains(ip, ":") {
-		ip += "/128"
-	} else {
-		ip += "/32"
-	}
+    simple-vpn client -bootstrap 'https://vpn.example.com/provision?token=...' \
+        -bootstrap-key sha256:... client.cfg
 
-	//
-	// The commands we're going to execute
-	//
-	cmds := [][]string{
-		{"ip", "link", "set", "dev", devStr, "up"},
-		{"ip", "link", "set", "mtu", mtuStr, "dev", devStr},
-		{"ip", "addr", "add", ip, "dev", devStr},
-		{"ip", "route", "add", gateway, "dev", devStr},
-		{"ip", "route", "add", subnet, "via", gateway},
-	}
+  With -import the configuration file is written from the string given
+  by the server's export-config sub-command:
 
-	//
-	// For each command
-	//
-	for _, cmd := range cmds {
-
-		//
-		// Show what we're doing.
-		//
-		fmt.Printf("Running: '%s'\n", strings.Join(cmd, " "))
+    simple-vpn client -import svpn1:... client.cfg
 
-		//
-		// Run the command
-		//
-		x := exec.Command(cmd[0], cmd[1:]...)
-		x.Stdout = os.Stdout
-		x.Stderr = os.Stderr
-		err := x.Run()
-		if err != nil {
-			fmt.Printf("Failed to run %s - %s",
-				strings.Join(cmd, " "), err.Error())
+  If we fail our exit status tells why: 3 if the server refused us, 4 if
+  it couldn't be reached, 5 if our configuration is invalid, and 6 if our
+  device couldn't be created.  With -json-errors the error is reported as
+  JSON too, upon the final line of our output.
+`
+}
 
-			return err
-		}
-	}
-	return nil
+//
+// Flag setup
+//
+func (p *clientCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.netns, "netns", "", "The network namespace to create our device within.")
+	f.StringVar(&p.bootstrap, "bootstrap", "", "The provisioning URL to download our configuration from.")
+	f.StringVar(&p.bootstrapKey, "bootstrap-key", "", "The fingerprint of the key which signs our downloaded configuration.")
+	f.StringVar(&p.importConfig, "import", "", "A configuration exported by the server, to save as our configuration file.")
+	f.BoolVar(&p.jsonErrors, "json-errors", false, "Report the error we fail with as JSON.")
+	f.BoolVar(&p.force, "force", false, "Start even if our key is weak.")
+	f.BoolVar(&p.fips, "fips", shared.FIPSBuild, "Restrict TLS to the FIPS-approved cipher suites of TLS 1.2.")
 }
 
 //
 // Entry-point.
 //
-func (p *clientCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+func (p *clientCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 
 	//
 	// Ensure we have a configuration file.
 	//
 	if len(f.Args()) < 1 {
-		fmt.Printf("We expect a configuration-file to be specified.\n")
-		return subcommands.ExitFailure
-	}
-
-	//
-	// Parse the configuration file.
-	//
-	var err error
-	p.config, err = config.New(f.Args()[0])
-	if err != nil {
-		fmt.Printf("Failed to read the configuration file %s - %s\n", f.Args()[0], err.Error())
-		return subcommands.ExitFailure
+		return fatal(p.jsonErrors, &shared.ConfigError{Err: fmt.Errorf("We expect a configuration-file to be specified.")})
 	}
 
 	//
-	// Get the end-point to which we're going to connect.
+	// Download the configuration file, if we're bootstrapping, and
+	// haven't done so before, or write the one we're importing.
 	//
-	endPoint := p.config.Get("vpn")
-	if endPoint == "" {
-		fmt.Printf("The configuration file didn't include a vpn=... line\n")
-		fmt.Printf("We don't know where to connect!  Aborting.\n")
-		return subcommands.ExitFailure
-	}
-
-	//
-	// Get the shared-secret.
-	//
-	key := p.config.Get("key")
-	if key == "" {
-		fmt.Printf("The configuration file didn't include key=... line\n")
-		fmt.Printf("That means authentication is impossible! Aborting.\n")
-		return subcommands.ExitFailure
-	}
-
-	//
-	// Get our client-name
-	//
-	name := p.config.Get("name")
-	if name == "" {
-		//
-		// If none is set then send the hostname.
-		//
-		name, _ = os.Hostname()
+	if p.bootstrap != "" {
+		policy, err := shared.LoadTLSPolicy(nil, p.fips)
+		if err == nil {
+			err = client.Bootstrap(p.bootstrap, p.bootstrapKey, f.Args()[0], policy)
+		}
+		if err != nil {
+			return fatal(p.jsonErrors, err)
+		}
 	}
 
-	//
-	// Add our name/key to the connection URI.
-	//
-	// Note that the URL might contain "?" already.  Unlikely, but
-	// certainly possible.
-	//
-	if strings.Contains(endPoint, "?") {
-		endPoint += "&"
-	} else {
-		endPoint += "?"
+	if p.importConfig != "" {
+		err := client.Import(p.importConfig, f.Args()[0])
+		if err != nil {
+			return fatal(p.jsonErrors, &shared.ConfigError{Err: fmt.Errorf("Failed to import our configuration - %s", err.Error())})
+		}
 	}
-	endPoint += "name=" + url.QueryEscape(name)
-	endPoint += "&"
-	endPoint += "key=" + url.QueryEscape(key)
 
 	//
-	// Connect to the remote host.
+	// Parse the configuration file.
 	//
-	conn, _, err := websocket.DefaultDialer.Dial(endPoint, nil)
+	cfg, err := config.New(f.Args()[0])
 	if err != nil {
-		fmt.Printf("Failed to connect to %s\n", endPoint)
-		fmt.Printf("%s\n", err.Error())
-		fmt.Printf("(The connection failed, or the key was bogus.)\n")
-		return 1
+		return fatal(p.jsonErrors, &shared.ConfigError{Err: fmt.Errorf("Failed to read the configuration file %s - %s", f.Args()[0], err.Error())})
 	}
-	defer conn.Close()
 
 	//
-	// Now we're cooking.
-	//
-	var iface *water.Interface
-
+	// When we're stopped we disconnect cleanly, so that our `down`
+	// hook runs, and our device is removed.
 	//
-	// When we're disconnected we cleanup the interface.
-	//
-	defer func() {
-		if iface != nil {
-			iface.Close()
-		}
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		stop()
 	}()
 
 	//
-	// Setup command-handlers for adding routes, etc.
+	// Connect, and run until we're disconnected.
 	//
-	socket := shared.MakeSocket("0", conn, nil, nil)
+	err = client.Connect(ctx, client.Options{Config: cfg, Version: version, Netns: p.netns, AllowWeakKey: p.force, FIPS: p.fips})
 
 	//
-	// Init is the function which is received when we connect.
-	//
-	// This gives us our IP, MTU, etc.
+	// If we installed a new version we run it in our place, with the
+	// same arguments.
 	//
-	socket.AddCommandHandler("init", func(args []string) error {
-		var err error
-
-		//
-		// We receive these arguments
-		//
-		//  1.  subnet
-		//  2.  ip address
-		//  3.  mtu
-		//  4.  gateway
-		//
-		subnetStr := args[0]
-		ipStr := args[1]
-		mtuStr := args[2]
-		gatewayStr := args[3]
-
-		mtu, err := strconv.Atoi(mtuStr)
-		if err != nil {
-			fmt.Printf("MTU was not a valid int: %s\n", err.Error())
-			os.Exit(1)
-		}
-
-		//
-		// Create the TUN device
-		//
-		var waterMode water.DeviceType
-		waterMode = water.TUN
-
-		iface, err = water.New(water.Config{
-			DeviceType: waterMode,
-		})
-		if err != nil {
-			fmt.Printf("Failed to create a new TUN device: %s\n", err.Error())
-			os.Exit(1)
-		}
-
-		//
-		// Now configure it.
-		//
-		err = p.configureClient(iface, ipStr, subnetStr, mtu, gatewayStr)
-		if err != nil {
-			panic(err)
-		}
-
-		//
-		// If we reached this point we're basically done.
-		//
-		// Launch the "up" script, if we can.
-		//
-		if p.config.Get("up") != "" {
-
-			//
-			// Setup the environment.
-			//
-			os.Setenv("DEVICE", iface.Name())
-			os.Setenv("CLIENT_IP", ipStr)
-			os.Setenv("SERVER_IP", gatewayStr)
-			os.Setenv("SUBNET", subnetStr)
-			os.Setenv("MTU", mtuStr)
-
-			//
-			// Launch the script.
-			//
-			cmd := p.config.Get("up")
-
-			x := exec.Command(cmd)
-			x.Stdout = os.Stdout
-			x.Stderr = os.Stderr
-			err = x.Run()
-			if err != nil {
-				fmt.Printf("Failed to run %s - %s",
-					cmd, err.Error())
-
-			}
-
-		}
-
-		//
-		// Now we start shuffling packets.
-		//
-		log.Printf("Configured interface, the VPN is up!")
-		err = socket.SetInterface(iface)
-		if err != nil {
-			fmt.Printf("Failed bind socket-magic to TUN device: %s\n", err.Error())
-			os.Exit(1)
-		}
-
-		//
-		// Send a command to the server, asking it to update all
-		// clients with the list of known-peers (and their IPs).
-		//
-		socket.SendCommand("refresh-peers", "now")
-
-		return nil
-	})
-
-	//
-	// This function is invoked when clients join/leave the VPN.
-	//
-	// It is the function which is called as a result of the server
-	// handling the `refresh` command that we sent at join-time.
-	//
-	socket.AddCommandHandler("update-peers", func(args []string) error {
-
-		fmt.Printf("Preparing to update peer-list\n")
-
-		//
-		// If the client has not defined a `peers` command then
-		// we can just return here.
-		//
-		cmd := p.config.Get("peers")
-		if cmd == "" {
-			fmt.Printf("Peer command is empty.\n")
-			return nil
-		}
-
-		//
-		// OK we have a command.
-		//
-		fmt.Printf("Updating peer-list now.\n")
-
-		//
-		// We're given an array of strings such as:
-		//
-		//  "1.2.3.3\tsteve",
-		//  "1.2.3.4\tgold",
-		//
-		// Convert that into a simple structure.
-		//
-		type Client struct {
-			Name string
-			IP   string
-		}
-
-		//
-		// The thing we'll send
-		//
-		var connected []Client
-
-		//
-		// Populate, appropriately.
-		//
-		for _, ent := range args {
-			out := strings.Split(ent, "\t")
-			connected = append(connected, Client{Name: out[1], IP: out[0]})
-		}
-
-		//
-		// Convert to JSON.
-		//
-		obj, err := json.Marshal(connected)
-		if err != nil {
-			fmt.Printf("Failed to convert object to JSON: %s\n", err.Error())
-			return err
-		}
-
-		x := exec.Command(cmd)
-		x.Stdin = bytes.NewBuffer(obj)
-		x.Stdout = os.Stdout
-		x.Stderr = os.Stderr
-		err = x.Run()
-		if err != nil {
-			fmt.Printf("Failed to run %s - %s",
-				cmd, err.Error())
-			return err
-		}
-		return nil
-	})
-
-	socket.Serve(false)
-	socket.Wait()
+	if updated, ok := err.(*client.UpdatedError); ok {
+		fmt.Printf("Restarting, to run version %s\n", updated.Version)
+		err = syscall.Exec(updated.Path, os.Args, os.Environ())
+		return fatal(p.jsonErrors, fmt.Errorf("Failed to restart - %s", err.Error()))
+	}
+	if err != nil {
+		return fatal(p.jsonErrors, err)
+	}
 
 	return subcommands.ExitSuccess
 }
@@ -0,0 +1,98 @@
+// cmd_client_status.go contains the sub-command which queries the
+// control-socket of the running VPN-client.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/pkg/client"
+)
+
+// clientStatusCmd is the structure for this sub-command.
+type clientStatusCmd struct {
+	// socket is the path to the control-socket of the client.
+	socket string
+
+	// json is set if we should output the raw status.
+	json bool
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*clientStatusCmd) Name() string     { return "client-status" }
+func (*clientStatusCmd) Synopsis() string { return "Show the status of the running VPN-client." }
+func (*clientStatusCmd) Usage() string {
+	return `client-status :
+  Show the state, traffic, and peers of the running VPN-client.
+`
+}
+
+//
+// Flag setup
+//
+func (p *clientStatusCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.socket, "socket", client.DefaultControlSocket, "The path to the client's control-socket.")
+	f.BoolVar(&p.json, "json", false, "Output the status as JSON.")
+}
+
+//
+// Entry-point.
+//
+func (p *clientStatusCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	status, err := client.QueryStatus(p.socket)
+	if err != nil {
+		fmt.Printf("Failed to query the client at %s - %s\n", p.socket, err.Error())
+		fmt.Printf("(Is the client running?)\n")
+		return subcommands.ExitFailure
+	}
+
+	if p.json {
+		out, _ := json.MarshalIndent(status, "", "  ")
+		fmt.Printf("%s\n", out)
+		return subcommands.ExitSuccess
+	}
+
+	fmt.Printf("State:     %s\n", status.State)
+	fmt.Printf("Server:    %s\n", status.Server)
+	if status.State == "up" {
+		fmt.Printf("Device:    %s\n", status.Device)
+		fmt.Printf("IP:        %s\n", status.IP)
+		fmt.Printf("Gateway:   %s\n", status.Gateway)
+		fmt.Printf("Subnet:    %s\n", status.Subnet)
+		fmt.Printf("MTU:       %d\n", status.MTU)
+		fmt.Printf("Framing:   %s\n", status.Framing)
+		if len(status.Commands) > 0 {
+			fmt.Printf("Commands:  %s\n", strings.Join(status.Commands, ", "))
+		}
+	}
+	if status.KeyExchange != "" {
+		fmt.Printf("Frames:    compressed %v, encrypted %v, keyed by %s\n", status.Compressed, status.Encrypted, status.KeyExchange)
+	} else {
+		fmt.Printf("Frames:    compressed %v, encrypted %v\n", status.Compressed, status.Encrypted)
+	}
+	if status.TLS != "" {
+		fmt.Printf("TLS:       %s\n", status.TLS)
+	}
+	fmt.Printf("RTT:       %.2fms\n", status.RTT)
+	fmt.Printf("Received:  %d bytes, %d packets\n", status.Stats.RxBytes, status.Stats.RxPackets)
+	fmt.Printf("Sent:      %d bytes, %d packets\n", status.Stats.TxBytes, status.Stats.TxPackets)
+	fmt.Printf("Dropped:   %d received, %d sent\n", status.Stats.Dropped, status.Stats.TxDropped)
+	fmt.Printf("Peers:\n")
+	for _, peer := range status.Peers {
+		if addr, ok := status.Direct[peer.IP]; ok {
+			fmt.Printf("\t%s\t%s\t(direct via %s)\n", peer.IP, peer.Name, addr)
+		} else {
+			fmt.Printf("\t%s\t%s\n", peer.IP, peer.Name)
+		}
+	}
+
+	return subcommands.ExitSuccess
+}
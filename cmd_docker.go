@@ -0,0 +1,79 @@
+// cmd_docker.go contains the sub-command which runs our Docker
+// network-driver, the core of which lives in pkg/docker.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/pkg/docker"
+)
+
+// dockerCmd is the structure for this sub-command.
+type dockerCmd struct {
+	// socket is the path upon which we serve Docker.
+	socket string
+
+	// state is the directory holding our state.
+	state string
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*dockerCmd) Name() string     { return "docker-plugin" }
+func (*dockerCmd) Synopsis() string { return "Run the Docker network-driver." }
+func (*dockerCmd) Usage() string {
+	return `docker-plugin :
+  Run a Docker network-driver, which lets containers join the VPN.
+
+  Create a network whose containers each run a VPN-client, configured
+  by the given file, and whose devices live within the containers:
+
+    docker network create -d simple-vpn --ipam-driver null \
+        -o config=/etc/simple-vpn/client.cfg vpn
+`
+}
+
+//
+// Flag setup
+//
+func (p *dockerCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.socket, "socket", "/run/docker/plugins/simple-vpn.sock", "The socket upon which Docker finds the driver.")
+	f.StringVar(&p.state, "state", "/var/run/simple-vpn", "The directory in which we keep our state.")
+}
+
+//
+// Entry-point.
+//
+func (p *dockerCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	//
+	// When we're stopped we disconnect every container.
+	//
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		stop()
+	}()
+
+	driver := docker.New(version)
+	driver.StateDir = p.state
+
+	fmt.Printf("Serving the Docker network-driver on %s\n", p.socket)
+	err := driver.Serve(ctx, p.socket)
+	if err != nil {
+		fmt.Printf("Failed to serve the Docker network-driver - %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
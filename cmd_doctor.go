@@ -0,0 +1,571 @@
+// cmd_doctor.go contains the sub-command which diagnoses common problems
+// with the environment we're running in, and with our configuration.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/provision"
+	"github.com/skx/simple-vpn/pkg/registry"
+	"github.com/skx/simple-vpn/pkg/geoip"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in the capability-sets.
+const capNetAdmin = 12
+
+// doctorCmd is the structure for this sub-command.
+type doctorCmd struct {
+	// failures counts the checks which failed.
+	failures int
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*doctorCmd) Name() string     { return "doctor" }
+func (*doctorCmd) Synopsis() string { return "Diagnose problems with our environment." }
+func (*doctorCmd) Usage() string {
+	return `doctor [config-file] :
+  Check that this host can run the VPN-server, or client, and that the
+  given configuration file is sane.
+`
+}
+
+//
+// Flag setup
+//
+func (p *doctorCmd) SetFlags(f *flag.FlagSet) {
+}
+
+// pass reports a check which passed.
+func (p *doctorCmd) pass(format string, args ...interface{}) {
+	fmt.Printf("[PASS] %s\n", fmt.Sprintf(format, args...))
+}
+
+// warn reports a check which found something which might be a problem,
+// along with a hint as to how to fix it.
+func (p *doctorCmd) warn(hint string, format string, args ...interface{}) {
+	fmt.Printf("[WARN] %s\n", fmt.Sprintf(format, args...))
+	fmt.Printf("       %s\n", hint)
+}
+
+// fail reports a check which failed, along with a hint as to how to fix
+// it.
+func (p *doctorCmd) fail(hint string, format string, args ...interface{}) {
+	p.failures++
+	fmt.Printf("[FAIL] %s\n", fmt.Sprintf(format, args...))
+	fmt.Printf("       %s\n", hint)
+}
+
+// checkTun ensures that we can open the TUN/TAP clone-device.
+func (p *doctorCmd) checkTun() {
+	file, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			p.fail("Load the module with 'modprobe tun', or pass /dev/net/tun into your container.",
+				"/dev/net/tun does not exist")
+		} else {
+			p.fail("Run as root, or check the permissions of the device.",
+				"/dev/net/tun cannot be opened: %s", err.Error())
+		}
+		return
+	}
+	file.Close()
+	p.pass("/dev/net/tun is available")
+}
+
+// checkCapability ensures that we have CAP_NET_ADMIN, which is required
+// to create, and configure, our devices.
+func (p *doctorCmd) checkCapability() {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		p.warn("We couldn't read /proc/self/status.", "Cannot determine our capabilities")
+		return
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			break
+		}
+		if caps&(1<<capNetAdmin) == 0 {
+			p.fail("Run as root, or grant it with 'setcap cap_net_admin+ep $(which simple-vpn)'.",
+				"We lack the CAP_NET_ADMIN capability")
+			return
+		}
+		p.pass("We have the CAP_NET_ADMIN capability")
+		return
+	}
+	p.warn("We couldn't parse /proc/self/status.", "Cannot determine our capabilities")
+}
+
+// checkIP ensures that the `ip` command, from iproute2, is available to
+// configure our devices.
+func (p *doctorCmd) checkIP() {
+	path, err := exec.LookPath("ip")
+	if err != nil {
+		p.fail("Install the iproute2 package, and ensure 'ip' is upon your PATH.",
+			"The 'ip' command is not available")
+		return
+	}
+	p.pass("The 'ip' command is available at %s", path)
+}
+
+// checkForwarding reports whether IP forwarding is enabled, which is
+// required if clients route traffic beyond the VPN via the server.
+func (p *doctorCmd) checkForwarding() {
+	for _, sysctl := range []string{"net.ipv4.ip_forward", "net.ipv6.conf.all.forwarding"} {
+		path := "/proc/sys/" + strings.Replace(sysctl, ".", "/", -1)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(data)) != "1" {
+			p.warn(fmt.Sprintf("If clients should reach networks beyond the VPN run 'sysctl -w %s=1'.", sysctl),
+				"%s is disabled", sysctl)
+		} else {
+			p.pass("%s is enabled", sysctl)
+		}
+	}
+}
+
+// checkDevice reports whether a device with the given name already
+// exists, which will conflict with the one we create.
+func (p *doctorCmd) checkDevice(name string) {
+	if shared.IsDeviceTemplate(name) {
+		free, err := shared.FreeDeviceName(name, 0)
+		if err != nil {
+			p.fail("Set 'device' to a different template.", "%s", err.Error())
+			return
+		}
+		p.pass("The device template %s would use %s", name, free)
+		return
+	}
+	_, err := net.InterfaceByName(name)
+	if err == nil {
+		p.warn(fmt.Sprintf("Stop whatever is using it, or set 'device' to a different name, or 'device_collision = recreate'.  ('ip link del %s' removes it.)", name),
+			"The device %s already exists", name)
+		return
+	}
+	p.pass("The device name %s is free", name)
+}
+
+// checkPersistentDevice reports whether the persistent device with the
+// given name, and mode, exists.
+func (p *doctorCmd) checkPersistentDevice(name string, mode string) {
+	_, err := net.InterfaceByName(name)
+	if err != nil {
+		p.fail(fmt.Sprintf("Create it with 'ip tuntap add dev %s mode %s user svpn', or similar.", name, mode),
+			"The persistent device %s doesn't exist", name)
+		return
+	}
+	p.pass("The persistent device %s exists", name)
+}
+
+// checkServer checks the sanity of a server configuration.
+func (p *doctorCmd) checkServer(cfg *config.Reader) {
+	label := "The configuration"
+	if cfg.Name != "" {
+		label = fmt.Sprintf("The network %s", strings.TrimPrefix(cfg.Name, "network "))
+	}
+
+	if cfg.Get("key") == "" {
+		p.fail("Add 'key = ...', with a long random secret.", "%s has no shared-key", label)
+	} else if err := shared.CheckKey(cfg.Get("key")); err != nil {
+		p.fail("Choose another, with 'openssl rand -base64 32'.", "%s has a weak shared-key, as %s", label, err.Error())
+	}
+
+	_, subnet, err := net.ParseCIDR(cfg.GetWithDefault("subnet", "10.137.248.0/24"))
+	if err != nil {
+		p.fail("Set 'subnet' to a CIDR range, such as 10.137.248.0/24.", "%s has an invalid subnet: %s", label, err.Error())
+	} else if pool := cfg.Get("pool"); pool != "" {
+		ip, _, err := net.ParseCIDR(pool)
+		if err != nil || !subnet.Contains(ip) {
+			p.fail("The 'pool' must be a CIDR range within the 'subnet'.", "%s has an invalid pool %s", label, pool)
+		}
+	}
+
+	var proxies []string
+	for _, entry := range shared.SplitList(cfg.Get("trusted_proxies")) {
+		if !strings.EqualFold(entry, "unix") {
+			proxies = append(proxies, entry)
+		}
+	}
+	_, err = shared.ParseNetworks(strings.Join(proxies, ","))
+	if err != nil {
+		p.fail("List IPs, CIDR ranges, or unix, separated by commas.", "%s has invalid trusted_proxies: %s", label, err.Error())
+	}
+	if header := strings.ToLower(cfg.Get("proxy_header")); header != "" && header != "forwarded" && header != "x-forwarded-for" {
+		p.fail("Set 'proxy_header' to the header your proxy writes: forwarded, or x-forwarded-for.", "%s has an invalid proxy_header %s", label, header)
+	}
+
+	_, err = shared.LoadWebsocketOptions(cfg.GetPrefixed("ws_"), 0)
+	if err != nil {
+		p.fail("See the ws_ settings in the sample server.cfg.", "%s has %s", label, err.Error())
+	}
+
+	if cfg.Name == "" {
+		_, err = shared.LoadTLSPolicy(cfg.GetPrefixed("tls_"), false)
+		if err != nil {
+			p.fail("See the tls_ settings in the sample server.cfg.", "%s has %s", label, err.Error())
+		}
+	} else if len(cfg.GetPrefixed("tls_")) > 0 {
+		p.warn("Move them to the top of the file.", "%s has tls_ settings, which only apply to every network at once", label)
+	}
+
+	for name, value := range cfg.GetPrefixed("encryption") {
+		switch value {
+		case "optional", "required", "disabled":
+		default:
+			p.fail("Set it to optional, required, or disabled.", "%s has an invalid encryption%s: %s", label, name, value)
+		}
+	}
+
+	for name, value := range cfg.GetPrefixed("kex") {
+		switch value {
+		case "optional", "disabled":
+		case "required":
+			if !shared.KeyExchangeSupported {
+				p.fail("Rebuild with Go 1.24, or later.", "%s requires the %s kex%s, which this binary lacks", label, shared.HybridKeyExchange, name)
+			}
+		default:
+			p.fail("Set it to optional, required, or disabled.", "%s has an invalid kex%s: %s", label, name, value)
+		}
+	}
+
+	for name, value := range cfg.GetPrefixed("keepalive") {
+		_, err = shared.LookupKeepalive(value)
+		if err != nil {
+			p.fail("Set it to fast, normal, or slow.", "%s has an invalid keepalive%s: %s", label, name, value)
+		}
+	}
+
+	if cfg.Get("update_version") != "" && cfg.Get("update_url") == "" {
+		p.fail("Set 'update_url' to where clients may download the new version.", "%s has an update_version, but no update_url", label)
+	}
+	for name, value := range cfg.GetPrefixed("update") {
+		if name == "_version" || name == "_url" {
+			continue
+		}
+		switch value {
+		case "notify", "install", "off":
+		default:
+			p.fail("Set it to notify, install, or off.", "%s has an invalid update%s: %s", label, name, value)
+		}
+	}
+
+	_, err = shared.ParseUnknownUnicast(cfg.Get("unknown_unicast"))
+	if err != nil {
+		p.fail("Set 'unknown_unicast' to drop, flood, or queue.", "%s has an %s", label, err.Error())
+	}
+
+	if path := cfg.Get("state_file"); path != "" {
+		if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+			p.fail(fmt.Sprintf("Create the directory %s.", filepath.Dir(path)), "%s saves its state to %s, whose directory doesn't exist", label, path)
+		}
+	}
+
+	for _, name := range shared.SplitList(cfg.Get("reserved_names")) {
+		key := cfg.GetWithDefault("key_"+name, cfg.Get("reserved_key"))
+		switch {
+		case key == "":
+			p.fail(fmt.Sprintf("Add 'key_%s = ...', or 'reserved_key = ...'.", name), "%s reserves the name %s, but gives no key to claim it", label, name)
+		case key == cfg.Get("key"):
+			p.fail(fmt.Sprintf("Give '%s' a key other than the shared-key.", name), "%s reserves the name %s with the shared-key, so any client may claim it", label, name)
+		}
+	}
+
+	_, err = shared.ParseRules(cfg.GetPrefixed("filter_"))
+	if err != nil {
+		p.fail("See the filter_ settings in the sample server.cfg.", "%s has an invalid rule %s", label, err.Error())
+	}
+
+	verdict, err := shared.ParseGateVerdict(cfg.GetWithDefault("gate_action", "reject"))
+	if err != nil {
+		p.fail("Set 'gate_action' to accept, flag, or reject.", "%s has an invalid gate_action: %s", label, err.Error())
+	}
+	if path := cfg.Get("geoip_database"); path != "" {
+		_, err = geoip.Open(path)
+		if err != nil {
+			p.fail("Download a GeoLite2 Country database from MaxMind.", "%s cannot load %s: %s", label, path, err.Error())
+		}
+	}
+	if path := cfg.Get("blocklist"); path != "" {
+		_, err = shared.LoadBlocklist(path, verdict)
+		if err != nil {
+			p.fail("List one IP, or CIDR range, per line.", "%s cannot load its blocklist: %s", label, err.Error())
+		}
+	}
+
+	for name, list := range cfg.GetPrefixed("source_") {
+		_, err = shared.ParseNetworks(list)
+		if err != nil {
+			p.fail("List IPs, or CIDR ranges, separated by commas.", "%s has invalid source_%s: %s", label, name, err.Error())
+		}
+	}
+
+	zone, err := time.LoadLocation(cfg.Get("timezone"))
+	if err != nil {
+		p.fail("Set 'timezone' to a name such as Europe/London.", "%s has an invalid timezone: %s", label, err.Error())
+		zone = time.Local
+	}
+	for name, str := range cfg.GetPrefixed("schedule_") {
+		_, err = shared.ParseSchedule(str, zone)
+		if err != nil {
+			p.fail("See the schedule_ settings in the sample server.cfg.", "%s has an invalid schedule_%s: %s", label, name, err.Error())
+		}
+	}
+
+	if spec := cfg.Get("registry"); spec != "" {
+		_, err = registry.New(spec)
+		if err != nil {
+			p.fail("Set 'registry' to consul:URL, or etcd:URL.", "%s has an invalid registry: %s", label, err.Error())
+		}
+		if cfg.Get("registry_url") == "" {
+			p.fail("Set 'registry_url' to the URL clients should connect to.", "%s has a registry, but no registry_url", label)
+		}
+	}
+
+	if hook := cfg.Get("quality_webhook"); hook != "" && !strings.HasPrefix(hook, "http://") && !strings.HasPrefix(hook, "https://") {
+		p.fail("Set 'quality_webhook' to an http:// or https:// URL.", "%s has an invalid quality_webhook: %s", label, hook)
+	}
+
+	if dir := cfg.Get("provision_dir"); dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			p.fail("Create the directory, or remove provision_dir.", "%s provisions clients from %s, which is not a directory", label, dir)
+		}
+		path := cfg.GetWithDefault("provision_key", filepath.Join(dir, "provision.key"))
+		if _, err = os.Stat(path); os.IsNotExist(err) {
+			p.warn("It will be created when the server starts.", "%s has no provisioning key %s", label, path)
+		} else {
+			key, err := provision.LoadKey(path)
+			if err != nil {
+				p.fail("Remove the key, so that a new one is created.", "%s has an invalid provisioning key: %s", label, err.Error())
+			} else {
+				fingerprint, _ := provision.Fingerprint(&key.PublicKey)
+				p.pass("%s provisions clients with the key %s", label, fingerprint)
+			}
+		}
+	}
+
+	if cfg.Get("exit_node") == "true" {
+		if cfg.Get("relay_only") == "true" || cfg.Get("client_devices") == "false" {
+			p.fail("Remove relay_only, and client_devices, or exit_node.", "%s is an exit_node, which needs a device for each client", label)
+		}
+		tool := cfg.Get("exit_firewall")
+		switch tool {
+		case "":
+			_, err = exec.LookPath("nft")
+			if err != nil {
+				_, err = exec.LookPath("iptables")
+			}
+			if err != nil {
+				p.fail("Install nftables, or iptables.", "%s is an exit_node, but neither nft nor iptables is available", label)
+			}
+		case "nft", "iptables":
+			_, err = exec.LookPath(tool)
+			if err != nil {
+				p.fail(fmt.Sprintf("Install %s, or change exit_firewall.", tool), "%s uses %s, which is not available", label, tool)
+			}
+		default:
+			p.fail("Set 'exit_firewall' to nft, or iptables.", "%s has an unknown exit_firewall", label)
+		}
+	}
+
+	framing, err := shared.ParseFraming(cfg.Get("framing"))
+	if err != nil {
+		p.fail("Set 'framing' to ethernet, or ip.", "%s has an %s", label, err.Error())
+	}
+
+	if cfg.Get("relay_only") != "true" {
+		if cfg.Get("persistent_device") == "true" {
+			mode := "tap"
+			if framing == shared.FramingIP {
+				mode = "tun"
+			}
+			p.checkPersistentDevice(cfg.GetWithDefault("device", "svpn"), mode)
+		} else {
+			p.checkDevice(cfg.GetWithDefault("device", "svpn"))
+		}
+	}
+}
+
+// checkClient checks the sanity of a client configuration.
+func (p *doctorCmd) checkClient(cfg *config.Reader) {
+	if cfg.Get("key") == "" {
+		p.fail("Add 'key = ...', with the shared-key of the server.", "The configuration has no shared-key")
+	} else if err := shared.CheckKey(cfg.Get("key")); err != nil {
+		p.fail("Choose another for the server, and client, with 'openssl rand -base64 32'.", "The configuration has a weak shared-key, as %s", err.Error())
+	}
+
+	for _, server := range strings.Split(cfg.Get("vpn"), ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if strings.HasPrefix(server, "auto:") {
+			_, servers, err := net.LookupSRV("simplevpn", "tcp", strings.TrimPrefix(server, "auto:"))
+			if err != nil || len(servers) == 0 {
+				p.fail(fmt.Sprintf("Publish SRV records for _simplevpn._tcp.%s.", strings.TrimPrefix(server, "auto:")), "No servers were discovered for %s", server)
+				continue
+			}
+			p.pass("Discovered %d servers for %s", len(servers), server)
+			continue
+		}
+		if strings.HasPrefix(server, "consul:") || strings.HasPrefix(server, "etcd:") {
+			i := strings.LastIndex(server, "/")
+			if i < 0 {
+				i = len(server)
+				server += "/"
+			}
+			catalog, err := registry.New(server[:i])
+			if err != nil {
+				p.fail("Use consul:URL/SERVICE, or etcd:URL/SERVICE.", "The server %s is not a valid registry: %s", server, err.Error())
+				continue
+			}
+			servers, err := catalog.Discover(server[i+1:])
+			if err != nil {
+				p.fail("Check that the registry is reachable, and that the servers have registered.", "No servers were discovered for %s: %s", server, err.Error())
+				continue
+			}
+			p.pass("Discovered %d servers for %s", len(servers), server)
+			continue
+		}
+		u, err := url.Parse(server)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+			p.fail("Each server should be a URL such as wss://vpn.example.com/vpn.", "The server %s is not a websocket URL", server)
+			continue
+		}
+		if u.Scheme == "ws" {
+			p.warn("Unless the connection is protected some other way use wss://.", "The server %s is not using TLS", server)
+		}
+	}
+
+	_, err := shared.LoadWebsocketOptions(cfg.GetPrefixed("ws_"), 0)
+	if err != nil {
+		p.fail("See the ws_ settings in the sample client.cfg.", "The configuration has %s", err.Error())
+	}
+
+	_, err = shared.LoadTLSPolicy(cfg.GetPrefixed("tls_"), false)
+	if err != nil {
+		p.fail("See the tls_ settings in the sample client.cfg.", "The configuration has %s", err.Error())
+	}
+
+	if kex := cfg.Get("kex"); kex != "" {
+		switch {
+		case kex != shared.HybridKeyExchange:
+			p.fail("Set it to "+shared.HybridKeyExchange+".", "The configuration has an unknown kex: %s", kex)
+		case cfg.Get("encryption") != "true":
+			p.fail("Add 'encryption = true'.", "The configuration has a kex, without encryption")
+		case !shared.KeyExchangeSupported:
+			p.fail("Rebuild with Go 1.24, or later.", "The configuration has a kex, which this binary lacks")
+		}
+	}
+
+	if cfg.Get("kill_switch") == "true" && cfg.Get("firewall_dry_run") != "true" {
+		if _, err := exec.LookPath("nft"); err != nil {
+			p.fail("Install nftables, or disable the kill_switch.", "The configuration enables the kill_switch, but nft is not available")
+		}
+	}
+	_, err = shared.ParseNetworks(cfg.Get("kill_switch_allow"))
+	if err != nil {
+		p.fail("List IPs, or CIDR ranges, separated by commas.", "The configuration has an invalid kill_switch_allow: %s", err.Error())
+	}
+
+	if cfg.Get("persistent_device") == "true" {
+		if cfg.Get("device") == "" {
+			p.fail("Set 'device' to the name of the persistent device.", "The configuration has a persistent_device, but no device")
+		} else {
+			p.checkPersistentDevice(cfg.Get("device"), "tun")
+		}
+	}
+
+	switch cfg.GetWithDefault("peers_format", "json") {
+	case "json", "array", "tab":
+	default:
+		p.fail("Set 'peers_format' to json, array, or tab.", "The configuration has an unknown peers_format")
+	}
+
+	_, err = shared.LookupKeepalive(cfg.Get("keepalive"))
+	if err != nil {
+		p.fail("Set 'keepalive' to fast, normal, or slow.", "The configuration has an %s", err.Error())
+	}
+}
+
+// checkConfig checks the sanity of the given configuration file, which
+// may be that of a client, or server.
+func (p *doctorCmd) checkConfig(path string) {
+	cfg, err := config.New(path)
+	if err != nil {
+		p.fail("Check that the file exists, and is readable.", "Failed to read %s: %s", path, err.Error())
+		return
+	}
+	failures := p.failures
+
+	if cfg.Get("vpn") != "" {
+		fmt.Printf("Checking client configuration %s\n", path)
+		p.checkClient(cfg)
+	} else {
+		fmt.Printf("Checking server configuration %s\n", path)
+		if cfg.Get("key") != "" || len(cfg.Sections) == 0 {
+			p.checkServer(cfg)
+		}
+		for _, section := range cfg.Sections {
+			if strings.HasPrefix(section.Name, "network ") {
+				if section.Get("device") == "" {
+					section.Settings["device"] = "svpn-" + strings.TrimPrefix(section.Name, "network ")
+				}
+				p.checkServer(section)
+			}
+		}
+	}
+
+	if p.failures == failures {
+		p.pass("The configuration looks sane")
+	}
+}
+
+//
+// Entry-point.
+//
+func (p *doctorCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if runtime.GOOS == "linux" {
+		p.checkTun()
+		p.checkCapability()
+		p.checkForwarding()
+	} else {
+		p.warn("Only the configuration can be checked.", "Environment checks are only implemented upon Linux")
+	}
+	p.checkIP()
+
+	for _, path := range f.Args() {
+		p.checkConfig(path)
+	}
+
+	if p.failures > 0 {
+		fmt.Printf("\n%d check(s) failed.\n", p.failures)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,82 @@
+// cmd_export.go contains the sub-command which exports the complete state
+// of a server, its configuration and the settings changed at runtime, as
+// a single document.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/server"
+)
+
+// exportCmd is the structure for this sub-command.
+type exportCmd struct {
+	// format is the format of the document, which must be "json".
+	format string
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*exportCmd) Name() string     { return "export" }
+func (*exportCmd) Synopsis() string { return "Export the configuration, and state, of a server." }
+func (*exportCmd) Usage() string {
+	return `export :
+  Export the configuration of a server, along with the leases, filter
+  rules, and rates, which were changed at runtime and persisted to the
+  state_file of each network:
+
+    simple-vpn export -format json server.cfg > server.json
+
+  The document is canonical, so that exporting the same state always
+  produces the same document, and it may be restored with "import".
+`
+}
+
+//
+// Flag setup
+//
+func (p *exportCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.format, "format", "json", "The format of the document, which must be json.")
+}
+
+//
+// Entry-point.
+//
+func (p *exportCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if len(f.Args()) != 1 {
+		fmt.Printf("We expect the server's configuration-file to be given.\n")
+		return subcommands.ExitFailure
+	}
+	if p.format != "json" {
+		fmt.Printf("The format %s is not supported, only json is.\n", p.format)
+		return subcommands.ExitFailure
+	}
+
+	cfg, err := config.New(f.Args()[0])
+	if err != nil {
+		fmt.Printf("Failed to read the configuration file %s - %s\n", f.Args()[0], err.Error())
+		return subcommands.ExitFailure
+	}
+
+	snapshot, err := server.Export(cfg)
+	if err != nil {
+		fmt.Printf("Failed to export the server's state - %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	out, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to encode the server's state - %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	fmt.Printf("%s\n", out)
+	return subcommands.ExitSuccess
+}
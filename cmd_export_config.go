@@ -0,0 +1,134 @@
+// cmd_export_config.go contains the sub-command which exports the
+// configuration of a client as a single string, or QR code, which the
+// client may import.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/provision"
+)
+
+// exportConfigCmd is the structure for this sub-command.
+type exportConfigCmd struct {
+	// url is the end-point the client should connect to.
+	url string
+
+	// network is the name of the network the client should join, if
+	// it isn't the top-level one.
+	network string
+
+	// qr is true if we should show a QR code, as well as the string.
+	qr bool
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*exportConfigCmd) Name() string     { return "export-config" }
+func (*exportConfigCmd) Synopsis() string { return "Export the configuration of a client." }
+func (*exportConfigCmd) Usage() string {
+	return `export-config :
+  Export the configuration of the named client, as a single string which
+  may be given to the client:
+
+    simple-vpn export-config -url wss://vpn.example.com/vpn server.cfg laptop
+    simple-vpn client -import svpn1:... client.cfg
+
+  The end-point defaults to the server's registry_url setting, if any.
+  With -qr the string is also shown as a QR code, which requires the
+  qrencode utility.
+`
+}
+
+//
+// Flag setup
+//
+func (p *exportConfigCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.url, "url", "", "The end-point the client should connect to.")
+	f.StringVar(&p.network, "network", "", "The name of the network the client should join.")
+	f.BoolVar(&p.qr, "qr", false, "Show the configuration as a QR code, too.")
+}
+
+//
+// Entry-point.
+//
+func (p *exportConfigCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if len(f.Args()) != 2 {
+		fmt.Printf("We expect the server's configuration-file, and the name of a client.\n")
+		return subcommands.ExitFailure
+	}
+	name := f.Args()[1]
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		fmt.Printf("The name of the client may not contain whitespace.\n")
+		return subcommands.ExitFailure
+	}
+
+	cfg, err := config.New(f.Args()[0])
+	if err != nil {
+		fmt.Printf("Failed to read the configuration file %s - %s\n", f.Args()[0], err.Error())
+		return subcommands.ExitFailure
+	}
+	cfg.LoadEnvironment("SIMPLE_VPN_")
+
+	//
+	// Find the settings of the network the client should join.
+	//
+	settings := cfg
+	if p.network != "" {
+		settings = nil
+		for _, section := range cfg.Sections {
+			if section.Name == "network "+p.network {
+				settings = section
+			}
+		}
+		if settings == nil {
+			fmt.Printf("There is no network named %s.\n", p.network)
+			return subcommands.ExitFailure
+		}
+	}
+
+	key := settings.Get("key")
+	if key == "" {
+		fmt.Printf("The network has no key, choose one with -network.\n")
+		return subcommands.ExitFailure
+	}
+	url := p.url
+	if url == "" {
+		url = settings.Get("registry_url")
+	}
+	if url == "" {
+		fmt.Printf("We expect the end-point of the server to be given with -url.\n")
+		return subcommands.ExitFailure
+	}
+
+	str := provision.Export(url, key, name)
+	fmt.Printf("%s\n", str)
+
+	//
+	// qrencode reads the configuration from its stdin, as other users
+	// could read it, and the key within it, from its arguments.
+	//
+	if p.qr {
+		cmd := exec.Command("qrencode", "-t", "ANSIUTF8")
+		cmd.Stdin = strings.NewReader(str)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			fmt.Printf("Failed to show the QR code, is qrencode installed? - %s\n", err.Error())
+			return subcommands.ExitFailure
+		}
+	}
+
+	return subcommands.ExitSuccess
+}
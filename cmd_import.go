@@ -0,0 +1,104 @@
+// cmd_import.go contains the sub-command which replaces the configuration,
+// and state, of a server with those exported by the "export" sub-command.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/pkg/server"
+)
+
+// importCmd is the structure for this sub-command.
+type importCmd struct {
+	// format is the format of the document, which must be "json".
+	format string
+
+	// dryRun is true if we should show the configuration we would
+	// write, rather than writing it.
+	dryRun bool
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*importCmd) Name() string     { return "import" }
+func (*importCmd) Synopsis() string { return "Import the configuration, and state, of a server." }
+func (*importCmd) Usage() string {
+	return `import :
+  Replace the configuration-file of a server, and the state_file of each
+  network, with those of a document produced by "export".  The document
+  is read from the named file, or from STDIN:
+
+    simple-vpn import -format json server.cfg server.json
+
+  The configuration-file is rewritten, so any comments are lost.  A
+  server which is running applies the changes once it is restarted, or
+  upgraded with SIGUSR2.
+`
+}
+
+//
+// Flag setup
+//
+func (p *importCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.format, "format", "json", "The format of the document, which must be json.")
+	f.BoolVar(&p.dryRun, "dry-run", false, "Show the configuration we would write, rather than writing it.")
+}
+
+//
+// Entry-point.
+//
+func (p *importCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if len(f.Args()) < 1 || len(f.Args()) > 2 {
+		fmt.Printf("We expect the server's configuration-file, and optionally the document to import.\n")
+		return subcommands.ExitFailure
+	}
+	if p.format != "json" {
+		fmt.Printf("The format %s is not supported, only json is.\n", p.format)
+		return subcommands.ExitFailure
+	}
+
+	var data []byte
+	var err error
+	if len(f.Args()) == 2 {
+		data, err = ioutil.ReadFile(f.Args()[1])
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		fmt.Printf("Failed to read the document - %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	var snapshot server.Snapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		fmt.Printf("Failed to parse the document - %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	if p.dryRun {
+		err = snapshot.Validate()
+		if err != nil {
+			fmt.Printf("The document is invalid - %s\n", err.Error())
+			return subcommands.ExitFailure
+		}
+		fmt.Printf("%s", snapshot.Config().String())
+		return subcommands.ExitSuccess
+	}
+
+	err = snapshot.Import(f.Args()[0])
+	if err != nil {
+		fmt.Printf("Failed to import the document - %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,232 @@
+// cmd_migrate_config.go contains the sub-command which migrates a server's
+// configuration-file from per-client settings, such as `host_NAME` and
+// `rate_NAME`, to "[host NAME]" sections.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// hostSettings are the settings which may be given for a single client,
+// as `SETTING_NAME`, and so may be moved into its section.
+var hostSettings = []string{
+	"allow_commands",
+	"compression",
+	"encryption",
+	"group",
+	"host",
+	"keepalive",
+	"key",
+	"macs",
+	"rate",
+	"source",
+	"update",
+}
+
+// notHostSettings are settings which look like those of a client, but
+// are not.
+var notHostSettings = map[string]bool{
+	"update_fingerprint": true,
+	"update_url":         true,
+	"update_version":     true,
+}
+
+// migrateConfigCmd is the structure for this sub-command.
+type migrateConfigCmd struct {
+	// write is true if we should replace the file, rather than show
+	// the migrated configuration.
+	write bool
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*migrateConfigCmd) Name() string { return "migrate-config" }
+func (*migrateConfigCmd) Synopsis() string {
+	return "Move the settings of each client into its own section."
+}
+func (*migrateConfigCmd) Usage() string {
+	return `migrate-config :
+  Migrate the settings of each client in a server's configuration, such
+  as host_NAME, rate_NAME, and group_NAME, into a "[host NAME]" section
+  following the network they belong to:
+
+    simple-vpn migrate-config server.cfg > server.cfg.new
+
+  Comments are preserved, and those directly above a setting move with
+  it.  The migrated configuration is checked to be equivalent to the
+  original before it is shown, or with -write, replaces it.
+`
+}
+
+//
+// Flag setup
+//
+func (p *migrateConfigCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.write, "write", false, "Replace the file, rather than showing the migrated configuration.")
+}
+
+// hostSetting returns the setting, and client, the given key sets, if it
+// is the setting of a single client.
+func hostSetting(key string) (string, string, bool) {
+	if notHostSettings[key] {
+		return "", "", false
+	}
+	for _, setting := range hostSettings {
+		name := strings.TrimPrefix(key, setting+"_")
+		if name != key && shared.ValidName(name) == nil {
+			if setting == "host" {
+				setting = "ip"
+			}
+			return setting, name, true
+		}
+	}
+	return "", "", false
+}
+
+// migrate returns the given configuration, with the settings of each
+// client moved into its own section.
+func migrate(original []byte) []byte {
+	keyVal := regexp.MustCompile("^([^=]+)\\s*=\\s*(.*)$")
+	section := regexp.MustCompile("^\\s*\\[\\s*([^\\]]+?)\\s*\\]\\s*$")
+
+	var out bytes.Buffer
+
+	//
+	// hosts holds the lines of each client's section, in the order the
+	// clients were found, until the section they belong to ends.
+	//
+	var order []string
+	hosts := make(map[string][]string)
+
+	// pending holds the comments which precede the current line.
+	var pending []string
+
+	// migrating is true if we're within the top-level, or a network,
+	// and so should migrate the settings we find.
+	migrating := true
+
+	flush := func() {
+		for _, line := range pending {
+			out.WriteString(line + "\n")
+		}
+		pending = nil
+	}
+	end := func() {
+		flush()
+		for _, name := range order {
+			if !bytes.HasSuffix(out.Bytes(), []byte("\n\n")) && out.Len() > 0 {
+				out.WriteString("\n")
+			}
+			out.WriteString("[host " + name + "]\n")
+			for _, line := range hosts[name] {
+				out.WriteString(line + "\n")
+			}
+			out.WriteString("\n")
+		}
+		order = nil
+		hosts = make(map[string][]string)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(original))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "#") {
+			pending = append(pending, line)
+			continue
+		}
+
+		if match := section.FindStringSubmatch(line); len(match) == 2 {
+			end()
+			fields := strings.Fields(match[1])
+			migrating = len(fields) == 2 && fields[0] == "network"
+			out.WriteString(line + "\n")
+			continue
+		}
+
+		match := keyVal.FindStringSubmatch(line)
+		if migrating && len(match) == 3 {
+			setting, name, ok := hostSetting(strings.TrimSpace(match[1]))
+			if ok {
+				if _, found := hosts[name]; !found {
+					order = append(order, name)
+				}
+				hosts[name] = append(hosts[name], pending...)
+				hosts[name] = append(hosts[name], setting+" = "+strings.TrimSpace(match[2]))
+				pending = nil
+				continue
+			}
+		}
+
+		flush()
+		out.WriteString(line + "\n")
+	}
+	end()
+
+	return out.Bytes()
+}
+
+//
+// Entry-point.
+//
+func (p *migrateConfigCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if len(f.Args()) != 1 {
+		fmt.Printf("We expect the server's configuration-file to be given.\n")
+		return subcommands.ExitFailure
+	}
+	path := f.Args()[0]
+
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Failed to read the configuration file %s - %s\n", path, err.Error())
+		return subcommands.ExitFailure
+	}
+	migrated := migrate(original)
+
+	//
+	// The migrated configuration must hold exactly the same settings.
+	//
+	before, err := config.Parse(string(original))
+	if err != nil {
+		fmt.Printf("Failed to parse the configuration file %s - %s\n", path, err.Error())
+		return subcommands.ExitFailure
+	}
+	after, err := config.Parse(string(migrated))
+	if err != nil || before.String() != after.String() {
+		fmt.Printf("Failed to migrate %s, the result differs from the original.\n", path)
+		return subcommands.ExitFailure
+	}
+
+	if !p.write {
+		os.Stdout.Write(migrated)
+		return subcommands.ExitSuccess
+	}
+
+	info, err := os.Stat(path)
+	if err == nil {
+		err = ioutil.WriteFile(path+".new", migrated, info.Mode())
+	}
+	if err == nil {
+		err = os.Rename(path+".new", path)
+	}
+	if err != nil {
+		fmt.Printf("Failed to write %s - %s\n", path, err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
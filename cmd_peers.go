@@ -0,0 +1,118 @@
+// cmd_peers.go contains the sub-command which lists the peers of the
+// running VPN-client, in a variety of formats.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/pkg/client"
+)
+
+// peersCmd is the structure for this sub-command.
+type peersCmd struct {
+	// socket is the path to the control-socket of the client.
+	socket string
+
+	// format is the output-format to use.
+	format string
+
+	// domain is appended to the name of each peer, if set.
+	domain string
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*peersCmd) Name() string     { return "peers" }
+func (*peersCmd) Synopsis() string { return "List the peers of the running VPN-client." }
+func (*peersCmd) Usage() string {
+	return `peers :
+  List the peers connected to the VPN, in one of several formats:
+
+    table    - A table, for humans.
+    json     - A JSON array, for scripts.
+    hosts    - Lines suitable for /etc/hosts.
+    dnsmasq  - host-record lines suitable for dnsmasq.
+`
+}
+
+//
+// Flag setup
+//
+func (p *peersCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.socket, "socket", client.DefaultControlSocket, "The path to the client's control-socket.")
+	f.StringVar(&p.format, "format", "table", "The output format: table, json, hosts, or dnsmasq.")
+	f.StringVar(&p.domain, "domain", "", "A domain to append to the name of each peer, for the hosts and dnsmasq formats.")
+}
+
+// fqdn returns the name of the given peer, qualified by our domain if
+// we have one.
+func (p *peersCmd) fqdn(peer client.Peer) string {
+	if p.domain == "" {
+		return peer.Name
+	}
+	return peer.Name + "." + p.domain
+}
+
+//
+// Entry-point.
+//
+func (p *peersCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	status, err := client.QueryStatus(p.socket)
+	if err != nil {
+		fmt.Printf("Failed to query the client at %s - %s\n", p.socket, err.Error())
+		fmt.Printf("(Is the client running?)\n")
+		return subcommands.ExitFailure
+	}
+
+	switch p.format {
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "NAME\tIP\tREMOTE\tCONNECTED\tTAGS\n")
+		for _, peer := range status.Peers {
+			connected := "-"
+			if !peer.Connected.IsZero() {
+				connected = peer.Connected.Local().Format("2006-01-02 15:04:05")
+			}
+			remote := peer.Remote
+			if remote == "" {
+				remote = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", peer.Name, peer.IP, remote, connected, strings.Join(peer.Tags, ","))
+		}
+		w.Flush()
+	case "json":
+		peers := status.Peers
+		if peers == nil {
+			peers = []client.Peer{}
+		}
+		out, _ := json.MarshalIndent(peers, "", "  ")
+		fmt.Printf("%s\n", out)
+	case "hosts":
+		for _, peer := range status.Peers {
+			if p.domain != "" {
+				fmt.Printf("%s\t%s %s\n", peer.IP, p.fqdn(peer), peer.Name)
+			} else {
+				fmt.Printf("%s\t%s\n", peer.IP, peer.Name)
+			}
+		}
+	case "dnsmasq":
+		for _, peer := range status.Peers {
+			fmt.Printf("host-record=%s,%s\n", p.fqdn(peer), peer.IP)
+		}
+	default:
+		fmt.Printf("Unknown format '%s'\n", p.format)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,209 @@
+// cmd_probe.go contains the sub-command which checks that a VPN-server
+// is reachable, and accepts our key, without joining the VPN.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/client"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// probeCmd is the structure for this sub-command.
+type probeCmd struct {
+	// key is the shared-key to present, if not taken from a
+	// configuration file.
+	key string
+
+	// name is the name we present to the server.
+	name string
+
+	// echoes is the number of in-band echoes to send.
+	echoes int
+
+	// timeout is how long to wait for each response, in seconds.
+	timeout int
+
+	// json is set if we should output the raw results.
+	json bool
+
+	// fips is true if our TLS connection may only use FIPS-approved
+	// cipher suites.
+	fips bool
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*probeCmd) Name() string     { return "probe" }
+func (*probeCmd) Synopsis() string { return "Check that a VPN-server is reachable." }
+func (*probeCmd) Usage() string {
+	return `probe [client-config|url] :
+  Connect to the VPN-server, and report upon its reachability, TLS,
+  latency, and whether it accepts our key, without creating a device.
+
+  Given a client configuration file each of its servers is probed, and
+  the key is read from it.  Otherwise give a URL, and -key.
+
+  We exit with a failure if any server could not be probed.
+`
+}
+
+//
+// Flag setup
+//
+func (p *probeCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.key, "key", "", "The shared-key to present, if not reading a configuration file.")
+	f.StringVar(&p.name, "name", "probe", "The name to present to the server.")
+	f.IntVar(&p.echoes, "echo", 3, "The number of in-band echoes to send.")
+	f.IntVar(&p.timeout, "timeout", 10, "The time to wait for each response, in seconds.")
+	f.BoolVar(&p.json, "json", false, "Output the results as JSON.")
+	f.BoolVar(&p.fips, "fips", shared.FIPSBuild, "Restrict TLS to the FIPS-approved cipher suites of TLS 1.2.")
+}
+
+// show reports the result of a single probe.
+func (p *probeCmd) show(result client.ProbeResult) {
+	fmt.Printf("Server:     %s\n", result.Server)
+	if !result.Reachable {
+		fmt.Printf("Reachable:  no - %s\n\n", result.Error)
+		return
+	}
+	fmt.Printf("Reachable:  yes\n")
+	fmt.Printf("Handshake:  %.2fms\n", float64(result.Handshake)/float64(time.Millisecond))
+
+	if result.TLS != nil {
+		fmt.Printf("TLS:        %s, %s\n", result.TLS.Version, result.TLS.CipherSuiteName)
+		if result.TLS.Subject != "" {
+			fmt.Printf("Subject:    %s\n", result.TLS.Subject)
+			fmt.Printf("Issuer:     %s\n", result.TLS.Issuer)
+			fmt.Printf("Expires:    %s (%d days)\n", result.TLS.Expires.Format("2006-01-02"),
+				int(time.Until(result.TLS.Expires).Hours()/24))
+		}
+	} else {
+		fmt.Printf("TLS:        none\n")
+	}
+
+	if !result.Authenticated {
+		fmt.Printf("Auth:       failed - %s\n\n", result.Error)
+		return
+	}
+	fmt.Printf("Auth:       ok\n")
+
+	if p.echoes > 0 {
+		fmt.Printf("Echo:       %d/%d replies", len(result.Echoes), p.echoes)
+		if len(result.Echoes) > 0 {
+			min, max, total := result.Echoes[0], result.Echoes[0], time.Duration(0)
+			for _, rtt := range result.Echoes {
+				if rtt < min {
+					min = rtt
+				}
+				if rtt > max {
+					max = rtt
+				}
+				total += rtt
+			}
+			ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+			fmt.Printf(", min/avg/max %.2f/%.2f/%.2fms",
+				ms(min), ms(total/time.Duration(len(result.Echoes))), ms(max))
+		}
+		fmt.Printf("\n")
+	}
+	if result.Error != "" {
+		fmt.Printf("Error:      %s\n", result.Error)
+	}
+	fmt.Printf("\n")
+}
+
+//
+// Entry-point.
+//
+func (p *probeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if len(f.Args()) != 1 {
+		fmt.Printf("We expect a client configuration-file, or URL, to be specified\n")
+		return subcommands.ExitFailure
+	}
+
+	opts := client.ProbeOptions{
+		Key:     p.key,
+		Name:    p.name,
+		Headers: http.Header{},
+		Echoes:  p.echoes,
+		Timeout: time.Duration(p.timeout) * time.Second,
+	}
+	servers := []string{f.Args()[0]}
+	tlsSettings := map[string]string{}
+
+	//
+	// If we weren't given a URL then read the configuration file, to
+	// find the servers, and our key.
+	//
+	if !strings.Contains(servers[0], "://") {
+		cfg, err := config.New(servers[0])
+		if err != nil {
+			fmt.Printf("Failed to read configuration file %s\n", err.Error())
+			return subcommands.ExitFailure
+		}
+
+		servers = nil
+		for _, server := range strings.Split(cfg.Get("vpn"), ",") {
+			server = strings.TrimSpace(server)
+			if server != "" {
+				servers = append(servers, server)
+			}
+		}
+		if len(servers) == 0 {
+			fmt.Printf("The configuration file didn't include a vpn=... line\n")
+			return subcommands.ExitFailure
+		}
+
+		if opts.Key == "" {
+			opts.Key = cfg.Get("key")
+		}
+		for name, value := range cfg.GetPrefixed("header_") {
+			opts.Headers.Set(name, value)
+		}
+		opts.Websocket, err = shared.LoadWebsocketOptions(cfg.GetPrefixed("ws_"), 0)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			return subcommands.ExitFailure
+		}
+		tlsSettings = cfg.GetPrefixed("tls_")
+	}
+
+	var err error
+	opts.TLS, err = shared.LoadTLSPolicy(tlsSettings, p.fips)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+
+	status := subcommands.ExitSuccess
+	var results []client.ProbeResult
+	for _, server := range servers {
+		opts.Server = server
+		result, err := client.Probe(opts)
+		if err != nil {
+			status = subcommands.ExitFailure
+		}
+		results = append(results, result)
+		if !p.json {
+			p.show(result)
+		}
+	}
+
+	if p.json {
+		out, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Printf("%s\n", out)
+	}
+	return status
+}
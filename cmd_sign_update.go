@@ -0,0 +1,102 @@
+// cmd_sign_update.go contains the sub-command which signs a new version
+// of our binary, so that clients may verify it before they install it.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/pkg/provision"
+)
+
+// signUpdateCmd is the structure for this sub-command.
+type signUpdateCmd struct {
+	// key is the path to the key we sign with.
+	key string
+
+	// embed is true if the signature should be appended to the binary,
+	// rather than written beside it.
+	embed bool
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*signUpdateCmd) Name() string     { return "sign-update" }
+func (*signUpdateCmd) Synopsis() string { return "Sign a new version of the client." }
+func (*signUpdateCmd) Usage() string {
+	return `sign-update :
+  Sign each of the given binaries, writing the signature of each beside
+  it with a ".sig" suffix, which clients download along with the binary:
+
+    simple-vpn sign-update -key release.key simple-vpn-linux-amd64
+
+  With -embed the signature is appended to the binary instead, so that a
+  single file may be distributed.  Signatures may be checked by "verify".
+
+  The key is created if it doesn't exist, and its fingerprint is shown,
+  which clients must be given as their update_fingerprint setting.
+`
+}
+
+//
+// Flag setup
+//
+func (p *signUpdateCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.key, "key", "release.key", "The path to the key to sign with.")
+	f.BoolVar(&p.embed, "embed", false, "Append the signature to the binary, rather than writing it beside it.")
+}
+
+//
+// Entry-point.
+//
+func (p *signUpdateCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if len(f.Args()) < 1 {
+		fmt.Printf("We expect the binaries to sign to be given.\n")
+		return subcommands.ExitFailure
+	}
+
+	key, err := provision.LoadKey(p.key)
+	if err != nil {
+		fmt.Printf("Failed to load the key %s - %s\n", p.key, err.Error())
+		return subcommands.ExitFailure
+	}
+	fingerprint, err := provision.Fingerprint(&key.PublicKey)
+	if err != nil {
+		fmt.Printf("Failed to find the fingerprint of our key - %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	fmt.Printf("Signing with the key %s\n", fingerprint)
+
+	for _, path := range f.Args() {
+		binary, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Printf("Failed to read %s - %s\n", path, err.Error())
+			return subcommands.ExitFailure
+		}
+		if unsigned, _, ok := provision.SplitRelease(binary); ok {
+			binary = unsigned
+		}
+		signature, err := provision.SignRelease(key, binary)
+		if err != nil {
+			fmt.Printf("Failed to sign %s - %s\n", path, err.Error())
+			return subcommands.ExitFailure
+		}
+		if p.embed {
+			err = ioutil.WriteFile(path, provision.EmbedRelease(binary, signature), 0755)
+		} else {
+			err = ioutil.WriteFile(path+".sig", signature, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Failed to write the signature of %s - %s\n", path, err.Error())
+			return subcommands.ExitFailure
+		}
+		fmt.Printf("Signed %s\n", path)
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,78 @@
+// cmd_tune.go contains the sub-command which changes the MTU, and
+// keepalive, of the running VPN-client's connection, without it
+// reconnecting.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/pkg/client"
+)
+
+// tuneCmd is the structure for this sub-command.
+type tuneCmd struct {
+	// socket is the path to the control-socket of the client.
+	socket string
+
+	// mtu is the MTU to propose, if non-zero.
+	mtu int
+
+	// keepalive is the keepalive to propose, in seconds, if non-zero.
+	keepalive int
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*tuneCmd) Name() string     { return "tune" }
+func (*tuneCmd) Synopsis() string { return "Change the MTU, or keepalive, of the running VPN-client." }
+func (*tuneCmd) Usage() string {
+	return `tune :
+  Propose a new MTU, and/or keepalive, to the server of the running
+  VPN-client.  Once the server has accepted, both sides apply them,
+  until the client reconnects:
+
+    simple-vpn tune -mtu 1400 -keepalive 60
+`
+}
+
+//
+// Flag setup
+//
+func (p *tuneCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.socket, "socket", client.DefaultControlSocket, "The path to the client's control-socket.")
+	f.IntVar(&p.mtu, "mtu", 0, "The MTU to propose.")
+	f.IntVar(&p.keepalive, "keepalive", 0, "The keepalive to propose, in seconds.")
+}
+
+//
+// Entry-point.
+//
+func (p *tuneCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if p.mtu == 0 && p.keepalive == 0 {
+		fmt.Printf("We expect an MTU, or keepalive, to be given.\n")
+		return subcommands.ExitFailure
+	}
+
+	mtu := ""
+	if p.mtu != 0 {
+		mtu = strconv.Itoa(p.mtu)
+	}
+	keepalive := ""
+	if p.keepalive != 0 {
+		keepalive = strconv.Itoa(p.keepalive)
+	}
+
+	err := client.Tune(p.socket, mtu, keepalive)
+	if err != nil {
+		fmt.Printf("Failed to tune the client at %s - %s\n", p.socket, err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,122 @@
+// cmd_verify.go contains the sub-command which verifies the signature of
+// a binary, as clients do before they install a new version.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/provision"
+)
+
+// verifyCmd is the structure for this sub-command.
+type verifyCmd struct {
+	// fingerprint is the fingerprint of the key which must have signed
+	// the binary.
+	fingerprint string
+
+	// config is the path to a client's configuration, whose
+	// update_fingerprint is used if no fingerprint is given.
+	config string
+
+	// signature is the path to the signature, if it isn't embedded in
+	// the binary, or beside it.
+	signature string
+}
+
+//
+// Glue for our sub-command-library.
+//
+func (*verifyCmd) Name() string     { return "verify" }
+func (*verifyCmd) Synopsis() string { return "Verify the signature of a binary." }
+func (*verifyCmd) Usage() string {
+	return `verify :
+  Verify that each of the given binaries was signed by "sign-update", with
+  the key of the given fingerprint.  The signature may be embedded in the
+  binary, or held beside it with a ".sig" suffix:
+
+    simple-vpn verify -fingerprint sha256:... simple-vpn-linux-amd64
+
+  With -config the update_fingerprint of that client configuration is
+  used, so that a binary may be checked just as the client would.
+`
+}
+
+//
+// Flag setup
+//
+func (p *verifyCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.fingerprint, "fingerprint", "", "The fingerprint of the key which must have signed the binary.")
+	f.StringVar(&p.config, "config", "", "A client configuration, whose update_fingerprint should be used.")
+	f.StringVar(&p.signature, "sig", "", "The path to the signature, if it isn't embedded, or beside the binary.")
+}
+
+//
+// Entry-point.
+//
+func (p *verifyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+
+	if len(f.Args()) < 1 {
+		fmt.Printf("We expect the binaries to verify to be given.\n")
+		return subcommands.ExitFailure
+	}
+	if p.signature != "" && len(f.Args()) != 1 {
+		fmt.Printf("A signature may only be given with a single binary.\n")
+		return subcommands.ExitFailure
+	}
+
+	fingerprint := p.fingerprint
+	if fingerprint == "" && p.config != "" {
+		cfg, err := config.New(p.config)
+		if err != nil {
+			fmt.Printf("Failed to read the configuration file %s - %s\n", p.config, err.Error())
+			return subcommands.ExitFailure
+		}
+		fingerprint = cfg.Get("update_fingerprint")
+	}
+	if fingerprint == "" {
+		fmt.Printf("We expect the fingerprint of the signing key, via -fingerprint, or -config.\n")
+		return subcommands.ExitFailure
+	}
+
+	status := subcommands.ExitSuccess
+	for _, path := range f.Args() {
+		err := p.verify(path, fingerprint)
+		if err != nil {
+			fmt.Printf("%s: FAILED - %s\n", path, err.Error())
+			status = subcommands.ExitFailure
+			continue
+		}
+		fmt.Printf("%s: OK\n", path)
+	}
+	return status
+}
+
+// verify checks the signature of the given binary.
+func (p *verifyCmd) verify(path string, fingerprint string) error {
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	//
+	// An embedded signature is used, unless we were given another.
+	//
+	signed, signature, embedded := provision.SplitRelease(binary)
+	if p.signature != "" || !embedded {
+		file := p.signature
+		if file == "" {
+			file = path + ".sig"
+		}
+		signature, err = ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read the signature: %s", err.Error())
+		}
+	}
+	return provision.VerifyRelease(signed, signature, fingerprint)
+}
@@ -4,32 +4,67 @@ package config
 
 import (
 	"bufio"
+	"io"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 // Reader contains the values we've read from the configuration-file.
 type Reader struct {
+	// Name is the name of this section, or "" for the top-level.
+	Name string
+
 	// Settings contains the key-value pairs from the named file
 	Settings map[string]string
+
+	// Sections contains any "[name]" sections from the file, in the
+	// order in which they were found.
+	//
+	// "[host NAME]" sections are not included, as their settings are
+	// stored in the network they follow, see hostSetting.
+	Sections []*Reader
 }
 
 // New opens the given file, and returns a reader-structure with
 // the specified contents.
 func New(filename string) (*Reader, error) {
-	r := &Reader{}
-	r.Settings = make(map[string]string)
-
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
+	return parse(file)
+}
+
+// Parse returns a reader-structure with the given contents, for those
+// who have a configuration but no file, such as our mobile clients.
+func Parse(contents string) (*Reader, error) {
+	return parse(strings.NewReader(contents))
+}
+
+// parse reads the configuration from the given reader.
+func parse(file io.Reader) (*Reader, error) {
+	r := &Reader{}
+	r.Settings = make(map[string]string)
+
 	// regexp to get our key=value lines
 	keyVal := regexp.MustCompile("^([^=]+)\\s*=\\s*(.*)$")
 
+	// regexp to get our [section] lines
+	section := regexp.MustCompile("^\\s*\\[\\s*([^\\]]+?)\\s*\\]\\s*$")
+
+	// settings from the file are stored in the current section
+	current := r
+
+	// network is the section which "[host NAME]" sections belong to,
+	// and host is the name of the host whose section we're within.
+	network := r
+	host := ""
+
 	// read line by line
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
@@ -42,6 +77,22 @@ func New(filename string) (*Reader, error) {
 			continue
 		}
 
+		// Start a new section?
+		if match := section.FindStringSubmatch(line); len(match) == 2 {
+			fields := strings.Fields(match[1])
+			if len(fields) == 2 && fields[0] == "host" {
+				host = fields[1]
+				continue
+			}
+			host = ""
+			current = &Reader{Name: match[1], Settings: make(map[string]string)}
+			r.Sections = append(r.Sections, current)
+			if fields[0] == "network" {
+				network = current
+			}
+			continue
+		}
+
 		//Get the key=value parts
 		match := keyVal.FindStringSubmatch(line)
 		if len(match) == 3 {
@@ -54,7 +105,11 @@ func New(filename string) (*Reader, error) {
 			key = strings.TrimSpace(key)
 			val = strings.TrimSpace(val)
 
-			r.Settings[key] = val
+			if host != "" {
+				network.Settings[hostSetting(key, host)] = val
+			} else {
+				current.Settings[key] = val
+			}
 		}
 	}
 
@@ -66,11 +121,39 @@ func New(filename string) (*Reader, error) {
 	return r, nil
 }
 
+// hostSetting returns the name of the setting which the given key, of
+// the section of the named host, is stored as.  A host's settings are
+// those of its network, suffixed with its name, and its `ip` is stored
+// as `host_NAME`:
+//
+//	[host frodo]
+//	ip   = 10.137.248.20    ->  host_frodo = 10.137.248.20
+//	rate = 65536            ->  rate_frodo = 65536
+func hostSetting(key string, host string) string {
+	if key == "ip" {
+		key = "host"
+	}
+	return key + "_" + host
+}
+
 // Get returns the value of the given configuration key, if any.
 func (r *Reader) Get(name string) string {
 	return (r.Settings[name])
 }
 
+// GetPrefixed returns all the configuration keys which begin with the
+// given prefix, along with their values.  The prefix is removed from
+// the keys of the returned map.
+func (r *Reader) GetPrefixed(prefix string) map[string]string {
+	out := make(map[string]string)
+	for key, val := range r.Settings {
+		if strings.HasPrefix(key, prefix) {
+			out[strings.TrimPrefix(key, prefix)] = val
+		}
+	}
+	return out
+}
+
 // GetWithDefault returns the value of the given configuration key, if
 // it is present, otherwise it returns the supplied default value.
 func (r *Reader) GetWithDefault(name string, value string) string {
@@ -81,3 +164,66 @@ func (r *Reader) GetWithDefault(name string, value string) string {
 
 	return x
 }
+
+// GetIntWithDefault returns the value of the given configuration key as
+// an integer, if it is present and valid, otherwise it returns the
+// supplied default value.
+func (r *Reader) GetIntWithDefault(name string, value int) int {
+	x, err := strconv.Atoi(r.Settings[name])
+	if err != nil {
+		return value
+	}
+
+	return x
+}
+
+// LoadEnvironment overrides our settings with any environment variables
+// which begin with the given prefix.  The prefix is removed, and the rest
+// of the name lower-cased, so with a prefix of "SIMPLE_VPN_" the variable
+// SIMPLE_VPN_TRUSTED_PROXIES sets `trusted_proxies`.
+//
+// It returns the number of settings which were found.
+func (r *Reader) LoadEnvironment(prefix string) int {
+	if r.Settings == nil {
+		r.Settings = make(map[string]string)
+	}
+
+	count := 0
+	for _, env := range os.Environ() {
+		fields := strings.SplitN(env, "=", 2)
+		if len(fields) != 2 || !strings.HasPrefix(fields[0], prefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(fields[0], prefix))
+		if key == "" {
+			continue
+		}
+		r.Settings[key] = strings.TrimSpace(fields[1])
+		count++
+	}
+	return count
+}
+
+// String returns our settings, and sections, in the format of our
+// configuration-file.  Each section's keys are sorted, so that the same
+// settings always produce the same file, but any comments are lost.
+func (r *Reader) String() string {
+	var out strings.Builder
+	write := func(settings map[string]string) {
+		keys := make([]string, 0, len(settings))
+		for key := range settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			out.WriteString(key + " = " + settings[key] + "\n")
+		}
+	}
+
+	write(r.Settings)
+	for _, section := range r.Sections {
+		out.WriteString("\n[" + section.Name + "]\n")
+		write(section.Settings)
+	}
+	return out.String()
+}
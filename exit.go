@@ -0,0 +1,71 @@
+// exit.go contains the statuses the client, and server, exit with when
+// they fail, so that orchestration tools can tell the failures apart:
+//
+//   1 - Any other failure.
+//   2 - We were invoked incorrectly.
+//   3 - The server refused our key, or name.
+//   4 - We couldn't reach the server, or lost our connection to it.
+//   5 - Our configuration is missing, or invalid.
+//   6 - We failed to create, or configure, our device.
+//   7 - We failed to listen upon an address.
+//
+// With -json-errors the error is also reported as a JSON object, upon
+// the final line of our output.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+	"github.com/skx/simple-vpn/pkg/client"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// The statuses we exit with, beyond those of our sub-command library.
+const (
+	exitAuthFailure  subcommands.ExitStatus = 3
+	exitNetworkError subcommands.ExitStatus = 4
+	exitConfigError  subcommands.ExitStatus = 5
+	exitDeviceError  subcommands.ExitStatus = 6
+	exitBindError    subcommands.ExitStatus = 7
+)
+
+// failure is the JSON object we report an error with.
+type failure struct {
+	Error  string `json:"error"`
+	Kind   string `json:"kind"`
+	Status int    `json:"status"`
+}
+
+// classify returns the kind of the given error, and the status we should
+// exit with because of it.
+func classify(err error) (string, subcommands.ExitStatus) {
+	switch err.(type) {
+	case *client.AuthError:
+		return "auth", exitAuthFailure
+	case *client.NetworkError:
+		return "network", exitNetworkError
+	case *shared.ConfigError:
+		return "config", exitConfigError
+	case *shared.DeviceError:
+		return "device", exitDeviceError
+	case *shared.BindError:
+		return "bind", exitBindError
+	}
+	return "error", subcommands.ExitFailure
+}
+
+// fatal reports the given error, as JSON if we should, and returns the
+// status we should exit with.
+func fatal(jsonErrors bool, err error) subcommands.ExitStatus {
+	kind, status := classify(err)
+	if jsonErrors {
+		json.NewEncoder(os.Stdout).Encode(failure{Error: err.Error(), Kind: kind, Status: int(status)})
+	} else {
+		fmt.Printf("%s\n", err.Error())
+	}
+	return status
+}
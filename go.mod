@@ -6,5 +6,5 @@ require (
 	github.com/google/subcommands v1.2.0
 	github.com/gorilla/websocket v1.5.0
 	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8
-	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/sys v0.13.0
 )
@@ -22,7 +22,19 @@ func main() {
 	subcommands.Register(subcommands.CommandsCommand(), "")
 
 	subcommands.Register(&clientCmd{}, "")
+	subcommands.Register(&clientStatusCmd{}, "")
+	subcommands.Register(&dockerCmd{}, "")
+	subcommands.Register(&doctorCmd{}, "")
+	subcommands.Register(&exportCmd{}, "")
+	subcommands.Register(&exportConfigCmd{}, "")
+	subcommands.Register(&importCmd{}, "")
+	subcommands.Register(&migrateConfigCmd{}, "")
+	subcommands.Register(&peersCmd{}, "")
+	subcommands.Register(&probeCmd{}, "")
 	subcommands.Register(&serverCmd{}, "")
+	subcommands.Register(&signUpdateCmd{}, "")
+	subcommands.Register(&tuneCmd{}, "")
+	subcommands.Register(&verifyCmd{}, "")
 	subcommands.Register(&versionCmd{}, "")
 
 	flag.Parse()
@@ -0,0 +1,44 @@
+// pkg/client/bind.go contains our support for choosing the uplink over
+// which we reach the server, and our peers.
+//
+// Upon a multi-homed host `bind_device` binds our sockets to the given
+// device, and `bind_address` to the given local address, rather than
+// leaving the choice to the routing table.  Binding to a device also
+// ensures that our connection never routes over our own device, even
+// while its routes are changing.
+
+package client
+
+import (
+	"fmt"
+	"net"
+)
+
+// setBind validates, and records, the device and local address we're to
+// bind our sockets to, either of which may be empty.
+func (p *Client) setBind(device string, address string) error {
+	if device != "" {
+		if _, err := net.InterfaceByName(device); err != nil {
+			return fmt.Errorf("the bind_device %s is not available: %s", device, err.Error())
+		}
+		p.bindDevice = device
+	}
+
+	if address != "" {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return fmt.Errorf("the bind_address %s is not a valid IP", address)
+		}
+		p.bindAddress = ip
+	}
+	return nil
+}
+
+// localAddr returns the local address we dial the server from, or nil if
+// we let the kernel choose.
+func (p *Client) localAddr() net.Addr {
+	if p.bindAddress == nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: p.bindAddress}
+}
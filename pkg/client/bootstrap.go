@@ -0,0 +1,105 @@
+// pkg/client/bootstrap.go contains our bootstrapping from a provisioning
+// URL, or an exported configuration, which allow devices to be onboarded
+// without writing their configuration by hand.
+//
+// A provisioned configuration is downloaded once, its signature verified,
+// and it is then cached in the file we'd otherwise have read it from.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/skx/simple-vpn/pkg/provision"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// Bootstrap downloads our configuration from the given provisioning URL,
+// subject to the given crypto-policy, verifies that it was signed by the
+// key with the given fingerprint, and saves it to the given path.
+//
+// If the path already exists then we've been bootstrapped before, and
+// nothing is downloaded.
+func Bootstrap(url string, fingerprint string, path string, policy shared.TLSPolicy) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if fingerprint == "" {
+		return fmt.Errorf("the fingerprint of the provisioning key must be given, to verify our configuration")
+	}
+
+	client := policy.HTTPClient(30 * time.Second)
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed to download our configuration: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	signed, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to download our configuration: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download our configuration: %s", resp.Status)
+	}
+
+	err = provision.Verify(signed, fingerprint)
+	if err != nil {
+		return fmt.Errorf("refusing our downloaded configuration: %s", err.Error())
+	}
+
+	return saveConfig(path, signed)
+}
+
+// Import saves the configuration encoded by `simple-vpn export-config`
+// to the given path.  If the path already exists it must hold the same
+// configuration, so that importing is repeatable, but nothing is lost.
+func Import(str string, path string) error {
+	cfg, err := provision.Import(str)
+	if err != nil {
+		return err
+	}
+
+	existing, err := ioutil.ReadFile(path)
+	if err == nil {
+		if !bytes.Equal(existing, cfg) {
+			return fmt.Errorf("refusing to replace the different configuration in %s", path)
+		}
+		return nil
+	}
+	return saveConfig(path, cfg)
+}
+
+// saveConfig writes the given configuration to the given path.
+func saveConfig(path string, cfg []byte) error {
+	//
+	// The configuration holds our key, so only we may read it, and
+	// it's written atomically so that a partial file isn't mistaken
+	// for a complete one.
+	//
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".bootstrap")
+	if err != nil {
+		return fmt.Errorf("failed to save our configuration: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(cfg)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save our configuration: %s", err.Error())
+	}
+	return nil
+}
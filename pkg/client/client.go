@@ -0,0 +1,1208 @@
+// pkg/client/client.go contains the core of the VPN-client
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/firewall"
+	"github.com/skx/simple-vpn/shared"
+	"github.com/songgao/water"
+)
+
+// Options holds the settings of a client.
+type Options struct {
+	// Config is the configuration of the client.
+	Config *config.Reader
+
+	// Version is the version of the client, which is reported to the
+	// server.
+	Version string
+
+	// Netns is the network namespace our device is created within, if
+	// not that of the `netns` setting, or our own.
+	Netns string
+
+	// OpenDevice supplies our device, in place of our creating, and
+	// configuring, one.  This allows us to run upon platforms such as
+	// Android, where the device is created for us by the operating
+	// system, with the settings we're given by the server.
+	OpenDevice func(settings DeviceSettings) (shared.TunDevice, error)
+
+	// AllowWeakKey is true if we accept a key which is trivially weak,
+	// rather than refusing to connect.
+	AllowWeakKey bool
+
+	// FIPS is true if our TLS connections may only use FIPS-approved
+	// cipher suites.
+	FIPS bool
+
+	// Protect is given each socket we open to reach the server, and
+	// our peers, before it is used, so that its traffic may be kept
+	// outside the VPN.
+	Protect func(fd uintptr) error
+}
+
+// Client is a connection to a VPN-server.
+type Client struct {
+	// The configuration file
+	config *config.Reader
+
+	// version is the version we report to the server.
+	version string
+
+	// updating is non-zero while we're installing a new version.  It
+	// is accessed atomically.
+	updating int32
+
+	// peers holds our peers, indexed by name.
+	peers map[string]Peer
+
+	// peersMutex protects access to the same.
+	peersMutex sync.Mutex
+
+	// status is the state we report over our control-socket.
+	status Status
+
+	// socket is our connection to the server, once established.
+	socket *shared.Socket
+
+	// statusMutex protects access to the status, socket, and failure.
+	statusMutex sync.Mutex
+
+	// failure is the error which caused us to disconnect, if any.
+	failure error
+
+	// queues are the queues of our device, and routes the extra routes
+	// we added to it, which are kept when we reconnect.
+	queues []shared.TunDevice
+	routes []string
+
+	// direct holds our direct paths to our peers, if p2p is enabled.
+	direct *p2p
+
+	// endPoint is the server, or servers, we're connecting to, and
+	// fingerprint the fingerprint we pin their certificates to, if
+	// any.  If the fingerprint was discovered via DNS, rather than
+	// configured, then discoveredPin is true, and their certificates
+	// must also be signed by one of our certificate authorities.
+	endPoint      string
+	fingerprint   string
+	discoveredPin bool
+
+	// killSwitch holds the rules of our kill-switch, if we applied it.
+	killSwitch *firewall.Ruleset
+
+	// netns is the path of the network namespace our device lives in,
+	// if it isn't our own.
+	netns string
+
+	// openDevice and protect are the hooks given by our Options, if
+	// our device is supplied to us.
+	openDevice func(settings DeviceSettings) (shared.TunDevice, error)
+	protect    func(fd uintptr) error
+
+	// bindDevice, and bindAddress, are the device, and local address,
+	// from which we reach the server, and our peers, if we were told.
+	bindDevice  string
+	bindAddress net.IP
+
+	// tls is the crypto-policy of our TLS connections.
+	tls shared.TLSPolicy
+
+	// keepalive is how quickly we, and the server, notice that our
+	// connection has gone away.  With the fast profile we reconnect as
+	// soon as it does.
+	keepalive     shared.KeepaliveProfile
+	fastReconnect bool
+
+	// recent holds our most recent warnings, and errors.
+	recent []string
+
+	// recentMutex protects access to the same.
+	recentMutex sync.Mutex
+}
+
+// configureClient configures our TUN device, and routes the given
+// destinations, which include our subnet, via the gateway.
+//
+// Persistent devices may already have been configured, by a previous
+// connection, so their addresses and routes are replaced rather than
+// added.
+func (p *Client) configureClient(dev shared.TunDevice, ip string, destinations []string, mtu int, gateway string, persistent bool) error {
+
+	//
+	// The MTU/Device as a string
+	//
+	mtuStr := fmt.Sprintf("%d", mtu)
+	devStr := dev.Name()
+
+	//
+	// Ensure we have the right mask for the client IP
+	//
+	fmt.Printf("Client IP is %s\n", ip)
+	if strings.Contains(ip, ":") {
+		ip += "/128"
+	} else {
+		ip += "/32"
+	}
+
+	add := "add"
+	if persistent {
+		add = "replace"
+	}
+
+	//
+	// The commands we're going to execute.
+	//
+	// Our routes are "onlink", so the kernel accepts them even if
+	// it doesn't yet consider the gateway to be reachable.
+	//
+	cmds := [][]string{
+		{"ip", "link", "set", "dev", devStr, "up"},
+		{"ip", "link", "set", "mtu", mtuStr, "dev", devStr},
+		{"ip", "addr", add, ip, "dev", devStr},
+		{"ip", "route", add, gateway, "dev", devStr},
+	}
+	for _, route := range destinations {
+		cmds = append(cmds, []string{"ip", "route", add, route, "via", gateway, "dev", devStr, "onlink"})
+	}
+
+	//
+	// For each command
+	//
+	for _, cmd := range cmds {
+
+		//
+		// Show what we're doing.
+		//
+		fmt.Printf("Running: '%s'\n", strings.Join(cmd, " "))
+
+		//
+		// Run the command
+		//
+		x := exec.Command(cmd[0], cmd[1:]...)
+		x.Stdout = os.Stdout
+		x.Stderr = os.Stderr
+		err := x.Run()
+		if err != nil {
+			p.warnf("Failed to run %s - %s",
+				strings.Join(cmd, " "), err.Error())
+
+			return err
+		}
+	}
+	return nil
+}
+
+// inNetns invokes the given function within the network namespace of our
+// device, such that the commands it runs configure that.
+func (p *Client) inNetns(fn func() error) error {
+	if p.netns == "" {
+		return fn()
+	}
+	return shared.InNetns(p.netns, fn)
+}
+
+// peerIP returns the VPN IP of the peer with the given name, if known.
+func (p *Client) peerIP(name string) string {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	return p.peers[name].IP
+}
+
+// startForwards launches each of the port-forwards defined in our
+// configuration file, which expose the services of our peers locally.
+func (p *Client) startForwards() error {
+	forwards, err := shared.LoadForwards(p.config.GetPrefixed("forward_"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range forwards {
+		listener, err := f.Bind()
+		if err != nil {
+			return fmt.Errorf("forward_%s: %s", f.Name, err.Error())
+		}
+		go func(f *shared.Forward) {
+			err := f.Serve(listener, p.peerIP)
+			if err != nil {
+				p.warnf("[forward %s] %s", f.Name, err.Error())
+			}
+		}(f)
+	}
+	return nil
+}
+
+// defaultHostsFormat is the template used for each line of our hosts
+// file, if not overridden by the configuration file.  It is written as
+// it would be in the configuration file, where tabs are escaped.
+const defaultHostsFormat = `{{.IP}}\t{{.Name}}`
+
+// writeHostsFile writes the peers of the given update to the named file,
+// in the format of /etc/hosts.
+//
+// Each line is generated by the given template, in which `\t` stands
+// for a tab, as our configuration file has no other way to write one.
+// The file is replaced atomically such that readers never see partial
+// contents.
+func (p *Client) writeHostsFile(path string, format string, update *PeersUpdate) error {
+
+	format = strings.Replace(format, `\t`, "\t", -1)
+	tmpl, err := template.New("hosts").Parse(format + "\n")
+	if err != nil {
+		return err
+	}
+
+	//
+	// Write to a temporary file in the same directory, so that
+	// we can rename it into place.
+	//
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".simple-vpn-hosts")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	fmt.Fprintf(tmp, "# This file is maintained by simple-vpn - do not edit.\n")
+	for _, peer := range update.Peers {
+		err = tmpl.Execute(tmp, peer)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// linkEnv returns the environment passed to our `up` and `down` hooks,
+// which describes the state of the link.
+func (p *Client) linkEnv(device, ip, gateway, subnet, mtu string) []string {
+	return []string{
+		"DEVICE=" + device,
+		"CLIENT_IP=" + ip,
+		"SERVER_IP=" + gateway,
+		"SUBNET=" + subnet,
+		"MTU=" + mtu,
+		"NETNS=" + p.netns,
+	}
+}
+
+// runHook runs the hook-command with the given name, if one has been
+// configured.  It runs within the network namespace of our device.
+func (p *Client) runHook(name string, env []string, stdin []byte) error {
+	hook := shared.Hook{
+		Name:    name,
+		Command: p.config.Get(name),
+		Timeout: time.Duration(p.config.GetIntWithDefault("hook_timeout", int(shared.DefaultHookTimeout/time.Second))) * time.Second,
+		Env:     env,
+		Stdin:   stdin,
+	}
+	return p.inNetns(hook.Run)
+}
+
+// fail records a fatal error, and closes our connection to the server.
+func (p *Client) fail(socket *shared.Socket, err error) error {
+	p.statusMutex.Lock()
+	p.failure = err
+	p.statusMutex.Unlock()
+
+	socket.Close()
+	return err
+}
+
+// Connect connects to the VPN-server, and shuffles packets until the
+// connection is closed or the given context is cancelled.
+func Connect(ctx context.Context, opts Options) error {
+	p := &Client{config: opts.Config, version: opts.Version, openDevice: opts.OpenDevice, protect: opts.Protect}
+
+	//
+	// Our device may live within another network namespace, such as
+	// that of a container we're serving.
+	//
+	netns := opts.Netns
+	if netns == "" {
+		netns = p.config.Get("netns")
+	}
+	if netns != "" {
+		p.netns = shared.NetnsPath(netns)
+	}
+
+	//
+	// Get the end-point to which we're going to connect.
+	//
+	endPoint := p.config.Get("vpn")
+	if endPoint == "" {
+		return &shared.ConfigError{Err: fmt.Errorf("the configuration file didn't include a vpn=... line\nWe don't know where to connect!  Aborting")}
+	}
+
+	//
+	// Get the shared-secret.
+	//
+	key := p.config.Get("key")
+	if key == "" {
+		return &shared.ConfigError{Err: fmt.Errorf("the configuration file didn't include key=... line\nThat means authentication is impossible! Aborting")}
+	}
+	if where := shared.KeyExposure(key); where != "" {
+		log.Printf("WARNING: Our key is visible in our %s, where other processes may read it", where)
+	}
+	if err := shared.CheckKey(key); err != nil {
+		if !opts.AllowWeakKey {
+			return &shared.ConfigError{Err: fmt.Errorf("our key is weak, as %s\nChoose another, with 'openssl rand -base64 32', or start with -force", err.Error())}
+		}
+		log.Printf("WARNING: Our key is weak, as %s", err.Error())
+	}
+
+	//
+	// A key exchange keys our encryption, so requires it.
+	//
+	if kex := p.config.Get("kex"); kex != "" {
+		switch {
+		case kex != shared.HybridKeyExchange:
+			return &shared.ConfigError{Err: fmt.Errorf("unknown kex %s, it should be %s", kex, shared.HybridKeyExchange)}
+		case p.config.Get("encryption") != "true":
+			return &shared.ConfigError{Err: fmt.Errorf("the kex setting requires encryption = true")}
+		case !shared.KeyExchangeSupported:
+			return &shared.ConfigError{Err: fmt.Errorf("this binary was built without the %s key exchange, which requires Go 1.24", kex)}
+		}
+	}
+
+	//
+	// Get our client-name
+	//
+	name := p.config.Get("name")
+	if name == "" {
+		//
+		// If none is set then send the hostname.
+		//
+		name, _ = os.Hostname()
+	}
+	if err := shared.ValidName(name); err != nil {
+		return &shared.ConfigError{Err: fmt.Errorf("we can't connect with our name - %s", err.Error())}
+	}
+
+	//
+	// Launch our control-socket, so that `client-status` can
+	// report upon our state.
+	//
+	p.setStatus(func(status *Status) {
+		status.State = "connecting"
+		status.Server = endPoint
+	})
+	control := p.config.GetWithDefault("control", DefaultControlSocket)
+	err := p.serveControl(control)
+	if err != nil {
+		fmt.Printf("Failed to create control-socket %s - %s\n", control, err.Error())
+	}
+
+	//
+	// Any `header_` settings are sent as extra HTTP-headers, which
+	// is useful if we're hiding behind a CDN, or similar.
+	//
+	headers := http.Header{}
+	for name, value := range p.config.GetPrefixed("header_") {
+		headers.Set(name, value)
+	}
+
+	//
+	// Our websocket settings.  We don't know our MTU until we've
+	// connected, so the buffers are only sized if configured.
+	//
+	ws, err := shared.LoadWebsocketOptions(p.config.GetPrefixed("ws_"), 0)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Our crypto-policy restricts the TLS connections we make.
+	//
+	p.tls, err = shared.LoadTLSPolicy(p.config.GetPrefixed("tls_"), opts.FIPS)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	if p.tls.Restricted() {
+		log.Printf("Restricting TLS to %s", p.tls)
+	}
+
+	//
+	// The server is told our version, and our peers are told about
+	// the routes we advertise, and our tags.
+	//
+	query := "name=" + url.QueryEscape(name) + "&key=" + url.QueryEscape(key) + "&version=" + url.QueryEscape(p.version)
+
+	//
+	// Our device is a TUN device, which carries IP packets.
+	//
+	query += "&framing=ip"
+	if routes := p.config.Get("advertise"); routes != "" {
+		query += "&routes=" + url.QueryEscape(routes)
+	}
+	if tags := p.config.Get("tags"); tags != "" {
+		query += "&tags=" + url.QueryEscape(tags)
+	}
+
+	//
+	// The server is asked to use our keepalive too, so that it notices
+	// when we've gone away as quickly as we do.
+	//
+	p.keepalive, err = shared.LookupKeepalive(p.config.Get("keepalive"))
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	p.fastReconnect = p.config.Get("keepalive") == "fast"
+	if keepalive := p.config.Get("keepalive"); keepalive != "" {
+		query += "&keepalive=" + url.QueryEscape(keepalive)
+	}
+
+	//
+	// Multi-homed hosts may choose the uplink over which we reach the
+	// server, which also keeps our connection off our own device.
+	//
+	err = p.setBind(p.config.Get("bind_device"), p.config.Get("bind_address"))
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Launch any port-forwards which have been configured.
+	//
+	err = p.startForwards()
+	if err != nil {
+		return &shared.BindError{Err: fmt.Errorf("error setting up port-forwards: %s", err.Error())}
+	}
+
+	//
+	// If we're to form direct paths to our peers then we need a UDP
+	// socket.
+	//
+	if p.config.Get("p2p") == "true" {
+		p.direct, err = newP2P(p)
+		if err != nil {
+			return &shared.BindError{Err: fmt.Errorf("error opening our p2p socket: %s", err.Error())}
+		}
+		defer p.direct.Close()
+	}
+
+	//
+	// When we're disconnected we cleanup our device.
+	//
+	defer func() {
+		for _, queue := range p.queues {
+			queue.Close()
+		}
+	}()
+
+	//
+	// Our kill-switch blocks traffic from leaking outside the VPN
+	// before we've connected, and is removed when we're stopped.
+	//
+	p.endPoint, p.fingerprint, p.discoveredPin, err = p.resolveEndPoint(endPoint)
+	if err != nil {
+		return err
+	}
+	err = p.updateKillSwitch(p.endPoint)
+	if err != nil {
+		return fmt.Errorf("error applying our kill-switch: %s", err.Error())
+	}
+	defer func() {
+		if ctx.Err() != nil {
+			p.removeKillSwitch()
+		}
+	}()
+
+	//
+	// Connect, and serve the connection until it closes.  If the
+	// server asked us to reconnect, because it is restarting, or to
+	// migrate to another server, then we do so, keeping our device
+	// and routes if we can.
+	//
+	reconnect := false
+	for {
+		var conn *websocket.Conn
+		var ciphers *shared.Ciphers
+		conn, ciphers, err = p.dial(ctx, endPoint, query, ws, headers, reconnect)
+		if err != nil {
+			break
+		}
+
+		var migrate string
+		reconnect, migrate = p.session(ctx, conn, ciphers)
+		conn.Close()
+		if ctx.Err() != nil {
+			break
+		}
+
+		//
+		// With the fast keepalive we reconnect as soon as we lose
+		// our connection, unless the server refused us.
+		//
+		if !reconnect && p.fastReconnect {
+			p.statusMutex.Lock()
+			reconnect = p.failure == nil
+			p.statusMutex.Unlock()
+			if reconnect {
+				log.Printf("Lost our connection to the server, reconnecting")
+				continue
+			}
+		}
+		if !reconnect {
+			p.statusMutex.Lock()
+			if p.failure == nil {
+				err = &NetworkError{Reason: "lost our connection to the server"}
+			}
+			p.statusMutex.Unlock()
+			break
+		}
+		if migrate != "" {
+			log.Printf("Migrating to %s", migrate)
+			endPoint = migrate
+			p.endPoint = endPoint
+			p.fingerprint = p.config.Get("fingerprint")
+			p.discoveredPin = false
+			err = p.updateKillSwitch(endPoint)
+			if err != nil {
+				p.warnf("Failed to update our kill-switch: %s", err.Error())
+			}
+		} else {
+			log.Printf("The server is restarting, reconnecting")
+		}
+	}
+
+	//
+	// Launch the "down" script, if we were ever up.
+	//
+	status := p.getStatus()
+	if status.State == "up" {
+		p.downHook(status)
+	}
+
+	p.statusMutex.Lock()
+	defer p.statusMutex.Unlock()
+	if p.failure != nil {
+		return p.failure
+	}
+	return err
+}
+
+// shutdownTimeout is how long we wait for our queued frames to be sent
+// when we're stopped.
+const shutdownTimeout = 2 * time.Second
+
+// reconnectTimeout is how long we keep trying to reconnect to a server
+// which is restarting.
+const reconnectTimeout = 60 * time.Second
+
+// dial connects to the VPN-server, sending the given query-string.
+//
+// The end-point might be a comma-separated list, in the case of a
+// hot-standby pair of servers.  We try each in turn until one of them
+// accepts our connection.  If we're reconnecting we keep trying for a
+// while, as the server is restarting, and servers which are discovered
+// via DNS are discovered afresh before each attempt after the first.
+func (p *Client) dial(ctx context.Context, endPoint string, query string, ws shared.WebsocketOptions, headers http.Header, reconnect bool) (*websocket.Conn, *shared.Ciphers, error) {
+	dialer := ws.Dialer()
+	dialer.NetDialContext = (&net.Dialer{Control: p.control, LocalAddr: p.localAddr()}).DialContext
+	deadline := time.Now().Add(reconnectTimeout)
+
+	//
+	// We retry more often if we're to reconnect quickly.
+	//
+	retry := time.Second
+	if p.keepalive.Interval < retry {
+		retry = p.keepalive.Interval
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && discovered(endPoint) {
+			servers, fingerprint, discoveredPin, err := p.resolveEndPoint(endPoint)
+			if err != nil {
+				p.warnf("%s", err.Error())
+			} else if sortedList(servers) != sortedList(p.endPoint) || fingerprint != p.fingerprint {
+				log.Printf("Discovered the servers %s", servers)
+				p.endPoint = servers
+				p.fingerprint = fingerprint
+				p.discoveredPin = discoveredPin
+				err = p.updateKillSwitch(servers)
+				if err != nil {
+					p.warnf("Failed to update our kill-switch: %s", err.Error())
+				}
+			}
+		}
+
+		//
+		// If we know the fingerprint of the servers' certificate then
+		// we accept only that.
+		//
+		var tlsConfig *tls.Config
+		if p.fingerprint != "" {
+			var err error
+			tlsConfig, err = pinnedTLS(p.fingerprint, p.discoveredPin)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		dialer.TLSClientConfig = p.tls.Apply(tlsConfig)
+
+		//
+		// If every server refuses us we report that, rather than a
+		// failure to connect.
+		//
+		tried := 0
+		refused := ""
+		refusals := 0
+
+		for _, server := range strings.Split(p.endPoint, ",") {
+			server = strings.TrimSpace(server)
+			if server == "" {
+				continue
+			}
+			tried++
+
+			//
+			// Add our query to the connection URI.
+			//
+			// Note that the URL might contain "?" already.  Unlikely,
+			// but certainly possible.
+			//
+			uri := server
+			if strings.Contains(uri, "?") {
+				uri += "&"
+			} else {
+				uri += "?"
+			}
+			uri += query
+
+			//
+			// If we're to encrypt our frames then each connection
+			// has its own nonce, and if we're to make a key exchange
+			// its own keys.
+			//
+			nonce := ""
+			var kex *shared.KeyExchange
+			if p.config.Get("encryption") == "true" {
+				nonce = shared.NewNonce()
+				uri += "&cipher=" + shared.FrameCipher + "&nonce=" + nonce
+			}
+			if nonce != "" && p.config.Get("kex") == shared.HybridKeyExchange {
+				var err error
+				kex, err = shared.NewKeyExchange()
+				if err != nil {
+					return nil, nil, &shared.ConfigError{Err: err}
+				}
+				uri += "&kex=" + shared.HybridKeyExchange + "&kex_offer=" + kex.Offer()
+			}
+
+			//
+			// Connect to the remote host.
+			//
+			conn, resp, err := shared.Dial(dialer, uri, headers)
+			if err != nil && resp != nil && (resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized) {
+				body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+				refused = strings.TrimSpace(string(body))
+				if refused == "" {
+					refused = resp.Status
+				}
+				refusals++
+			}
+			if err != nil {
+				fmt.Printf("Failed to connect to %s\n", server)
+				fmt.Printf("%s\n", err.Error())
+				fmt.Printf("(The connection failed, or the key was bogus.)\n")
+				continue
+			}
+			ws.Configure(conn)
+
+			var ciphers *shared.Ciphers
+			if nonce != "" {
+				ciphers, err = p.agreeCiphers(resp, nonce, kex)
+				if err != nil {
+					conn.Close()
+					p.warnf("Refusing the server %s: %s", server, err.Error())
+					continue
+				}
+			}
+
+			//
+			// Record the parameters we negotiated, which we report to
+			// the server.
+			//
+			negotiated := ""
+			if tc, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+				negotiated = shared.DescribeTLS(tc.ConnectionState())
+				log.Printf("Connected to %s using %s", server, negotiated)
+			}
+
+			p.setStatus(func(status *Status) {
+				status.Server = server
+				status.TLS = negotiated
+				status.Compressed = strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+				status.Encrypted = ciphers != nil
+				status.KeyExchange = ""
+				if ciphers != nil && kex != nil {
+					status.KeyExchange = shared.HybridKeyExchange
+				}
+			})
+			return conn, ciphers, nil
+		}
+
+		if !reconnect || time.Now().After(deadline) {
+			if tried > 0 && refusals == tried {
+				return nil, nil, &AuthError{Reason: refused}
+			}
+			return nil, nil, &NetworkError{Reason: "failed to connect to any server"}
+		}
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// agreeCiphers returns the ciphers of a connection upon which we asked for
+// encryption, with the given nonce, which the server must have agreed to.
+// If we offered a key exchange the server must have agreed to that too.
+func (p *Client) agreeCiphers(resp *http.Response, nonce string, kex *shared.KeyExchange) (*shared.Ciphers, error) {
+	if resp.Header.Get(shared.CipherHeader) != shared.FrameCipher {
+		return nil, fmt.Errorf("it did not agree to encrypt our frames")
+	}
+
+	var secret []byte
+	if kex != nil {
+		reply := resp.Header.Get(shared.KeyExchangeHeader)
+		if reply == "" {
+			return nil, fmt.Errorf("it did not agree to the %s key exchange", shared.HybridKeyExchange)
+		}
+		var err error
+		secret, err = kex.Finish(reply)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shared.NewCiphers(p.config.Get("key"), secret, nonce, resp.Header.Get(shared.NonceHeader), false)
+}
+
+// downHook runs our "down" script, with the details of the link we had,
+// and our final traffic counters.
+func (p *Client) downHook(status Status) {
+	env := p.linkEnv(status.Device, status.IP, status.Gateway, status.Subnet, strconv.Itoa(status.MTU))
+	env = append(env,
+		"RX_BYTES="+strconv.FormatUint(status.Stats.RxBytes, 10),
+		"RX_PACKETS="+strconv.FormatUint(status.Stats.RxPackets, 10),
+		"TX_BYTES="+strconv.FormatUint(status.Stats.TxBytes, 10),
+		"TX_PACKETS="+strconv.FormatUint(status.Stats.TxPackets, 10),
+	)
+	err := p.runHook("down", env, nil)
+	if err != nil {
+		fmt.Printf("Failed to run down-script - %s\n", err.Error())
+	}
+}
+
+// session shuffles packets over the given connection, until it is closed
+// or the given context is cancelled.
+//
+// We return true if the server asked us to reconnect, along with the
+// end-point it asked us to migrate to, if any.
+func (p *Client) session(ctx context.Context, conn *websocket.Conn, ciphers *shared.Ciphers) (bool, string) {
+
+	//
+	// Setup command-handlers for adding routes, etc.
+	//
+	socket := shared.MakeSocket("0", conn, nil, nil)
+	if ciphers != nil {
+		socket.SetCiphers(ciphers)
+	}
+	socket.SetKeepaliveProfile(p.keepalive)
+	socket.SetQueueDepth(p.config.GetIntWithDefault("queue_depth", shared.DefaultQueueDepth))
+	if p.direct != nil {
+		p.direct.setSTUN(0)
+		socket.SetDirect(p.direct.send)
+	}
+	p.setStatus(func(status *Status) {
+		if status.State != "up" {
+			status.State = "connected"
+		}
+	})
+	p.statusMutex.Lock()
+	p.socket = socket
+	p.statusMutex.Unlock()
+
+	//
+	// Init is the function which is received when we connect.
+	//
+	// This gives us our IP, MTU, etc, as described in init.go.
+	//
+	socket.AddCommandHandler("init", func(args []string) error {
+		settings, err := parseInit(args)
+		if err != nil {
+			return p.fail(socket, err)
+		}
+		subnetStr := settings.Subnet
+		ipStr := settings.IP
+		mtu := settings.MTU
+		gatewayStr := settings.Gateway
+		routes := settings.Routes
+		framing := settings.Framing
+
+		//
+		// If we've reconnected, and were given the same settings as
+		// before, then we keep our existing device.  Otherwise we
+		// replace it.
+		//
+		status := p.getStatus()
+		if p.queues != nil && (status.IP != ipStr || status.Subnet != subnetStr || status.MTU != mtu ||
+			status.Gateway != gatewayStr || strings.Join(p.routes, ",") != strings.Join(routes, ",")) {
+			log.Printf("Our settings have changed, replacing our device")
+			p.downHook(status)
+			for _, queue := range p.queues {
+				queue.Close()
+			}
+			p.queues = nil
+		}
+
+		if p.queues == nil {
+			err = p.createDevice(ipStr, subnetStr, mtu, gatewayStr, routes)
+			if err != nil {
+				return p.fail(socket, &shared.DeviceError{Err: err})
+			}
+			log.Printf("Configured interface, the VPN is up!")
+		} else {
+			log.Printf("Reusing interface, the VPN is up!")
+		}
+		iface := p.queues[0]
+		socket.SetMTU(mtu)
+		socket.SetFraming(framing)
+
+		//
+		// Now we start shuffling packets.
+		//
+		// The socket mustn't close our device, as we might reuse it
+		// with a later connection.
+		//
+		p.setStatus(func(status *Status) {
+			status.State = "up"
+			status.Device = iface.Name()
+			status.IP = ipStr
+			status.Gateway = gatewayStr
+			status.Subnet = subnetStr
+			status.MTU = mtu
+			status.Framing = framing.String()
+			status.Commands = socket.PeerCommands()
+		})
+		var queues []shared.TunDevice
+		for _, queue := range p.queues[1:] {
+			queues = append(queues, shared.KeepOpen(queue))
+		}
+		err = socket.SetInterface(shared.KeepOpen(iface), queues...)
+		if err != nil {
+			return p.fail(socket, &shared.DeviceError{Err: fmt.Errorf("failed bind socket-magic to TUN device: %s", err.Error())})
+		}
+
+		//
+		// Send a command to the server, asking it to update all
+		// clients with the list of known-peers (and their IPs).
+		//
+		socket.SendCommand("refresh-peers", "now")
+
+		//
+		// Keep the server informed of our health.
+		//
+		go p.sendReports(socket, iface.Name())
+
+		//
+		// Tell the server how our peers may reach us directly.
+		//
+		if p.direct != nil {
+			go p.direct.start(socket, iface, framing, ipStr, subnetStr, gatewayStr)
+		}
+
+		return nil
+	})
+
+	//
+	// When we join the server sends us the list of connected peers,
+	// and then tells us about each peer which joins, or leaves.
+	//
+	socket.AddCommandHandler("update-peers", func(args []string) error {
+		return p.updatePeers(PeersFullSync, func(peers map[string]Peer) {
+			for name := range peers {
+				delete(peers, name)
+			}
+			for _, peer := range p.parsePeers(args) {
+				peers[peer.Name] = peer
+			}
+		})
+	})
+	socket.AddCommandHandler("peer-added", func(args []string) error {
+		return p.updatePeers(PeersJoin, func(peers map[string]Peer) {
+			for _, peer := range p.parsePeers(args) {
+				peers[peer.Name] = peer
+			}
+		})
+	})
+	socket.AddCommandHandler("peer-removed", func(args []string) error {
+		return p.updatePeers(PeersLeave, func(peers map[string]Peer) {
+			for _, peer := range p.parsePeers(args) {
+				if old, ok := peers[peer.Name]; ok && shared.EncodePeer(old) == shared.EncodePeer(peer) {
+					delete(peers, peer.Name)
+				}
+			}
+		})
+	})
+
+	//
+	// The server tells us where its STUN responder is, and introduces
+	// us to the peers we wish to talk to directly.
+	//
+	socket.AddCommandHandler("p2p-stun", func(args []string) error {
+		if p.direct == nil || len(args) != 1 {
+			return fmt.Errorf("unexpected STUN responder")
+		}
+		port, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		p.direct.setSTUN(port)
+		return nil
+	})
+	socket.AddCommandHandler("p2p-offer", func(args []string) error {
+		if p.direct == nil {
+			return fmt.Errorf("p2p is not enabled")
+		}
+		return p.direct.offer(args)
+	})
+
+	//
+	// We measure the path to each peer via the server by sending it
+	// pings, which the server passes on, and which the peer answers.
+	//
+	socket.AddCommandHandler("p2p-ping", func(args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("malformed ping")
+		}
+		return socket.SendCommand("p2p-pong", args...)
+	})
+	socket.AddCommandHandler("p2p-pong", func(args []string) error {
+		if p.direct == nil {
+			return fmt.Errorf("p2p is not enabled")
+		}
+		return p.direct.pong(args)
+	})
+
+	//
+	// The server may change our MTU, and keepalive, while we're
+	// connected.
+	//
+	socket.AddCommandHandler("set-mtu", func(args []string) error {
+		return p.acceptMTU(args)
+	})
+	socket.AddCommandHandler("set-keepalive", func(args []string) error {
+		return acceptKeepalive(socket, args)
+	})
+
+	//
+	// The server may ask us to perform actions, if we allow it.
+	//
+	socket.AddCommandHandler("exec", func(args []string) error {
+		return p.remoteExec(socket, args)
+	})
+
+	//
+	// The server tells us when a new version is available.
+	//
+	socket.AddCommandHandler("update", func(args []string) error {
+		return p.update(socket, args)
+	})
+
+	//
+	// When the server is restarting it asks us to reconnect, and when
+	// it is being maintained it may ask us to migrate to another, which
+	// we allow unless `allow_migrate` is false.
+	//
+	reconnect := false
+	migrate := ""
+	socket.AddCommandHandler("reconnect", func(args []string) error {
+		reconnect = true
+		socket.Close()
+		return nil
+	})
+	socket.AddCommandHandler("migrate", func(args []string) error {
+		if p.config.Get("allow_migrate") == "false" {
+			return fmt.Errorf("migration is not permitted")
+		}
+		if len(args) != 1 || !(strings.HasPrefix(args[0], "ws://") || strings.HasPrefix(args[0], "wss://")) {
+			return fmt.Errorf("invalid end-point to migrate to")
+		}
+		reconnect = true
+		migrate = args[0]
+		socket.Close()
+		return nil
+	})
+
+	//
+	// When we're stopped we close our connection gracefully, so that
+	// the frames we've queued are sent, and the server releases our
+	// address at once.
+	//
+	go func() {
+		select {
+		case <-ctx.Done():
+			socket.Shutdown(shutdownTimeout)
+		case <-socket.Done():
+		}
+	}()
+
+	//
+	// Tell the server which of its commands we accept, which may be
+	// restricted to those we've been told to allow.
+	//
+	if allow := p.config.Get("allow_commands"); allow != "" {
+		socket.AllowCommands(shared.SplitList(allow))
+	}
+	socket.AdvertiseCommands()
+
+	socket.Serve(context.Background())
+	socket.Wait()
+
+	return reconnect, migrate
+}
+
+// createDevice creates our TUN device, configures it, and runs our "up"
+// script.
+func (p *Client) createDevice(ipStr string, subnetStr string, mtu int, gatewayStr string, routes []string) error {
+	if p.openDevice != nil {
+		return p.externalDevice(DeviceSettings{IP: ipStr, Subnet: subnetStr, MTU: mtu, Gateway: gatewayStr, Routes: routes})
+	}
+
+	//
+	// We may be given the name of our device, or a template such as
+	// "svpn%d", and it may be a persistent one which was created for
+	// us, in which case we don't need CAP_NET_ADMIN to open it.
+	//
+	config := water.Config{DeviceType: water.TUN}
+	name := p.config.Get("device")
+	persistent := p.config.Get("persistent_device") == "true"
+	if persistent && name == "" {
+		return fmt.Errorf("a persistent_device must be named by the 'device' setting")
+	}
+	collision, err := shared.ParseDeviceCollision(p.config.Get("device_collision"))
+	if err != nil {
+		return err
+	}
+
+	var queues []shared.TunDevice
+	err = p.inNetns(func() error {
+		var err error
+		if persistent {
+			queues, err = shared.OpenPersistentDevice(config, name, p.config.GetIntWithDefault("tun_queues", 1))
+			return err
+		}
+
+		//
+		// A device of our name may be left over from a previous
+		// run, which crashed, in which case we may rename, or
+		// recreate, it.
+		//
+		if name != "" {
+			var note string
+			config.Name, note, err = shared.ChooseDeviceName(name, collision)
+			if err != nil {
+				return err
+			}
+			if note != "" {
+				p.warnf("%s", note)
+			}
+		}
+		queues, err = shared.OpenDevice(config, p.config.GetIntWithDefault("tun_queues", 1))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create a new TUN device: %s", err.Error())
+	}
+
+	//
+	// Our subnet, and the extra routes the server gave us, mustn't
+	// silently break our access to our local networks.
+	//
+	var destinations []string
+	err = p.inNetns(func() error {
+		var err error
+		destinations, err = p.resolveRouteConflicts(queues[0].Name(), append([]string{subnetStr}, routes...))
+		return err
+	})
+	if err != nil {
+		for _, queue := range queues {
+			queue.Close()
+		}
+		return err
+	}
+
+	//
+	// Now configure it.
+	//
+	// If we can't then a persistent device may be configured by its
+	// owner, perhaps via our "up" script.
+	//
+	err = p.inNetns(func() error {
+		return p.configureClient(queues[0], ipStr, destinations, mtu, gatewayStr, persistent)
+	})
+	if err != nil && persistent {
+		p.warnf("Assuming the persistent device %s is configured elsewhere", queues[0].Name())
+		err = nil
+	}
+	if err != nil {
+		for _, queue := range queues {
+			queue.Close()
+		}
+		return err
+	}
+	p.queues = queues
+	p.routes = routes
+
+	//
+	// Our kill-switch must permit the traffic over our new device.
+	//
+	err = p.updateKillSwitch(p.endPoint)
+	if err != nil {
+		p.warnf("Failed to update our kill-switch: %s", err.Error())
+	}
+
+	//
+	// If we reached this point we're basically done.
+	//
+	// Launch the "up" script, if we can.
+	//
+	err = p.runHook("up", p.linkEnv(queues[0].Name(), ipStr, gatewayStr, subnetStr, strconv.Itoa(mtu)), nil)
+	if err != nil {
+		p.warnf("Failed to run up-script - %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// pkg/client/conflict.go contains our detection of the routes we'd add
+// which conflict with those this host already has.
+//
+// If the VPN's subnet, or a route the server gives us, lies within one of
+// our local networks, such as our LAN, then routing it over the VPN would
+// silently break our access to part of that network.  So before adding
+// our routes we look for such conflicts, and apply our `route_conflict`
+// policy to each:
+//
+//   fail          - Refuse to configure our device, saying why.  This is
+//                   the default.
+//   skip          - Don't add the route, so the local network is kept.
+//   more-specific - Add the route, split into halves if it's the same as
+//                   the local network, so that the VPN wins.
+//   ignore        - Add the route as it is, as we used to.
+//
+// A route which contains a local network isn't a conflict, as the local
+// network remains more specific, so we only warn that the VPN won't reach
+// it.
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// localRoute is a route this host already has.
+type localRoute struct {
+	// network is its destination, and device the device it is upon.
+	network *net.IPNet
+	device  string
+}
+
+// routeTypes are the types which may precede the destination of a route
+// in the output of `ip route`.
+var routeTypes = map[string]bool{
+	"unicast": true, "unreachable": true, "blackhole": true, "prohibit": true,
+	"throw": true, "local": true, "broadcast": true, "multicast": true,
+}
+
+// localRoutes returns the routes of this host, other than the default
+// routes, and those upon the given device, which is our own.
+func localRoutes(ours string) ([]localRoute, error) {
+	var out []localRoute
+	for _, family := range []string{"-4", "-6"} {
+		output, err := exec.Command("ip", "-o", family, "route", "show").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list our routes: %s", err.Error())
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && routeTypes[fields[0]] {
+				fields = fields[1:]
+			}
+			if len(fields) == 0 || fields[0] == "default" {
+				continue
+			}
+
+			dest := fields[0]
+			if !strings.Contains(dest, "/") {
+				if strings.Contains(dest, ":") {
+					dest += "/128"
+				} else {
+					dest += "/32"
+				}
+			}
+			_, network, err := net.ParseCIDR(dest)
+			if err != nil {
+				continue
+			}
+
+			device := ""
+			for i := 1; i+1 < len(fields); i++ {
+				if fields[i] == "dev" {
+					device = fields[i+1]
+				}
+			}
+			if device == ours || device == "lo" {
+				continue
+			}
+			out = append(out, localRoute{network: network, device: device})
+		}
+	}
+	return out, nil
+}
+
+// contains returns true if the network a contains the network b.
+func contains(a *net.IPNet, b *net.IPNet) bool {
+	aOnes, aBits := a.Mask.Size()
+	bOnes, bBits := b.Mask.Size()
+	return aBits == bBits && aOnes <= bOnes && a.Contains(b.IP)
+}
+
+// halves splits the given network into its two halves, or returns it as
+// it is if it is a single address.
+func halves(network *net.IPNet) []string {
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return []string{network.String()}
+	}
+
+	mask := net.CIDRMask(ones+1, bits)
+	low := &net.IPNet{IP: network.IP.Mask(mask), Mask: mask}
+
+	high := make(net.IP, len(low.IP))
+	copy(high, low.IP)
+	high[ones/8] |= 0x80 >> uint(ones%8)
+	return []string{low.String(), (&net.IPNet{IP: high, Mask: mask}).String()}
+}
+
+// resolveRouteConflicts returns the routes we should add upon the given
+// device, for the given destinations, applying our policy to those which
+// conflict with the routes this host already has.
+func (p *Client) resolveRouteConflicts(device string, destinations []string) ([]string, error) {
+	policy := p.config.GetWithDefault("route_conflict", "fail")
+	switch policy {
+	case "ignore":
+		return destinations, nil
+	case "fail", "skip", "more-specific":
+	default:
+		return nil, fmt.Errorf("the route_conflict must be one of 'fail', 'skip', 'more-specific', or 'ignore', not '%s'", policy)
+	}
+
+	locals, err := localRoutes(device)
+	if err != nil {
+		p.warnf("Cannot check our routes for conflicts: %s", err.Error())
+		return destinations, nil
+	}
+
+	var out []string
+	for _, dest := range destinations {
+		_, network, err := net.ParseCIDR(dest)
+		if err != nil {
+			out = append(out, dest)
+			continue
+		}
+
+		var conflict *localRoute
+		for i, local := range locals {
+			if contains(local.network, network) {
+				conflict = &locals[i]
+				break
+			}
+			if ones, _ := network.Mask.Size(); ones > 0 && contains(network, local.network) {
+				p.warnf("The route %s contains the local network %s, upon %s, which the VPN won't reach", dest, local.network, local.device)
+			}
+		}
+		if conflict == nil {
+			out = append(out, dest)
+			continue
+		}
+
+		switch policy {
+		case "fail":
+			return nil, fmt.Errorf("the route %s, from the server, lies within the local network %s, upon %s, so would break our access to it; change the server's subnet, or routes, or set route_conflict", dest, conflict.network, conflict.device)
+		case "skip":
+			p.warnf("Not adding the route %s, which lies within the local network %s, upon %s", dest, conflict.network, conflict.device)
+		case "more-specific":
+			if conflict.network.String() == network.String() {
+				p.warnf("The route %s is the same as the local network upon %s, so adding it as %s", dest, conflict.device, strings.Join(halves(network), ", "))
+				out = append(out, halves(network)...)
+			} else {
+				p.warnf("The route %s lies within the local network %s, upon %s, which the VPN takes over", dest, conflict.network, conflict.device)
+				out = append(out, dest)
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,71 @@
+// pkg/client/device.go contains our support for devices which are
+// supplied to us, rather than created by us.
+//
+// Upon Android the VpnService creates the device, with the addresses and
+// routes we give it, and hands us its file-descriptor.  The sockets we
+// use to reach the server must be "protected", so that their traffic
+// isn't routed over the VPN itself.
+
+package client
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// DeviceSettings are the settings of the device we need, which we're
+// given by the server when we connect.
+type DeviceSettings struct {
+	// IP is our address within the VPN.
+	IP string
+
+	// Subnet is the CIDR range of the VPN.
+	Subnet string
+
+	// Gateway is the address of the server, within the VPN.
+	Gateway string
+
+	// MTU is the MTU of the device.
+	MTU int
+
+	// Routes are the extra CIDR ranges we should route over the VPN.
+	Routes []string
+}
+
+// externalDevice obtains our device from our OpenDevice hook.  The device
+// is expected to be configured already, so we run no commands, and nor
+// do we apply our kill-switch, or run our hooks.
+func (p *Client) externalDevice(settings DeviceSettings) error {
+	dev, err := p.openDevice(settings)
+	if err != nil {
+		return fmt.Errorf("failed to open our device: %s", err.Error())
+	}
+	p.queues = []shared.TunDevice{dev}
+	p.routes = settings.Routes
+	return nil
+}
+
+// control is given each socket we open to reach the server, or our peers,
+// before it is used.  It binds the socket to our `bind_device`, if we have
+// one, and passes it to our Protect hook, if we have one.
+func (p *Client) control(network string, address string, conn syscall.RawConn) error {
+	if p.protect == nil && p.bindDevice == "" {
+		return nil
+	}
+
+	var err error
+	cerr := conn.Control(func(fd uintptr) {
+		if p.bindDevice != "" {
+			err = shared.BindToDevice(fd, p.bindDevice)
+		}
+		if err == nil && p.protect != nil {
+			err = p.protect(fd)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+// pkg/client/discover.go contains our discovery of servers via DNS, or
+// the service catalogs of Consul, and etcd.
+//
+// A client configured with `vpn = auto:example.com` looks up the SRV
+// records of `_simplevpn._tcp.example.com`, which name each server and
+// its port, in order of preference.  TXT records of the same name may
+// give the scheme, and path, of the servers, and the fingerprint of their
+// TLS certificate:
+//
+//    _simplevpn._tcp.example.com. SRV 10 0 443 vpn1.example.com.
+//    _simplevpn._tcp.example.com. SRV 20 0 443 vpn2.example.com.
+//    _simplevpn._tcp.example.com. TXT "path=/vpn"
+//    _simplevpn._tcp.example.com. TXT "fingerprint=sha256:ab:cd:..."
+//
+// Servers registered in Consul, or etcd, are discovered with an end-point
+// such as `consul:http://127.0.0.1:8500/simple-vpn`, which gives the URL
+// of the catalog's API, and the name of the service.
+//
+// This allows a fleet of clients to be moved between servers by changing
+// DNS, or the catalog, rather than their configuration.
+//
+// Whoever can spoof our DNS can choose both the servers, and the pin, so a
+// fingerprint which is discovered only narrows the certificates we accept
+// to those our certificate authorities have signed.  Only a fingerprint in
+// our configuration lets a self-signed certificate be used.
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/skx/simple-vpn/pkg/registry"
+)
+
+// autoPrefix is the prefix of an end-point which is discovered via DNS.
+const autoPrefix = "auto:"
+
+// discover returns the servers described by the DNS records of the given
+// domain, as a comma-separated list of end-points, and the fingerprint
+// of their certificate, if one is published.
+func discover(domain string) (string, string, error) {
+	_, records, err := net.LookupSRV("simplevpn", "tcp", domain)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to discover the servers of %s: %s", domain, err.Error())
+	}
+
+	scheme := "wss"
+	path := "/"
+	fingerprint := ""
+	txt, _ := net.LookupTXT("_simplevpn._tcp." + domain)
+	for _, record := range txt {
+		for _, field := range strings.Fields(record) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "scheme":
+				scheme = kv[1]
+			case "path":
+				path = kv[1]
+			case "fingerprint":
+				fingerprint = kv[1]
+			}
+		}
+	}
+	if scheme != "ws" && scheme != "wss" {
+		return "", "", fmt.Errorf("the servers of %s have an unknown scheme %s", domain, scheme)
+	}
+
+	//
+	// The records are sorted by priority, and randomized by weight,
+	// so we try them in that order.
+	//
+	var servers []string
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		if host == "" {
+			continue
+		}
+		servers = append(servers, scheme+"://"+net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))+path)
+	}
+	if len(servers) == 0 {
+		return "", "", fmt.Errorf("%s has no servers", domain)
+	}
+	return strings.Join(servers, ","), fingerprint, nil
+}
+
+// discoverFromRegistry returns the servers registered in the catalog of
+// Consul, or etcd, given as "consul:URL/SERVICE", or "etcd:URL/SERVICE".
+func discoverFromRegistry(endPoint string) (string, error) {
+	i := strings.LastIndex(endPoint, "/")
+	if i < 0 || i == len(endPoint)-1 {
+		return "", fmt.Errorf("invalid end-point %s, expected the name of a service after the URL of the registry", endPoint)
+	}
+
+	catalog, err := registry.New(endPoint[:i])
+	if err != nil {
+		return "", err
+	}
+	servers, err := catalog.Discover(endPoint[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("failed to discover the servers of %s: %s", endPoint, err.Error())
+	}
+	return strings.Join(servers, ","), nil
+}
+
+// discovered returns true if the servers of the given end-point are
+// discovered, via DNS, or a service catalog.
+func discovered(endPoint string) bool {
+	return strings.HasPrefix(endPoint, autoPrefix) || strings.HasPrefix(endPoint, "consul:") || strings.HasPrefix(endPoint, "etcd:")
+}
+
+// resolveEndPoint returns the servers of the given end-point, discovering
+// them if it is of the form "auto:DOMAIN", or names a service catalog, and
+// the fingerprint we should pin their certificate to.  A configured
+// fingerprint takes precedence over one which is discovered.
+//
+// We also return true if the fingerprint was discovered, in which case the
+// certificate must be verified against our certificate authorities too.
+func (p *Client) resolveEndPoint(endPoint string) (string, string, bool, error) {
+	fingerprint := p.config.Get("fingerprint")
+	if !discovered(endPoint) {
+		return endPoint, fingerprint, false, nil
+	}
+	if !strings.HasPrefix(endPoint, autoPrefix) {
+		servers, err := discoverFromRegistry(endPoint)
+		return servers, fingerprint, false, err
+	}
+
+	servers, discovered, err := discover(strings.TrimPrefix(endPoint, autoPrefix))
+	if err != nil {
+		return "", "", false, err
+	}
+	if fingerprint == "" && discovered != "" {
+		return servers, discovered, true, nil
+	}
+	return servers, fingerprint, false, nil
+}
+
+// sortedList returns the given comma-separated list, sorted, so that
+// lists may be compared.
+func sortedList(list string) string {
+	items := strings.Split(list, ",")
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// pinnedTLS returns a TLS configuration which accepts only the server
+// certificate with the given SHA-256 fingerprint.  Unless verify is true
+// that is in place of verifying it against our certificate authorities,
+// which allows self-signed certificates to be used safely.
+func pinnedTLS(fingerprint string, verify bool) (*tls.Config, error) {
+	hexed := strings.Replace(strings.TrimPrefix(strings.ToLower(fingerprint), "sha256:"), ":", "", -1)
+	want, err := hex.DecodeString(hexed)
+	if err != nil || len(want) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint %s, it should be the hex-encoded SHA-256 of the certificate", fingerprint)
+	}
+
+	return &tls.Config{
+		InsecureSkipVerify: !verify,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return fmt.Errorf("the server sent no certificate")
+			}
+			got := sha256.Sum256(raw[0])
+			if !bytes.Equal(got[:], want) {
+				return fmt.Errorf("the server's certificate has the fingerprint sha256:%s, not %s", hex.EncodeToString(got[:]), fingerprint)
+			}
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestPinnedTLS ensures that a pinned fingerprint replaces the verification
+// of a certificate only when we're told to, as we are for a fingerprint in
+// our configuration, but not for one discovered via DNS.
+func TestPinnedTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(srv.Certificate().Raw)
+	right := "sha256:" + hex.EncodeToString(sum[:])
+	wrong := "sha256:" + hex.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		fingerprint string
+		verify      bool
+		trusted     bool
+		accepted    bool
+	}{
+		{right, false, false, true},
+		{wrong, false, false, false},
+
+		// The test server's certificate is self-signed, so is
+		// refused unless it is one of our authorities.
+		{right, true, false, false},
+		{wrong, true, false, false},
+		{right, true, true, true},
+		{wrong, true, true, false},
+	}
+
+	for _, test := range tests {
+		config, err := pinnedTLS(test.fingerprint, test.verify)
+		if err != nil {
+			t.Fatalf("failed to pin %s: %s", test.fingerprint, err)
+		}
+		if test.trusted {
+			config.RootCAs = x509.NewCertPool()
+			config.RootCAs.AddCert(srv.Certificate())
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		res, err := client.Get(srv.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		if (err == nil) != test.accepted {
+			t.Errorf("pinning %s, verifying %t, trusted %t: expected acceptance %t, got %v", test.fingerprint, test.verify, test.trusted, test.accepted, err)
+		}
+	}
+
+	if _, err := pinnedTLS("sha256:abcd", false); err == nil {
+		t.Errorf("expected a short fingerprint to be refused")
+	}
+}
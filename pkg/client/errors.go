@@ -0,0 +1,27 @@
+// pkg/client/errors.go contains the errors which Connect returns when
+// the server refuses us, or can't be reached, so that our supervisor can
+// tell them apart from our own failures.
+
+package client
+
+// AuthError is returned by Connect if every server refused our key, or
+// our name.  Trying again won't help until our configuration is fixed.
+type AuthError struct {
+	Reason string
+}
+
+// Error returns a description of the error.
+func (e *AuthError) Error() string {
+	return "the server refused us: " + e.Reason
+}
+
+// NetworkError is returned by Connect if we couldn't reach any server,
+// or lost our connection to it.  Trying again later might succeed.
+type NetworkError struct {
+	Reason string
+}
+
+// Error returns a description of the error.
+func (e *NetworkError) Error() string {
+	return e.Reason
+}
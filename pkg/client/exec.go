@@ -0,0 +1,113 @@
+// pkg/client/exec.go contains our handling of the actions which the
+// server may ask us to perform, for the remote-management of clients
+// which are only reachable via the VPN.
+//
+// This is strictly opt-in: we only obey if `allow_remote_exec` is true,
+// and the action is listed in `remote_exec_allow`.  The actions are:
+//
+//   up      - Re-run our `up` hook.
+//   routes  - Route the given CIDR ranges over the VPN.
+//   logs    - Send our recent warnings, and errors, to the server.
+//   NAME    - Run the command defined by the `exec_NAME` setting.
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// execAllowed returns true if we may perform the given action.
+func (p *Client) execAllowed(action string) bool {
+	if p.config.Get("allow_remote_exec") != "true" {
+		return false
+	}
+	for _, allowed := range shared.SplitList(p.config.Get("remote_exec_allow")) {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteExec performs the action the server sent us, if we allow it, and
+// reports the result.
+//
+// Actions may take a while, so they're performed in the background.
+func (p *Client) remoteExec(socket *shared.Socket, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("missing action")
+	}
+	action := args[0]
+
+	if !p.execAllowed(action) {
+		p.warnf("Refused remote action '%s'", action)
+		socket.SendCommand("exec-result", action, "false", "not permitted")
+		return fmt.Errorf("remote action '%s' is not permitted", action)
+	}
+
+	go func() {
+		msg, err := p.performAction(socket, action, args[1:])
+		if err != nil {
+			p.warnf("Remote action '%s' failed - %s", action, err.Error())
+			socket.SendCommand("exec-result", action, "false", err.Error())
+			return
+		}
+		socket.SendCommand("exec-result", action, "true", msg)
+	}()
+	return nil
+}
+
+// performAction performs the given action, returning a description of
+// what we did.
+func (p *Client) performAction(socket *shared.Socket, action string, args []string) (string, error) {
+	status := p.getStatus()
+	if status.State != "up" {
+		return "", fmt.Errorf("the VPN is not up")
+	}
+	env := p.linkEnv(status.Device, status.IP, status.Gateway, status.Subnet, strconv.Itoa(status.MTU))
+
+	switch action {
+	case "up":
+		if p.config.Get("up") == "" {
+			return "", fmt.Errorf("no up-script is configured")
+		}
+		return "ran up-script", p.runHook("up", env, nil)
+
+	case "routes":
+		for _, route := range args {
+			if _, _, err := net.ParseCIDR(route); err != nil {
+				return "", fmt.Errorf("invalid route '%s'", route)
+			}
+		}
+		for _, route := range args {
+			var out []byte
+			err := p.inNetns(func() error {
+				var err error
+				out, err = exec.Command("ip", "route", "replace", route, "via", status.Gateway, "dev", status.Device, "onlink").CombinedOutput()
+				return err
+			})
+			if err != nil {
+				return "", fmt.Errorf("failed to add route %s - %s %s", route, err.Error(), strings.TrimSpace(string(out)))
+			}
+		}
+		return fmt.Sprintf("routed %s", strings.Join(args, ", ")), nil
+
+	case "logs":
+		recent := p.recentWarnings()
+		for _, msg := range recent {
+			socket.SendCommand("log", msg)
+		}
+		return fmt.Sprintf("sent %d messages", len(recent)), nil
+	}
+
+	if p.config.Get("exec_"+action) == "" {
+		return "", fmt.Errorf("unknown action")
+	}
+	return "ran exec_" + action, p.runHook("exec_"+action, env, nil)
+}
@@ -0,0 +1,99 @@
+// pkg/client/init.go contains the parsing of the `init` command, which
+// the server sends us once we've connected, to tell us how to configure
+// ourselves.
+//
+// The first four arguments are positional: the subnet, our IP, the MTU,
+// and the gateway.  Older servers then send our extra routes, and perhaps
+// our framing, positionally too.  Anything else is given as "key=value",
+// so that newer servers may tell us more without breaking us: arguments
+// we don't understand are ignored.
+
+package client
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// initArgs holds the settings the server sent us in its `init` command.
+type initArgs struct {
+	Subnet  string
+	IP      string
+	MTU     int
+	Gateway string
+	Routes  []string
+	Framing shared.Framing
+}
+
+// parseInit parses the arguments of the `init` command.
+func parseInit(args []string) (initArgs, error) {
+	var out initArgs
+
+	//
+	// Split the named arguments from those which are positional.
+	//
+	var positional []string
+	named := make(map[string]string)
+	for _, arg := range args {
+		if eq := strings.Index(arg, "="); eq > 0 {
+			named[arg[:eq]] = arg[eq+1:]
+		} else {
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) < 4 {
+		return out, fmt.Errorf("expected at least four arguments, got %d", len(positional))
+	}
+
+	values := map[string]string{
+		"subnet":  positional[0],
+		"ip":      positional[1],
+		"mtu":     positional[2],
+		"gateway": positional[3],
+	}
+	if len(positional) > 4 {
+		values["routes"] = positional[4]
+	}
+	if len(positional) > 5 {
+		values["framing"] = positional[5]
+	}
+
+	//
+	// Named arguments take precedence, and those we don't know are
+	// ignored.
+	//
+	for key, value := range named {
+		switch key {
+		case "subnet", "ip", "mtu", "gateway", "routes", "framing":
+			values[key] = value
+		default:
+			log.Printf("Ignoring the unknown init argument %s", key)
+		}
+	}
+
+	var err error
+	out.Subnet = values["subnet"]
+	out.IP = values["ip"]
+	out.Gateway = values["gateway"]
+	out.MTU, err = strconv.Atoi(values["mtu"])
+	if err != nil {
+		return out, fmt.Errorf("MTU was not a valid int: %s", err.Error())
+	}
+	if values["routes"] != "" {
+		out.Routes = strings.Split(values["routes"], ",")
+	}
+
+	//
+	// Older servers don't tell us their framing, and switch our
+	// packets as if they were Ethernet frames.
+	//
+	out.Framing, err = shared.ParseFraming(values["framing"])
+	if err != nil {
+		return out, err
+	}
+	return out, nil
+}
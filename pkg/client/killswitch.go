@@ -0,0 +1,106 @@
+// pkg/client/killswitch.go contains our kill-switch.
+//
+// When enabled we block all outgoing traffic which doesn't pass over the
+// VPN, except that to our servers, so that nothing leaks while we're
+// disconnected, or reconnecting.  The rules are removed when we're
+// stopped, but remain if we fail, until we're restarted.
+
+package client
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/skx/simple-vpn/pkg/firewall"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// killSwitchTable is the nftables table which holds our kill-switch.
+const killSwitchTable = "simple-vpn-client"
+
+// updateKillSwitch applies our kill-switch, if it is enabled, permitting
+// traffic over our device, to the given servers, and to the networks we
+// are configured to allow.
+//
+// The addresses of the servers are resolved now, so this is called again
+// whenever they, or our device, change.
+func (p *Client) updateKillSwitch(endPoint string) error {
+	if p.config.Get("kill_switch") != "true" {
+		return nil
+	}
+
+	rules := firewall.New(killSwitchTable, p.config.Get("firewall_dry_run") == "true")
+	out := rules.Chain("output", "filter", "output", 0)
+	out.Policy = "drop"
+
+	out.Add(`oifname "lo" accept`)
+	if len(p.queues) > 0 {
+		out.Add("oifname %q accept", p.queues[0].Name())
+	}
+
+	//
+	// Replies to connections made to us are permitted, but not the
+	// traffic of connections we made, which would otherwise continue
+	// outside the VPN.
+	//
+	out.Add("ct direction reply accept")
+
+	for _, server := range strings.Split(endPoint, ",") {
+		u, err := url.Parse(strings.TrimSpace(server))
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "wss" {
+				port = "443"
+			}
+		}
+		addrs, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			log.Printf("Failed to resolve %s for our kill-switch: %s", u.Hostname(), err.Error())
+			continue
+		}
+		for _, addr := range addrs {
+			if p.bindDevice != "" {
+				out.Add("oifname %q %s daddr %s tcp dport %s accept", p.bindDevice, firewall.Family(addr), addr, port)
+			} else {
+				out.Add("%s daddr %s tcp dport %s accept", firewall.Family(addr), addr, port)
+			}
+		}
+	}
+
+	allow, err := shared.ParseNetworks(p.config.Get("kill_switch_allow"))
+	if err != nil {
+		return err
+	}
+	for _, network := range allow {
+		out.Add("%s daddr %s accept", firewall.Family(network.String()), network.String())
+	}
+
+	if p.direct != nil {
+		out.Add("udp sport %d accept", p.direct.conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+
+	err = p.inNetns(rules.Apply)
+	if err != nil {
+		return err
+	}
+	p.killSwitch = rules
+	return nil
+}
+
+// removeKillSwitch removes our kill-switch, if we applied it.
+func (p *Client) removeKillSwitch() {
+	if p.killSwitch == nil {
+		return
+	}
+	err := p.inNetns(p.killSwitch.Remove)
+	if err != nil {
+		p.warnf("Failed to remove our kill-switch: %s", err.Error())
+	}
+	p.killSwitch = nil
+}
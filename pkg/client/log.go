@@ -0,0 +1,51 @@
+// pkg/client/log.go contains our reporting of warnings, and errors.
+//
+// If `remote_log` is enabled these are also forwarded to the server, so
+// that a headless client can be debugged without shell access to it.  The
+// most recent are also kept, for the server to fetch.
+
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxRecentWarnings is the number of warnings we keep, for the server to
+// fetch.
+const maxRecentWarnings = 50
+
+// warnf reports a warning, or error, upon the console, and forwards it
+// to the server if we've been configured to do so.
+func (p *Client) warnf(format string, args ...interface{}) {
+	msg := strings.TrimSpace(fmt.Sprintf(format, args...))
+	fmt.Printf("%s\n", msg)
+
+	p.recentMutex.Lock()
+	p.recent = append(p.recent, msg)
+	if len(p.recent) > maxRecentWarnings {
+		p.recent = p.recent[len(p.recent)-maxRecentWarnings:]
+	}
+	p.recentMutex.Unlock()
+
+	if p.config.Get("remote_log") != "true" {
+		return
+	}
+
+	p.statusMutex.Lock()
+	socket := p.socket
+	p.statusMutex.Unlock()
+
+	if socket != nil {
+		socket.SendCommand("log", msg)
+	}
+}
+
+// recentWarnings returns the most recent warnings, and errors, we've
+// reported.
+func (p *Client) recentWarnings() []string {
+	p.recentMutex.Lock()
+	defer p.recentMutex.Unlock()
+
+	return append([]string(nil), p.recent...)
+}
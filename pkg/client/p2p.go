@@ -0,0 +1,566 @@
+// pkg/client/p2p.go contains our direct paths to peers.
+//
+// If `p2p = true` we open a UDP socket, learn its public address via
+// STUN, from the server itself unless we've been configured to use
+// another, and tell the server each address we may be reached upon.  When
+// we first send traffic to a peer we ask the server to introduce us, and
+// it sends us both the addresses of the other along with a key for the
+// pair.  We each then send probes to the other's addresses, opening a
+// path through any NAT between us, and once a probe is acknowledged our
+// traffic to that peer is sent directly.
+//
+// Until a path is found, or if it stops working, traffic continues to be
+// relayed via the server.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// The types of the packets we exchange with our peers.
+const (
+	p2pProbe = 1
+	p2pAck   = 2
+	p2pData  = 3
+)
+
+const (
+	// p2pHeader is the size of the header of our packets: their type,
+	// the VPN IP of the sender, and the nonce.  The type and IP are
+	// authenticated, but not encrypted.
+	p2pHeader = 1 + net.IPv6len + 12
+
+	// p2pPunch is how long we try to open a path after an introduction.
+	p2pPunch = 10 * time.Second
+
+	// p2pKeepalive is how often we probe a path, and p2pTimeout how
+	// long it may go unanswered before we abandon it.
+	p2pKeepalive = 5 * time.Second
+	p2pTimeout   = 45 * time.Second
+
+	// p2pRetry is how often we may ask the server to introduce us to
+	// the same peer.
+	p2pRetry = 30 * time.Second
+)
+
+// p2pPath is a direct path to a single peer.
+type p2pPath struct {
+	// peer is the VPN IP of the peer.
+	peer net.IP
+
+	// aead encrypts our traffic, with the key the server gave us.
+	aead cipher.AEAD
+
+	// direction distinguishes the nonces we send from those of the
+	// peer, as we share a key.
+	direction byte
+
+	// sent is the number of packets we've sent, which forms our nonce.
+	sent uint64
+
+	// highest is the highest counter we've received, and window records
+	// which of those before it we've seen, so replays are rejected.
+	highest uint64
+	window  uint64
+
+	// candidates are the addresses the peer may be reached upon, and
+	// addr the one which answered us.
+	candidates []*net.UDPAddr
+	addr       *net.UDPAddr
+
+	// offered is when we were introduced, and lastAck when the peer
+	// last answered a probe.
+	offered time.Time
+	lastAck time.Time
+
+	// metrics measures this path, and the path via the server, and
+	// decides which we use.
+	metrics pathMetrics
+}
+
+// fresh returns true if we've not seen the given counter before.
+func (path *p2pPath) fresh(counter uint64) bool {
+	if counter > path.highest {
+		return true
+	}
+	age := path.highest - counter
+	return age < 64 && path.window&(1<<age) == 0
+}
+
+// accept records that we've seen the given counter.
+func (path *p2pPath) accept(counter uint64) {
+	if counter > path.highest {
+		shift := counter - path.highest
+		if shift >= 64 {
+			path.window = 0
+		} else {
+			path.window <<= shift
+		}
+		path.highest = counter
+	}
+	path.window |= 1 << (path.highest - counter)
+}
+
+// p2p holds the state of our direct paths.
+type p2p struct {
+	client *Client
+
+	// conn is our UDP socket.
+	conn *net.UDPConn
+
+	// stunReplies receives the STUN responses read from our socket.
+	stunReplies chan []byte
+
+	// done is closed when we're closed.
+	done chan struct{}
+
+	// mutex protects the remaining fields.
+	mutex sync.Mutex
+
+	// socket is our connection to the server, and iface our device.
+	socket *shared.Socket
+	iface  shared.TunDevice
+
+	// ip is our VPN IP, within subnet, and gateway that of the server.
+	ip      net.IP
+	subnet  *net.IPNet
+	gateway net.IP
+
+	// stunPort is the port of the server's STUN responder, if it has
+	// one.
+	stunPort int
+
+	// paths holds the path to each peer, by VPN IP, and requested when
+	// we last asked the server to introduce us.
+	paths     map[string]*p2pPath
+	requested map[string]time.Time
+}
+
+// newP2P opens our UDP socket, upon the port given by `p2p_port`, and
+// launches the goroutines which serve it until it is closed.
+func newP2P(client *Client) (*p2p, error) {
+	lc := net.ListenConfig{Control: client.control}
+	host := ""
+	if client.bindAddress != nil {
+		host = client.bindAddress.String()
+	}
+	packet, err := lc.ListenPacket(context.Background(), "udp", net.JoinHostPort(host, strconv.Itoa(client.config.GetIntWithDefault("p2p_port", 0))))
+	if err != nil {
+		return nil, err
+	}
+	conn := packet.(*net.UDPConn)
+
+	d := &p2p{
+		client:      client,
+		conn:        conn,
+		stunReplies: make(chan []byte, 1),
+		done:        make(chan struct{}),
+		paths:       make(map[string]*p2pPath),
+		requested:   make(map[string]time.Time),
+	}
+	go d.serve()
+	go d.maintain()
+	return d, nil
+}
+
+// Close closes our UDP socket.
+func (d *p2p) Close() {
+	close(d.done)
+	d.conn.Close()
+}
+
+// start begins using the given connection to the server, which assigned
+// us the given settings.  We forget any paths we had, and tell the server
+// how we may be reached.
+//
+// Direct paths carry IP packets, which we route by their destination, so
+// are only used when the server gave us IP framing.
+func (d *p2p) start(socket *shared.Socket, iface shared.TunDevice, framing shared.Framing, ip string, subnet string, gateway string) {
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil || framing != shared.FramingIP {
+		d.mutex.Lock()
+		d.iface = nil
+		d.ip = nil
+		d.subnet = nil
+		d.paths = make(map[string]*p2pPath)
+		d.mutex.Unlock()
+		return
+	}
+
+	d.mutex.Lock()
+	d.socket = socket
+	d.iface = iface
+	d.ip = net.ParseIP(ip)
+	d.subnet = network
+	d.gateway = net.ParseIP(gateway)
+	d.paths = make(map[string]*p2pPath)
+	d.requested = make(map[string]time.Time)
+	d.mutex.Unlock()
+
+	err = socket.SendCommand("p2p-candidates", d.candidates()...)
+	if err != nil {
+		d.client.warnf("Failed to send our p2p addresses - %s", err.Error())
+	}
+}
+
+// setSTUN records the port of the STUN responder of the server we're
+// connected to, which is zero if it has none.
+func (d *p2p) setSTUN(port int) {
+	d.mutex.Lock()
+	d.stunPort = port
+	d.mutex.Unlock()
+}
+
+// stunServer returns the address of the STUN server we should use, if
+// any.  That configured by `stun` is preferred, and otherwise we use the
+// responder of the server we're connected to.
+func (d *p2p) stunServer() string {
+	if server := d.client.config.Get("stun"); server != "" {
+		return server
+	}
+
+	d.mutex.Lock()
+	port := d.stunPort
+	d.mutex.Unlock()
+	if port == 0 {
+		return ""
+	}
+
+	endPoint, err := url.Parse(d.client.getStatus().Server)
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(endPoint.Hostname(), strconv.Itoa(port))
+}
+
+// candidates returns the addresses we may be reached upon: those of our
+// local interfaces, and our public address if we've a STUN server.
+func (d *p2p) candidates() []string {
+	port := d.conn.LocalAddr().(*net.UDPAddr).Port
+
+	var out []string
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() || d.subnet.Contains(ipnet.IP) {
+			continue
+		}
+		out = append(out, net.JoinHostPort(ipnet.IP.String(), strconv.Itoa(port)))
+	}
+
+	server := d.stunServer()
+	if server != "" {
+		public, err := d.stun(server)
+		if err != nil {
+			d.client.warnf("Failed to learn our public address from %s - %s", server, err.Error())
+		} else {
+			out = append(out, public.String())
+		}
+	}
+
+	if len(out) > maxCandidates {
+		out = out[:maxCandidates]
+	}
+	return out
+}
+
+// maxCandidates is the number of addresses the server will accept.
+const maxCandidates = 16
+
+// stun asks the given STUN server for the public address of our socket.
+func (d *p2p) stun(server string) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	// Our request is sent a few times, in case it is lost.
+	//
+	request := shared.STUNRequest()
+	for attempt := 0; attempt < 3; attempt++ {
+		_, err = d.conn.WriteToUDP(request, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		timeout := time.After(time.Second)
+	wait:
+		for {
+			select {
+			case reply := <-d.stunReplies:
+				public, err := shared.ParseSTUNResponse(request, reply)
+				if err == nil {
+					return public, nil
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+	}
+	return nil, fmt.Errorf("no response")
+}
+
+// offer handles an introduction to a peer, which the server sends as the
+// VPN IP of the peer, our key, and the addresses it may be reached upon.
+func (d *p2p) offer(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("malformed introduction")
+	}
+	peer := net.ParseIP(args[0])
+	if peer == nil {
+		return fmt.Errorf("invalid peer %s", args[0])
+	}
+	key, err := hex.DecodeString(args[1])
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	path := &p2pPath{peer: peer, aead: aead, offered: time.Now()}
+	for _, str := range strings.Split(args[2], ",") {
+		addr, err := net.ResolveUDPAddr("udp", str)
+		if err == nil {
+			path.candidates = append(path.candidates, addr)
+		}
+	}
+
+	d.mutex.Lock()
+	if d.ip == nil {
+		d.mutex.Unlock()
+		return fmt.Errorf("not yet configured")
+	}
+	if bytes.Compare(d.ip.To16(), peer.To16()) < 0 {
+		path.direction = 1
+	}
+	d.paths[peer.String()] = path
+	d.mutex.Unlock()
+
+	go d.punch(path)
+	return nil
+}
+
+// punch sends probes to each of the addresses of the peer, until one of
+// them is acknowledged or we give up.
+func (d *p2p) punch(path *p2pPath) {
+	for time.Since(path.offered) < p2pPunch {
+		d.mutex.Lock()
+		if d.paths[path.peer.String()] != path || path.addr != nil {
+			d.mutex.Unlock()
+			return
+		}
+		for _, addr := range path.candidates {
+			d.write(path, addr, p2pProbe, timestamp())
+		}
+		d.mutex.Unlock()
+
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// write encrypts the given payload, and sends it to the given address.
+// The caller must hold our mutex.
+func (d *p2p) write(path *p2pPath, addr *net.UDPAddr, kind byte, payload []byte) {
+	packet := make([]byte, p2pHeader, p2pHeader+len(payload)+path.aead.Overhead())
+	packet[0] = kind
+	copy(packet[1:], d.ip.To16())
+	nonce := packet[1+net.IPv6len : p2pHeader]
+	nonce[0] = path.direction
+	binary.BigEndian.PutUint64(nonce[4:], path.sent)
+	path.sent++
+
+	packet = path.aead.Seal(packet, nonce, payload, packet[:1+net.IPv6len])
+	d.conn.WriteToUDP(packet, addr)
+}
+
+// send is offered each packet read from our device.  If we've a direct
+// path to its destination, and it is the better path, we send it that
+// way and return true.
+// Otherwise we ask the server to introduce us to the peer, if we've not
+// done so recently, and it's relayed via the server meanwhile.
+func (d *p2p) send(packet []byte) bool {
+	dest := shared.GetDestIP(packet)
+	if dest == nil {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.subnet == nil || !d.subnet.Contains(dest) || dest.Equal(d.gateway) || dest.Equal(d.ip) {
+		return false
+	}
+
+	key := dest.String()
+	path := d.paths[key]
+	if path != nil && path.addr != nil {
+		if path.metrics.relayed {
+			return false
+		}
+		d.write(path, path.addr, p2pData, packet)
+		return true
+	}
+
+	if path == nil && time.Since(d.requested[key]) > p2pRetry {
+		d.requested[key] = time.Now()
+		socket := d.socket
+		go socket.SendCommand("p2p-request", key)
+	}
+	return false
+}
+
+// serve reads the packets our peers send us, until our socket is closed.
+func (d *p2p) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if shared.IsSTUN(buf[:n]) {
+			select {
+			case d.stunReplies <- append([]byte(nil), buf[:n]...):
+			default:
+			}
+			continue
+		}
+
+		d.receive(buf[:n], from)
+	}
+}
+
+// receive handles a packet sent to us by a peer, from the given address.
+func (d *p2p) receive(packet []byte, from *net.UDPAddr) {
+	if len(packet) < p2pHeader {
+		return
+	}
+
+	d.mutex.Lock()
+	path := d.paths[net.IP(packet[1:1+net.IPv6len]).String()]
+	if path == nil {
+		d.mutex.Unlock()
+		return
+	}
+
+	//
+	// Reject our own packets, reflected back to us, and replays.
+	//
+	nonce := packet[1+net.IPv6len : p2pHeader]
+	counter := binary.BigEndian.Uint64(nonce[4:])
+	if nonce[0] == path.direction || !path.fresh(counter) {
+		d.mutex.Unlock()
+		return
+	}
+	payload, err := path.aead.Open(nil, nonce, packet[p2pHeader:], packet[:1+net.IPv6len])
+	if err != nil {
+		d.mutex.Unlock()
+		return
+	}
+	path.accept(counter)
+
+	iface := d.iface
+	switch packet[0] {
+	case p2pProbe:
+		d.write(path, from, p2pAck, payload)
+	case p2pAck:
+		if path.addr == nil || path.addr.String() != from.String() {
+			log.Printf("Direct path to %s via %s", path.peer, from)
+		}
+		path.addr = from
+		path.lastAck = time.Now()
+		path.metrics.acked(payload)
+	}
+	d.mutex.Unlock()
+
+	//
+	// Traffic is only accepted if it really came from the peer, and
+	// is well-formed.
+	//
+	if packet[0] == p2pData && iface != nil && shared.CheckPacket(payload, shared.FramingIP, 0) == "" {
+		src := shared.GetSrcIP(payload)
+		if src != nil && src.Equal(path.peer) {
+			iface.Write(payload)
+		}
+	}
+}
+
+// maintain keeps our paths alive, and abandons those which have failed,
+// until we're closed.
+//
+// Each path is probed periodically, and only the acknowledgements prove
+// that it works in both directions.  We also measure the path to each
+// peer via the server, so that we can use whichever is better.
+func (d *p2p) maintain() {
+	for {
+		select {
+		case <-time.After(p2pKeepalive):
+		case <-d.done:
+			return
+		}
+
+		var pings []string
+		d.mutex.Lock()
+		socket := d.socket
+		for key, path := range d.paths {
+			if path.addr == nil {
+				if time.Since(path.offered) > p2pPunch {
+					delete(d.paths, key)
+				}
+				continue
+			}
+			if time.Since(path.lastAck) > p2pTimeout {
+				log.Printf("Direct path to %s lost, relaying via the server", path.peer)
+				delete(d.paths, key)
+				continue
+			}
+			path.metrics.probed()
+			path.metrics.choose(path.peer)
+			d.write(path, path.addr, p2pProbe, timestamp())
+			pings = append(pings, key)
+		}
+		d.mutex.Unlock()
+
+		for _, key := range pings {
+			socket.SendCommand("p2p-ping", key, strconv.FormatInt(time.Now().UnixNano(), 10))
+		}
+	}
+}
+
+// direct returns the address of the direct path to each peer we're using,
+// by VPN IP.
+func (d *p2p) direct() map[string]string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	out := make(map[string]string)
+	for key, path := range d.paths {
+		if path.addr != nil && !path.metrics.relayed {
+			out[key] = path.addr.String()
+		}
+	}
+	return out
+}
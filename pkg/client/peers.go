@@ -0,0 +1,197 @@
+// pkg/client/peers.go contains our handling of the peer-list.
+//
+// The server sends us the full list of peers when we join, and then
+// only the changes to it.  Whenever the list changes we update our
+// hosts-file, and run the `peers` hook, passing each a PeersUpdate.
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// PeersVersion is the version of the PeersUpdate document, which will be
+// raised if we ever change it incompatibly.
+const PeersVersion = 1
+
+// The events which change our peer-list.
+const (
+	// PeersFullSync is sent when the server gives us the whole list,
+	// as it does when we join.
+	PeersFullSync = "full-sync"
+
+	// PeersJoin is sent when peers join, or change.
+	PeersJoin = "join"
+
+	// PeersLeave is sent when peers leave.
+	PeersLeave = "leave"
+)
+
+// PeersUpdate is the document describing a change to our peer-list, which
+// the `peers` hook receives upon STDIN as JSON.
+type PeersUpdate struct {
+	// Version is the version of this document, see PeersVersion.
+	Version int
+
+	// Event is the event which changed the list.
+	Event string
+
+	// Added are the peers which joined, or changed, and Removed those
+	// which left, or changed, as they were before.
+	Added   []Peer
+	Removed []Peer
+
+	// Peers is the whole list, sorted by name.
+	Peers []Peer
+}
+
+// sortPeers sorts the given peers by name.
+func sortPeers(peers []Peer) {
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+}
+
+// parsePeers parses the peers the server sent us.  Any which are
+// malformed, or whose names are invalid, are logged, and ignored.
+func (p *Client) parsePeers(args []string) []Peer {
+	var peers []Peer
+	for _, ent := range args {
+		if ent == "" {
+			continue
+		}
+		peer, err := shared.DecodePeer(ent)
+		if err == nil {
+			err = shared.ValidName(peer.Name)
+		}
+		if err != nil {
+			p.warnf("Ignoring peer: %s", err.Error())
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// updatePeers applies the given change, caused by the given event, to our
+// peer-list.  If that changed anything we update our hosts-file, and run
+// the `peers` hook.
+//
+// The hook receives a PeersUpdate upon STDIN, as JSON, unless the
+// `peers_format` is "array", in which case it receives just the list, or
+// "tab", in which case it receives "IP[TAB]NAME" lines.  The names of the
+// peers which were added, and removed, are in $PEERS_ADDED and
+// $PEERS_REMOVED.
+func (p *Client) updatePeers(event string, fn func(peers map[string]Peer)) error {
+
+	p.peersMutex.Lock()
+	old := p.peers
+	peers := make(map[string]Peer)
+	for name, peer := range old {
+		peers[name] = peer
+	}
+	fn(peers)
+	p.peers = peers
+	p.peersMutex.Unlock()
+
+	//
+	// Find what changed.
+	//
+	update := &PeersUpdate{
+		Version: PeersVersion,
+		Event:   event,
+		Added:   make([]Peer, 0),
+		Removed: make([]Peer, 0),
+		Peers:   make([]Peer, 0),
+	}
+	var added, removed []string
+	for name, peer := range peers {
+		if prev, ok := old[name]; !ok || shared.EncodePeer(prev) != shared.EncodePeer(peer) {
+			added = append(added, name)
+			update.Added = append(update.Added, peer)
+		}
+		update.Peers = append(update.Peers, peer)
+	}
+	for name, peer := range old {
+		if cur, ok := peers[name]; !ok || cur.IP != peer.IP {
+			removed = append(removed, name)
+			update.Removed = append(update.Removed, peer)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sortPeers(update.Added)
+	sortPeers(update.Removed)
+	sortPeers(update.Peers)
+
+	fmt.Printf("Peers added: %v, removed: %v\n", added, removed)
+
+	//
+	// Update our hosts-file, if we're maintaining one.
+	//
+	hosts := p.config.Get("hosts_file")
+	if hosts != "" {
+		format := p.config.GetWithDefault("hosts_format", defaultHostsFormat)
+		err := p.writeHostsFile(hosts, format, update)
+		if err != nil {
+			p.warnf("Failed to update %s - %s", hosts, err.Error())
+		}
+	}
+
+	//
+	// If the client has not defined a `peers` command then
+	// we can just return here.
+	//
+	cmd := p.config.Get("peers")
+	if cmd == "" {
+		return nil
+	}
+
+	input, err := encodePeersUpdate(p.config.GetWithDefault("peers_format", "json"), update)
+	if err != nil {
+		p.warnf("Failed to encode our peers: %s", err.Error())
+		return err
+	}
+
+	env := []string{
+		"PEERS_EVENT=" + event,
+		"PEERS_ADDED=" + strings.Join(added, " "),
+		"PEERS_REMOVED=" + strings.Join(removed, " "),
+	}
+	err = p.runHook("peers", env, input)
+	if err != nil {
+		p.warnf("Failed to run %s - %s", cmd, err.Error())
+		return err
+	}
+	return nil
+}
+
+// encodePeersUpdate encodes the given update in the given format, for the
+// `peers` hook.
+//
+// The "array" and "tab" formats are those older releases used, and
+// contain only the list of peers.
+func encodePeersUpdate(format string, update *PeersUpdate) ([]byte, error) {
+	switch format {
+	case "json":
+		return json.Marshal(update)
+	case "array":
+		return json.Marshal(update.Peers)
+	case "tab":
+		var out bytes.Buffer
+		for _, peer := range update.Peers {
+			fmt.Fprintf(&out, "%s\t%s\n", peer.IP, peer.Name)
+		}
+		return out.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown peers_format '%s'", format)
+}
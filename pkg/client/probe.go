@@ -0,0 +1,187 @@
+// pkg/client/probe.go contains our support for probing a VPN-server.
+//
+// A probe performs the same handshake as a client, but then asks the
+// server not to assign it an IP, so no device is created at either end.
+// It is useful for monitoring, or for checking a configuration.
+
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// ProbeOptions holds the settings of a probe.
+type ProbeOptions struct {
+	// Server is the end-point to probe.
+	Server string
+
+	// Key is the shared-key to present.
+	Key string
+
+	// Name is the name to present, which is only used for logging.
+	Name string
+
+	// Headers are extra HTTP-headers to send.
+	Headers http.Header
+
+	// Websocket holds the settings of our connection.
+	Websocket shared.WebsocketOptions
+
+	// TLS is the crypto-policy of our connection.
+	TLS shared.TLSPolicy
+
+	// Echoes is the number of in-band echo commands to send, once
+	// we've connected.
+	Echoes int
+
+	// Timeout is how long we wait for the handshake, and for each
+	// echo.
+	Timeout time.Duration
+}
+
+// TLSInfo describes the TLS connection to a server.
+type TLSInfo struct {
+	// Version is the TLS version, such as "TLS 1.3".
+	Version string
+
+	// CipherSuite is the ID of the cipher suite, and CipherSuiteName
+	// its name.
+	CipherSuite     uint16
+	CipherSuiteName string
+
+	// Subject and Issuer describe the certificate of the server.
+	Subject string
+	Issuer  string
+
+	// Expires is when the certificate expires.
+	Expires time.Time
+}
+
+// ProbeResult holds the result of a probe.
+type ProbeResult struct {
+	// Server is the end-point we probed.
+	Server string
+
+	// Reachable is true if the server answered.
+	Reachable bool
+
+	// Authenticated is true if the server accepted our key.
+	Authenticated bool
+
+	// Status is the HTTP-status with which the server refused us,
+	// if it did.
+	Status int `json:",omitempty"`
+
+	// Handshake is how long the websocket handshake took.
+	Handshake time.Duration
+
+	// TLS describes the TLS connection, if the end-point used it.
+	TLS *TLSInfo `json:",omitempty"`
+
+	// Echoes holds the round-trip time of each echo which was
+	// answered.
+	Echoes []time.Duration
+
+	// Error describes why the probe failed, if it did.
+	Error string `json:",omitempty"`
+}
+
+// Probe connects to a VPN-server, and reports upon what it found.
+//
+// If the probe failed the returned error describes why, and is also
+// recorded in the result.
+func Probe(opts ProbeOptions) (ProbeResult, error) {
+	result := ProbeResult{Server: opts.Server}
+
+	fail := func(err error) (ProbeResult, error) {
+		result.Error = err.Error()
+		return result, err
+	}
+
+	uri := opts.Server
+	if strings.Contains(uri, "?") {
+		uri += "&"
+	} else {
+		uri += "?"
+	}
+	uri += "probe=1"
+	uri += "&name=" + url.QueryEscape(opts.Name)
+	uri += "&key=" + url.QueryEscape(opts.Key)
+
+	dialer := opts.Websocket.Dialer()
+	dialer.HandshakeTimeout = opts.Timeout
+	dialer.TLSClientConfig = opts.TLS.Apply(nil)
+
+	start := time.Now()
+	conn, resp, err := shared.Dial(dialer, uri, opts.Headers)
+	result.Handshake = time.Since(start)
+	if err != nil {
+		if resp != nil {
+			result.Reachable = true
+			result.Status = resp.StatusCode
+			if resp.StatusCode == http.StatusForbidden {
+				return fail(fmt.Errorf("the server refused our key"))
+			}
+			return fail(fmt.Errorf("the server responded with %s", resp.Status))
+		}
+		return fail(err)
+	}
+	defer conn.Close()
+	opts.Websocket.Configure(conn)
+
+	result.Reachable = true
+	result.Authenticated = true
+
+	if tc, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		info := &TLSInfo{
+			Version:         shared.TLSVersionName(state.Version),
+			CipherSuite:     state.CipherSuite,
+			CipherSuiteName: shared.CipherSuiteName(state.CipherSuite),
+		}
+		if len(state.PeerCertificates) > 0 {
+			cert := state.PeerCertificates[0]
+			info.Subject = cert.Subject.String()
+			info.Issuer = cert.Issuer.String()
+			info.Expires = cert.NotAfter
+		}
+		result.TLS = info
+	}
+
+	//
+	// Send our echoes, one at a time, and wait for each reply.
+	//
+	for i := 1; i <= opts.Echoes; i++ {
+		id := fmt.Sprintf("%d", i)
+
+		start = time.Now()
+		conn.SetWriteDeadline(start.Add(opts.Timeout))
+		err = conn.WriteMessage(websocket.TextMessage, []byte(id+"|echo|"))
+		if err != nil {
+			return fail(fmt.Errorf("failed to send echo: %s", err.Error()))
+		}
+
+		conn.SetReadDeadline(start.Add(opts.Timeout))
+		for {
+			msgType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return fail(fmt.Errorf("no reply to echo: %s", err.Error()))
+			}
+			if msgType == websocket.TextMessage && strings.HasPrefix(string(msg), id+"|reply|") {
+				break
+			}
+		}
+		result.Echoes = append(result.Echoes, time.Since(start))
+	}
+
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return result, nil
+}
@@ -0,0 +1,95 @@
+// pkg/client/report.go contains the health-reports we periodically send
+// to the server, which let an operator spot unhealthy clients centrally.
+
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// deviceCounter returns the named statistic of the given device, or zero
+// if it cannot be read.  Only Linux exposes these.
+func deviceCounter(device string, name string) uint64 {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", device, "statistics", name))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return n
+}
+
+// localAddresses returns the addresses of our network interfaces, other
+// than the loopback interface, and our VPN device.
+func localAddresses(device string) []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	var out []string
+	for _, iface := range ifaces {
+		if iface.Name == device || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				out = append(out, ipnet.IP.String())
+			}
+		}
+	}
+	return out
+}
+
+// report returns a description of our health.
+func (p *Client) report(socket *shared.Socket, device string) shared.Report {
+	hostname, _ := os.Hostname()
+	return shared.Report{
+		Version:   p.version,
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Hostname:  hostname,
+		Addresses: localAddresses(device),
+		TLS:       p.getStatus().TLS,
+		RTT:       float64(socket.RTT()) / float64(time.Millisecond),
+		Stats:     socket.Stats(),
+		RxErrors:  deviceCounter(device, "rx_errors"),
+		TxErrors:  deviceCounter(device, "tx_errors"),
+	}
+}
+
+// sendReports sends a report to the server once we've connected, so that
+// it knows what we are, and then every `report_interval` seconds, until
+// the socket is closed.
+func (p *Client) sendReports(socket *shared.Socket, device string) {
+	interval := p.config.GetIntWithDefault("report_interval", 60)
+	if interval <= 0 {
+		return
+	}
+
+	delay := time.Second
+	for {
+		select {
+		case <-time.After(delay):
+			err := socket.SendCommand("report", shared.EncodeReport(p.report(socket, device)))
+			if err != nil {
+				return
+			}
+			delay = time.Duration(interval) * time.Second
+		case <-socket.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// pkg/client/routing.go contains our choice between the paths to a peer.
+//
+// Once we have a direct path to a peer we keep measuring it, along with
+// the path via the server, and send our traffic over whichever is better.
+// A direct path isn't always the faster, for example if it crosses a
+// congested link which the server avoids.
+//
+// To avoid flapping between them we only switch once the other path is
+// clearly better.
+
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// lossPenalty is the latency we consider equivalent to losing every
+	// packet, when comparing paths.
+	lossPenalty = time.Second
+
+	// hysteresis is how much better the other path must be before we
+	// switch to it, and minImprovement the least improvement which is
+	// worth switching for.
+	hysteresis     = 0.8
+	minImprovement = 10 * time.Millisecond
+)
+
+// pathMetrics measures the direct path to a peer, and the path via the
+// server.
+type pathMetrics struct {
+	// rtt, and loss, are the smoothed round-trip time, and proportion of
+	// probes lost, of the direct path.  answered is true if our most recent
+	// probe was answered.
+	rtt      time.Duration
+	loss     float64
+	answered bool
+
+	// relayRTT is the smoothed round-trip time via the server.
+	relayRTT time.Duration
+
+	// relayed is true if we're sending via the server, despite having a
+	// direct path.
+	relayed bool
+}
+
+// smooth returns the given average, updated by the new sample.
+func smooth(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return (average*7 + sample) / 8
+}
+
+// timestamp returns the current time, as the payload of a probe.
+func timestamp() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(time.Now().UnixNano()))
+	return buf
+}
+
+// probed records that we're about to send another probe, so that if the
+// last was never answered it counts as lost.
+func (m *pathMetrics) probed() {
+	m.loss *= 0.8
+	if !m.answered {
+		m.loss += 0.2
+	}
+	m.answered = false
+}
+
+// acked records the answer to one of our probes, which echoes the time
+// at which we sent it.
+func (m *pathMetrics) acked(payload []byte) {
+	m.answered = true
+	if len(payload) == 8 {
+		sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+		m.rtt = smooth(m.rtt, time.Since(sent))
+	}
+}
+
+// cost returns the cost of the direct path, which penalizes its loss.
+func (m *pathMetrics) cost() time.Duration {
+	return m.rtt + time.Duration(m.loss*float64(lossPenalty))
+}
+
+// better returns true if a path with the given cost is clearly better
+// than the path we're using.
+func better(cost time.Duration, current time.Duration) bool {
+	return float64(cost) < float64(current)*hysteresis && current-cost >= minImprovement
+}
+
+// choose decides which path to send our traffic to the given peer over.
+// We prefer the direct path until we've measured both.
+func (m *pathMetrics) choose(peer net.IP) {
+	if m.rtt == 0 || m.relayRTT == 0 {
+		return
+	}
+
+	direct := m.cost()
+	if !m.relayed && better(m.relayRTT, direct) {
+		log.Printf("Sending traffic to %s via the server, %s rather than %s directly", peer, m.relayRTT, direct)
+		m.relayed = true
+	} else if m.relayed && better(direct, m.relayRTT) {
+		log.Printf("Sending traffic to %s directly, %s rather than %s via the server", peer, direct, m.relayRTT)
+		m.relayed = false
+	}
+}
+
+// pong handles the answer to a ping we sent a peer via the server, which
+// the server sends as the VPN IP of the peer, and the time we sent it.
+func (d *p2p) pong(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("malformed pong")
+	}
+	sent, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	rtt := time.Since(time.Unix(0, sent))
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	path := d.paths[args[0]]
+	if path != nil {
+		path.metrics.relayRTT = smooth(path.metrics.relayRTT, rtt)
+	}
+	return nil
+}
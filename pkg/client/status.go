@@ -0,0 +1,280 @@
+// pkg/client/status.go contains the control-socket of the VPN-client.
+//
+// We write our status, as JSON, to each connection, after which the
+// connection may send a single request, such as:
+//
+//   tune mtu=1400 keepalive=60
+//
+// to which we reply with a TuneResult.
+
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// DefaultControlSocket is the path of the client's control-socket, if
+// not overridden by the configuration file.
+const DefaultControlSocket = "/var/run/simple-vpn.sock"
+
+// Peer is a single entry in the peer-list of a client.
+type Peer = shared.Peer
+
+// Status is the structure which the client reports over its
+// control-socket.
+type Status struct {
+	// State is one of "connecting", "connected", or "up".
+	State string
+
+	// Server is the VPN end-point we're connected to.
+	Server string
+
+	// Device is the name of our local TUN device.
+	Device string
+
+	// IP is the address we were assigned.
+	IP string
+
+	// Gateway is the (internal) IP of the VPN-server.
+	Gateway string
+
+	// Subnet is the range of the VPN.
+	Subnet string
+
+	// MTU is the MTU of our device.
+	MTU int
+
+	// Framing is how the server switches our traffic, "ip" if it's
+	// routed by IP, or "ethernet" if it's switched by MAC.
+	Framing string `json:",omitempty"`
+
+	// Commands are the in-band commands the server told us that it
+	// accepts, which older servers don't.
+	Commands []string `json:",omitempty"`
+
+	// Compressed, and Encrypted, are true if the server agreed to
+	// compress, and encrypt, our frames.
+	Compressed bool
+	Encrypted  bool
+
+	// KeyExchange is the name of the key exchange which keyed our
+	// encryption, if we made one.
+	KeyExchange string `json:",omitempty"`
+
+	// TLS describes the parameters negotiated for our connection, if
+	// it used TLS.
+	TLS string `json:",omitempty"`
+
+	// RTT is the round-trip time to the server, in milliseconds.
+	RTT float64
+
+	// Stats contains our traffic-counters.
+	Stats shared.Stats
+
+	// Peers contains the currently connected peers.
+	Peers []Peer
+
+	// Direct contains the address of our direct path to each peer, by
+	// its VPN IP.
+	Direct map[string]string `json:",omitempty"`
+}
+
+// TuneResult is our reply to a request over our control-socket.
+type TuneResult struct {
+	// Error describes why the request failed, if it did.
+	Error string `json:",omitempty"`
+}
+
+// controlRequestTimeout is how long a connection to our control-socket
+// has to send its request, after we've written our status.
+const controlRequestTimeout = 2 * time.Second
+
+// setStatus updates the state reported over our control-socket.
+func (p *Client) setStatus(fn func(status *Status)) {
+	p.statusMutex.Lock()
+	fn(&p.status)
+	p.statusMutex.Unlock()
+}
+
+// getStatus returns our current state, for reporting.
+func (p *Client) getStatus() Status {
+	p.statusMutex.Lock()
+	out := p.status
+	socket := p.socket
+	p.statusMutex.Unlock()
+
+	if socket != nil {
+		out.RTT = float64(socket.RTT()) / float64(time.Millisecond)
+		out.Stats = socket.Stats()
+	}
+
+	if p.direct != nil {
+		out.Direct = p.direct.direct()
+	}
+
+	p.peersMutex.Lock()
+	for _, peer := range p.peers {
+		out.Peers = append(out.Peers, peer)
+	}
+	p.peersMutex.Unlock()
+
+	sort.Slice(out.Peers, func(i, j int) bool {
+		return out.Peers[i].Name < out.Peers[j].Name
+	})
+	return out
+}
+
+// serveControl listens upon the given unix-domain socket, and writes
+// our status, as JSON, to each connection it receives.
+func (p *Client) serveControl(path string) error {
+
+	//
+	// Remove any stale socket left behind by a previous run.
+	//
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Our status includes details of the network, so restrict it.
+	//
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		defer listener.Close()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Error accepting control connection: %v", err)
+				return
+			}
+
+			go p.serveControlConn(conn)
+		}
+	}()
+	return nil
+}
+
+// serveControlConn writes our status to the given connection, and then
+// handles its request, if it makes one.
+func (p *Client) serveControlConn(conn net.Conn) {
+	defer conn.Close()
+
+	err := json.NewEncoder(conn).Encode(p.getStatus())
+	if err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(controlRequestTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	var result TuneResult
+	err = p.controlRequest(strings.Fields(line))
+	if err != nil {
+		result.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(result)
+}
+
+// controlRequest handles a request made over our control-socket.
+func (p *Client) controlRequest(fields []string) error {
+	if len(fields) == 0 || fields[0] != "tune" {
+		return fmt.Errorf("unknown request")
+	}
+
+	mtu := ""
+	keepalive := ""
+	for _, field := range fields[1:] {
+		switch {
+		case strings.HasPrefix(field, "mtu="):
+			mtu = strings.TrimPrefix(field, "mtu=")
+		case strings.HasPrefix(field, "keepalive="):
+			keepalive = strings.TrimPrefix(field, "keepalive=")
+		default:
+			return fmt.Errorf("unknown setting %q", field)
+		}
+	}
+	if mtu == "" && keepalive == "" {
+		return fmt.Errorf("an mtu, or keepalive, is required")
+	}
+	return p.tune(mtu, keepalive)
+}
+
+// QueryStatus fetches the status of the client listening upon the given
+// control-socket.
+func QueryStatus(path string) (Status, error) {
+	var status Status
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return status, err
+	}
+	defer conn.Close()
+
+	err = json.NewDecoder(conn).Decode(&status)
+	return status, err
+}
+
+// Tune asks the client listening upon the given control-socket to
+// propose the given MTU, and keepalive, either of which may be empty, to
+// its server.
+func Tune(path string, mtu string, keepalive string) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//
+	// Our status comes first, which we skip.
+	//
+	decoder := json.NewDecoder(conn)
+	var status Status
+	err = decoder.Decode(&status)
+	if err != nil {
+		return err
+	}
+
+	request := "tune"
+	if mtu != "" {
+		request += " mtu=" + mtu
+	}
+	if keepalive != "" {
+		request += " keepalive=" + keepalive
+	}
+	_, err = fmt.Fprintf(conn, "%s\n", request)
+	if err != nil {
+		return err
+	}
+
+	var result TuneResult
+	err = decoder.Decode(&result)
+	if err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return fmt.Errorf("%s", result.Error)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// pkg/client/tune.go contains our renegotiation of the MTU of our device,
+// and the keepalive of our connection, while we're connected.
+//
+// The server may propose changes, which we apply before accepting, and
+// we may propose them, via our control-socket, applying them once the
+// server has accepted.  They last until we reconnect, when we're given
+// the server's settings again.
+
+package client
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// setMTU sets the MTU of our device.
+func (p *Client) setMTU(mtu int) error {
+	if p.openDevice != nil {
+		return fmt.Errorf("the MTU of an external device can't be changed")
+	}
+	device := p.getStatus().Device
+	if device == "" {
+		return fmt.Errorf("we have no device")
+	}
+
+	err := p.inNetns(func() error {
+		out, err := exec.Command("ip", "link", "set", "mtu", strconv.Itoa(mtu), "dev", device).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to set the MTU of %s: %s %s", device, err.Error(), strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.setStatus(func(status *Status) {
+		status.MTU = mtu
+	})
+
+	p.statusMutex.Lock()
+	socket := p.socket
+	p.statusMutex.Unlock()
+	if socket != nil {
+		socket.SetMTU(mtu)
+	}
+	return nil
+}
+
+// acceptMTU applies the MTU the server proposed.
+func (p *Client) acceptMTU(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected an MTU")
+	}
+	mtu, err := shared.ParseMTU(args[0])
+	if err != nil {
+		return err
+	}
+	err = p.setMTU(mtu)
+	if err != nil {
+		p.warnf("Failed to change our MTU: %s", err.Error())
+		return err
+	}
+	log.Printf("The server changed our MTU to %d", mtu)
+	return nil
+}
+
+// acceptKeepalive applies the keepalive the server proposed.
+func acceptKeepalive(socket *shared.Socket, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a keepalive")
+	}
+	keepalive, err := shared.ParseKeepalive(args[0])
+	if err != nil {
+		return err
+	}
+	socket.SetKeepalive(keepalive)
+	log.Printf("The server changed our keepalive to %s", keepalive)
+	return nil
+}
+
+// tune proposes the given MTU, and keepalive, either of which may be
+// empty, to the server, and applies them once it has accepted.
+func (p *Client) tune(mtuStr string, keepaliveStr string) error {
+	var mtu int
+	var err error
+	if mtuStr != "" {
+		mtu, err = shared.ParseMTU(mtuStr)
+		if err != nil {
+			return err
+		}
+	}
+	if keepaliveStr != "" {
+		_, err = shared.ParseKeepalive(keepaliveStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.statusMutex.Lock()
+	socket := p.socket
+	up := p.status.State == "up"
+	p.statusMutex.Unlock()
+	if socket == nil || !up {
+		return fmt.Errorf("we're not connected")
+	}
+
+	if mtuStr != "" {
+		if p.openDevice != nil {
+			return fmt.Errorf("the MTU of an external device can't be changed")
+		}
+		err = socket.Request("set-mtu", mtuStr)
+		if err != nil {
+			return err
+		}
+		err = p.setMTU(mtu)
+		if err != nil {
+			return err
+		}
+		log.Printf("Changed our MTU to %d", mtu)
+	}
+	if keepaliveStr != "" {
+		err = socket.Request("set-keepalive", keepaliveStr)
+		if err != nil {
+			return err
+		}
+		keepalive, _ := shared.ParseKeepalive(keepaliveStr)
+		socket.SetKeepalive(keepalive)
+		log.Printf("Changed our keepalive to %s", keepalive)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// pkg/client/update.go contains our handling of the server telling us
+// that a new version of the client is available.
+//
+// By default we only log that we may upgrade.  If the server instructs us
+// to install the new version, and we've been given the fingerprint of the
+// key which signs releases, `update_fingerprint`, then we download it, and
+// its signature, from the URL we were given, verify it, and replace our
+// binary.  Connect then returns an UpdatedError, so that we may be
+// restarted with the new version.
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/skx/simple-vpn/pkg/provision"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// maxUpdateSize is the largest binary we'll download.
+const maxUpdateSize = 256 << 20
+
+// UpdatedError is returned by Connect once we've installed a new version
+// of our binary, which should be run in our place.
+type UpdatedError struct {
+	// Version is the version we installed.
+	Version string
+
+	// Path is the path of the binary we replaced.
+	Path string
+}
+
+// Error returns a description of the error.
+func (e *UpdatedError) Error() string {
+	return fmt.Sprintf("installed version %s to %s, a restart is required", e.Version, e.Path)
+}
+
+// update handles the server telling us about a new version, which it may
+// instruct us to install.
+func (p *Client) update(socket *shared.Socket, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("expected a version, URL, and mode")
+	}
+	version, url, mode := args[0], args[1], args[2]
+
+	log.Printf("Version %s is available, we run %s, from %s", version, p.version, url)
+	if mode != "install" {
+		return nil
+	}
+
+	fingerprint := p.config.Get("update_fingerprint")
+	if fingerprint == "" {
+		p.warnf("Not installing version %s, as no update_fingerprint is configured to verify it", version)
+		return nil
+	}
+
+	//
+	// Only one update is installed at a time.
+	//
+	if !atomic.CompareAndSwapInt32(&p.updating, 0, 1) {
+		return nil
+	}
+	go func() {
+		defer atomic.StoreInt32(&p.updating, 0)
+
+		path, err := p.installUpdate(url, fingerprint)
+		if err != nil {
+			p.warnf("Failed to install version %s: %s", version, err.Error())
+			return
+		}
+		log.Printf("Installed version %s to %s", version, path)
+		p.fail(socket, &UpdatedError{Version: version, Path: path})
+	}()
+	return nil
+}
+
+// installUpdate downloads the binary at the given URL, and its signature if it
+// isn't embedded, verifies that it was signed by the key with the given
+// fingerprint, and replaces our own binary with it.  We return the path of
+// our binary.
+func (p *Client) installUpdate(url string, fingerprint string) (string, error) {
+	binary, err := p.download(url)
+	if err != nil {
+		return "", err
+	}
+
+	//
+	// The signature may be embedded in the binary, or beside it.
+	//
+	signed, signature, embedded := provision.SplitRelease(binary)
+	if !embedded {
+		signature, err = p.download(url + ".sig")
+		if err != nil {
+			return "", err
+		}
+	}
+	err = provision.VerifyRelease(signed, signature, fingerprint)
+	if err != nil {
+		return "", fmt.Errorf("refusing the download: %s", err.Error())
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	//
+	// The new binary is written beside our own, and renamed over it,
+	// so that we're never left with a partial binary.
+	//
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".simple-vpn-update")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(binary)
+	if err == nil {
+		err = tmp.Chmod(0755)
+	}
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// download returns the contents of the given URL.
+func (p *Client) download(url string) ([]byte, error) {
+	client := p.tls.HTTPClient(5 * time.Minute)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %s", url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxUpdateSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %s", url, err.Error())
+	}
+	if len(data) > maxUpdateSize {
+		return nil, fmt.Errorf("%s is too large", url)
+	}
+	return data, nil
+}
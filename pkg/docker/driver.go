@@ -0,0 +1,308 @@
+// Package docker contains a Docker network-driver, which lets containers
+// join the VPN directly.
+//
+// It implements the remote-driver API of libnetwork.  A network created
+// with this driver names the configuration of a VPN-client, and each
+// container which joins it gets a client of its own.  The clients run
+// within the driver, but their devices are created within the network
+// namespaces of the containers, and are removed when they leave:
+//
+//    docker network create -d simple-vpn --ipam-driver null \
+//        -o config=/etc/simple-vpn/client.cfg vpn
+//    docker run --network vpn ...
+//
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/client"
+)
+
+// genericOptions is the key of the options given to `docker network
+// create` with `-o`.
+const genericOptions = "com.docker.network.generic"
+
+// endpoint is a container which has joined one of our networks.
+type endpoint struct {
+	// stop disconnects its client, and done is closed once it has.
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// Driver is a Docker network-driver.
+type Driver struct {
+	// Version is the version reported by the clients we run.
+	Version string
+
+	// StateDir is the directory holding the control-sockets of our
+	// clients, and a record of our networks, which Docker expects us to
+	// remember if we're restarted.
+	StateDir string
+
+	// networks holds the client-configuration of each network, and
+	// endpoints the containers which have joined them, by ID.
+	networks  map[string]*config.Reader
+	endpoints map[string]*endpoint
+
+	// mutex protects the same.
+	mutex sync.Mutex
+}
+
+// New creates a new driver.
+func New(version string) *Driver {
+	return &Driver{
+		Version:   version,
+		StateDir:  "/var/run/simple-vpn",
+		networks:  make(map[string]*config.Reader),
+		endpoints: make(map[string]*endpoint),
+	}
+}
+
+// request is the union of the requests Docker sends us, of which we only
+// need a few fields.
+type request struct {
+	NetworkID  string
+	EndpointID string
+	SandboxKey string
+	Options    map[string]interface{}
+}
+
+// shortID returns the abbreviated form of the given ID, as Docker shows.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// createNetwork records the configuration of a new network, which is
+// given by the `config` option.
+func (d *Driver) createNetwork(req request) error {
+	opts, _ := req.Options[genericOptions].(map[string]interface{})
+	path, _ := opts["config"].(string)
+	if path == "" {
+		return fmt.Errorf("the network must be created with -o config=/path/to/client.cfg")
+	}
+
+	cfg, err := config.New(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s - %s", path, err.Error())
+	}
+
+	err = os.MkdirAll(filepath.Join(d.StateDir, "networks"), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(d.StateDir, "networks", filepath.Base(req.NetworkID)), []byte(path), 0600)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	d.networks[req.NetworkID] = cfg
+	d.mutex.Unlock()
+	return nil
+}
+
+// network returns the configuration of the network with the given ID,
+// which we reload if we've been restarted since it was created.  The
+// caller must hold our mutex.
+func (d *Driver) network(id string) (*config.Reader, error) {
+	if cfg := d.networks[id]; cfg != nil {
+		return cfg, nil
+	}
+
+	path, err := ioutil.ReadFile(filepath.Join(d.StateDir, "networks", filepath.Base(id)))
+	if err != nil {
+		return nil, fmt.Errorf("unknown network %s", id)
+	}
+	cfg, err := config.New(string(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s - %s", path, err.Error())
+	}
+	d.networks[id] = cfg
+	return cfg, nil
+}
+
+// deleteNetwork forgets a network.
+func (d *Driver) deleteNetwork(req request) error {
+	d.mutex.Lock()
+	delete(d.networks, req.NetworkID)
+	d.mutex.Unlock()
+
+	os.Remove(filepath.Join(d.StateDir, "networks", filepath.Base(req.NetworkID)))
+	return nil
+}
+
+// join connects a container to the VPN, by launching a client whose
+// device lives within the container's network namespace.
+//
+// Each container is named by the ID of its endpoint, prefixed by the
+// `name` of the configuration if it has one, and has a control-socket
+// of its own.
+func (d *Driver) join(req request) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	base, err := d.network(req.NetworkID)
+	if err != nil {
+		return err
+	}
+	if d.endpoints[req.EndpointID] != nil {
+		return fmt.Errorf("endpoint %s has already joined", req.EndpointID)
+	}
+
+	cfg := &config.Reader{Settings: make(map[string]string)}
+	for key, value := range base.Settings {
+		cfg.Settings[key] = value
+	}
+	id := shortID(req.EndpointID)
+	if name := cfg.Settings["name"]; name != "" {
+		cfg.Settings["name"] = name + "-" + id
+	} else {
+		cfg.Settings["name"] = id
+	}
+	os.MkdirAll(d.StateDir, 0700)
+	cfg.Settings["control"] = filepath.Join(d.StateDir, id+".sock")
+
+	ctx, stop := context.WithCancel(context.Background())
+	ep := &endpoint{stop: stop, done: make(chan struct{})}
+	d.endpoints[req.EndpointID] = ep
+
+	go func() {
+		defer close(ep.done)
+
+		log.Printf("Connecting endpoint %s to the VPN", id)
+		err := client.Connect(ctx, client.Options{Config: cfg, Version: d.Version, Netns: req.SandboxKey})
+		if err != nil {
+			log.Printf("Endpoint %s disconnected - %s", id, err.Error())
+		}
+	}()
+	return nil
+}
+
+// leave disconnects a container from the VPN, waiting a while for its
+// client to clean up.
+func (d *Driver) leave(req request) error {
+	d.mutex.Lock()
+	ep := d.endpoints[req.EndpointID]
+	delete(d.endpoints, req.EndpointID)
+	d.mutex.Unlock()
+
+	if ep == nil {
+		return nil
+	}
+	ep.stop()
+	select {
+	case <-ep.done:
+	case <-time.After(10 * time.Second):
+		log.Printf("Endpoint %s is slow to disconnect", shortID(req.EndpointID))
+	}
+	return nil
+}
+
+// Handler returns the HTTP-handler which serves the driver API.
+func (d *Driver) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	//
+	// Each call receives a JSON request, and returns a JSON response,
+	// which contains an `Err` if it failed.
+	//
+	handle := func(path string, fn func(req request) (interface{}, error)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			var req request
+			json.NewDecoder(r.Body).Decode(&req)
+
+			resp, err := fn(req)
+			if err != nil {
+				log.Printf("%s failed - %s", path, err.Error())
+				resp = map[string]string{"Err": err.Error()}
+			}
+			if resp == nil {
+				resp = map[string]string{}
+			}
+			w.Header().Set("Content-Type", "application/vnd.docker.plugins.v1+json")
+			json.NewEncoder(w).Encode(resp)
+		})
+	}
+
+	//
+	// Many calls need nothing from us, and most of the rest return an
+	// empty response.
+	//
+	none := func(req request) (interface{}, error) {
+		return nil, nil
+	}
+	ok := func(fn func(req request) error) func(req request) (interface{}, error) {
+		return func(req request) (interface{}, error) {
+			return nil, fn(req)
+		}
+	}
+
+	handle("/Plugin.Activate", func(req request) (interface{}, error) {
+		return map[string][]string{"Implements": {"NetworkDriver"}}, nil
+	})
+	handle("/NetworkDriver.GetCapabilities", func(req request) (interface{}, error) {
+		return map[string]string{"Scope": "local"}, nil
+	})
+	handle("/NetworkDriver.CreateNetwork", ok(d.createNetwork))
+	handle("/NetworkDriver.DeleteNetwork", ok(d.deleteNetwork))
+	handle("/NetworkDriver.CreateEndpoint", none)
+	handle("/NetworkDriver.DeleteEndpoint", none)
+	handle("/NetworkDriver.EndpointOperInfo", func(req request) (interface{}, error) {
+		return map[string]interface{}{"Value": map[string]string{}}, nil
+	})
+	handle("/NetworkDriver.Join", ok(d.join))
+	handle("/NetworkDriver.Leave", ok(d.leave))
+	handle("/NetworkDriver.DiscoverNew", none)
+	handle("/NetworkDriver.DiscoverDelete", none)
+	handle("/NetworkDriver.ProgramExternalConnectivity", none)
+	handle("/NetworkDriver.RevokeExternalConnectivity", none)
+	return mux
+}
+
+// Serve serves the driver API upon the given unix-domain socket, until
+// the context is cancelled.  Every container is then disconnected.
+func (d *Driver) Serve(ctx context.Context, path string) error {
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: d.Handler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	err = srv.Serve(l)
+	if ctx.Err() == nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	var ids []string
+	for id := range d.endpoints {
+		ids = append(ids, id)
+	}
+	d.mutex.Unlock()
+	for _, id := range ids {
+		d.leave(request{EndpointID: id})
+	}
+	return nil
+}
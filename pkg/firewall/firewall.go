@@ -0,0 +1,140 @@
+// Package firewall manages the nftables rules which our features need,
+// such as masquerading, MSS clamping, access-control, and kill-switches.
+//
+// Each user of this package owns a single table, which it describes in
+// full as a Ruleset.  Applying the ruleset replaces the table in one
+// transaction, so the kernel never sees a partial set of rules, and
+// rules we no longer need never linger.
+//
+// In dry-run mode the rulesets are printed rather than applied, which
+// allows them to be reviewed before they are trusted.
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Chain is one chain of a ruleset.
+type Chain struct {
+	// Name is the name of the chain.
+	Name string
+
+	// Type is the type of the chain, such as "filter" or "nat".
+	Type string
+
+	// Hook is the hook the chain is attached to, such as "forward".
+	Hook string
+
+	// Priority orders the chain relative to others upon the same hook.
+	Priority int
+
+	// Policy is the verdict for packets which no rule matches.
+	Policy string
+
+	// Rules holds each of our rules, in order.
+	Rules []string
+}
+
+// Add appends a rule to the chain, formatting it as fmt.Sprintf does.
+func (c *Chain) Add(format string, args ...interface{}) {
+	c.Rules = append(c.Rules, fmt.Sprintf(format, args...))
+}
+
+// Ruleset describes the complete contents of a table.
+type Ruleset struct {
+	// Table is the name of our table, which is in the inet family so
+	// that it applies to both IPv4 and IPv6.
+	Table string
+
+	// DryRun causes Apply, and Remove, to print what they would do,
+	// rather than doing it.
+	DryRun bool
+
+	// Chains holds each of our chains.
+	Chains []*Chain
+}
+
+// New returns an empty ruleset, for the named table.
+func New(table string, dryRun bool) *Ruleset {
+	return &Ruleset{Table: table, DryRun: dryRun}
+}
+
+// Chain adds a chain to the ruleset, attached to the given hook, and
+// returns it.  Packets which no rule matches are accepted, unless the
+// policy of the chain is changed.
+func (r *Ruleset) Chain(name string, kind string, hook string, priority int) *Chain {
+	chain := &Chain{Name: name, Type: kind, Hook: hook, Priority: priority, Policy: "accept"}
+	r.Chains = append(r.Chains, chain)
+	return chain
+}
+
+// String returns the ruleset in the syntax of `nft -f`.
+func (r *Ruleset) String() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "table inet %s {\n", r.Table)
+	for i, chain := range r.Chains {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "\tchain %s {\n", chain.Name)
+		fmt.Fprintf(&out, "\t\ttype %s hook %s priority %d; policy %s;\n", chain.Type, chain.Hook, chain.Priority, chain.Policy)
+		for _, rule := range chain.Rules {
+			fmt.Fprintf(&out, "\t\t%s\n", rule)
+		}
+		out.WriteString("\t}\n")
+	}
+	out.WriteString("}\n")
+	return out.String()
+}
+
+// Apply replaces our table with the ruleset.
+//
+// The table is created, if it is missing, deleted, and defined afresh in
+// a single transaction.
+func (r *Ruleset) Apply() error {
+	return r.run(fmt.Sprintf("add table inet %s\ndelete table inet %s\n%s", r.Table, r.Table, r.String()))
+}
+
+// Remove deletes our table, if it exists.
+func (r *Ruleset) Remove() error {
+	return r.run(fmt.Sprintf("add table inet %s\ndelete table inet %s\n", r.Table, r.Table))
+}
+
+// run gives the given script to nft, or prints it in dry-run mode.
+func (r *Ruleset) run(script string) error {
+	if r.DryRun {
+		fmt.Printf("nft -f - <<EOF\n%sEOF\n", script)
+		return nil
+	}
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to update the nftables table %s: %s %s", r.Table, err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Family returns the nftables family of addresses which matches the
+// given address, or CIDR range, which is "ip6" for IPv6, and otherwise
+// "ip".
+func Family(addr string) string {
+	if strings.Contains(addr, ":") {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// Set returns the given networks as an anonymous nftables set, such as
+// "{ 10.0.0.0/24, 192.168.1.1/32 }".
+func Set(networks []*net.IPNet) string {
+	var out []string
+	for _, network := range networks {
+		out = append(out, network.String())
+	}
+	return "{ " + strings.Join(out, ", ") + " }"
+}
@@ -0,0 +1,71 @@
+// pkg/geoip/gate.go contains a gate which checks the country of each
+// connection.
+
+package geoip
+
+import (
+	"net"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// Gate is a shared.Gate which looks up the country of each connection,
+// and gives its verdict upon those from unexpected countries.
+//
+// A country is unexpected if it is denied, or if some are allowed and it
+// is not one of them.  Addresses which aren't in the database, such as
+// private addresses, are always accepted.
+type Gate struct {
+	db *Reader
+
+	// allow and deny hold ISO country-codes, in upper-case.
+	allow map[string]bool
+	deny  map[string]bool
+
+	// verdict is the verdict upon unexpected countries.
+	verdict shared.GateVerdict
+}
+
+// NewGate creates a gate which uses the given database, and countries,
+// which are lists of ISO country-codes.
+func NewGate(db *Reader, allow []string, deny []string, verdict shared.GateVerdict) *Gate {
+	g := &Gate{db: db, allow: make(map[string]bool), deny: make(map[string]bool), verdict: verdict}
+	for _, country := range allow {
+		g.allow[strings.ToUpper(country)] = true
+	}
+	for _, country := range deny {
+		g.deny[strings.ToUpper(country)] = true
+	}
+	return g
+}
+
+// Country returns the ISO country-code of the given address, or "" if
+// it is unknown.  The country in which the address is registered is used
+// if the database doesn't know where it is.
+func (g *Gate) Country(ip net.IP) string {
+	record, err := g.db.Lookup(ip)
+	if err != nil {
+		return ""
+	}
+	fields, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := fields[key].(map[string]interface{})
+		if code, ok := country["iso_code"].(string); ok {
+			return code
+		}
+	}
+	return ""
+}
+
+// Check implements shared.Gate.
+func (g *Gate) Check(remote net.IP) (shared.GateVerdict, string) {
+	country := g.Country(remote)
+	if country == "" {
+		return shared.GateAccept, ""
+	}
+	if g.deny[country] || (len(g.allow) > 0 && !g.allow[country]) {
+		return g.verdict, "connecting from " + country
+	}
+	return shared.GateAccept, ""
+}
@@ -0,0 +1,314 @@
+// Package geoip contains a reader of MaxMind databases, such as the
+// GeoLite2 Country database, and a gate which accepts, flags, or rejects
+// connections by the country they come from.
+//
+// The reader implements just enough of the MaxMind DB format to look up
+// the record of an address:
+//
+//    https://maxmind.github.io/MaxMind-DB/
+//
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// metadataMarker precedes the metadata, at the end of the database.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// errCorrupt is returned when the database cannot be decoded.
+var errCorrupt = errors.New("the database is corrupt")
+
+// The types of the values in the data section.
+const (
+	typeExtended = 0
+	typePointer  = 1
+	typeString   = 2
+	typeDouble   = 3
+	typeBytes    = 4
+	typeUint16   = 5
+	typeUint32   = 6
+	typeMap      = 7
+	typeInt32    = 8
+	typeUint64   = 9
+	typeUint128  = 10
+	typeArray    = 11
+	typeBool     = 14
+	typeFloat    = 15
+)
+
+// maxDepth limits the nesting of the values we decode.
+const maxDepth = 32
+
+// Reader is a MaxMind database.
+type Reader struct {
+	// tree is the search tree, and data the data section.
+	tree []byte
+	data []byte
+
+	// nodeCount is the number of nodes in the tree, each of which holds
+	// two records of recordSize bits.
+	nodeCount  uint
+	recordSize uint
+
+	// ipVersion is 4 or 6, and ipv4Start is the node at which lookups
+	// of IPv4 addresses start, within an IPv6 tree.
+	ipVersion uint
+	ipv4Start uint
+}
+
+// Open reads the named database.
+func Open(path string) (*Reader, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(data)
+}
+
+// New parses the given database.
+func New(data []byte) (*Reader, error) {
+	i := bytes.LastIndex(data, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind database")
+	}
+
+	meta, _, err := decoder(data[i+len(metadataMarker):]).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, errCorrupt
+	}
+
+	r := &Reader{
+		nodeCount:  toUint(fields["node_count"]),
+		recordSize: toUint(fields["record_size"]),
+		ipVersion:  toUint(fields["ip_version"]),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.ipVersion)
+	}
+
+	//
+	// The tree is followed by sixteen zero bytes, and then the data.
+	//
+	size := r.nodeCount * r.recordSize / 4
+	if size+16 > uint(i) {
+		return nil, errCorrupt
+	}
+	r.tree = data[:size]
+	r.data = data[size+16 : i]
+
+	//
+	// IPv4 addresses live beneath ::/96 of an IPv6 tree.
+	//
+	if r.ipVersion == 6 {
+		for bit := 0; bit < 96 && r.ipv4Start < r.nodeCount; bit++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// toUint returns the given metadata value as an unsigned integer.
+func toUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
+
+// record returns the left, or right, record of the given node.
+func (r *Reader) record(node uint, right uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+right*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if right == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+right*4:]))
+	}
+}
+
+// Lookup returns the record of the given address, or nil if there is
+// none.  Maps are returned as map[string]interface{}, and arrays as
+// []interface{}.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	addr := ip.To4()
+	if addr != nil {
+		node = r.ipv4Start
+	} else {
+		if r.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+		if addr == nil {
+			return nil, fmt.Errorf("invalid address %s", ip)
+		}
+	}
+
+	for bit := 0; bit < len(addr)*8 && node < r.nodeCount; bit++ {
+		node = r.record(node, uint(addr[bit/8]>>(7-uint(bit%8)))&1)
+	}
+
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount || node-r.nodeCount-16 >= uint(len(r.data)) {
+		return nil, errCorrupt
+	}
+	value, _, err := decoder(r.data).decode(node-r.nodeCount-16, 0)
+	return value, err
+}
+
+// decoder decodes the values of a data section.
+type decoder []byte
+
+// decode decodes the value at the given offset, returning it along with
+// the offset of the value which follows.
+func (d decoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if offset >= uint(len(d)) || depth > maxDepth {
+		return nil, 0, errCorrupt
+	}
+	ctrl := d[offset]
+	offset++
+
+	//
+	// Pointers refer to a value elsewhere in the data section.
+	//
+	kind := uint(ctrl >> 5)
+	if kind == typePointer {
+		n := uint(ctrl>>3)&3 + 1
+		if offset+n > uint(len(d)) {
+			return nil, 0, errCorrupt
+		}
+		b := d[offset : offset+n]
+		v := uint(ctrl & 7)
+		var target uint
+		switch n {
+		case 1:
+			target = v<<8 | uint(b[0])
+		case 2:
+			target = (v<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 3:
+			target = (v<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			target = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := d.decode(target, depth+1)
+		return value, offset + n, err
+	}
+
+	if kind == typeExtended {
+		if offset >= uint(len(d)) {
+			return nil, 0, errCorrupt
+		}
+		kind = 7 + uint(d[offset])
+		offset++
+	}
+
+	//
+	// Large sizes are held in the following bytes.
+	//
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d)) {
+			return nil, 0, errCorrupt
+		}
+		extra := uint(0)
+		for _, b := range d[offset : offset+n] {
+			extra = extra<<8 | uint(b)
+		}
+		offset += n
+		size = []uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			m[name], offset, err = d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case typeArray:
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			var err error
+			value, offset, err = d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d)) {
+		return nil, 0, errCorrupt
+	}
+	b := d[offset : offset+size]
+	offset += size
+
+	switch kind {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes:
+		return append([]byte(nil), b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		if size > 8 {
+			return nil, 0, errCorrupt
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if kind == typeInt32 {
+			return int32(uint32(n)), offset, nil
+		}
+		return n, offset, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported type %d", kind)
+}
@@ -0,0 +1,121 @@
+// Package mobile is the interface of our client for mobile platforms,
+// which is bound to Java, or Objective-C, with gomobile:
+//
+//    gomobile bind -target=android github.com/skx/simple-vpn/pkg/mobile
+//
+// Mobile platforms create the device on our behalf, such as Android's
+// VpnService, so the application implements Platform, which creates it
+// with the settings we're given by the server, and keeps our sockets
+// outside the VPN.
+//
+// The types here are restricted to those gomobile can bind.
+package mobile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/client"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// Platform is implemented by the application, to supply our device.
+type Platform interface {
+	// OpenTun creates the device, with the given address within the
+	// given subnet, MTU, and comma-separated extra routes, and returns
+	// its file-descriptor.  The descriptor becomes ours, and is closed
+	// when we're done with it, so upon Android it should be detached
+	// from its ParcelFileDescriptor.
+	OpenTun(ip string, subnet string, gateway string, mtu int, routes string) (int, error)
+
+	// Protect excludes the given socket from the VPN, returning false
+	// if it could not be, as VpnService.protect does.
+	Protect(fd int) bool
+}
+
+// Client is a client which runs upon a mobile platform.
+type Client struct {
+	cfg      *config.Reader
+	platform Platform
+	version  string
+
+	// cancel stops the client, while it is running.
+	cancel context.CancelFunc
+	mutex  sync.Mutex
+}
+
+// NewClient returns a client with the given configuration, which is in
+// the format of our configuration files, and which uses the given
+// platform.
+func NewClient(cfg string, platform Platform, version string) (*Client, error) {
+	reader, err := config.Parse(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if platform == nil {
+		return nil, fmt.Errorf("a platform must be given")
+	}
+	return &Client{cfg: reader, platform: platform, version: version}, nil
+}
+
+// Run connects to the server, and shuffles packets until we're stopped,
+// or the connection fails.  It should be called upon a background
+// thread.
+func (c *Client) Run() error {
+	c.mutex.Lock()
+	if c.cancel != nil {
+		c.mutex.Unlock()
+		return fmt.Errorf("the client is already running")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		c.cancel = nil
+		c.mutex.Unlock()
+		cancel()
+	}()
+
+	return client.Connect(ctx, client.Options{
+		Config:     c.cfg,
+		Version:    c.version,
+		OpenDevice: c.openDevice,
+		Protect:    c.protect,
+	})
+}
+
+// Stop disconnects the client, if it is running, which causes Run to
+// return.
+func (c *Client) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// openDevice asks our platform for our device.
+func (c *Client) openDevice(settings client.DeviceSettings) (shared.TunDevice, error) {
+	fd, err := c.platform.OpenTun(settings.IP, settings.Subnet, settings.Gateway, settings.MTU, strings.Join(settings.Routes, ","))
+	if err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return nil, fmt.Errorf("the platform gave us no device")
+	}
+	return shared.NewFileDevice(os.NewFile(uintptr(fd), "tun"), "tun"), nil
+}
+
+// protect asks our platform to keep the given socket outside the VPN.
+func (c *Client) protect(fd uintptr) error {
+	if !c.platform.Protect(int(fd)) {
+		return fmt.Errorf("failed to protect our socket from the VPN")
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+// pkg/provision/export.go contains our encoding of a client configuration
+// as a single string, which may be copied, or scanned as a QR code, onto
+// the client.
+
+package provision
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// exportPrefix is the prefix of an exported configuration, which allows
+// its format to change in the future.
+const exportPrefix = "svpn1:"
+
+// Export returns the configuration of a client, which connects to the
+// given end-point with the given key and name, as a single string.
+func Export(endPoint string, key string, name string) string {
+	cfg := fmt.Sprintf("vpn = %s\nkey = %s\nname = %s\n", endPoint, key, name)
+	return exportPrefix + base64.RawURLEncoding.EncodeToString([]byte(cfg))
+}
+
+// Import returns the configuration file encoded by Export.
+func Import(str string) ([]byte, error) {
+	str = strings.TrimSpace(str)
+	if !strings.HasPrefix(str, exportPrefix) {
+		return nil, fmt.Errorf("the configuration should begin with %s", exportPrefix)
+	}
+	cfg, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(str, exportPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("the configuration is not valid: %s", err.Error())
+	}
+
+	text := "\n" + string(cfg)
+	if !strings.Contains(text, "\nvpn = ") || !strings.Contains(text, "\nkey = ") {
+		return nil, fmt.Errorf("the configuration has no end-point, or key")
+	}
+	return cfg, nil
+}
@@ -0,0 +1,189 @@
+// Package provision allows the configuration of a client to be downloaded
+// from the server, so that many devices may be onboarded with just a URL.
+//
+// The server signs each configuration it hands out with its provisioning
+// key, and clients verify the signature against the fingerprint of that
+// key, which they are given alongside the URL.  The signed configuration
+// is an ordinary configuration file, with two trailing comments which
+// hold the public key, and the signature:
+//
+//    vpn = wss://vpn.example.com/vpn
+//    key = secret
+//    # public-key: MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE...
+//    # signature: MEUCIQD...
+//
+// The signature covers everything before its own line, so the file may be
+// cached, and verified again later.
+package provision
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+)
+
+const (
+	// keyPrefix is the prefix of the line which holds our public key.
+	keyPrefix = "# public-key: "
+
+	// signaturePrefix is the prefix of the line which holds the
+	// signature.
+	signaturePrefix = "# signature: "
+)
+
+// LoadKey reads the ECDSA private key from the given PEM file, creating
+// it, with a new key, if it doesn't exist.
+func LoadKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createKey(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM-encoded key", path)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the key in %s: %s", path, err.Error())
+	}
+	return key, nil
+}
+
+// createKey generates a new key, and saves it to the given file.
+func createKey(path string) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save a new key to %s: %s", path, err.Error())
+	}
+	return key, nil
+}
+
+// Fingerprint returns the fingerprint of the given public key, as
+// "sha256:" followed by the hex-encoded SHA-256 of its DER encoding.
+func Fingerprint(pub *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// Sign returns the given configuration, signed with the given key.
+func Sign(key *ecdsa.PrivateKey, cfg []byte) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.Write(cfg)
+	if len(cfg) > 0 && !bytes.HasSuffix(cfg, []byte("\n")) {
+		out.WriteString("\n")
+	}
+	out.WriteString(keyPrefix + base64.StdEncoding.EncodeToString(der) + "\n")
+
+	sum := sha256.Sum256(out.Bytes())
+	sig, err := key.Sign(rand.Reader, sum[:], nil)
+	if err != nil {
+		return nil, err
+	}
+	out.WriteString(signaturePrefix + base64.StdEncoding.EncodeToString(sig) + "\n")
+	return out.Bytes(), nil
+}
+
+// Verify checks that the given configuration was signed by the key with
+// the given fingerprint.
+func Verify(signed []byte, fingerprint string) error {
+	return verify(signed, fingerprint, "configuration")
+}
+
+// verify checks that the given document was signed by the key with the
+// given fingerprint.  Errors describe the document as `what`.
+func verify(signed []byte, fingerprint string, what string) error {
+	//
+	// The signature is the last line, and the public key precedes it.
+	//
+	body := bytes.TrimSuffix(signed, []byte("\n"))
+	i := bytes.LastIndexByte(body, '\n')
+	if i < 0 || !bytes.HasPrefix(body[i+1:], []byte(signaturePrefix)) {
+		return fmt.Errorf("the %s is not signed", what)
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(body[i+1+len(signaturePrefix):]))
+	if err != nil {
+		return fmt.Errorf("the %s has an invalid signature", what)
+	}
+	body = body[:i+1]
+
+	j := bytes.LastIndexByte(body[:len(body)-1], '\n')
+	line := strings.TrimSuffix(string(body[j+1:]), "\n")
+	if !strings.HasPrefix(line, keyPrefix) {
+		return fmt.Errorf("the %s does not include the public key which signed it", what)
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(line, keyPrefix))
+	if err != nil {
+		return fmt.Errorf("the %s has an invalid public key", what)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("the %s has an invalid public key: %s", what, err.Error())
+	}
+	pub, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("the %s was signed with an unsupported key", what)
+	}
+
+	got, err := Fingerprint(pub)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, normalize(fingerprint)) {
+		return fmt.Errorf("the %s was signed by the key %s, not %s", what, got, fingerprint)
+	}
+
+	var rs struct {
+		R, S *big.Int
+	}
+	_, err = asn1.Unmarshal(sig, &rs)
+	if err != nil {
+		return fmt.Errorf("the %s has an invalid signature", what)
+	}
+	sum := sha256.Sum256(body)
+	if !ecdsa.Verify(pub, sum[:], rs.R, rs.S) {
+		return fmt.Errorf("the signature of the %s is invalid", what)
+	}
+	return nil
+}
+
+// normalize returns the given fingerprint in the form Fingerprint returns,
+// so that fingerprints may be given with colons, or without the prefix.
+func normalize(fingerprint string) string {
+	hexed := strings.Replace(strings.TrimPrefix(strings.ToLower(fingerprint), "sha256:"), ":", "", -1)
+	return "sha256:" + hexed
+}
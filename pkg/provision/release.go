@@ -0,0 +1,87 @@
+// pkg/provision/release.go contains the signing of the binaries which
+// clients download when they're told to upgrade.
+//
+// The signature of a binary is in the same format as a signed
+// configuration, whose body is the digest of the binary:
+//
+//	sha256: 9f86d081884c7d659a2feaa0c55ad015...
+//	# public-key: MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE...
+//	# signature: MEUCIQD...
+//
+// It may be held in a separate file, or embedded by appending it to the
+// binary, which still runs, as the trailing bytes are ignored.
+
+package provision
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// digestPrefix is the prefix of the line which holds the digest of the
+// binary.
+const digestPrefix = "sha256: "
+
+// SignRelease returns the signature of the given binary, made with the
+// given key.
+func SignRelease(key *ecdsa.PrivateKey, binary []byte) ([]byte, error) {
+	sum := sha256.Sum256(binary)
+	return Sign(key, []byte(digestPrefix+hex.EncodeToString(sum[:])+"\n"))
+}
+
+// VerifyRelease checks that the given signature was made of the given
+// binary, by the key with the given fingerprint.
+func VerifyRelease(binary []byte, signature []byte, fingerprint string) error {
+	err := verify(signature, fingerprint, "binary")
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(binary)
+	want := digestPrefix + hex.EncodeToString(sum[:]) + "\n"
+	if !bytes.HasPrefix(signature, []byte(want)) || bytes.Count(signature, []byte("\n")) != 3 {
+		return fmt.Errorf("the signature is not that of the binary")
+	}
+	return nil
+}
+
+// EmbedRelease returns the given binary, with the given signature appended
+// to it, after a newline.  Any signature which was already embedded is
+// replaced.
+func EmbedRelease(binary []byte, signature []byte) []byte {
+	if unsigned, _, ok := SplitRelease(binary); ok {
+		binary = unsigned
+	}
+	out := make([]byte, 0, len(binary)+1+len(signature))
+	out = append(out, binary...)
+	out = append(out, '\n')
+	return append(out, signature...)
+}
+
+// SplitRelease splits a binary into the binary which was signed, and the
+// signature embedded in it, if there is one.
+func SplitRelease(data []byte) ([]byte, []byte, bool) {
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		return data, nil, false
+	}
+
+	//
+	// The signature is the final three lines.
+	//
+	start := len(data) - 1
+	for lines := 0; lines < 3; lines++ {
+		start = bytes.LastIndexByte(data[:start], '\n')
+		if start < 0 {
+			return data, nil, false
+		}
+	}
+	signature := data[start+1:]
+	if !strings.HasPrefix(string(signature), digestPrefix) || !bytes.Contains(signature, []byte(signaturePrefix)) {
+		return data, nil, false
+	}
+	return data[:start], signature, true
+}
@@ -0,0 +1,84 @@
+// pkg/registry/consul.go contains our use of Consul's catalog.
+//
+// Each server is registered with a TTL check, which we pass while it is
+// healthy, and fail otherwise.  Its URL is stored in its metadata.
+
+package registry
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// consul is a Registry which uses the Consul agent with the given API.
+type consul struct {
+	api string
+
+	// registered is true once we've registered our service.
+	registered bool
+}
+
+// Register adds the service, with its TTL check, and then updates the
+// state of its check.
+func (c *consul) Register(service Service, healthy bool) error {
+	if !c.registered {
+		body := map[string]interface{}{
+			"ID":   service.ID,
+			"Name": service.Name,
+			"Meta": map[string]string{"url": service.URL},
+			"Check": map[string]interface{}{
+				"TTL":                            service.TTL.String(),
+				"DeregisterCriticalServiceAfter": (10 * service.TTL).String(),
+			},
+		}
+		err := call("PUT", c.api+"/v1/agent/service/register", body, nil)
+		if err != nil {
+			return err
+		}
+		c.registered = true
+	}
+
+	state := "pass"
+	if !healthy {
+		state = "fail"
+	}
+	err := call("PUT", c.api+"/v1/agent/check/"+state+"/service:"+url.PathEscape(service.ID), nil, nil)
+	if err != nil {
+		//
+		// The agent may have forgotten us, if it restarted.
+		//
+		c.registered = false
+	}
+	return err
+}
+
+// Deregister removes the service.
+func (c *consul) Deregister(service Service) error {
+	c.registered = false
+	return call("PUT", c.api+"/v1/agent/service/deregister/"+url.PathEscape(service.ID), nil, nil)
+}
+
+// Discover returns the URLs of the named service's instances whose checks
+// are passing.
+func (c *consul) Discover(name string) ([]string, error) {
+	var entries []struct {
+		Service struct {
+			Meta map[string]string
+		}
+	}
+	err := call("GET", c.api+"/v1/health/service/"+url.PathEscape(name)+"?passing=true", nil, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, entry := range entries {
+		if u := entry.Service.Meta["url"]; u != "" {
+			out = append(out, u)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("the service %s has no healthy servers", name)
+	}
+	return out, nil
+}
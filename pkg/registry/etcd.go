@@ -0,0 +1,117 @@
+// pkg/registry/etcd.go contains our use of etcd.
+//
+// Each server stores its URL under the key "/NAME/ID", attached to a
+// lease which we keep alive while it is healthy.  If it becomes unhealthy
+// we revoke the lease, which removes the key, and if it fails the lease
+// expires.
+
+package registry
+
+import (
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// etcd is a Registry which uses the etcd server with the given API.
+type etcd struct {
+	api string
+
+	// lease is the ID of the lease of our key, once it's stored.
+	lease string
+}
+
+// etcdKV is a key, or value, in the form etcd's API expects.
+func etcdKV(str string) string {
+	return base64.StdEncoding.EncodeToString([]byte(str))
+}
+
+// Register stores our key, with a new lease, or keeps the lease alive.
+// Unhealthy services have their lease revoked.
+func (e *etcd) Register(service Service, healthy bool) error {
+	if !healthy {
+		return e.Deregister(service)
+	}
+
+	if e.lease != "" {
+		var alive struct {
+			Result struct {
+				TTL string
+			}
+		}
+		err := call("POST", e.api+"/v3/lease/keepalive", map[string]string{"ID": e.lease}, &alive)
+		if err == nil && alive.Result.TTL != "" && alive.Result.TTL != "0" {
+			return nil
+		}
+
+		//
+		// Our lease expired, so we start afresh.
+		//
+		e.lease = ""
+	}
+
+	ttl := int64(service.TTL / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	var grant struct {
+		ID string
+	}
+	err := call("POST", e.api+"/v3/lease/grant", map[string]int64{"TTL": ttl}, &grant)
+	if err != nil {
+		return err
+	}
+	if grant.ID == "" {
+		return fmt.Errorf("etcd granted no lease")
+	}
+
+	put := map[string]string{
+		"key":   etcdKV("/" + service.Name + "/" + service.ID),
+		"value": etcdKV(service.URL),
+		"lease": grant.ID,
+	}
+	err = call("POST", e.api+"/v3/kv/put", put, nil)
+	if err != nil {
+		return err
+	}
+	e.lease = grant.ID
+	return nil
+}
+
+// Deregister revokes our lease, which removes our key.
+func (e *etcd) Deregister(service Service) error {
+	if e.lease == "" {
+		return nil
+	}
+	lease := e.lease
+	e.lease = ""
+	return call("POST", e.api+"/v3/lease/revoke", map[string]string{"ID": lease}, nil)
+}
+
+// Discover returns the URLs stored beneath "/NAME/".
+func (e *etcd) Discover(name string) ([]string, error) {
+	prefix := "/" + name + "/"
+	end := prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+
+	var reply struct {
+		Kvs []struct {
+			Value string
+		}
+	}
+	err := call("POST", e.api+"/v3/kv/range", map[string]string{"key": etcdKV(prefix), "range_end": etcdKV(end)}, &reply)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, kv := range reply.Kvs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err == nil && len(value) > 0 {
+			out = append(out, string(value))
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("the service %s has no healthy servers", name)
+	}
+	return out, nil
+}
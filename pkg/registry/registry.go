@@ -0,0 +1,111 @@
+// Package registry allows servers to be registered in, and discovered from,
+// the service catalogs of Consul, or etcd.
+//
+// Each server registers the URL its clients should connect to, and keeps
+// its entry alive while it is healthy.  Entries expire if they're not kept
+// alive, so a server which fails is soon forgotten.  Clients discover the
+// URLs of the healthy servers.
+//
+// Both catalogs are used via their HTTP APIs, so no client libraries are
+// needed.
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Service describes the registration of a server.
+type Service struct {
+	// Name is the name of the service, which is shared by each server
+	// clients may connect to.
+	Name string
+
+	// ID identifies this server, amongst the others.
+	ID string
+
+	// URL is the end-point clients connect to.
+	URL string
+
+	// TTL is how long our entry remains after it was last refreshed.
+	TTL time.Duration
+}
+
+// Registry is a catalog of services.
+type Registry interface {
+	// Register adds the service, or refreshes it, marking it healthy,
+	// or not.  Unhealthy services are not discovered.
+	Register(service Service, healthy bool) error
+
+	// Deregister removes the service.
+	Deregister(service Service) error
+
+	// Discover returns the URLs of the healthy servers of the named
+	// service.
+	Discover(name string) ([]string, error)
+}
+
+// New returns the registry described by the given specification, which is
+// "consul:" or "etcd:" followed by the URL of its HTTP API, such as
+// "consul:http://127.0.0.1:8500".
+func New(spec string) (Registry, error) {
+	kv := strings.SplitN(spec, ":", 2)
+	if len(kv) != 2 || !strings.HasPrefix(kv[1], "http") {
+		return nil, fmt.Errorf("invalid registry %s, expected consul:URL, or etcd:URL", spec)
+	}
+	api := strings.TrimSuffix(kv[1], "/")
+
+	switch kv[0] {
+	case "consul":
+		return &consul{api: api}, nil
+	case "etcd":
+		return &etcd{api: api}, nil
+	}
+	return nil, fmt.Errorf("unknown registry %s, expected consul, or etcd", kv[0])
+}
+
+// client is used for each of our requests.
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// call makes a request of the given API, sending the given body as JSON,
+// if it isn't nil, and decoding the JSON response into out, if it isn't
+// nil.
+func call(method string, url string, body interface{}, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s failed: %s %s", method, url, resp.Status, strings.TrimSpace(string(reply)))
+	}
+	if out != nil {
+		return json.Unmarshal(reply, out)
+	}
+	return nil
+}
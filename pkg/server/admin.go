@@ -0,0 +1,499 @@
+// pkg/server/admin.go contains our admin API.
+//
+// The API is served upon the `admin` address, which is disabled unless
+// set, and should only be reachable by the server's operators.  Each
+// request applies to every network, unless a `network` is named.
+//
+//   GET  /status   - The state of each network, as JSON.
+//   POST /drain    - Stop accepting new clients, and if `migrate` is set
+//                    ask existing clients to move to that end-point.
+//   POST /resume   - Accept new clients again.
+//   GET  /metrics  - The metrics of each client, for Prometheus.
+//   GET  /quality  - The recent samples of the quality of each client's
+//                    link, by network, and name.
+//   GET  /inventory - The clients which have connected, with the version,
+//                     platform, and addresses they reported, as JSON, or
+//                     as CSV if `format` is "csv".
+//   GET  /tls      - Our crypto-policy, and the TLS parameters negotiated
+//                    by the request, and reported by each client.
+//   POST /tune     - Change the `mtu`, and/or `keepalive`, of the clients
+//                    selected by `name`, and `tag`, while they remain
+//                    connected.
+//   GET  /state    - The settings changed at runtime, by network.
+//   POST /leases   - Give the client `name` the static `ip`, or remove it
+//                    with DELETE.
+//   POST /rules    - Set the filter rule `number` to `rule`, or remove it
+//                    with DELETE.
+//   POST /rates    - Limit the client `name` to `rate` bytes per second,
+//                    or remove its limit with DELETE.
+//   GET  /bans     - The source addresses which are banned, as JSON.
+//   POST /bans     - Ban the address `ip` for `duration` seconds, or for
+//                    ever if that is zero, recording the `reason`, or
+//                    remove its ban with DELETE.
+//
+// Changes are persisted to the `state_file` of their network, and each
+// applies to a single network.  Bans apply to every network, and aren't
+// persisted.
+//
+// When the API is served over TLS the gRPC service defined in admin.proto
+// is served too, for orchestration systems which prefer a typed, and
+// streaming, interface.
+//
+// Requests may be required to present the bearer token `admin_token`, and
+// the API may be served over TLS, with `admin_tls_cert` and `admin_tls_key`,
+// requiring client certificates signed by `admin_client_ca`.  Unless one of
+// those protects it the API may only be served upon a loopback address.
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// networkStatus describes a network, for the admin API.
+type networkStatus struct {
+	// Name is the name of the network.
+	Name string
+
+	// Draining is true if we're not accepting new clients.
+	Draining bool
+
+	// Clients is the number of connected clients.
+	Clients int
+}
+
+// isDraining returns true if we're not accepting new clients.
+func (p *Server) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) != 0
+}
+
+// clientCount returns the number of connected clients.
+func (p *Server) clientCount() int {
+	p.assignedMutex.Lock()
+	defer p.assignedMutex.Unlock()
+
+	count := 0
+	for _, client := range p.assigned {
+		if client != nil && client.socket != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// drain stops us accepting new clients, and if an end-point is given
+// asks our existing clients to migrate to it.
+func (p *Server) drain(endPoint string) {
+	atomic.StoreInt32(&p.draining, 1)
+	if endPoint != "" {
+		p.hub.BroadcastCommand("migrate", []string{endPoint})
+	}
+}
+
+// adminHandler returns the HTTP-handler of our admin API, for the given
+// networks.
+func adminHandler(networks []*Server) http.Handler {
+
+	//
+	// selected returns the networks a request applies to.
+	//
+	selected := func(r *http.Request) ([]*Server, error) {
+		name := r.FormValue("network")
+		if name == "" {
+			return networks, nil
+		}
+		for _, n := range networks {
+			if n.network == name {
+				return []*Server{n}, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown network '%s'", name)
+	}
+
+	//
+	// reply writes the status of the selected networks.
+	//
+	reply := func(w http.ResponseWriter, r *http.Request) {
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		out := make([]networkStatus, 0)
+		for _, n := range nets {
+			out = append(out, networkStatus{Name: n.network, Draining: n.isDraining(), Clients: n.clientCount()})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", reply)
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		migrate := r.FormValue("migrate")
+		if migrate != "" && !strings.HasPrefix(migrate, "ws://") && !strings.HasPrefix(migrate, "wss://") {
+			http.Error(w, "the end-point to migrate to must be a ws:// or wss:// URL", http.StatusBadRequest)
+			return
+		}
+		for _, n := range nets {
+			n.drain(migrate)
+		}
+		reply(w, r)
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		for _, n := range nets {
+			atomic.StoreInt32(&n.draining, 0)
+		}
+		reply(w, r)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, nets)
+	})
+	mux.HandleFunc("/quality", func(w http.ResponseWriter, r *http.Request) {
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		out := make(map[string]map[string][]QualitySample)
+		for _, n := range nets {
+			out[n.network] = n.qualityOf()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+	mux.HandleFunc("/inventory", func(w http.ResponseWriter, r *http.Request) {
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		out := make([]InventoryEntry, 0)
+		for _, n := range nets {
+			out = append(out, n.inventoryOf()...)
+		}
+
+		switch r.FormValue("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(out)
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="inventory.csv"`)
+			writeInventoryCSV(w, out)
+		default:
+			http.Error(w, "the format must be json, or csv", http.StatusBadRequest)
+		}
+	})
+	mux.HandleFunc("/tls", func(w http.ResponseWriter, r *http.Request) {
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tlsStatusOf(r, nets))
+	})
+	mux.HandleFunc("/tune", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		mtu := r.FormValue("mtu")
+		keepalive := r.FormValue("keepalive")
+		if mtu == "" && keepalive == "" {
+			http.Error(w, "an mtu, or keepalive, is required", http.StatusBadRequest)
+			return
+		}
+
+		//
+		// Report the result of each client, by name.
+		//
+		out := make(map[string]string)
+		for _, n := range nets {
+			for _, client := range n.execTargets(shared.SplitList(r.FormValue("name")), shared.SplitList(r.FormValue("tag"))) {
+				out[client.name] = "ok"
+				err := n.tune(client, mtu, keepalive)
+				if err != nil {
+					out[client.name] = err.Error()
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		nets, err := selected(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		out := make(map[string]State)
+		for _, n := range nets {
+			out[n.network] = n.currentState()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+
+	//
+	// change returns the handler of an endpoint which changes the
+	// state of a single network, by POST, or DELETE, and replies with
+	// its new state.
+	//
+	change := func(set func(n *Server, r *http.Request) error, remove func(n *Server, r *http.Request) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			apply := set
+			switch r.Method {
+			case http.MethodPost:
+			case http.MethodDelete:
+				apply = remove
+			default:
+				http.Error(w, "POST, or DELETE, required", http.StatusMethodNotAllowed)
+				return
+			}
+			nets, err := selected(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if len(nets) != 1 {
+				http.Error(w, "a network is required", http.StatusBadRequest)
+				return
+			}
+			n := nets[0]
+			if !n.mutable() {
+				http.Error(w, "no state_file is configured, so changes cannot be persisted", http.StatusConflict)
+				return
+			}
+
+			err = apply(n, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(n.currentState())
+		}
+	}
+	mux.HandleFunc("/leases", change(
+		func(n *Server, r *http.Request) error {
+			return n.setLease(r.FormValue("name"), r.FormValue("ip"))
+		},
+		func(n *Server, r *http.Request) error {
+			return n.removeLease(r.FormValue("name"))
+		}))
+	mux.HandleFunc("/rules", change(
+		func(n *Server, r *http.Request) error {
+			return n.setRule(r.FormValue("number"), r.FormValue("rule"))
+		},
+		func(n *Server, r *http.Request) error {
+			return n.removeRule(r.FormValue("number"))
+		}))
+	mux.HandleFunc("/rates", change(
+		func(n *Server, r *http.Request) error {
+			rate, err := strconv.Atoi(r.FormValue("rate"))
+			if err != nil {
+				return fmt.Errorf("the rate must be a number of bytes per second")
+			}
+			return n.setRate(r.FormValue("name"), rate)
+		},
+		func(n *Server, r *http.Request) error {
+			return n.removeRate(r.FormValue("name"))
+		}))
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		if len(networks) == 0 || networks[0].throttle == nil {
+			http.Error(w, "connections aren't throttled", http.StatusConflict)
+			return
+		}
+		throttle := networks[0].throttle
+
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			seconds := 0
+			if value := r.FormValue("duration"); value != "" {
+				seconds, err = strconv.Atoi(value)
+				if err != nil {
+					http.Error(w, "the duration must be a number of seconds", http.StatusBadRequest)
+					return
+				}
+			}
+			err = throttle.banAddress(r.FormValue("ip"), time.Duration(seconds)*time.Second, r.FormValue("reason"))
+		case http.MethodDelete:
+			err = throttle.unbanAddress(r.FormValue("ip"))
+		default:
+			http.Error(w, "GET, POST, or DELETE, required", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(throttle.banList())
+	})
+	mux.HandleFunc(grpcPrefix, grpcHandler(networks))
+	return mux
+}
+
+// adminPrefix distinguishes the listener of our admin API from those of
+// our networks, when it is passed to the process we upgrade to.
+const adminPrefix = "admin:"
+
+// serveAdmin serves our admin API upon the given address, for the given
+// networks, until the context is cancelled.  We return the listener, so
+// that it may be passed on if we upgrade.
+func (p *Server) serveAdmin(ctx context.Context, addr string, networks []*Server) (net.Listener, error) {
+	token := p.Config.Get("admin_token")
+	tlsConfig, err := p.adminTLS()
+	if err != nil {
+		return nil, fmt.Errorf("failed to launch the admin API: %s", err.Error())
+	}
+
+	//
+	// Anybody who can reach the API can manage the server, so it must
+	// be protected unless only local processes can reach it.
+	//
+	mutual := tlsConfig != nil && tlsConfig.ClientCAs != nil
+	if token == "" && !mutual && !loopbackAddress(addr) {
+		return nil, fmt.Errorf("the admin API may only be served upon %s with an admin_token, or admin_client_ca", addr)
+	}
+
+	l := p.inherited.listener(adminPrefix + addr)
+	if l == nil {
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to launch the admin API: %s", err.Error())
+		}
+	}
+
+	handler := adminHandler(networks)
+	if token != "" {
+		handler = adminAuth(token, handler)
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	if tlsConfig != nil {
+		fmt.Printf("Launching the admin API on https://%s\n", addr)
+		go srv.Serve(tls.NewListener(l, tlsConfig))
+	} else {
+		fmt.Printf("Launching the admin API on http://%s\n", addr)
+		go srv.Serve(l)
+	}
+	return l, nil
+}
+
+// adminTLS returns the TLS configuration of our admin API, or nil if it
+// isn't served over TLS.  If `admin_client_ca` is set clients must present
+// a certificate which it signed.
+func (p *Server) adminTLS() (*tls.Config, error) {
+	cert := p.Config.Get("admin_tls_cert")
+	if cert == "" {
+		if p.Config.Get("admin_client_ca") != "" {
+			return nil, fmt.Errorf("admin_client_ca requires admin_tls_cert, and admin_tls_key")
+		}
+		return nil, nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, p.Config.Get("admin_tls_key"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load our certificate: %s", err.Error())
+	}
+	//
+	// Offer HTTP/2, which our gRPC service requires.
+	//
+	config := &tls.Config{Certificates: []tls.Certificate{pair}, NextProtos: []string{"h2", "http/1.1"}}
+	p.tls.Apply(config)
+
+	if ca := p.Config.Get("admin_client_ca"); ca != "" {
+		data, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read our client CA: %s", err.Error())
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates were found in %s", ca)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// adminAuth wraps the given handler, so that requests must present the
+// given bearer token.
+func adminAuth(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="simple-vpn"`)
+			http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loopbackAddress returns true if the given address, on which we listen,
+// is only reachable from this host.
+func loopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
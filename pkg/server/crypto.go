@@ -0,0 +1,92 @@
+// pkg/server/crypto.go contains the reporting of our crypto-policy, and
+// of the TLS parameters negotiated by our clients, for compliance-minded
+// deployments.
+//
+// Our clients usually reach us via a TLS-terminating proxy, so we can't
+// see their TLS connections ourselves.  Instead each client reports the
+// parameters it negotiated, along with its health.
+
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// tlsStatus describes our crypto-policy, and the TLS connections which
+// are subject to it, for the admin API.
+type tlsStatus struct {
+	// FIPS is true if we only use FIPS-approved cipher suites.
+	FIPS bool
+
+	// MinVersion, and MaxVersion, are the versions of TLS we accept.
+	MinVersion string
+	MaxVersion string `json:",omitempty"`
+
+	// CipherSuites are the cipher suites we accept, if they're
+	// restricted.
+	CipherSuites []string `json:",omitempty"`
+
+	// Admin describes the parameters negotiated for the request, if
+	// our admin API is served over TLS.
+	Admin string `json:",omitempty"`
+
+	// Clients describes the connection of each connected client.
+	Clients []clientTLS
+}
+
+// clientTLS describes the TLS connection of a client.
+type clientTLS struct {
+	Network string
+	Name    string
+	IP      string
+
+	// TLS is the parameters the client reported negotiating, or empty
+	// if it hasn't reported them, or didn't use TLS.
+	TLS string `json:",omitempty"`
+}
+
+// tlsStatusOf returns the status of our crypto-policy, and of the clients
+// of the given networks, for the given request.  Every network shares the
+// same policy.
+func tlsStatusOf(r *http.Request, networks []*Server) tlsStatus {
+	p := networks[0]
+	out := tlsStatus{
+		FIPS:         p.tls.FIPS,
+		MinVersion:   p.tls.MinVersionName(),
+		CipherSuites: p.tls.CipherSuiteNames(),
+		Clients:      make([]clientTLS, 0),
+	}
+	if p.tls.MaxVersion != 0 {
+		out.MaxVersion = shared.TLSVersionName(p.tls.MaxVersion)
+	}
+	if r.TLS != nil {
+		out.Admin = shared.DescribeTLS(*r.TLS)
+	}
+	for _, n := range networks {
+		out.Clients = append(out.Clients, n.clientsTLS()...)
+	}
+	return out
+}
+
+// clientsTLS describes the TLS connections of our connected clients.
+func (p *Server) clientsTLS() []clientTLS {
+	p.assignedMutex.Lock()
+	defer p.assignedMutex.Unlock()
+
+	var out []clientTLS
+	for ip, client := range p.assigned {
+		if client == nil || client.socket == nil {
+			continue
+		}
+		entry := clientTLS{Network: p.network, Name: client.name, IP: ip}
+		if client.report != nil {
+			entry.TLS = client.report.TLS
+		}
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
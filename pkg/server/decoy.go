@@ -0,0 +1,123 @@
+// pkg/server/decoy.go contains the decoy we serve for every request which
+// isn't for the VPN, so that a scan of the server finds an ordinary site.
+//
+// By default this is a simple page upon "/", but we may instead serve a
+// directory of static files, or pass each request to another web-server.
+// These settings apply to every network, so are read from the top-level
+// of the configuration file:
+//
+//   decoy_directory - The directory of static files to serve.
+//   decoy_proxy     - The URL of the web-server to pass requests to.
+//
+// Only one of them may be set.  Neither has any effect unless the VPN is
+// served upon a specific `path`, as otherwise every request is for it.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// decoyPage is the content we serve upon "/", if the VPN is being
+// served upon a different path, and no other decoy is configured.
+const decoyPage = `<!DOCTYPE html>
+<html>
+<head><title>Welcome</title></head>
+<body><h1>It works!</h1></body>
+</html>
+`
+
+// serveDecoy serves our decoy page, for any request which isn't for
+// the VPN end-point.
+func serveDecoy(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(decoyPage))
+}
+
+// decoy returns the handler of the requests which aren't for any of the
+// given networks.
+func (p *Server) decoy(networks []*Server) (http.HandlerFunc, error) {
+	dir := p.Config.Get("decoy_directory")
+	proxy := p.Config.Get("decoy_proxy")
+	if dir != "" && proxy != "" {
+		return nil, fmt.Errorf("only one of decoy_directory, and decoy_proxy, may be set")
+	}
+	if dir == "" && proxy == "" {
+		return serveDecoy, nil
+	}
+
+	//
+	// If every network is served upon "/" our decoy is unreachable,
+	// which is probably a mistake.
+	//
+	hidden := false
+	for _, n := range networks {
+		if n.path != "/" {
+			hidden = true
+		}
+	}
+	if !hidden {
+		log.Printf("WARNING: The decoy is never served, as the VPN is served upon every path")
+	}
+
+	if dir != "" {
+		return decoyDirectory(dir)
+	}
+	return decoyProxy(proxy)
+}
+
+// decoyDirectory returns a handler which serves the static files beneath
+// the given directory.
+//
+// We don't list the contents of directories, which would look unusual,
+// unless they contain an index.html, which is served instead.
+func decoyDirectory(dir string) (http.HandlerFunc, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the decoy_directory: %s", err.Error())
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("the decoy_directory %s isn't a directory", dir)
+	}
+
+	files := http.FileServer(http.Dir(dir))
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+		info, err := os.Stat(name)
+		if err == nil && info.IsDir() {
+			_, err = os.Stat(filepath.Join(name, "index.html"))
+		}
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}, nil
+}
+
+// decoyProxy returns a handler which passes each request to the web-server
+// at the given URL.
+func decoyProxy(target string) (http.HandlerFunc, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("the decoy_proxy must be an http:// or https:// URL, not '%s'", target)
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("[S] Failed to proxy %s to the decoy - %s", r.URL.Path, err.Error())
+		http.Error(w, "502 - Bad Gateway", http.StatusBadGateway)
+	}
+	return proxy.ServeHTTP, nil
+}
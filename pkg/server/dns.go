@@ -0,0 +1,155 @@
+// pkg/server/dns.go contains our export of the names, and VPN IPs, of our
+// peers to a file, for operators who run their own DNS server.
+//
+// The file is named by `dns_file`, and rewritten whenever our peers
+// change, in the format given by `dns_format`:
+//
+//   hosts   - Lines in the format of /etc/hosts, suitable for the
+//             `addn-hosts` setting of dnsmasq.  This is the default.
+//   dnsmasq - `host-record` lines, for the `conf-dir` of dnsmasq.
+//   zone    - A complete zone, for BIND or NSD, whose nameserver is
+//             ourselves.  This requires `dns_domain`.
+//
+// Names are qualified by `dns_domain`, if it is set, and `dns_reload` is
+// run after each change, to tell the DNS server about it.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// dnsTTL is the TTL of the records of our zone, which is short because
+// our peers come and go.
+const dnsTTL = 60
+
+// checkDNS checks our DNS settings.
+func (p *Server) checkDNS() error {
+	if p.Config.Get("dns_file") == "" {
+		return nil
+	}
+	switch p.Config.GetWithDefault("dns_format", "hosts") {
+	case "hosts", "dnsmasq":
+	case "zone":
+		if p.Config.Get("dns_domain") == "" {
+			return fmt.Errorf("a dns_format of zone requires a dns_domain")
+		}
+	default:
+		return fmt.Errorf("the dns_format must be hosts, dnsmasq, or zone")
+	}
+	return nil
+}
+
+// updateDNS rewrites our `dns_file`, if we have one, with the given
+// peers, which are encoded by shared.EncodePeer.  It is only rewritten if
+// they've changed.
+//
+// NOTE: The caller must hold the announceMutex.
+func (p *Server) updateDNS(encoded []string) {
+	path := p.Config.Get("dns_file")
+	if path == "" {
+		return
+	}
+
+	//
+	// The names, and IPs, are written to a file which the DNS server
+	// parses, so we skip any which might add records of their own,
+	// and write each IP in its canonical form.
+	//
+	var peers []shared.Peer
+	for _, str := range encoded {
+		peer, err := shared.DecodePeer(str)
+		if err != nil || shared.ValidName(peer.Name) != nil {
+			continue
+		}
+		ip := net.ParseIP(peer.IP)
+		if ip == nil {
+			continue
+		}
+		peer.IP = ip.String()
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].Name != peers[j].Name {
+			return peers[i].Name < peers[j].Name
+		}
+		return peers[i].IP < peers[j].IP
+	})
+
+	domain := strings.Trim(p.Config.Get("dns_domain"), ".")
+	fqdn := func(name string) string {
+		if domain == "" {
+			return name
+		}
+		return name + "." + domain
+	}
+
+	var records strings.Builder
+	switch p.Config.GetWithDefault("dns_format", "hosts") {
+	case "hosts":
+		for _, peer := range peers {
+			if domain != "" {
+				fmt.Fprintf(&records, "%s\t%s %s\n", peer.IP, fqdn(peer.Name), peer.Name)
+			} else {
+				fmt.Fprintf(&records, "%s\t%s\n", peer.IP, peer.Name)
+			}
+		}
+	case "dnsmasq":
+		for _, peer := range peers {
+			fmt.Fprintf(&records, "host-record=%s,%s\n", fqdn(peer.Name), peer.IP)
+		}
+	case "zone":
+		for _, peer := range peers {
+			kind := "A"
+			if strings.Contains(peer.IP, ":") {
+				kind = "AAAA"
+			}
+			fmt.Fprintf(&records, "%-24s IN %-4s %s\n", strings.ToLower(peer.Name), kind, peer.IP)
+		}
+	}
+
+	if records.String() == p.dnsRecords {
+		return
+	}
+	p.dnsRecords = records.String()
+
+	out := records.String()
+	if p.Config.Get("dns_format") == "zone" {
+		//
+		// The serial must increase with each change, so we use
+		// the time.
+		//
+		out = fmt.Sprintf("$ORIGIN %s.\n$TTL %d\n@ IN SOA %s. hostmaster.%s. (%d 3600 600 86400 %d)\n@ IN NS %s.\n\n%s",
+			domain, dnsTTL, fqdn(serverName), domain, time.Now().Unix(), dnsTTL, fqdn(serverName), out)
+	}
+
+	err := writeAtomic(path, []byte(out))
+	if err != nil {
+		log.Printf("[S] Failed to write our dns_file %s: %s", path, err.Error())
+		return
+	}
+	os.Chmod(path, 0644)
+
+	if cmd := p.Config.Get("dns_reload"); cmd != "" {
+		hook := shared.Hook{
+			Name:    "dns_reload",
+			Command: cmd,
+			Timeout: time.Duration(p.Config.GetIntWithDefault("hook_timeout", int(shared.DefaultHookTimeout/time.Second))) * time.Second,
+			Env:     []string{"DNS_FILE=" + path},
+		}
+		go func() {
+			err := hook.Run()
+			if err != nil {
+				log.Printf("[S] Failed to run dns_reload - %s", err.Error())
+			}
+		}()
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// TestDNSHostilePeers ensures that peers whose names, or IPs, would add
+// records of their own are left out of our dns_file.
+func TestDNSHostilePeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatalf("failed to create a directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vpn.conf")
+	cfg, err := config.Parse("dns_file = " + path + "\ndns_format = dnsmasq\n")
+	if err != nil {
+		t.Fatalf("failed to parse our configuration: %s", err)
+	}
+	p := &Server{Config: cfg}
+
+	p.updateDNS([]string{
+		shared.EncodePeer(shared.Peer{Name: "laptop", IP: "10.0.0.2"}),
+		shared.EncodePeer(shared.Peer{Name: "evil\naddress=/#/6.6.6.6", IP: "10.0.0.3"}),
+		shared.EncodePeer(shared.Peer{Name: "sneaky", IP: "10.0.0.4\naddress=/#/6.6.6.6"}),
+	})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read our dns_file: %s", err)
+	}
+	out := string(data)
+	if out != "host-record=laptop,10.0.0.2\n" {
+		t.Errorf("unexpected dns_file:\n%s", out)
+	}
+	if strings.Contains(out, "address=") || strings.Contains(out, "sneaky") {
+		t.Errorf("a hostile peer reached our dns_file:\n%s", out)
+	}
+}
@@ -0,0 +1,201 @@
+// pkg/server/dos.go contains our protection of the public listener from
+// floods of handshakes, which would otherwise exhaust it with half-open
+// connections.
+//
+// These settings apply to every network, so are read from the top-level of
+// the configuration file:
+//
+//   handshake_limit        - The connections whose handshake may be in
+//                            progress at once.  Others are closed at once.
+//   handshake_timeout      - The seconds in which a connection must send its
+//                            headers, and complete its handshake.
+//   handshake_header_bytes - The largest headers we read.
+//   handshake_cookie       - If true the handshake of each client must
+//                            present a cookie, which we give it in reply to
+//                            its first attempt, before we do any work upon
+//                            its behalf.
+//
+// A cookie is stamped with the time, and an HMAC of that and the address
+// it was given to, so we needn't remember the cookies we've given out.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// cookieLifetime is how long a cookie remains valid.
+const cookieLifetime = 2 * time.Minute
+
+// handshakeGuard limits the handshakes in progress upon our listeners, and
+// how long each may take.
+type handshakeGuard struct {
+	// limit is the number of handshakes which may be in progress, and
+	// timeout how long each may take.
+	limit   int
+	timeout time.Duration
+
+	// headerBytes is the size of the largest headers we read.
+	headerBytes int
+
+	// secret keys the HMAC of our cookies, if we require them.
+	secret []byte
+
+	// pending holds the connections whose handshake is in progress,
+	// with the timer which closes each if it takes too long.
+	pending map[net.Conn]*time.Timer
+
+	// refused counts the connections we refused, by reason.
+	refused map[string]uint64
+
+	// mutex protects pending, and refused.
+	mutex sync.Mutex
+}
+
+// newHandshakeGuard returns the guard configured by the given settings.
+func newHandshakeGuard(cfg *config.Reader) (*handshakeGuard, error) {
+	g := &handshakeGuard{
+		limit:       cfg.GetIntWithDefault("handshake_limit", 512),
+		timeout:     time.Duration(cfg.GetIntWithDefault("handshake_timeout", 10)) * time.Second,
+		headerBytes: cfg.GetIntWithDefault("handshake_header_bytes", 16384),
+		pending:     make(map[net.Conn]*time.Timer),
+		refused:     make(map[string]uint64),
+	}
+	if g.limit < 1 || g.timeout < time.Second || g.headerBytes < 1024 {
+		return nil, fmt.Errorf("the handshake_limit must be at least 1, the handshake_timeout at least 1 second, and handshake_header_bytes at least 1024")
+	}
+
+	if cfg.Get("handshake_cookie") == "true" {
+		g.secret = make([]byte, 32)
+		if _, err := rand.Read(g.secret); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// configure applies our limits to the given HTTP-server.
+func (g *handshakeGuard) configure(srv *http.Server) {
+	srv.ReadHeaderTimeout = g.timeout
+	srv.MaxHeaderBytes = g.headerBytes
+	srv.ConnState = g.connState
+}
+
+// connState tracks the connections whose handshake is in progress, which
+// is from when they're accepted until their first request is complete,
+// or they're upgraded to a websocket.
+func (g *handshakeGuard) connState(conn net.Conn, state http.ConnState) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	timer, pending := g.pending[conn]
+	switch state {
+	case http.StateNew:
+		if len(g.pending) >= g.limit {
+			g.refused["limit"]++
+			conn.Close()
+			return
+		}
+		g.pending[conn] = time.AfterFunc(g.timeout, func() {
+			g.mutex.Lock()
+			_, pending := g.pending[conn]
+			if pending {
+				delete(g.pending, conn)
+				g.refused["timeout"]++
+			}
+			g.mutex.Unlock()
+
+			if pending {
+				conn.Close()
+			}
+		})
+	case http.StateIdle, http.StateHijacked, http.StateClosed:
+		if pending {
+			timer.Stop()
+			delete(g.pending, conn)
+		}
+	}
+}
+
+// protect wraps the given handler, so that websocket handshakes must present
+// a valid cookie, if we require them.
+func (g *handshakeGuard) protect(next http.HandlerFunc) http.HandlerFunc {
+	if g.secret == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !websocket.IsWebSocketUpgrade(r) {
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if g.validCookie(r.URL.Query().Get("cookie"), host, now) {
+			next(w, r)
+			return
+		}
+
+		g.mutex.Lock()
+		g.refused["cookie"]++
+		g.mutex.Unlock()
+
+		w.Header().Set(shared.CookieHeader, g.cookie(host, now))
+		http.Error(w, "428 - Present the cookie we gave you", http.StatusPreconditionRequired)
+	}
+}
+
+// cookie returns the cookie for the given address, at the given time.
+func (g *handshakeGuard) cookie(host string, now time.Time) string {
+	stamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(stamp, uint64(now.Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(stamp, g.stamp(host, stamp)...))
+}
+
+// validCookie returns true if the given cookie was given to the given
+// address, and hasn't expired.
+func (g *handshakeGuard) validCookie(cookie string, host string, now time.Time) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(cookie)
+	if err != nil || len(raw) != 8+16 {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	if now.Before(issued.Add(-time.Minute)) || now.After(issued.Add(cookieLifetime)) {
+		return false
+	}
+	return hmac.Equal(raw[8:], g.stamp(host, raw[:8]))
+}
+
+// stamp returns the HMAC of the given address, and time-stamp.
+func (g *handshakeGuard) stamp(host string, stamp []byte) []byte {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(stamp)
+	mac.Write([]byte(host))
+	return mac.Sum(nil)[:16]
+}
+
+// stats returns the number of handshakes in progress, and a copy of the
+// counts of the connections we refused, by reason.
+func (g *handshakeGuard) stats() (int, map[string]uint64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	refused := make(map[string]uint64)
+	for reason, count := range g.refused {
+		refused[reason] = count
+	}
+	return len(g.pending), refused
+}
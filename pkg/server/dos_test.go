@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+// TestValidCookie tests that our handshake cookies are only valid for the
+// address they were given to, and until they expire.
+func TestValidCookie(t *testing.T) {
+	g := &handshakeGuard{secret: []byte("0123456789abcdef0123456789abcdef")}
+	other := &handshakeGuard{secret: []byte("fedcba9876543210fedcba9876543210")}
+
+	now := time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC)
+	cookie := g.cookie("192.0.2.1", now)
+	raw, _ := base64.RawURLEncoding.DecodeString(cookie)
+
+	// tamper returns our cookie, with the given byte flipped.
+	tamper := func(n int) string {
+		changed := append([]byte{}, raw...)
+		changed[n] ^= 0x01
+		return base64.RawURLEncoding.EncodeToString(changed)
+	}
+
+	tests := []struct {
+		name   string
+		guard  *handshakeGuard
+		cookie string
+		host   string
+		now    time.Time
+		valid  bool
+	}{
+		{"fresh", g, cookie, "192.0.2.1", now, true},
+		{"nearly expired", g, cookie, "192.0.2.1", now.Add(119 * time.Second), true},
+		{"expired", g, cookie, "192.0.2.1", now.Add(121 * time.Second), false},
+		{"slight skew", g, cookie, "192.0.2.1", now.Add(-59 * time.Second), true},
+		{"future", g, cookie, "192.0.2.1", now.Add(-61 * time.Second), false},
+		{"other host", g, cookie, "192.0.2.2", now, false},
+		{"other secret", other, cookie, "192.0.2.1", now, false},
+		{"tampered hmac", g, tamper(len(raw) - 1), "192.0.2.1", now, false},
+		{"tampered time", g, tamper(7), "192.0.2.1", now, false},
+		{"bad base64", g, "!" + cookie[1:], "192.0.2.1", now, false},
+		{"short", g, base64.RawURLEncoding.EncodeToString(raw[:20]), "192.0.2.1", now, false},
+		{"long", g, base64.RawURLEncoding.EncodeToString(append(raw, 0)), "192.0.2.1", now, false},
+		{"empty", g, "", "192.0.2.1", now, false},
+	}
+
+	for _, test := range tests {
+		if test.guard.validCookie(test.cookie, test.host, test.now) != test.valid {
+			t.Errorf("%s: expected %v", test.name, test.valid)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// pkg/server/events.go contains our event-bus.
+//
+// Programs which embed the server may register callbacks to be invoked
+// when clients connect, disconnect, or fail to authenticate, and which
+// periodically receive the traffic-counters, and health-reports, of each
+// client.
+//
+// The same events may be streamed over HTTP, as server-sent events, by
+// fetching "/events" with the `events_key` of a network as a bearer token.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// The types of event we generate.
+const (
+	EventPeerConnected    = "peer-connected"
+	EventPeerDisconnected = "peer-disconnected"
+	EventAuthFailure      = "auth-failure"
+	EventTraffic          = "traffic"
+	EventReport           = "report"
+	EventExecResult       = "exec-result"
+	EventSourceMismatch   = "source-mismatch"
+	EventFlagged          = "flagged"
+	EventLinkDegraded     = "link-degraded"
+	EventLinkRecovered    = "link-recovered"
+)
+
+// Event describes something which happened upon the server.
+type Event struct {
+	// Type is one of the Event* constants.
+	Type string
+
+	// Time is when the event happened.
+	Time time.Time
+
+	// Network is the name of the virtual network, which is "" for the
+	// network defined at the top-level of the configuration file.
+	Network string
+
+	// Name is the name of the client.
+	Name string
+
+	// IP is the VPN IP of the client, if it has one.
+	IP string `json:",omitempty"`
+
+	// Remote is the public IP the client connected from.
+	Remote string `json:",omitempty"`
+
+	// Via is every address recorded by the proxies the client connected
+	// through, ending with the proxy which connected to us, for
+	// peer-connected events.
+	Via []string `json:",omitempty"`
+
+	// Stats holds the traffic-counters of the client, for traffic
+	// events.
+	Stats *shared.Stats `json:",omitempty"`
+
+	// Report holds the most recent health-report of the client, for
+	// report and traffic events.
+	Report *shared.Report `json:",omitempty"`
+
+	// Message describes the result of a remote action, for exec-result
+	// events, the networks a client was expected to connect from, for
+	// source-mismatch events, why a connection was flagged, or
+	// rejected by a gate, or how a client's link has degraded.
+	Message string `json:",omitempty"`
+}
+
+// EventHandler is the signature of a function which is invoked when an
+// event happens.  Handlers are invoked synchronously, so must not block.
+type EventHandler func(Event)
+
+// eventBus delivers events to our handlers, and subscribers.
+type eventBus struct {
+	// handlers holds the handlers for each type of event.
+	handlers map[string][]EventHandler
+
+	// subscribers receive every event.
+	subscribers map[chan Event]bool
+
+	// mutex protects the handlers, and subscribers.
+	mutex sync.Mutex
+}
+
+// newEventBus creates an event-bus with no handlers, or subscribers.
+func newEventBus() *eventBus {
+	return &eventBus{
+		handlers:    make(map[string][]EventHandler),
+		subscribers: make(map[chan Event]bool),
+	}
+}
+
+// on registers a handler for the given type of event.
+func (b *eventBus) on(kind string, fn EventHandler) {
+	b.mutex.Lock()
+	b.handlers[kind] = append(b.handlers[kind], fn)
+	b.mutex.Unlock()
+}
+
+// active returns true if anything is interested in events.
+func (b *eventBus) active() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.handlers) > 0 || len(b.subscribers) > 0
+}
+
+// emit delivers the given event.
+//
+// Subscribers which aren't keeping up miss the event, rather than
+// delaying us.
+func (b *eventBus) emit(e Event) {
+	e.Time = time.Now()
+
+	b.mutex.Lock()
+	handlers := b.handlers[e.Type]
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, fn := range handlers {
+		fn(e)
+	}
+}
+
+// OnPeerConnected registers a function to be invoked when a client
+// connects.
+func (p *Server) OnPeerConnected(fn EventHandler) {
+	p.events.on(EventPeerConnected, fn)
+}
+
+// OnPeerDisconnected registers a function to be invoked when a client
+// disconnects.
+func (p *Server) OnPeerDisconnected(fn EventHandler) {
+	p.events.on(EventPeerDisconnected, fn)
+}
+
+// OnAuthFailure registers a function to be invoked when a client, or
+// federated server, presents the wrong key.
+func (p *Server) OnAuthFailure(fn EventHandler) {
+	p.events.on(EventAuthFailure, fn)
+}
+
+// OnTraffic registers a function to be invoked periodically with the
+// traffic-counters of each client.
+func (p *Server) OnTraffic(fn EventHandler) {
+	p.events.on(EventTraffic, fn)
+}
+
+// OnReport registers a function to be invoked when a client sends us a
+// health-report.
+func (p *Server) OnReport(fn EventHandler) {
+	p.events.on(EventReport, fn)
+}
+
+// Subscribe returns a channel upon which every event is delivered, and
+// a function to be called once it is no longer required.
+func (p *Server) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+
+	p.events.mutex.Lock()
+	p.events.subscribers[ch] = true
+	p.events.mutex.Unlock()
+
+	return ch, func() {
+		p.events.mutex.Lock()
+		delete(p.events.subscribers, ch)
+		p.events.mutex.Unlock()
+	}
+}
+
+// emit delivers an event from this network.
+func (p *Server) emit(kind string, name string, ip string, remote string) {
+	p.events.emit(Event{Type: kind, Network: p.network, Name: name, IP: ip, Remote: remote})
+}
+
+// emitTraffic delivers a traffic event for each of our clients.
+func (p *Server) emitTraffic() {
+	p.assignedMutex.Lock()
+	var clients []connection
+	for _, client := range p.assigned {
+		if client != nil && client.socket != nil {
+			clients = append(clients, *client)
+		}
+	}
+	p.assignedMutex.Unlock()
+
+	for _, client := range clients {
+		stats := client.socket.Stats()
+		p.events.emit(Event{
+			Type:    EventTraffic,
+			Network: p.network,
+			Name:    client.name,
+			IP:      client.localIP,
+			Remote:  client.remoteIP,
+			Stats:   &stats,
+			Report:  client.report,
+		})
+	}
+}
+
+// recordReport stores the health-report the given client sent us, and
+// delivers it as an event.
+func (p *Server) recordReport(ip string, report shared.Report) {
+	p.assignedMutex.Lock()
+	client := p.assigned[ip]
+	if client == nil {
+		p.assignedMutex.Unlock()
+		return
+	}
+	previous := ""
+	if client.report != nil {
+		previous = client.report.TLS
+	}
+	client.report = &report
+	name := client.name
+	remote := client.remoteIP
+	p.assignedMutex.Unlock()
+
+	if report.TLS != "" && report.TLS != previous {
+		log.Printf("[S] Client %s negotiated %s", name, report.TLS)
+	}
+
+	p.reportInventory(name, report)
+	p.offerUpdate(ip, report)
+
+	p.events.emit(Event{
+		Type:    EventReport,
+		Network: p.network,
+		Name:    name,
+		IP:      ip,
+		Remote:  remote,
+		Report:  &report,
+	})
+}
+
+// eventsKey returns the key which must be presented to stream our
+// events.  There is no default, so streaming is disabled unless one is
+// configured.
+func (p *Server) eventsKey() string {
+	return p.Config.Get("events_key")
+}
+
+// serveEvents is the HTTP-handler which streams events, as server-sent
+// events, until the client goes away.
+func (p *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+
+	if !bearer(r, p.eventsKey()) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Invalid/missing shared-secret"))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := p.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-events:
+
+			//
+			// Only events from this network are sent, since the
+			// key is specific to it.
+			//
+			if e.Network != p.network {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/skx/simple-vpn/config"
+)
+
+// TestServeEventsKey ensures that events are only streamed to those who
+// present the `events_key` as a bearer token.
+func TestServeEventsKey(t *testing.T) {
+	cfg, err := config.Parse("events_key = an-events-secret\n")
+	if err != nil {
+		t.Fatalf("failed to parse our configuration: %s", err)
+	}
+	p := &Server{Config: cfg}
+
+	for _, test := range []struct {
+		url           string
+		authorization string
+	}{
+		{"/events?key=an-events-secret", ""},
+		{"/events", "Bearer an-events-secre"},
+		{"/events", "an-events-secret"},
+		{"/events", ""},
+	} {
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		p.serveEvents(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s with %q: expected %d, got %d", test.url, test.authorization, http.StatusForbidden, w.Code)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// pkg/server/exec.go contains the remote-management of clients.
+//
+// An operator may ask clients to perform an action, such as re-running
+// their `up` hook, by POSTing to "/exec" with the `exec_key` of a network
+// as a bearer token.  Clients only obey if they've enabled `allow_remote_exec`,
+// and listed the action in their `remote_exec_allow` setting, and report
+// the result back to us.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// execKey returns the key which must be presented to send actions to our
+// clients.  There is no default, so remote-management is disabled unless
+// one is configured.
+func (p *Server) execKey() string {
+	return p.Config.Get("exec_key")
+}
+
+// execTargets returns the connected clients which match the given names,
+// or tags.
+func (p *Server) execTargets(names []string, tags []string) []connection {
+	p.assignedMutex.Lock()
+	defer p.assignedMutex.Unlock()
+
+	var out []connection
+	for _, client := range p.assigned {
+		if client == nil || client.socket == nil {
+			continue
+		}
+
+		match := false
+		for _, name := range names {
+			if name == client.name {
+				match = true
+			}
+		}
+		for _, tag := range tags {
+			for _, t := range client.tags {
+				if tag == t {
+					match = true
+				}
+			}
+		}
+		if match {
+			out = append(out, *client)
+		}
+	}
+	return out
+}
+
+// serveExec is the HTTP-handler which sends an action to the selected
+// clients.
+//
+// The clients are selected by the comma-separated `name`, and `tag`,
+// parameters, and any `args` are passed to the action.  We return the
+// names of the clients the action was sent to, as JSON, and each client
+// reports the result itself.
+func (p *Server) serveExec(w http.ResponseWriter, r *http.Request) {
+
+	if !bearer(r, p.execKey()) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Invalid/missing shared-secret"))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	action := r.FormValue("action")
+	if action == "" || strings.Contains(action, "|") {
+		http.Error(w, "missing, or invalid, action", http.StatusBadRequest)
+		return
+	}
+
+	args := []string{action}
+	for _, arg := range shared.SplitList(r.FormValue("args")) {
+		if strings.Contains(arg, "|") {
+			http.Error(w, "invalid argument", http.StatusBadRequest)
+			return
+		}
+		args = append(args, arg)
+	}
+
+	sent := make([]string, 0)
+	for _, client := range p.execTargets(shared.SplitList(r.FormValue("name")), shared.SplitList(r.FormValue("tag"))) {
+		if client.socket.SendCommand("exec", args...) == nil {
+			sent = append(sent, client.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sent)
+}
+
+// execResult records the result of an action which the named client
+// performed, which it sends to us as the action, "true" or "false", and
+// a message.
+func (p *Server) execResult(name string, ip string, args []string) {
+	if len(args) < 2 {
+		return
+	}
+	result := "failed"
+	if args[1] == "true" {
+		result = "succeeded"
+	}
+	msg := fmt.Sprintf("remote action '%s' %s: %s", args[0], result, strings.Join(args[2:], "|"))
+
+	p.clientLog(name, msg)
+	p.events.emit(Event{
+		Type:    EventExecResult,
+		Network: p.network,
+		Name:    name,
+		IP:      ip,
+		Message: msg,
+	})
+}
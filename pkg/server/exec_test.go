@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/skx/simple-vpn/config"
+)
+
+// TestServeExecKey ensures that actions are only accepted with the
+// `exec_key` as a bearer token.
+func TestServeExecKey(t *testing.T) {
+	cfg, err := config.Parse("exec_key = an-exec-secret\n")
+	if err != nil {
+		t.Fatalf("failed to parse our configuration: %s", err)
+	}
+	p := &Server{Config: cfg}
+
+	tests := []struct {
+		url           string
+		authorization string
+		expected      int
+	}{
+		{"/exec?action=up", "Bearer an-exec-secret", http.StatusOK},
+		{"/exec?action=up&key=an-exec-secret", "", http.StatusForbidden},
+		{"/exec?action=up", "Bearer an-exec-secre", http.StatusForbidden},
+		{"/exec?action=up", "an-exec-secret", http.StatusForbidden},
+		{"/exec?action=up", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", test.url, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		w := httptest.NewRecorder()
+		p.serveExec(w, req)
+		if w.Code != test.expected {
+			t.Errorf("%s with %q: expected %d, got %d", test.url, test.authorization, test.expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// pkg/server/exit.go contains our support for acting as an exit node,
+// routing the traffic of our clients beyond the VPN.
+//
+// The kernel receives the traffic of each client from its device, so we
+// route each client's IP to its device, enable IP forwarding, and add the
+// firewall rules which masquerade the traffic leaving the VPN.  The rules
+// are added with nftables, via our firewall package, if it is available,
+// otherwise iptables, and removed when we shut down.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/skx/simple-vpn/pkg/firewall"
+)
+
+// exitNode returns true if we route the traffic of our clients beyond
+// the VPN.
+func (p *Server) exitNode() bool {
+	return p.Config.Get("exit_node") == "true"
+}
+
+// exitCommand is a command which we run to add, or remove, our firewall
+// rules.
+type exitCommand struct {
+	// args holds the command, and its arguments.
+	args []string
+
+	// input is given to the command, for nftables.
+	input string
+
+	// optional is true if the command may fail, such as when removing
+	// the rules a previous instance of us left behind.
+	optional bool
+}
+
+// run runs the command.
+func (c exitCommand) run() error {
+	fmt.Printf("Running: '%s'\n", strings.Join(c.args, " "))
+	x := exec.Command(c.args[0], c.args[1:]...)
+	x.Stdin = strings.NewReader(c.input)
+	output, err := x.CombinedOutput()
+	if err != nil && !c.optional {
+		return fmt.Errorf("failed to run %s - %s %s", strings.Join(c.args, " "), err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// exitTool returns the tool we use to add our firewall rules, which is
+// nftables if it is available, unless we're told otherwise.
+func (p *Server) exitTool() (string, error) {
+	tool := p.Config.Get("exit_firewall")
+	if tool == "" {
+		tool = "iptables"
+		if _, err := exec.LookPath("nft"); err == nil || p.Config.Get("firewall_dry_run") == "true" {
+			tool = "nft"
+		}
+	}
+	if tool != "nft" && tool != "iptables" {
+		return "", fmt.Errorf("exit_firewall must be nft or iptables")
+	}
+	return tool, nil
+}
+
+// exitRuleset returns the nftables ruleset of an exit node.
+func (p *Server) exitRuleset() *firewall.Ruleset {
+	family := firewall.Family(p.subnet)
+	table := "simple-vpn"
+	if p.network != "" {
+		table += "-" + p.network
+	}
+	rules := firewall.New(table, p.Config.Get("firewall_dry_run") == "true")
+
+	//
+	// Traffic between our clients is switched by us, so the copies
+	// their devices give the kernel are dropped.
+	//
+	forward := rules.Chain("forward", "filter", "forward", 0)
+	if p.Config.Get("mss_clamp") == "true" {
+		forward.Add("%s saddr %s tcp flags syn tcp option maxseg size set rt mtu", family, p.subnet)
+		forward.Add("%s daddr %s tcp flags syn tcp option maxseg size set rt mtu", family, p.subnet)
+	}
+	forward.Add("%s saddr %s %s daddr %s drop", family, p.subnet, family, p.subnet)
+
+	//
+	// The destinations the members of each group may reach are also
+	// enforced here, for groups whose members are allocated from a
+	// pool.
+	//
+	var names []string
+	for name := range p.policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		pol := p.policies[name]
+		if pol.pool == nil || len(pol.allow) == 0 {
+			continue
+		}
+		forward.Add("%s saddr %s %s daddr != %s drop comment %q", family, pol.pool.String(), family, firewall.Set(pol.allow), "group "+name)
+	}
+
+	oif := ""
+	if out := p.Config.Get("exit_interface"); out != "" {
+		oif = fmt.Sprintf("oifname %q ", out)
+	}
+	nat := rules.Chain("postrouting", "nat", "postrouting", 100)
+	nat.Add("%s saddr %s %s daddr != %s %smasquerade", family, p.subnet, family, p.subnet, oif)
+	return rules
+}
+
+// exitRules returns the commands which add, and remove, the iptables
+// rules of an exit node.
+func (p *Server) exitRules() ([]exitCommand, []exitCommand) {
+	cmd := "iptables"
+	if strings.Contains(p.subnet, ":") {
+		cmd = "ip6tables"
+	}
+	masquerade := []string{"-t", "nat", "POSTROUTING", "-s", p.subnet, "!", "-d", p.subnet}
+	if out := p.Config.Get("exit_interface"); out != "" {
+		masquerade = append(masquerade, "-o", out)
+	}
+	masquerade = append(masquerade, "-j", "MASQUERADE")
+
+	//
+	// These are inserted in turn, so the last is first, and traffic
+	// between our clients is dropped for the reason given above.
+	//
+	rules := [][]string{
+		masquerade,
+		{"FORWARD", "-d", p.subnet, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		{"FORWARD", "-s", p.subnet, "!", "-d", p.subnet, "-j", "ACCEPT"},
+		{"FORWARD", "-s", p.subnet, "-d", p.subnet, "-j", "DROP"},
+	}
+	if p.Config.Get("mss_clamp") == "true" {
+		rules = append(rules, []string{"-t", "mangle", "FORWARD", "-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS", "--clamp-mss-to-pmtu"})
+	}
+
+	//
+	// We remove any rules a previous instance left behind first, so
+	// we don't add duplicates.
+	//
+	var add, remove []exitCommand
+	for _, rule := range rules {
+		add = append(add, exitCommand{args: iptablesRule(cmd, "-D", rule), optional: true})
+		remove = append(remove, exitCommand{args: iptablesRule(cmd, "-D", rule)})
+	}
+	for _, rule := range rules {
+		add = append(add, exitCommand{args: iptablesRule(cmd, "-I", rule)})
+	}
+	return add, remove
+}
+
+// iptablesRule returns the command which adds, or deletes, the given
+// rule.  The rule may start with the table it belongs to.
+func iptablesRule(cmd string, action string, rule []string) []string {
+	out := []string{cmd}
+	if rule[0] == "-t" {
+		out = append(out, rule[:2]...)
+		rule = rule[2:]
+	}
+	out = append(out, action, rule[0], "-m", "comment", "--comment", "simple-vpn")
+	return append(out, rule[1:]...)
+}
+
+// setupExit enables IP forwarding, and adds the firewall rules of an exit
+// node.  The latter are removed by teardownExit.
+func (p *Server) setupExit() error {
+	if p.relayOnly() || !p.clientDevices() {
+		return fmt.Errorf("an exit_node needs a device for each client, so cannot be used with relay_only, or client_devices = false")
+	}
+
+	tool, err := p.exitTool()
+	if err != nil {
+		return err
+	}
+
+	sysctl := "/proc/sys/net/ipv4/ip_forward"
+	if strings.Contains(p.subnet, ":") {
+		sysctl = "/proc/sys/net/ipv6/conf/all/forwarding"
+	}
+	data, err := ioutil.ReadFile(sysctl)
+	if p.Config.Get("firewall_dry_run") == "true" {
+		fmt.Printf("Not enabling IP forwarding, or adding firewall rules, as this is a dry-run.\n")
+	} else if err != nil || strings.TrimSpace(string(data)) != "1" {
+		fmt.Printf("Enabling IP forwarding.\n")
+		err = ioutil.WriteFile(sysctl, []byte("1\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to enable IP forwarding: %s", err.Error())
+		}
+	}
+
+	if tool == "nft" {
+		rules := p.exitRuleset()
+		err = rules.Apply()
+		if err != nil {
+			return err
+		}
+		p.firewall = rules
+		if !rules.DryRun {
+			p.run.setFirewall(p.network, rules.Table, nil)
+		}
+		return nil
+	}
+
+	add, remove := p.exitRules()
+	for _, cmd := range add {
+		err = cmd.run()
+		if err != nil {
+			return err
+		}
+	}
+	p.exitCleanup = remove
+	p.run.setFirewall(p.network, "", remove)
+	return nil
+}
+
+// teardownExit removes the firewall rules of an exit node, if we added
+// them.
+func (p *Server) teardownExit() {
+	if p.firewall != nil {
+		err := p.firewall.Remove()
+		if err != nil {
+			log.Printf("[S] %s", err.Error())
+		}
+		p.firewall = nil
+	}
+	for _, cmd := range p.exitCleanup {
+		err := cmd.run()
+		if err != nil {
+			log.Printf("[S] %s", err.Error())
+		}
+	}
+	p.exitCleanup = nil
+}
+
+// routeClient raises the device of a client, and routes its IP to it, so
+// that the replies to its traffic reach it.
+func (p *Server) routeClient(device string, ip string) {
+	cmds := [][]string{
+		{"ip", "link", "set", "dev", device, "up"},
+		{"ip", "route", "replace", ip, "dev", device},
+	}
+	for _, cmd := range cmds {
+		output, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+		if err != nil {
+			log.Printf("[S] Failed to run %s - %s %s", strings.Join(cmd, " "), err.Error(), strings.TrimSpace(string(output)))
+			return
+		}
+	}
+	p.run.addRoute(p.network, ip, device)
+}
@@ -0,0 +1,168 @@
+// pkg/server/export.go contains the export, and import, of the complete
+// state of a server, as a single document, so that it may be managed
+// declaratively, for example by infrastructure-as-code pipelines.
+//
+// A snapshot holds the settings of our configuration-file, and the
+// settings of each network which were changed at runtime, and persisted
+// to its `state_file`, such as leases, filter rules, and rates.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/skx/simple-vpn/config"
+)
+
+// Snapshot is the complete state of a server.
+type Snapshot struct {
+	// Settings holds the top-level settings of our configuration.
+	Settings map[string]string
+
+	// Sections holds the sections of our configuration, in order.
+	Sections []SnapshotSection `json:",omitempty"`
+
+	// State holds the settings changed at runtime, of each network
+	// which has a `state_file`, by name.  The network defined at the
+	// top-level of the configuration is "".
+	State map[string]State `json:",omitempty"`
+}
+
+// SnapshotSection is a section of our configuration.
+type SnapshotSection struct {
+	// Name is the name of the section, such as "network office".
+	Name string
+
+	// Settings holds the settings of the section.
+	Settings map[string]string
+}
+
+// Export returns the snapshot of the server with the given configuration.
+func Export(cfg *config.Reader) (*Snapshot, error) {
+	out := &Snapshot{Settings: cfg.Settings, State: make(map[string]State)}
+
+	for _, section := range cfg.Sections {
+		out.Sections = append(out.Sections, SnapshotSection{Name: section.Name, Settings: section.Settings})
+	}
+
+	for network, settings := range out.networks() {
+		path := settings["state_file"]
+		if path == "" {
+			continue
+		}
+		state, err := readState(path)
+		if err != nil {
+			return nil, err
+		}
+		out.State[network] = state
+	}
+	return out, nil
+}
+
+// networks returns the settings of each network of the snapshot, by name.
+func (s *Snapshot) networks() map[string]map[string]string {
+	out := make(map[string]map[string]string)
+	if s.Settings["key"] != "" {
+		out[""] = s.Settings
+	}
+	for _, section := range s.Sections {
+		if strings.HasPrefix(section.Name, "network ") {
+			out[strings.TrimPrefix(section.Name, "network ")] = section.Settings
+		}
+	}
+	return out
+}
+
+// Config returns the configuration of the snapshot.
+func (s *Snapshot) Config() *config.Reader {
+	out := &config.Reader{Settings: s.Settings}
+	if out.Settings == nil {
+		out.Settings = make(map[string]string)
+	}
+	for _, section := range s.Sections {
+		out.Sections = append(out.Sections, &config.Reader{Name: section.Name, Settings: section.Settings})
+	}
+	return out
+}
+
+// Validate returns an error if the snapshot can't be imported.
+func (s *Snapshot) Validate() error {
+
+	//
+	// valid checks that the given settings may be written to our
+	// configuration-file, and read back unchanged.
+	//
+	valid := func(settings map[string]string) error {
+		for key, val := range settings {
+			if key == "" || key != strings.TrimSpace(key) || strings.ContainsAny(key, "=[#\r\n") {
+				return fmt.Errorf("the setting %q has an invalid name", key)
+			}
+			if val != strings.TrimSpace(val) || strings.ContainsAny(val, "\r\n") {
+				return fmt.Errorf("the setting %s has an invalid value", key)
+			}
+		}
+		return nil
+	}
+
+	err := valid(s.Settings)
+	if err != nil {
+		return err
+	}
+	for _, section := range s.Sections {
+		fields := strings.Fields(section.Name)
+		if len(fields) != 2 || (fields[0] != "network" && fields[0] != "group") || strings.ContainsAny(section.Name, "[]") {
+			return fmt.Errorf("unknown section [%s]", section.Name)
+		}
+		err = valid(section.Settings)
+		if err != nil {
+			return fmt.Errorf("[%s]: %s", section.Name, err.Error())
+		}
+	}
+
+	networks := s.networks()
+	for network := range s.State {
+		settings, ok := networks[network]
+		if !ok {
+			return fmt.Errorf("there is state for the unknown network '%s'", network)
+		}
+		if settings["state_file"] == "" {
+			return fmt.Errorf("there is state for the network '%s', which has no state_file", network)
+		}
+	}
+	return nil
+}
+
+// Import replaces the configuration-file at the given path, and the
+// `state_file` of each network, with those of the snapshot.  A server
+// which is running applies them once it restarts, or upgrades.
+func (s *Snapshot) Import(path string) error {
+	err := s.Validate()
+	if err != nil {
+		return err
+	}
+
+	//
+	// The state is written before the configuration which refers to
+	// it, and each file is written atomically.
+	//
+	networks := s.networks()
+	for network, state := range s.State {
+		data, err := json.MarshalIndent(state.copy(), "", "  ")
+		if err != nil {
+			return err
+		}
+		file := networks[network]["state_file"]
+		err = writeAtomic(file, append(data, '\n'))
+		if err != nil {
+			return fmt.Errorf("failed to write the state to %s: %s", file, err.Error())
+		}
+	}
+
+	err = writeAtomic(path, []byte(s.Config().String()))
+	if err != nil {
+		return fmt.Errorf("failed to write the configuration to %s: %s", path, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// pkg/server/federation.go contains the code which allows several
+// VPN-servers to be linked together, forming a single VPN.
+//
+// One server connects to another as a special peer, over the same
+// websocket end-point that clients use.  The link has no network device
+// associated with it, so traffic which arrives over it is simply relayed
+// to the local clients, and vice-versa.
+//
+// Each server sends its own list of connected clients to the other, via
+// the `federate-peers` command, and includes the clients of its partners
+// in the peer-list it sends to its own clients.
+//
+// Federated servers must share a subnet, but each must allocate IPs from
+// a distinct `pool` within it.  Links must not form a loop.
+
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// federationKey returns the key which federated servers must present.
+// Federation is disabled unless it is set, as the links are trusted with
+// the names of our peers.
+func (p *Server) federationKey() string {
+	return p.Config.Get("federation_key")
+}
+
+// federatedPeer returns true if the given peer, encoded by
+// shared.EncodePeer, which a federated server sent us, may be passed on
+// to our clients.  Its name, and IP, end up in their hosts-files, and
+// our dns_file, so we're as strict with them as with our own clients.
+func (p *Server) federatedPeer(encoded string) bool {
+	peer, err := shared.DecodePeer(encoded)
+	if err != nil {
+		return false
+	}
+	if validClientName(peer.Name) != nil || net.ParseIP(peer.IP) == nil {
+		return false
+	}
+
+	//
+	// A federated server can't prove that its client presented the
+	// key of a reserved name, so it may not announce one.
+	//
+	if _, ok := p.reserved(peer.Name); ok {
+		return false
+	}
+	return true
+}
+
+// federatedPeers returns the clients of all the servers we're linked
+// with, encoded by shared.EncodePeer.
+func (p *Server) federatedPeers() []string {
+	var out []string
+
+	p.linksMutex.Lock()
+	for _, peers := range p.links {
+		out = append(out, peers...)
+	}
+	p.linksMutex.Unlock()
+
+	return out
+}
+
+// federatePeers sends the list of our local clients to each of the
+// servers we're linked with.
+func (p *Server) federatePeers() {
+	local := p.linkPeers()
+
+	p.linksMutex.Lock()
+	var links []*shared.Socket
+	for link := range p.links {
+		links = append(links, link)
+	}
+	p.linksMutex.Unlock()
+
+	for _, link := range links {
+		link.SendCommand("federate-peers", local...)
+	}
+}
+
+// linkPeers returns the list of our local clients which we send to
+// the servers we're linked with.
+//
+// We don't include ourselves, since every server has the same name.
+func (p *Server) linkPeers() []string {
+	var out []string
+	for _, peer := range p.localPeers() {
+		if peer.IP != p.serverIP {
+			out = append(out, shared.EncodePeer(peer))
+		}
+	}
+	return out
+}
+
+// serveLink handles the connection to a federated server, regardless
+// of which of us initiated it.  It returns when the link goes away.
+func (p *Server) serveLink(name string, conn *websocket.Conn) {
+
+	log.Printf("[federation] Linked with %s", name)
+
+	var socket *shared.Socket
+	socket = shared.MakeSocket("link:"+name, conn, nil,
+		//
+		// When the link goes away we forget about the
+		// clients of the remote server.
+		//
+		func(sock *shared.Socket, x string) {
+			p.linksMutex.Lock()
+			delete(p.links, socket)
+			p.linksMutex.Unlock()
+
+			log.Printf("[federation] Lost link with %s", name)
+			p.announcePeers()
+		})
+
+	socket.SetFraming(p.framing)
+	socket.SetHub(p.hub)
+
+	//
+	// The remote server tells us about its clients, which we pass on
+	// to our own clients.
+	//
+	socket.AddCommandHandler("federate-peers", func(args []string) error {
+		var peers []string
+		for _, peer := range args {
+			if peer == "" {
+				continue
+			}
+			if !p.federatedPeer(peer) {
+				log.Printf("[federation] Ignoring the invalid peer %q from %s", peer, name)
+				continue
+			}
+			peers = append(peers, peer)
+		}
+
+		p.linksMutex.Lock()
+		p.links[socket] = peers
+		p.linksMutex.Unlock()
+
+		p.announcePeers()
+		return nil
+	})
+
+	//
+	// The remote server will receive the changes to the peer-list we
+	// broadcast to all of our clients, but it has no use for them.
+	//
+	for _, command := range []string{"peer-added", "peer-removed"} {
+		socket.AddCommandHandler(command, func(args []string) error {
+			return nil
+		})
+	}
+
+	p.linksMutex.Lock()
+	p.links[socket] = nil
+	p.linksMutex.Unlock()
+
+	socket.Serve(p.ctx)
+	socket.SendCommand("federate-peers", p.linkPeers()...)
+	socket.Wait()
+}
+
+// serveFederation is the handler which is invoked when another server
+// connects to us, to form a link.
+func (p *Server) serveFederation(w http.ResponseWriter, r *http.Request) {
+
+	key := p.federationKey()
+	if key == "" || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("key")), []byte(key)) != 1 {
+		_, remote := RemoteIP(r, p.trustedProxies)
+		p.emit(EventAuthFailure, r.URL.Query().Get("name"), "", remote)
+
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Invalid/missing shared-secret"))
+		return
+	}
+
+	conn, err := p.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[federation] Error upgrading to WS: %v", err)
+		return
+	}
+	p.ws.Configure(conn)
+
+	name := r.URL.Query().Get("name")
+	if shared.ValidName(name) != nil {
+		name = "unnamed"
+	}
+	p.serveLink(name, conn)
+}
+
+// federate maintains a link to the server at the given end-point,
+// reconnecting whenever it goes away, until our context is cancelled.
+func (p *Server) federate(endPoint string) {
+
+	name := p.Config.Get("name")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+
+	uri := endPoint
+	if strings.Contains(uri, "?") {
+		uri += "&"
+	} else {
+		uri += "?"
+	}
+	uri += "federation=1"
+	uri += "&name=" + url.QueryEscape(name)
+	uri += "&key=" + url.QueryEscape(p.federationKey())
+
+	dialer := p.ws.Dialer()
+	dialer.TLSClientConfig = p.tls.Apply(nil)
+	for {
+		conn, _, err := shared.Dial(dialer, uri, nil)
+		if err != nil {
+			log.Printf("[federation] Failed to connect to %s: %v", endPoint, err)
+		} else {
+			p.ws.Configure(conn)
+			p.serveLink(endPoint, conn)
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// pkg/server/gate.go contains the gates which may reject, or flag, the
+// connections of clients by the address they come from, such as those
+// from unexpected countries, or known-bad networks.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/geoip"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// AddGate adds a gate which is consulted about each connection to every
+// network we serve, after any configured with the `geoip_` and
+// `blocklist` settings.
+//
+// This must be called before Run.
+func (p *Server) AddGate(gate shared.Gate) {
+	p.gates = append(p.gates, gate)
+}
+
+// loadGates returns the gates defined by the given configuration.
+func loadGates(cfg *config.Reader) ([]shared.Gate, error) {
+	verdict, err := shared.ParseGateVerdict(cfg.GetWithDefault("gate_action", "reject"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gate_action: %s", err.Error())
+	}
+
+	var gates []shared.Gate
+	if path := cfg.Get("geoip_database"); path != "" {
+		db, err := geoip.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %s", path, err.Error())
+		}
+		gates = append(gates, geoip.NewGate(db, shared.SplitList(cfg.Get("geoip_allow")), shared.SplitList(cfg.Get("geoip_deny")), verdict))
+	}
+	if path := cfg.Get("blocklist"); path != "" {
+		gate, err := shared.LoadBlocklist(path, verdict)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %s", path, err.Error())
+		}
+		gates = append(gates, gate)
+	}
+	return gates, nil
+}
+
+// gated consults our gates about a connection from the given client, and
+// address, and returns true if any rejected it.  Connections which are
+// flagged are reported.
+func (p *Server) gated(name string, remote string) bool {
+	ip := net.ParseIP(remote)
+	if ip == nil {
+		return false
+	}
+
+	for _, gate := range p.gates {
+		verdict, reason := gate.Check(ip)
+		switch verdict {
+		case shared.GateFlag:
+			log.Printf("[S] Flagged client %s from %s: %s", name, remote, reason)
+			p.events.emit(Event{Type: EventFlagged, Network: p.network, Name: name, Remote: remote, Message: reason})
+		case shared.GateReject:
+			log.Printf("[S] Rejected client %s from %s: %s", name, remote, reason)
+			p.events.emit(Event{Type: EventAuthFailure, Network: p.network, Name: name, Remote: remote, Message: reason})
+			return true
+		}
+	}
+	return false
+}
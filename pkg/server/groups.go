@@ -0,0 +1,127 @@
+// pkg/server/groups.go contains our support for client groups.
+//
+// Clients may be placed into a group via `group_NAME = GROUP`, and each
+// group may be given a policy in a "[group GROUP]" section, which is
+// applied to its members when they connect.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// policy holds the settings which are applied to the members of a group.
+type policy struct {
+	// name is the name of the group.
+	name string
+
+	// pool is the range from which members are allocated IPs.
+	pool *net.IPNet
+
+	// allow contains the destinations members may send traffic to.
+	// If it is empty then all destinations are permitted.
+	allow []*net.IPNet
+
+	// rate is the number of bytes per second members may send, or
+	// zero for no limit.
+	rate int
+
+	// routes contains additional routes which members should send
+	// over the VPN.
+	routes []string
+
+	// update is how members are told about a new version, if not the
+	// default.
+	update string
+}
+
+// loadPolicies parses the given "[group NAME]" sections.
+func loadPolicies(sections []*config.Reader, subnet *net.IPNet) (map[string]*policy, error) {
+	out := make(map[string]*policy)
+
+	for _, section := range sections {
+		name := strings.TrimSpace(strings.TrimPrefix(section.Name, "group"))
+		pol := &policy{name: name, rate: section.GetIntWithDefault("rate", 0), update: section.Get("update")}
+
+		if section.Get("pool") != "" {
+			var err error
+			_, pol.pool, err = net.ParseCIDR(section.Get("pool"))
+			if err != nil {
+				return nil, fmt.Errorf("group %s: invalid pool: %s", name, err.Error())
+			}
+			if !subnet.Contains(pol.pool.IP) {
+				return nil, fmt.Errorf("group %s: the pool %s is not within the subnet %s", name, pol.pool.String(), subnet.String())
+			}
+		}
+
+		var err error
+		pol.allow, err = shared.ParseNetworks(section.Get("allow"))
+		if err != nil {
+			return nil, fmt.Errorf("group %s: invalid allow entry: %s", name, err.Error())
+		}
+
+		routes, err := shared.ParseNetworks(section.Get("routes"))
+		if err != nil {
+			return nil, fmt.Errorf("group %s: invalid route: %s", name, err.Error())
+		}
+		for _, route := range routes {
+			pol.routes = append(pol.routes, route.String())
+		}
+
+		out[name] = pol
+	}
+	return out, nil
+}
+
+// policyFor returns the policy of the group the named client belongs
+// to, if any.
+func (p *Server) policyFor(name string) *policy {
+	group := p.Config.Get("group_" + name)
+	if group == "" {
+		return nil
+	}
+
+	pol := p.policies[group]
+	if pol == nil {
+		log.Printf("Client %s is in group %s, which has no policy", name, group)
+	}
+	return pol
+}
+
+// filter returns a packet-filter which enforces this policy upon the
+// traffic sent by a client.
+//
+// Traffic to the VPN-server itself is always permitted.
+func (pol *policy) filter(serverIP string) shared.Filter {
+	if len(pol.allow) == 0 && pol.rate == 0 {
+		return nil
+	}
+
+	var limiter *shared.RateLimiter
+	if pol.rate > 0 {
+		limiter = shared.NewRateLimiter(pol.rate, pol.rate)
+	}
+	server := net.ParseIP(serverIP)
+
+	return shared.FilterFunc(func(frame *shared.Frame) shared.Verdict {
+		if limiter != nil && !limiter.Allow(len(frame.Data)) {
+			return shared.Drop
+		}
+
+		if len(pol.allow) > 0 {
+			if frame.Dest == nil {
+				return shared.Drop
+			}
+			if !frame.Dest.Equal(server) && !shared.NetworksContain(pol.allow, frame.Dest) {
+				return shared.Drop
+			}
+		}
+		return shared.Accept
+	})
+}
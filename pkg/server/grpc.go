@@ -0,0 +1,290 @@
+// pkg/server/grpc.go contains the gRPC service of our admin API, which is
+// defined in admin.proto.
+//
+// gRPC is carried over HTTP/2, so the service is mounted upon the mux of
+// our admin API, and is only available when that is served over TLS.  We
+// implement the framing ourselves, rather than depending upon the gRPC
+// runtime:
+//
+//   - Each message is prefixed by a compression flag, and its length.
+//   - The result of each call is sent in the Grpc-Status, and
+//     Grpc-Message, trailers.
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// grpcPrefix is the path of our gRPC service.
+const grpcPrefix = "/simplevpn.admin.Admin/"
+
+// The gRPC status-codes we return.
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+)
+
+// grpcError is an error with a gRPC status-code.
+type grpcError struct {
+	code    int
+	message string
+}
+
+// Error returns the message of the error.
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// grpcErrorf returns an error with the given status-code.
+func grpcErrorf(code int, format string, args ...interface{}) error {
+	return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// grpcHandler returns the HTTP-handler of our gRPC service, for the given
+// networks.
+func grpcHandler(networks []*Server) http.HandlerFunc {
+
+	//
+	// selected returns the networks a request applies to.
+	//
+	selected := func(name string) ([]*Server, error) {
+		if name == "" {
+			return networks, nil
+		}
+		for _, n := range networks {
+			if n.network == name {
+				return []*Server{n}, nil
+			}
+		}
+		return nil, grpcErrorf(grpcNotFound, "unknown network '%s'", name)
+	}
+
+	//
+	// unary returns the handler of a call with a single response.
+	//
+	unary := func(call func(req *pbFields) (pbMessage, error)) func(w http.ResponseWriter, r *http.Request) error {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			req, err := readGrpcMessage(r.Body)
+			if err != nil {
+				return err
+			}
+			out, err := call(req)
+			if err != nil {
+				return err
+			}
+			return writeGrpcMessage(w, out)
+		}
+	}
+
+	methods := map[string]func(w http.ResponseWriter, r *http.Request) error{
+		"ListPeers": unary(func(req *pbFields) (pbMessage, error) {
+			nets, err := selected(req.String(1))
+			if err != nil {
+				return nil, err
+			}
+			var out pbMessage
+			for _, n := range nets {
+				for _, peer := range n.grpcPeers() {
+					out.Bytes(1, peer)
+				}
+			}
+			return out, nil
+		}),
+		"KickPeer": unary(func(req *pbFields) (pbMessage, error) {
+			nets, err := selected(req.String(1))
+			if err != nil {
+				return nil, err
+			}
+			name := req.String(2)
+			if name == "" {
+				return nil, grpcErrorf(grpcInvalidArgument, "a name is required")
+			}
+			var out pbMessage
+			for _, n := range nets {
+				socket, found := n.connectedNamed(name)
+				if found && socket != nil {
+					socket.Close()
+					out.Bool(1, true)
+				}
+			}
+			return out, nil
+		}),
+		"SetRateLimit": unary(func(req *pbFields) (pbMessage, error) {
+			nets, err := selected(req.String(1))
+			if err != nil {
+				return nil, err
+			}
+			if len(nets) != 1 {
+				return nil, grpcErrorf(grpcInvalidArgument, "a network is required")
+			}
+			n := nets[0]
+			if !n.mutable() {
+				return nil, grpcErrorf(grpcFailedPrecondition, "no state_file is configured, so changes cannot be persisted")
+			}
+			err = n.setRate(req.String(2), int(req.Int(3)))
+			if err != nil {
+				return nil, grpcErrorf(grpcInvalidArgument, "%s", err.Error())
+			}
+			return pbMessage{}, nil
+		}),
+		"StreamEvents": func(w http.ResponseWriter, r *http.Request) error {
+			req, err := readGrpcMessage(r.Body)
+			if err != nil {
+				return err
+			}
+			network := req.String(1)
+			if _, err = selected(network); err != nil {
+				return err
+			}
+			types := make(map[string]bool)
+			for _, kind := range req.Strings(2) {
+				types[kind] = true
+			}
+
+			//
+			// Every network shares the same event-bus, so we
+			// subscribe once, and filter by network.
+			//
+			events, unsubscribe := networks[0].Subscribe()
+			defer unsubscribe()
+
+			w.WriteHeader(http.StatusOK)
+			flusher, _ := w.(http.Flusher)
+			if flusher != nil {
+				flusher.Flush()
+			}
+			for {
+				select {
+				case <-r.Context().Done():
+					return nil
+				case e := <-events:
+					if network != "" && e.Network != network {
+						continue
+					}
+					if len(types) > 0 && !types[e.Type] {
+						continue
+					}
+					err = writeGrpcMessage(w, grpcEvent(e))
+					if err != nil {
+						return nil
+					}
+					if flusher != nil {
+						flusher.Flush()
+					}
+				}
+			}
+		},
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.ProtoMajor != 2 {
+			http.Error(w, "gRPC requires POST, over HTTP/2", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+
+		err := grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+		if method, ok := methods[strings.TrimPrefix(r.URL.Path, grpcPrefix)]; ok {
+			err = method(w, r)
+		}
+
+		code := grpcOK
+		message := ""
+		if err != nil {
+			code = grpcInvalidArgument
+			if e, ok := err.(*grpcError); ok {
+				code = e.code
+			}
+			message = err.Error()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", fmt.Sprintf("%d", code))
+		if message != "" {
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", message)
+		}
+	}
+}
+
+// grpcPeers returns the clients which are connected, as encoded Peer
+// messages.
+func (p *Server) grpcPeers() []pbMessage {
+	p.assignedMutex.Lock()
+	var clients []connection
+	for _, client := range p.assigned {
+		if client != nil && client.socket != nil {
+			clients = append(clients, *client)
+		}
+	}
+	p.assignedMutex.Unlock()
+
+	var out []pbMessage
+	for _, client := range clients {
+		stats := client.socket.Stats()
+		negotiated := ""
+		if client.report != nil {
+			negotiated = client.report.TLS
+		}
+
+		var peer pbMessage
+		peer.String(1, p.network)
+		peer.String(2, client.name)
+		peer.String(3, client.localIP)
+		peer.String(4, client.remoteIP)
+		peer.Int(5, client.connected.Unix())
+		peer.Strings(6, client.routes)
+		peer.Strings(7, client.tags)
+		peer.Uint(8, stats.RxBytes)
+		peer.Uint(9, stats.TxBytes)
+		peer.String(10, negotiated)
+		out = append(out, peer)
+	}
+	return out
+}
+
+// grpcEvent returns the given event, as an encoded Event message.
+func grpcEvent(e Event) pbMessage {
+	var out pbMessage
+	out.String(1, e.Type)
+	out.Int(2, e.Time.UnixNano())
+	out.String(3, e.Network)
+	out.String(4, e.Name)
+	out.String(5, e.IP)
+	out.String(6, e.Remote)
+	out.String(7, e.Message)
+	return out
+}
+
+// readGrpcMessage reads, and decodes, the single message of a request.
+func readGrpcMessage(r io.Reader) (*pbFields, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 5 || binary.BigEndian.Uint32(data[1:5]) != uint32(len(data)-5) {
+		return nil, grpcErrorf(grpcInvalidArgument, "malformed request")
+	}
+	if data[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed requests are not supported")
+	}
+	fields, err := decodeMessage(data[5:])
+	if err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "malformed request: %s", err.Error())
+	}
+	return fields, nil
+}
+
+// writeGrpcMessage writes the given message, with its prefix.
+func writeGrpcMessage(w io.Writer, msg pbMessage) error {
+	prefix := make([]byte, 5)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	_, err := w.Write(append(prefix, msg...))
+	return err
+}
@@ -0,0 +1,173 @@
+// pkg/server/ha.go contains the state-synchronization which allows two
+// VPN-servers to run as a hot-standby pair.
+//
+// Each server remembers the IP it has leased to each named client, and
+// periodically fetches the leases of its partner.  Clients which are
+// configured with both servers will fail over to the standby when the
+// active server goes away, and will be given the same IP they had before.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// lease records the IP which was assigned to a named client.
+type lease struct {
+	Name string
+	IP   string
+}
+
+// recordLease remembers the IP assigned to the given client.
+//
+// NOTE: The caller must hold the assignedMutex.
+func (p *Server) recordLease(name string, ip string) {
+	if name == "" {
+		return
+	}
+
+	// If we've reused an IP then the previous holder loses it.
+	for other, addr := range p.leases {
+		if addr == ip {
+			delete(p.leases, other)
+		}
+	}
+	p.leases[name] = ip
+	p.run.setLease(p.network, name, ip)
+}
+
+// leased returns true if the given IP is leased to any client, such
+// that we should avoid handing it out to another.
+//
+// NOTE: The caller must hold the assignedMutex.
+func (p *Server) leased(ip string) bool {
+	for _, addr := range p.leases {
+		if addr == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// haKey returns the key which must be presented to fetch our leases.  Our
+// leases are only served if it is set.
+func (p *Server) haKey() string {
+	return p.Config.Get("ha_key")
+}
+
+// checkHA checks our hot-standby settings.  The leases name every client,
+// so they're protected by a key of their own, rather than the shared-key
+// every client knows.
+func (p *Server) checkHA() error {
+	key := p.haKey()
+	if p.Config.Get("ha_partner") != "" && key == "" {
+		return fmt.Errorf("the ha_partner setting requires an ha_key")
+	}
+	if key != "" && key == p.Config.Get("key") {
+		return fmt.Errorf("the ha_key must differ from the shared-key")
+	}
+	return nil
+}
+
+// serveLeases is the HTTP-handler which returns our leases, as JSON,
+// to our partner server.
+//
+// The key is sent as a bearer token, rather than in the URL, so that it
+// doesn't appear in the logs of proxies.
+func (p *Server) serveLeases(w http.ResponseWriter, r *http.Request) {
+
+	if !bearer(r, p.haKey()) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Invalid/missing shared-secret"))
+		return
+	}
+
+	out := make([]lease, 0)
+	p.assignedMutex.Lock()
+	for name, ip := range p.leases {
+		out = append(out, lease{Name: name, IP: ip})
+	}
+	p.assignedMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// fetchLeases retrieves the leases of our partner, and merges them
+// with our own.
+//
+// Leases for clients which are currently connected to us are left
+// alone, since we're the authority for those.
+func (p *Server) fetchLeases(partner string) error {
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(partner, "/")+"/ha/leases", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.haKey())
+
+	client := p.tls.HTTPClient(10 * time.Second)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	var leases []lease
+	err = json.NewDecoder(res.Body).Decode(&leases)
+	if err != nil {
+		return err
+	}
+
+	p.assignedMutex.Lock()
+	defer p.assignedMutex.Unlock()
+
+	for _, l := range leases {
+		if p.connected(l.Name) {
+			continue
+		}
+		p.leases[l.Name] = l.IP
+	}
+	return nil
+}
+
+// connected returns true if the named client is connected to us.
+//
+// NOTE: The caller must hold the assignedMutex.
+func (p *Server) connected(name string) bool {
+	for _, client := range p.assigned {
+		if client != nil && client.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// syncLeases periodically fetches the leases of our partner server,
+// until our context is cancelled.
+func (p *Server) syncLeases(partner string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := p.fetchLeases(partner)
+		if err != nil {
+			log.Printf("[ha] Failed to fetch leases from %s: %v", partner, err)
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/skx/simple-vpn/config"
+)
+
+// TestSyncLeasesStops ensures that we stop fetching the leases of our
+// partner once our context is cancelled, as an embedded server may be
+// stopped without its process exiting.
+func TestSyncLeasesStops(t *testing.T) {
+	partner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer partner.Close()
+
+	cfg, err := config.Parse("ha_key = a-partner-secret\n")
+	if err != nil {
+		t.Fatalf("failed to parse our configuration: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Server{Config: cfg, ctx: ctx}
+
+	done := make(chan struct{})
+	go func() {
+		p.syncLeases(partner.URL, time.Hour)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("syncLeases didn't return once its context was cancelled")
+	}
+}
@@ -0,0 +1,45 @@
+// pkg/server/health.go contains the health-checks we offer to platforms,
+// such as Kubernetes, which probe us to decide whether to restart us, and
+// whether to send us new clients.
+//
+//   GET /healthz   - Liveness, which succeeds while we're serving.
+//   GET /readyz    - Readiness, which fails while we're draining every
+//                    network, or upgrading.
+
+package server
+
+import (
+	"net/http"
+)
+
+// serveLive is the handler of our liveness check.
+func serveLive(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// ready returns true if we're ready for new clients, which we are if any
+// of the given networks accepts them, so that a single network may be
+// drained without the others losing their traffic.
+func (p *Server) ready(networks []*Server) bool {
+	if p.upgradingNow() {
+		return false
+	}
+	for _, n := range networks {
+		if !n.isDraining() {
+			return true
+		}
+	}
+	return false
+}
+
+// serveReady returns the handler of our readiness check, for the given
+// networks.
+func (p *Server) serveReady(networks []*Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.ready(networks) {
+			w.Write([]byte("ok\n"))
+			return
+		}
+		http.Error(w, "not accepting new clients", http.StatusServiceUnavailable)
+	}
+}
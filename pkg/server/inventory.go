@@ -0,0 +1,124 @@
+// pkg/server/inventory.go contains our inventory of the clients which
+// have connected to us, built from the health-reports they send, so that
+// operators may see which versions, and platforms, their fleet runs.
+//
+// The inventory is held in memory, and each client remains in it after
+// it disconnects, with the time it was last seen, until we restart.
+
+package server
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// InventoryEntry describes a client which has connected to us.
+type InventoryEntry struct {
+	// Network is the name of the network the client joined.
+	Network string
+
+	// Name is the name of the client.
+	Name string
+
+	// Connected is true if the client is connected.
+	Connected bool
+
+	// LastSeen is when we last heard from the client.
+	LastSeen time.Time
+
+	// IP is the VPN IP the client was last assigned, and Remote the
+	// public IP it last connected from.
+	IP     string
+	Remote string
+
+	// Hostname, Addresses, Version, OS, and Arch, are those the client
+	// last reported.
+	Hostname  string
+	Addresses []string
+	Version   string
+	OS        string
+	Arch      string
+}
+
+// recordInventory notes that the named client has connected, with the
+// given IPs.
+func (p *Server) recordInventory(name string, ip string, remote string) {
+	p.inventoryMutex.Lock()
+	defer p.inventoryMutex.Unlock()
+
+	entry := p.inventory[name]
+	if entry == nil {
+		entry = &InventoryEntry{Network: p.network, Name: name}
+		p.inventory[name] = entry
+	}
+	entry.IP = ip
+	entry.Remote = remote
+	entry.LastSeen = time.Now()
+}
+
+// reportInventory updates the inventory of the named client with the
+// given health-report.
+func (p *Server) reportInventory(name string, report shared.Report) {
+	p.inventoryMutex.Lock()
+	defer p.inventoryMutex.Unlock()
+
+	entry := p.inventory[name]
+	if entry == nil {
+		return
+	}
+	entry.Hostname = report.Hostname
+	entry.Addresses = report.Addresses
+	entry.Version = report.Version
+	entry.OS = report.OS
+	entry.Arch = report.Arch
+	entry.LastSeen = time.Now()
+}
+
+// seenInventory notes that we last heard from the named client now, as
+// it has disconnected.
+func (p *Server) seenInventory(name string) {
+	p.inventoryMutex.Lock()
+	defer p.inventoryMutex.Unlock()
+
+	if entry := p.inventory[name]; entry != nil {
+		entry.LastSeen = time.Now()
+	}
+}
+
+// inventoryOf returns the inventory of our clients, sorted by name.
+func (p *Server) inventoryOf() []InventoryEntry {
+	p.inventoryMutex.Lock()
+	out := make([]InventoryEntry, 0, len(p.inventory))
+	for _, entry := range p.inventory {
+		out = append(out, *entry)
+	}
+	p.inventoryMutex.Unlock()
+
+	for i := range out {
+		socket, found := p.connectedNamed(out[i].Name)
+		out[i].Connected = found && socket != nil
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// writeInventoryCSV writes the given inventory as CSV, with a header.
+func writeInventoryCSV(w io.Writer, entries []InventoryEntry) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"network", "name", "connected", "last_seen", "ip", "remote", "hostname", "addresses", "version", "os", "arch"})
+
+	for _, e := range entries {
+		connected := "false"
+		if e.Connected {
+			connected = "true"
+		}
+		out.Write([]string{e.Network, e.Name, connected, e.LastSeen.UTC().Format(time.RFC3339), e.IP, e.Remote, e.Hostname, strings.Join(e.Addresses, " "), e.Version, e.OS, e.Arch})
+	}
+	out.Flush()
+	return out.Error()
+}
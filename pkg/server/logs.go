@@ -0,0 +1,61 @@
+// pkg/server/logs.go contains our handling of the warnings, and errors,
+// which clients forward to us when they've enabled `remote_log`.
+//
+// Each client's messages are appended to its own file, "NAME.log", beneath
+// the `client_logs` directory, or otherwise written to our own log.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// safeName replaces any characters in a client's name which shouldn't
+// appear in a filename.
+func safeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// clientLog records a message which the named client forwarded to us.
+func (p *Server) clientLog(name string, msg string) {
+	dir := p.Config.Get("client_logs")
+	if dir == "" {
+		log.Printf("[client %s] %s", name, msg)
+		return
+	}
+
+	//
+	// The clients of each "[network NAME]" section have their own
+	// sub-directory.
+	//
+	if p.network != "" {
+		dir = filepath.Join(dir, safeName(p.network))
+	}
+	path := filepath.Join(dir, safeName(name)+".log")
+
+	p.logMutex.Lock()
+	defer p.logMutex.Unlock()
+
+	err := os.MkdirAll(dir, 0750)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	}
+	if err != nil {
+		log.Printf("[client %s] %s", name, msg)
+		log.Printf("Failed to open %s - %s", path, err.Error())
+		return
+	}
+	fmt.Fprintf(f, "%s %s\n", time.Now().Format(time.RFC3339), msg)
+	f.Close()
+}
@@ -0,0 +1,152 @@
+// pkg/server/metrics.go contains the metrics of each client, which are
+// served by our admin API at "/metrics", in the text format of
+// Prometheus.
+//
+// The packets we drop from each client are counted by the reason we
+// dropped them, such as being malformed, or larger than the MTU.
+//
+// If `traffic_classes` is true we also count each client's traffic by
+// protocol, and by the `traffic_top_ports` ports which carried the most.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// metricHelp holds the description, and type, of each of our metrics.
+var metricHelp = []struct {
+	name string
+	kind string
+	help string
+}{
+	{"simple_vpn_clients", "gauge", "The number of connected clients."},
+	{"simple_vpn_unknown_unicast_frames_total", "counter", "The frames sent to MACs we hadn't learned, by what we did with them."},
+	{"simple_vpn_client_rx_bytes_total", "counter", "The bytes received from each client."},
+	{"simple_vpn_client_tx_bytes_total", "counter", "The bytes sent to each client."},
+	{"simple_vpn_client_rtt_seconds", "gauge", "The round-trip time to each client."},
+	{"simple_vpn_client_delay_seconds", "gauge", "The estimated one-way delay to, and from, each client, by direction."},
+	{"simple_vpn_client_jitter_seconds", "gauge", "The jitter of the one-way delay to, and from, each client, by direction."},
+	{"simple_vpn_client_dropped_packets_total", "counter", "The packets received from each client which were dropped, by reason."},
+	{"simple_vpn_client_protocol_bytes_total", "counter", "The bytes sent to, and received from, each client, by protocol."},
+	{"simple_vpn_client_protocol_packets_total", "counter", "The packets sent to, and received from, each client, by protocol."},
+	{"simple_vpn_client_port_bytes_total", "counter", "The bytes sent to, and received from, each client, upon its busiest ports."},
+	{"simple_vpn_handshakes_in_progress", "gauge", "The connections whose handshake is in progress."},
+	{"simple_vpn_handshakes_refused_total", "counter", "The connections whose handshake we refused, by reason."},
+	{"simple_vpn_connections_throttled_total", "counter", "The connections refused by our per-address throttle, by reason."},
+	{"simple_vpn_banned_addresses", "gauge", "The source addresses which are banned."},
+}
+
+// classifyTraffic returns true if we count the traffic of our clients by
+// protocol, and port.
+func (p *Server) classifyTraffic() bool {
+	return p.Config.Get("traffic_classes") == "true"
+}
+
+// labels formats the given pairs of names, and values, as the labels of
+// a metric.
+func labels(pairs ...string) string {
+	var out []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		out = append(out, fmt.Sprintf("%s=\"%s\"", pairs[i], value))
+	}
+	return "{" + strings.Join(out, ",") + "}"
+}
+
+// writeMetrics writes the metrics of the given networks.
+func writeMetrics(w io.Writer, networks []*Server) {
+	samples := make(map[string][]string)
+	add := func(name string, labels string, value interface{}) {
+		samples[name] = append(samples[name], fmt.Sprintf("%s%s %v", name, labels, value))
+	}
+
+	for _, n := range networks {
+		n.assignedMutex.Lock()
+		var clients []connection
+		for _, client := range n.assigned {
+			if client != nil && client.socket != nil {
+				clients = append(clients, *client)
+			}
+		}
+		n.assignedMutex.Unlock()
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].name < clients[j].name
+		})
+
+		add("simple_vpn_clients", labels("network", n.network), len(clients))
+		unknown := n.hub.UnknownUnicast()
+		add("simple_vpn_unknown_unicast_frames_total", labels("network", n.network, "action", "dropped"), unknown.Dropped)
+		add("simple_vpn_unknown_unicast_frames_total", labels("network", n.network, "action", "flooded"), unknown.Flooded)
+		add("simple_vpn_unknown_unicast_frames_total", labels("network", n.network, "action", "queued"), unknown.Queued)
+		add("simple_vpn_unknown_unicast_frames_total", labels("network", n.network, "action", "delivered"), unknown.Delivered)
+		top := n.Config.GetIntWithDefault("traffic_top_ports", 10)
+		for _, client := range clients {
+			l := labels("network", n.network, "name", client.name)
+			stats := client.socket.Stats()
+			add("simple_vpn_client_rx_bytes_total", l, stats.RxBytes)
+			add("simple_vpn_client_tx_bytes_total", l, stats.TxBytes)
+			add("simple_vpn_client_rtt_seconds", l, client.socket.RTT().Seconds())
+			if delays, ok := client.socket.Delays(); ok {
+				tx := labels("network", n.network, "name", client.name, "direction", "tx")
+				rx := labels("network", n.network, "name", client.name, "direction", "rx")
+				add("simple_vpn_client_delay_seconds", tx, delays.Tx.Seconds())
+				add("simple_vpn_client_delay_seconds", rx, delays.Rx.Seconds())
+				add("simple_vpn_client_jitter_seconds", tx, delays.TxJitter.Seconds())
+				add("simple_vpn_client_jitter_seconds", rx, delays.RxJitter.Seconds())
+			}
+
+			var reasons []string
+			for reason := range stats.Drops {
+				reasons = append(reasons, reason)
+			}
+			sort.Strings(reasons)
+			for _, reason := range reasons {
+				add("simple_vpn_client_dropped_packets_total", labels("network", n.network, "name", client.name, "reason", reason), stats.Drops[reason])
+			}
+
+			protocols, ports := client.socket.Classes(top)
+			for _, class := range protocols {
+				l := labels("network", n.network, "name", client.name, "protocol", class.Protocol)
+				add("simple_vpn_client_protocol_bytes_total", l, class.Bytes)
+				add("simple_vpn_client_protocol_packets_total", l, class.Packets)
+			}
+			for _, class := range ports {
+				l := labels("network", n.network, "name", client.name, "protocol", class.Protocol, "port", fmt.Sprintf("%d", class.Port))
+				add("simple_vpn_client_port_bytes_total", l, class.Bytes)
+			}
+		}
+	}
+
+	//
+	// Our handshakes are shared by every network.
+	//
+	if len(networks) > 0 && networks[0].guard != nil {
+		pending, refused := networks[0].guard.stats()
+		add("simple_vpn_handshakes_in_progress", "", pending)
+		for _, reason := range []string{"cookie", "limit", "timeout"} {
+			add("simple_vpn_handshakes_refused_total", labels("reason", reason), refused[reason])
+		}
+	}
+	if len(networks) > 0 && networks[0].throttle != nil {
+		bans, throttled := networks[0].throttle.stats()
+		add("simple_vpn_banned_addresses", "", bans)
+		for _, reason := range []string{"banned", "rate"} {
+			add("simple_vpn_connections_throttled_total", labels("reason", reason), throttled[reason])
+		}
+	}
+
+	for _, metric := range metricHelp {
+		if len(samples[metric.name]) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", metric.name, metric.kind)
+		for _, sample := range samples[metric.name] {
+			fmt.Fprintf(w, "%s\n", sample)
+		}
+	}
+}
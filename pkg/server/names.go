@@ -0,0 +1,129 @@
+// pkg/server/names.go contains the validation of the names our clients
+// connect with, and our handling of clients which connect with the name
+// of a client which is already connected.
+//
+// Usually that's the same client reconnecting before we've noticed that
+// its previous connection was lost, so by default the new connection
+// replaces the old one.  With `duplicate_names = reject` we refuse the
+// new connection instead, so that two hosts can't share a name.
+//
+// Names may also be reserved, via `reserved_names`, for infrastructure
+// hosts which other machines script against.  A reserved name may only be
+// claimed by a client which presents its own `key_NAME`, or our
+// `reserved_key`, rather than the shared key, so an ordinary client can't
+// impersonate it in the peer-list.  Federated servers may not announce a
+// reserved name at all.
+//
+// Names are compared without regard to case, since they are used as
+// hostnames by our clients.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// serverName is the name we give ourselves in the peer-list.
+const serverName = "vpn-server"
+
+// validClientName returns an error if the given name isn't one a client
+// may connect with.
+func validClientName(name string) error {
+	err := shared.ValidName(name)
+	if err == nil && strings.EqualFold(name, serverName) {
+		err = fmt.Errorf("the name %q is reserved for the server", name)
+	}
+	return err
+}
+
+// namedSettings returns the settings of the given configuration which
+// begin with the given prefix, and end with the name of a client, keyed by
+// that name in lower-case, so that they apply however a client chooses to
+// capitalise its name.  Look them up with strings.ToLower.
+func namedSettings(cfg *config.Reader, prefix string) (map[string]string, error) {
+	out := make(map[string]string)
+	for name, value := range cfg.GetPrefixed(prefix) {
+		key := strings.ToLower(name)
+		if _, ok := out[key]; ok {
+			return nil, fmt.Errorf("%s%s is set more than once, with different cases", prefix, key)
+		}
+		out[key] = value
+	}
+	return out, nil
+}
+
+// reserved returns the entry of `reserved_names` which matches the given
+// name, if any.
+func (p *Server) reserved(name string) (string, bool) {
+	for _, entry := range shared.SplitList(p.Config.Get("reserved_names")) {
+		if strings.EqualFold(entry, name) {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// clientKey returns the key the named client must present, which is the
+// shared key unless its name is reserved.  The empty string is returned
+// for a reserved name which has no key, and which nobody may claim.
+func (p *Server) clientKey(name string) string {
+	entry, ok := p.reserved(name)
+	if !ok {
+		return p.Config.Get("key")
+	}
+	return p.Config.GetWithDefault("key_"+entry, p.Config.Get("reserved_key"))
+}
+
+// reservedKeys returns the keys with which reserved names are claimed.
+func (p *Server) reservedKeys() []string {
+	var keys []string
+	for _, entry := range shared.SplitList(p.Config.Get("reserved_names")) {
+		if key := p.clientKey(entry); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// connectedNamed returns true if a client with the given name is already
+// connected, along with its socket, which is nil if it's still
+// connecting.
+func (p *Server) connectedNamed(name string) (*shared.Socket, bool) {
+	p.assignedMutex.Lock()
+	defer p.assignedMutex.Unlock()
+
+	for _, client := range p.assigned {
+		if client != nil && strings.EqualFold(client.name, name) {
+			return client.socket, true
+		}
+	}
+	return nil, false
+}
+
+// rejectDuplicates returns true if we refuse clients which connect with
+// the name of a client which is already connected.
+func (p *Server) rejectDuplicates() bool {
+	return p.Config.Get("duplicate_names") == "reject"
+}
+
+// replaceClient closes the connection of the client with the given name,
+// and waits a short while for it to be reaped, so that the client which
+// is replacing it may be given the same IP.
+func (p *Server) replaceClient(name string, socket *shared.Socket) {
+	log.Printf("[S] Client %s connected again, closing its previous connection", name)
+	socket.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, found := p.connectedNamed(name); !found {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,95 @@
+// pkg/server/negotiate.go contains our negotiation of the compression,
+// and encryption, of each client's frames.
+//
+// Clients ask for compression via the websocket extension, for
+// encryption via the `cipher` parameter, and for a hybrid key exchange,
+// which keys that encryption, via the `kex` parameter.  We agree
+// according to our policy, which may be overridden for each client:
+//
+//   ws_compression = true      compression_NAME = false
+//   encryption     = optional  encryption_NAME  = required
+//   kex            = optional  kex_NAME         = required
+//
+// Requiring a key exchange implies requiring encryption.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// clientPolicy returns the value of the given setting for the named
+// client, which may override our own.
+func (p *Server) clientPolicy(setting string, name string, fallback string) string {
+	if value := p.Config.Get(setting + "_" + name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// negotiate decides whether the frames of the named client, which
+// presented the given key, are compressed, and encrypted.
+//
+// We return the upgrader, and headers, with which to accept the client,
+// and the ciphers of its connection, if it is encrypted.  An error is
+// returned if the client refuses encryption which our policy requires.
+func (p *Server) negotiate(name string, key string, r *http.Request) (*websocket.Upgrader, http.Header, *shared.Ciphers, error) {
+	upgrader := *p.upgrader
+	upgrader.EnableCompression = p.clientPolicy("compression", name, p.Config.Get("ws_compression")) == "true"
+
+	policy := p.clientPolicy("encryption", name, p.Config.GetWithDefault("encryption", "optional"))
+	kexPolicy := p.clientPolicy("kex", name, p.Config.GetWithDefault("kex", "optional"))
+	if kexPolicy == "required" {
+		policy = "required"
+	}
+	wanted := r.URL.Query().Get("cipher")
+	switch {
+	case policy == "disabled":
+		return &upgrader, nil, nil, nil
+	case wanted == "" && policy == "required":
+		return nil, nil, nil, fmt.Errorf("encryption is required")
+	case wanted == "":
+		return &upgrader, nil, nil, nil
+	case wanted != shared.FrameCipher:
+		if policy == "required" {
+			return nil, nil, nil, fmt.Errorf("the cipher %s is not supported", wanted)
+		}
+		return &upgrader, nil, nil, nil
+	}
+
+	//
+	// Complete the key exchange the client offered, if we agree to it.
+	//
+	header := http.Header{}
+	keyed := ""
+	var secret []byte
+	offered := r.URL.Query().Get("kex") == shared.HybridKeyExchange
+	switch {
+	case offered && kexPolicy != "disabled" && shared.KeyExchangeSupported:
+		reply, s, err := shared.AcceptKeyExchange(r.URL.Query().Get("kex_offer"))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		header.Set(shared.KeyExchangeHeader, reply)
+		secret = s
+		keyed = ", keyed by " + shared.HybridKeyExchange
+	case kexPolicy == "required":
+		return nil, nil, nil, fmt.Errorf("the %s key exchange is required", shared.HybridKeyExchange)
+	}
+
+	nonce := shared.NewNonce()
+	ciphers, err := shared.NewCiphers(key, secret, r.URL.Query().Get("nonce"), nonce, true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	log.Printf("[S] Encrypting the frames of %s with %s%s", name, shared.FrameCipher, keyed)
+
+	header.Set(shared.CipherHeader, shared.FrameCipher)
+	header.Set(shared.NonceHeader, nonce)
+	return &upgrader, header, ciphers, nil
+}
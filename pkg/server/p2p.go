@@ -0,0 +1,157 @@
+// pkg/server/p2p.go contains our introduction of clients to each other,
+// so that they may exchange traffic directly rather than via us.
+//
+// Clients which enable `p2p` tell us the UDP addresses they may be
+// reached upon.  When one wishes to talk to another it asks us to
+// introduce them, and we send each the addresses of the other along
+// with a key for the pair, which they use to punch a path through any
+// NAT between them.  Traffic which cannot take a direct path continues
+// to be relayed by us.
+//
+// We also pass on the pings with which clients measure the path to each
+// other via us, so they can tell which path is better.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// maxCandidates is the number of addresses a client may tell us about.
+const maxCandidates = 16
+
+// introductionInterval is how often we'll introduce the same pair of
+// clients.
+const introductionInterval = 10 * time.Second
+
+// p2pEnabled returns true if our clients may form direct paths to each
+// other.
+//
+// Direct traffic bypasses our filters, so we never allow it if we have
+// any.
+func (p *Server) p2pEnabled() bool {
+	return p.Config.Get("p2p") == "true" && !p.hub.Filtered()
+}
+
+// setCandidates records the addresses upon which the client with the
+// given IP may be reached directly.
+func (p *Server) setCandidates(ip string, args []string) error {
+	if !p.p2pEnabled() {
+		return fmt.Errorf("direct paths are not permitted")
+	}
+	if len(args) > maxCandidates {
+		return fmt.Errorf("too many candidates")
+	}
+
+	var candidates []string
+	for _, arg := range args {
+		host, port, err := net.SplitHostPort(arg)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(port)
+		if net.ParseIP(host) == nil || err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid candidate %s", arg)
+		}
+		candidates = append(candidates, arg)
+	}
+
+	p.assignedMutex.Lock()
+	defer p.assignedMutex.Unlock()
+	if p.assigned[ip] != nil {
+		p.assigned[ip].candidates = candidates
+	}
+	return nil
+}
+
+// introduce sends the client with the given IP, and the peer it asked
+// for, the details each needs to form a direct path to the other.
+func (p *Server) introduce(ip string, args []string) error {
+	if !p.p2pEnabled() {
+		return fmt.Errorf("direct paths are not permitted")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("expected the IP of a peer")
+	}
+
+	p.assignedMutex.Lock()
+	pa, pb := p.assigned[ip], p.assigned[args[0]]
+	if pa == nil || pb == nil || pa.socket == nil || pb.socket == nil || pa == pb {
+		p.assignedMutex.Unlock()
+		return fmt.Errorf("unknown peer %s", args[0])
+	}
+	if len(pa.candidates) == 0 || len(pb.candidates) == 0 {
+		p.assignedMutex.Unlock()
+		return fmt.Errorf("%s cannot be reached directly", args[0])
+	}
+
+	//
+	// Both peers often ask at once, as each sees the other's traffic,
+	// and we must give them the same key.  So we ignore requests for a
+	// pair we've recently introduced.
+	//
+	if time.Since(pa.introduced[pb.localIP]) < introductionInterval {
+		p.assignedMutex.Unlock()
+		return nil
+	}
+	for _, c := range []*connection{pa, pb} {
+		if c.introduced == nil {
+			c.introduced = make(map[string]time.Time)
+		}
+	}
+	pa.introduced[pb.localIP] = time.Now()
+	pb.introduced[pa.localIP] = time.Now()
+	a, b := *pa, *pb
+	p.assignedMutex.Unlock()
+
+	//
+	// The policies of groups are enforced upon the traffic we relay,
+	// so their members must not bypass us.
+	//
+	if p.policyFor(a.name) != nil || p.policyFor(b.name) != nil {
+		return fmt.Errorf("direct paths are not permitted for this peer")
+	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return err
+	}
+	secret := hex.EncodeToString(key)
+
+	log.Printf("[S] Introducing %s to %s", a.name, b.name)
+	b.socket.SendCommand("p2p-offer", a.localIP, secret, strings.Join(a.candidates, ","))
+	return a.socket.SendCommand("p2p-offer", b.localIP, secret, strings.Join(b.candidates, ","))
+}
+
+// relayPing passes on a ping, or its answer, from the client with the
+// given IP to the peer it names.  The peer is told who sent it instead.
+func (p *Server) relayPing(ip string, cmd string, args []string) error {
+	if !p.p2pEnabled() {
+		return fmt.Errorf("direct paths are not permitted")
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("expected the IP of a peer, and a token")
+	}
+
+	p.assignedMutex.Lock()
+	var socket *shared.Socket
+	if p.assigned[args[0]] != nil {
+		socket = p.assigned[args[0]].socket
+	}
+	p.assignedMutex.Unlock()
+
+	if socket == nil {
+		return fmt.Errorf("unknown peer %s", args[0])
+	}
+	return socket.SendCommand(cmd, ip, args[1])
+}
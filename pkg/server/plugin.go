@@ -0,0 +1,364 @@
+// pkg/server/plugin.go contains our support for external plugins.
+//
+// Operators who cannot rebuild the server may run a plugin process,
+// which speaks JSON-RPC 2.0 over its stdin and stdout, one message per
+// line.  The plugin is sent each event as an "event" notification, and
+// may optionally be asked to authorise each client, via "auth", and to
+// decide the fate of each packet a client sends, via "filter".
+//
+// If the plugin doesn't reply in time, or has failed, then the
+// `plugin_failure` setting decides whether we allow or deny.  A plugin
+// which exits is restarted, at most every few seconds.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// pluginRestartDelay is the minimum time between starting our plugin.
+const pluginRestartDelay = 5 * time.Second
+
+// rpcRequest is a JSON-RPC request, or notification if it has no ID.
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      *uint64     `json:"id,omitempty"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// rpcResponse is a JSON-RPC response.
+type rpcResponse struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// authParams are the parameters of an "auth" request.
+type authParams struct {
+	Network string `json:"network"`
+	Name    string `json:"name"`
+	Remote  string `json:"remote"`
+}
+
+// authResult is the result of an "auth" request.
+type authResult struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// filterParams are the parameters of a "filter" request.
+type filterParams struct {
+	Network string `json:"network"`
+	Source  string `json:"source"`
+	Dest    string `json:"dest,omitempty"`
+	Data    []byte `json:"data"`
+}
+
+// filterResult is the result of a "filter" request.  If data is
+// returned it replaces the packet.
+type filterResult struct {
+	Verdict string `json:"verdict"`
+	Data    []byte `json:"data,omitempty"`
+}
+
+// plugin holds the state of our plugin process.
+type plugin struct {
+	// command is the command-line of the plugin.
+	command []string
+
+	// timeout is how long we wait for a reply.
+	timeout time.Duration
+
+	// failOpen is true if we allow, rather than deny, when the plugin
+	// fails to reply.
+	failOpen bool
+
+	// auth and filter are true if the plugin should be consulted for
+	// each client, and packet, respectively.
+	auth   bool
+	filter bool
+
+	// mutex protects the following fields.
+	mutex sync.Mutex
+
+	// stdin is the pipe to the plugin, or nil if it isn't running.
+	stdin io.WriteCloser
+
+	// cmd is the running plugin.
+	cmd *exec.Cmd
+
+	// started is when we last started the plugin.
+	started time.Time
+
+	// stopped is true once we've shut down, so the plugin must not be
+	// restarted.
+	stopped bool
+
+	// pending holds the channels awaiting each reply, by ID.
+	pending map[uint64]chan rpcResponse
+
+	// nextID is the ID of our next request.
+	nextID uint64
+}
+
+// loadPlugin creates a plugin from the settings in our configuration
+// file, or returns nil if none is configured.
+func loadPlugin(cfg *config.Reader) (*plugin, error) {
+	command := strings.Fields(cfg.Get("plugin"))
+	if len(command) == 0 {
+		return nil, nil
+	}
+
+	failure := cfg.GetWithDefault("plugin_failure", "open")
+	if failure != "open" && failure != "closed" {
+		return nil, fmt.Errorf("plugin_failure must be 'open', or 'closed'")
+	}
+
+	return &plugin{
+		command:  command,
+		timeout:  time.Duration(cfg.GetIntWithDefault("plugin_timeout", 500)) * time.Millisecond,
+		failOpen: failure == "open",
+		auth:     cfg.Get("plugin_auth") == "true",
+		filter:   cfg.Get("plugin_filter") == "true",
+		pending:  make(map[uint64]chan rpcResponse),
+	}, nil
+}
+
+// start launches the plugin, if it isn't running.  The caller must hold
+// our mutex.
+func (pl *plugin) start() error {
+	if pl.stdin != nil {
+		return nil
+	}
+	if pl.stopped || time.Since(pl.started) < pluginRestartDelay {
+		return fmt.Errorf("plugin is not running")
+	}
+	pl.started = time.Now()
+
+	cmd := exec.Command(pl.command[0], pl.command[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start plugin: %s", err.Error())
+	}
+	log.Printf("[plugin] Started %s [pid:%d]", pl.command[0], cmd.Process.Pid)
+
+	pl.cmd = cmd
+	pl.stdin = stdin
+
+	//
+	// Anything the plugin writes to stderr is logged.
+	//
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("[plugin] %s", scanner.Text())
+		}
+	}()
+
+	go pl.read(cmd, stdout)
+	return nil
+}
+
+// read delivers the replies of the plugin, until it exits.
+func (pl *plugin) read(cmd *exec.Cmd, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 4096), 4*shared.FrameSize)
+
+	for scanner.Scan() {
+		var resp rpcResponse
+		err := json.Unmarshal(scanner.Bytes(), &resp)
+		if err != nil {
+			log.Printf("[plugin] Invalid response: %s", err.Error())
+			continue
+		}
+
+		pl.mutex.Lock()
+		ch := pl.pending[resp.ID]
+		delete(pl.pending, resp.ID)
+		pl.mutex.Unlock()
+
+		if ch != nil {
+			ch <- resp
+		}
+	}
+
+	err := cmd.Wait()
+	log.Printf("[plugin] Exited: %v", err)
+
+	//
+	// Anybody waiting for a reply won't get one.
+	//
+	pl.mutex.Lock()
+	if pl.cmd == cmd {
+		pl.stdin.Close()
+		pl.stdin = nil
+		pl.cmd = nil
+	}
+	for id, ch := range pl.pending {
+		close(ch)
+		delete(pl.pending, id)
+	}
+	pl.mutex.Unlock()
+}
+
+// send writes a message to the plugin, starting it if necessary.  The
+// caller must hold our mutex.
+func (pl *plugin) send(req rpcRequest) error {
+	err := pl.start()
+	if err != nil {
+		return err
+	}
+
+	req.JSONRPC = "2.0"
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = pl.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// call invokes a method of the plugin, and waits for its result.
+func (pl *plugin) call(method string, params interface{}, result interface{}) error {
+	ch := make(chan rpcResponse, 1)
+
+	pl.mutex.Lock()
+	pl.nextID++
+	id := pl.nextID
+	pl.pending[id] = ch
+	err := pl.send(rpcRequest{ID: &id, Method: method, Params: params})
+	if err != nil {
+		delete(pl.pending, id)
+	}
+	pl.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(pl.timeout)
+	defer timer.Stop()
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return fmt.Errorf("plugin exited")
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("plugin error %d: %s", resp.Error.Code, resp.Error.Message)
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-timer.C:
+		pl.mutex.Lock()
+		delete(pl.pending, id)
+		pl.mutex.Unlock()
+		return fmt.Errorf("plugin timed out")
+	}
+}
+
+// notify sends a notification to the plugin, which doesn't reply.
+func (pl *plugin) notify(method string, params interface{}) error {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	return pl.send(rpcRequest{Method: method, Params: params})
+}
+
+// stop kills the plugin.
+func (pl *plugin) stop() {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	pl.stopped = true
+	if pl.cmd != nil {
+		pl.stdin.Close()
+		pl.cmd.Process.Kill()
+	}
+}
+
+// forward sends the events we receive to the plugin, until the given
+// context is cancelled.
+func (pl *plugin) forward(ctx context.Context, events <-chan Event) {
+	for {
+		select {
+		case e := <-events:
+			err := pl.notify("event", e)
+			if err != nil {
+				log.Printf("[plugin] Failed to send event: %s", err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// authorise asks the plugin whether the given client may connect.
+func (pl *plugin) authorise(network string, name string, remote string) (bool, string) {
+	var result authResult
+	err := pl.call("auth", authParams{Network: network, Name: name, Remote: remote}, &result)
+	if err != nil {
+		log.Printf("[plugin] auth failed for %s: %s", name, err.Error())
+		return pl.failOpen, err.Error()
+	}
+	return result.Allow, result.Reason
+}
+
+// filterFor returns a filter which asks the plugin about each packet
+// sent by the clients of the given network.
+func (pl *plugin) filterFor(network string) shared.Filter {
+	return shared.FilterFunc(func(frame *shared.Frame) shared.Verdict {
+		params := filterParams{
+			Network: network,
+			Source:  frame.Source.ClientIP(),
+			Data:    frame.Data,
+		}
+		if frame.Dest != nil {
+			params.Dest = frame.Dest.String()
+		}
+
+		var result filterResult
+		err := pl.call("filter", params, &result)
+		if err != nil {
+			if pl.failOpen {
+				return shared.Accept
+			}
+			return shared.Drop
+		}
+
+		if result.Verdict == "drop" {
+			return shared.Drop
+		}
+		if len(result.Data) > 0 {
+			frame.Data = result.Data
+		}
+		return shared.Accept
+	})
+}
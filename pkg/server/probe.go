@@ -0,0 +1,38 @@
+// pkg/server/probe.go contains our handling of probes.
+//
+// A probe is a connection which presents a valid key, but which doesn't
+// want to join the VPN, such as that made by `simple-vpn probe` to check
+// that we're reachable.  We don't assign it an IP, nor create a device,
+// but answer its in-band "echo" commands until it disconnects.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// serveProbe is the HTTP-handler for a probe, which has already been
+// authenticated.
+func (p *Server) serveProbe(w http.ResponseWriter, r *http.Request) {
+
+	conn, err := p.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("[S] Error upgrading to WS: %v", err)
+		return
+	}
+	p.ws.Configure(conn)
+
+	_, ip := RemoteIP(r, p.trustedProxies)
+	fmt.Printf("Probe from IP:%s\n", ip)
+
+	socket := shared.MakeSocket("probe:"+ip, conn, nil, nil)
+	socket.AddCommandHandler("echo", func(args []string) error {
+		return nil
+	})
+	socket.Serve(p.ctx)
+	socket.Wait()
+}
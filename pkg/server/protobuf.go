@@ -0,0 +1,160 @@
+// pkg/server/protobuf.go contains a minimal encoder, and decoder, of the
+// protocol buffers wire-format, sufficient for the messages of our gRPC
+// admin service, which are defined in admin.proto.
+//
+// Our messages only contain strings, integers, booleans, and nested
+// messages, so this is far simpler than depending upon the protobuf
+// runtime, and generated code.
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The wire-types we encode, and decode.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// pbMessage is an encoded protocol buffers message, to which fields may
+// be appended.  Fields with their default values are omitted, as proto3
+// requires.
+type pbMessage []byte
+
+// tag appends the tag of the given field.
+func (m *pbMessage) tag(field int, wire int) {
+	*m = appendVarint(*m, uint64(field<<3|wire))
+}
+
+// String appends a string field.
+func (m *pbMessage) String(field int, value string) {
+	if value == "" {
+		return
+	}
+	m.Bytes(field, []byte(value))
+}
+
+// Strings appends a repeated string field.
+func (m *pbMessage) Strings(field int, values []string) {
+	for _, value := range values {
+		m.tag(field, wireBytes)
+		*m = appendVarint(*m, uint64(len(value)))
+		*m = append(*m, value...)
+	}
+}
+
+// Bytes appends a bytes field, or an embedded message.
+func (m *pbMessage) Bytes(field int, value []byte) {
+	m.tag(field, wireBytes)
+	*m = appendVarint(*m, uint64(len(value)))
+	*m = append(*m, value...)
+}
+
+// Uint appends an unsigned integer field.
+func (m *pbMessage) Uint(field int, value uint64) {
+	if value == 0 {
+		return
+	}
+	m.tag(field, wireVarint)
+	*m = appendVarint(*m, value)
+}
+
+// Int appends a signed, but not zig-zag encoded, integer field.
+func (m *pbMessage) Int(field int, value int64) {
+	m.Uint(field, uint64(value))
+}
+
+// Bool appends a boolean field.
+func (m *pbMessage) Bool(field int, value bool) {
+	if value {
+		m.Uint(field, 1)
+	}
+}
+
+// appendVarint appends the given value, as a varint.
+func appendVarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	return append(buf, tmp[:n]...)
+}
+
+// pbFields holds the fields of a decoded message, by number.  Integers
+// are held in ints, and strings, and embedded messages, in strings.
+// Each holds every value of a field, for repeated fields.
+type pbFields struct {
+	ints    map[int][]uint64
+	strings map[int][]string
+}
+
+// decodeMessage decodes the given message.
+func decodeMessage(data []byte) (*pbFields, error) {
+	out := &pbFields{ints: make(map[int][]uint64), strings: make(map[int][]string)}
+
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("malformed tag")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case wireVarint:
+			value, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, fmt.Errorf("malformed varint in field %d", field)
+			}
+			data = data[n:]
+			out.ints[field] = append(out.ints[field], value)
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, fmt.Errorf("malformed length in field %d", field)
+			}
+			data = data[n:]
+			out.strings[field] = append(out.strings[field], string(data[:length]))
+			data = data[length:]
+		case 1:
+			if len(data) < 8 {
+				return nil, fmt.Errorf("truncated field %d", field)
+			}
+			data = data[8:]
+		case 5:
+			if len(data) < 4 {
+				return nil, fmt.Errorf("truncated field %d", field)
+			}
+			data = data[4:]
+		default:
+			return nil, fmt.Errorf("unsupported wire-type in field %d", field)
+		}
+	}
+	return out, nil
+}
+
+// String returns the last value of the given string field, or the empty
+// string if it wasn't present.
+func (f *pbFields) String(field int) string {
+	values := f.strings[field]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// Strings returns every value of the given repeated string field.
+func (f *pbFields) Strings(field int) []string {
+	return f.strings[field]
+}
+
+// Int returns the last value of the given integer field, or zero if it
+// wasn't present.
+func (f *pbFields) Int(field int) int64 {
+	values := f.ints[field]
+	if len(values) == 0 {
+		return 0
+	}
+	return int64(values[len(values)-1])
+}
@@ -0,0 +1,80 @@
+// pkg/server/provision.go contains our provisioning of clients.
+//
+// Each file "TOKEN.cfg" within the `provision_dir` directory holds the
+// configuration of a client, which it may download, signed with our
+// provisioning key, from `/provision?token=TOKEN`.  Removing the file
+// revokes the token.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+
+	"github.com/skx/simple-vpn/pkg/provision"
+)
+
+// validToken matches the tokens we accept, which may not name files
+// outside our directory.
+var validToken = regexp.MustCompile("^[A-Za-z0-9_-]{16,}$")
+
+// provisioningKey returns our provisioning key, which is created if it
+// is missing, or nil if provisioning is disabled.
+func (p *Server) provisioningKey() (*ecdsa.PrivateKey, error) {
+	dir := p.Config.Get("provision_dir")
+	if dir == "" {
+		return nil, nil
+	}
+
+	path := p.Config.GetWithDefault("provision_key", filepath.Join(dir, "provision.key"))
+	key, err := provision.LoadKey(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load our provisioning key: %s", err.Error())
+	}
+	fingerprint, err := provision.Fingerprint(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[S] Provisioning clients from %s, with the key %s", dir, fingerprint)
+	return key, nil
+}
+
+// serveProvision returns the handler which gives clients their signed
+// configuration, when they present a valid token.
+func (p *Server) serveProvision(key *ecdsa.PrivateKey) http.HandlerFunc {
+	dir := p.Config.Get("provision_dir")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		remote, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+		token := r.FormValue("token")
+		if !validToken.MatchString(token) {
+			http.Error(w, "invalid token", http.StatusForbidden)
+			return
+		}
+		cfg, err := ioutil.ReadFile(filepath.Join(dir, token+".cfg"))
+		if err != nil {
+			log.Printf("[S] Refused to provision %s, with an unknown token", remote)
+			http.Error(w, "invalid token", http.StatusForbidden)
+			return
+		}
+
+		signed, err := provision.Sign(key, cfg)
+		if err != nil {
+			log.Printf("[S] Failed to sign the configuration of the token %s...: %s", token[:8], err.Error())
+			http.Error(w, "failed to sign the configuration", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("[S] Provisioned %s with the token %s...", remote, token[:8])
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(signed)
+	}
+}
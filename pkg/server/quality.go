@@ -0,0 +1,235 @@
+// pkg/server/quality.go contains our tracking of the quality of each
+// client's link.
+//
+// Every `quality_interval` seconds we sample the loss, round-trip time,
+// and throughput of each client, along with the number of times it has
+// reconnected in the past hour, and keep the most recent samples.  If a
+// sample crosses any of the thresholds we've been given we log a warning,
+// emit a link-degraded event, and POST it to the `quality_webhook`, and
+// do the same when the link recovers:
+//
+//   quality_loss       = 10     (percent of pings unanswered)
+//   quality_rtt        = 500    (milliseconds)
+//   quality_reconnects = 5      (per hour)
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// qualityHistory is the number of samples we keep of each client.
+const qualityHistory = 60
+
+// QualitySample is a measurement of the quality of a client's link.
+type QualitySample struct {
+	// Time is when the sample was taken.
+	Time time.Time
+
+	// Loss is the percentage of our pings which went unanswered.
+	Loss float64
+
+	// RTT is the round-trip time to the client, in milliseconds.
+	RTT float64
+
+	// RxRate, and TxRate, are the bytes per second we received from,
+	// and sent to, the client.
+	RxRate float64
+	TxRate float64
+
+	// Reconnects is the number of times the client reconnected in the
+	// past hour.
+	Reconnects int
+}
+
+// linkQuality is the history of a client's link.
+type linkQuality struct {
+	// connects holds the times the client connected, in the past hour.
+	connects []time.Time
+
+	// socket is the connection we last sampled, and last its counters,
+	// at the time of the last sample.
+	socket *shared.Socket
+	last   shared.Stats
+	at     time.Time
+
+	// samples holds our most recent samples, oldest first.
+	samples []QualitySample
+
+	// degraded is true while the link is below our thresholds.
+	degraded bool
+}
+
+// recordConnect notes that the named client has connected.
+func (p *Server) recordConnect(name string) {
+	p.qualityMutex.Lock()
+	defer p.qualityMutex.Unlock()
+
+	q := p.quality[name]
+	if q == nil {
+		q = &linkQuality{}
+		p.quality[name] = q
+	}
+	q.connects = append(q.connects, time.Now())
+}
+
+// sampleQuality takes a sample of each connected client's link, and
+// raises, or clears, alerts for those which cross our thresholds.
+func (p *Server) sampleQuality() {
+	p.assignedMutex.Lock()
+	var clients []connection
+	for _, client := range p.assigned {
+		if client != nil && client.socket != nil {
+			clients = append(clients, *client)
+		}
+	}
+	p.assignedMutex.Unlock()
+
+	now := time.Now()
+	connected := make(map[string]bool)
+
+	p.qualityMutex.Lock()
+	var alerts []Event
+	for _, client := range clients {
+		connected[client.name] = true
+		q := p.quality[client.name]
+		if q == nil {
+			q = &linkQuality{}
+			p.quality[client.name] = q
+		}
+
+		//
+		// The first sample of each connection only records its
+		// counters, which the next is measured against.
+		//
+		stats := client.socket.Stats()
+		if q.socket != client.socket {
+			q.socket = client.socket
+			q.last = stats
+			q.at = now
+			continue
+		}
+
+		sample := QualitySample{
+			Time:       now,
+			RTT:        float64(client.socket.RTT()) / float64(time.Millisecond),
+			Reconnects: q.reconnects(now),
+		}
+		if pings := stats.Pings - q.last.Pings; pings > 0 {
+			sample.Loss = 100 * float64(stats.MissedPongs-q.last.MissedPongs) / float64(pings)
+		}
+		if secs := now.Sub(q.at).Seconds(); secs > 0 {
+			sample.RxRate = float64(stats.RxBytes-q.last.RxBytes) / secs
+			sample.TxRate = float64(stats.TxBytes-q.last.TxBytes) / secs
+		}
+		q.last = stats
+		q.at = now
+
+		q.samples = append(q.samples, sample)
+		if len(q.samples) > qualityHistory {
+			q.samples = q.samples[len(q.samples)-qualityHistory:]
+		}
+
+		//
+		// Alert when the link degrades, and again when it recovers.
+		//
+		problems := p.qualityProblems(sample)
+		switch {
+		case len(problems) > 0 && !q.degraded:
+			q.degraded = true
+			log.Printf("[S] The link of client %s has degraded: %s", client.name, strings.Join(problems, ", "))
+			alerts = append(alerts, Event{Type: EventLinkDegraded, Network: p.network, Name: client.name, IP: client.localIP, Remote: client.remoteIP, Message: strings.Join(problems, ", ")})
+		case len(problems) == 0 && q.degraded:
+			q.degraded = false
+			log.Printf("[S] The link of client %s has recovered", client.name)
+			alerts = append(alerts, Event{Type: EventLinkRecovered, Network: p.network, Name: client.name, IP: client.localIP, Remote: client.remoteIP})
+		}
+	}
+
+	//
+	// We remember the connections of absent clients for an hour, so
+	// that their reconnects are counted.
+	//
+	for name, q := range p.quality {
+		if !connected[name] {
+			q.socket = nil
+			if q.reconnects(now); len(q.connects) == 0 {
+				delete(p.quality, name)
+			}
+		}
+	}
+	p.qualityMutex.Unlock()
+
+	for _, alert := range alerts {
+		alert.Time = now
+		p.events.emit(alert)
+		if hook := p.Config.Get("quality_webhook"); hook != "" {
+			go p.postWebhook(hook, alert)
+		}
+	}
+}
+
+// reconnects returns the number of times the client reconnected in the
+// hour before the given time, forgetting any earlier connections.
+func (q *linkQuality) reconnects(now time.Time) int {
+	for len(q.connects) > 0 && now.Sub(q.connects[0]) > time.Hour {
+		q.connects = q.connects[1:]
+	}
+	if len(q.connects) < 2 {
+		return 0
+	}
+	return len(q.connects) - 1
+}
+
+// qualityProblems returns a description of each of our thresholds which
+// the given sample crosses.
+func (p *Server) qualityProblems(sample QualitySample) []string {
+	var problems []string
+	if limit := p.Config.GetIntWithDefault("quality_loss", 0); limit > 0 && sample.Loss > float64(limit) {
+		problems = append(problems, fmt.Sprintf("loss %.0f%% exceeds %d%%", sample.Loss, limit))
+	}
+	if limit := p.Config.GetIntWithDefault("quality_rtt", 0); limit > 0 && sample.RTT > float64(limit) {
+		problems = append(problems, fmt.Sprintf("round-trip time %.0fms exceeds %dms", sample.RTT, limit))
+	}
+	if limit := p.Config.GetIntWithDefault("quality_reconnects", 0); limit > 0 && sample.Reconnects > limit {
+		problems = append(problems, fmt.Sprintf("%d reconnects in the past hour exceeds %d", sample.Reconnects, limit))
+	}
+	return problems
+}
+
+// qualityOf returns the samples of each client, by name.
+func (p *Server) qualityOf() map[string][]QualitySample {
+	p.qualityMutex.Lock()
+	defer p.qualityMutex.Unlock()
+
+	out := make(map[string][]QualitySample)
+	for name, q := range p.quality {
+		if len(q.samples) > 0 {
+			out[name] = append([]QualitySample(nil), q.samples...)
+		}
+	}
+	return out
+}
+
+// postWebhook POSTs the given event, as JSON, to the given URL.
+func (p *Server) postWebhook(url string, e Event) {
+	data, _ := json.Marshal(e)
+
+	client := p.tls.HTTPClient(10 * time.Second)
+	res, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Printf("[S] Failed to deliver the %s event to %s: %s", e.Type, url, err.Error())
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		log.Printf("[S] Failed to deliver the %s event to %s: %s", e.Type, url, res.Status)
+	}
+}
@@ -0,0 +1,80 @@
+// pkg/server/ra.go contains the configuration of the IPv6 router
+// advertisements we send to the clients of a network.
+//
+// If `ra` is true we advertise the IPv6 `ra_prefix`, which defaults to our
+// subnet, with the `ra_managed`, and `ra_other`, flags, and the DNS servers
+// of `ra_dns`, and search domains of `ra_search`, every `ra_interval`
+// seconds.  If `ra_default` is true clients may route their traffic via
+// us, as their default router.
+//
+// Advertisements are Ethernet frames, so need ethernet framing.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// maxRouterLifetime is the longest a router may be advertised as a
+// default router, per RFC 4861.
+const maxRouterLifetime = 9000 * time.Second
+
+// routerAdvertisement returns the router advertisements we send, or nil
+// if we don't send any.
+func (p *Server) routerAdvertisement() (*shared.RouterAdvertisement, error) {
+	if p.Config.Get("ra") != "true" {
+		return nil, nil
+	}
+	if p.framing != shared.FramingEthernet {
+		return nil, fmt.Errorf("router advertisements are Ethernet frames, so ra needs ethernet framing")
+	}
+
+	ra := &shared.RouterAdvertisement{
+		Managed:  p.Config.Get("ra_managed") == "true",
+		Other:    p.Config.Get("ra_other") == "true",
+		MTU:      p.MTU,
+		Interval: time.Duration(p.Config.GetIntWithDefault("ra_interval", 200)) * time.Second,
+	}
+	if ra.Interval < 4*time.Second || ra.Interval > 1800*time.Second {
+		return nil, fmt.Errorf("the ra_interval must be between 4 and 1800 seconds")
+	}
+
+	prefix := p.Config.GetWithDefault("ra_prefix", p.subnet)
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil || network.IP.To4() != nil {
+		return nil, fmt.Errorf("the ra_prefix %q is not an IPv6 network; set it if our subnet is IPv4", prefix)
+	}
+	ra.Prefix = network
+
+	if p.Config.Get("ra_default") == "true" {
+		if p.relayOnly() {
+			return nil, fmt.Errorf("ra_default needs a device to route traffic, so cannot be used when relaying only")
+		}
+		ra.Lifetime = 3 * ra.Interval
+		if ra.Lifetime > maxRouterLifetime {
+			ra.Lifetime = maxRouterLifetime
+		}
+	}
+
+	for _, str := range shared.SplitList(p.Config.Get("ra_dns")) {
+		ip := net.ParseIP(str)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("the ra_dns server %q is not an IPv6 address", str)
+		}
+		ra.DNS = append(ra.DNS, ip)
+	}
+	for _, domain := range shared.SplitList(p.Config.Get("ra_search")) {
+		for _, label := range strings.Split(strings.Trim(domain, "."), ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("the ra_search domain %q is not valid", domain)
+			}
+		}
+		ra.Search = append(ra.Search, domain)
+	}
+	return ra, nil
+}
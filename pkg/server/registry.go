@@ -0,0 +1,88 @@
+// pkg/server/registry.go contains our registration in the catalog of
+// Consul, or etcd, so that clients may discover us there.
+//
+// We're registered as healthy while we're ready for new clients, and as
+// unhealthy while we're draining.  When we shut down we're removed,
+// unless we're upgrading, in which case our successor takes over our
+// registration.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/skx/simple-vpn/pkg/registry"
+)
+
+// startRegistration registers us in the catalog given by our `registry`
+// setting, if any, and keeps our entry up to date until the returned
+// function is called, which also removes it.
+func (p *Server) startRegistration(networks []*Server) (func(), error) {
+	spec := p.Config.Get("registry")
+	if spec == "" {
+		return func() {}, nil
+	}
+
+	catalog, err := registry.New(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	service := registry.Service{
+		Name: p.Config.GetWithDefault("registry_service", "simple-vpn"),
+		ID:   p.Config.Get("registry_id"),
+		URL:  p.Config.Get("registry_url"),
+		TTL:  time.Duration(p.Config.GetIntWithDefault("registry_ttl", 30)) * time.Second,
+	}
+	if service.URL == "" {
+		return nil, fmt.Errorf("registry_url must be set to the URL our clients connect to")
+	}
+	if service.ID == "" {
+		service.ID, _ = os.Hostname()
+	}
+	if service.TTL < 3*time.Second {
+		return nil, fmt.Errorf("registry_ttl must be at least three seconds")
+	}
+
+	update := func() {
+		err := catalog.Register(service, p.ready(networks))
+		if err != nil {
+			log.Printf("[S] Failed to update our registration in %s: %s", spec, err.Error())
+		}
+	}
+	update()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(service.TTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if p.upgradingNow() {
+					return
+				}
+				update()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		if p.upgradingNow() {
+			return
+		}
+		err := catalog.Deregister(service)
+		if err != nil {
+			log.Printf("[S] Failed to remove our registration from %s: %s", spec, err.Error())
+		}
+	}, nil
+}
@@ -0,0 +1,211 @@
+// pkg/server/remote.go contains our discovery of the address each client
+// connected from, which may be hidden behind one or more reverse-proxies.
+//
+// Proxies record the addresses they received each request from in either
+// the RFC 7239 `Forwarded` header, or the older `X-Forwarded-For` header.
+// Either may contain IPv6 addresses, which are bracketed when they carry
+// a port, so we strip ports before parsing each address.  We only believe
+// those headers when the connection came from one of our trusted proxies,
+// or over one of our unix-domain sockets if "unix" is listed among them.
+// Any local user may be able to reach those, so they aren't trusted by
+// default.
+//
+// We only read the header our proxies write.  A proxy appends to the one
+// it uses, and passes the other through untouched, so a client could put
+// whatever it liked in that.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// The headers in which our proxies may record the addresses of clients.
+const (
+	headerForwarded    = "forwarded"
+	headerForwardedFor = "x-forwarded-for"
+	defaultProxyHeader = headerForwardedFor
+)
+
+// Proxies describes the reverse-proxies whose forwarding headers we
+// believe.
+type Proxies struct {
+	// Networks holds the addresses of our proxies.
+	Networks []*net.IPNet
+
+	// Header is the header in which they record the addresses of our
+	// clients, either "forwarded" or "x-forwarded-for".
+	Header string
+
+	// Unix is true if connections over our unix-domain sockets come
+	// from a trusted proxy.
+	Unix bool
+}
+
+// ParseProxies returns the Proxies of the given list of IPs, or CIDR
+// ranges, which record clients in the given header.  The header defaults
+// to X-Forwarded-For if it is empty.  The list may include "unix", to
+// trust connections over our unix-domain sockets.
+func ParseProxies(list string, header string) (*Proxies, error) {
+	header = strings.ToLower(strings.TrimSpace(header))
+	if header == "" {
+		header = defaultProxyHeader
+	}
+	if header != headerForwarded && header != headerForwardedFor {
+		return nil, fmt.Errorf("the proxy_header must be forwarded, or x-forwarded-for, not %q", header)
+	}
+
+	proxies := &Proxies{Header: header}
+	var addresses []string
+	for _, entry := range shared.SplitList(list) {
+		if strings.EqualFold(entry, "unix") {
+			proxies.Unix = true
+		} else {
+			addresses = append(addresses, entry)
+		}
+	}
+
+	var err error
+	proxies.Networks, err = shared.ParseNetworks(strings.Join(addresses, ","))
+	if err != nil {
+		return nil, err
+	}
+	return proxies, nil
+}
+
+// RemoteIP retrieves the remote IP address of the requesting HTTP-client.
+//
+// This is used for logging, and storing the remote (public) IP of each
+// connecting client.
+//
+// We return both the raw address which connected to us, and the derived
+// address of the client.  These only differ if the connection came from
+// one of the given trusted proxies, in which case the header they write
+// is used to find the real client.  A nil Proxies trusts nobody.
+func RemoteIP(request *http.Request, trusted *Proxies) (string, string) {
+	raw := remoteAddr(request)
+
+	//
+	// If the connection didn't come from a trusted proxy then we
+	// ignore the forwarding headers, as they might be spoofed.
+	//
+	if !fromProxy(request, raw, trusted) {
+		return raw, raw
+	}
+
+	//
+	// Each proxy appends the address it received the request from, so
+	// we walk the header backwards until we find the first address which
+	// isn't one of our proxies.
+	//
+	address := raw
+	entries := forwardedFor(request, trusted.Header)
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip := net.ParseIP(entries[i])
+		if ip == nil {
+			break
+		}
+
+		address = ip.String()
+		if !shared.NetworksContain(trusted.Networks, ip) {
+			break
+		}
+	}
+	return raw, address
+}
+
+// RemoteChain returns every address the given request passed through, as
+// recorded by its proxies, from the client to the proxy which connected
+// to us.  It returns nil unless the connection came from one of the given
+// trusted proxies.
+//
+// Entries beyond the first address which isn't a trusted proxy might be
+// forged, so this is only suitable for logging.
+func RemoteChain(request *http.Request, trusted *Proxies) []string {
+	raw := remoteAddr(request)
+	if !fromProxy(request, raw, trusted) {
+		return nil
+	}
+	if raw == "" {
+		raw = "unix"
+	}
+	return append(forwardedFor(request, trusted.Header), raw)
+}
+
+// fromProxy returns true if the given request, which came from the given
+// address, was made by a proxy whose forwarding headers we believe.  That
+// is one of the given trusted proxies, or anything connecting over a
+// unix-domain socket if they include "unix".
+func fromProxy(request *http.Request, raw string, trusted *Proxies) bool {
+	if trusted == nil {
+		return false
+	}
+	if local, ok := request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && local.Network() == "unix" {
+		return trusted.Unix
+	}
+	ip := net.ParseIP(raw)
+	return ip != nil && shared.NetworksContain(trusted.Networks, ip)
+}
+
+// remoteAddr returns the address which connected to us, without its
+// port, or the empty string if it wasn't an IP, as with unix sockets.
+func remoteAddr(request *http.Request) string {
+	raw := stripPort(request.RemoteAddr)
+	if net.ParseIP(raw) == nil {
+		return ""
+	}
+	return raw
+}
+
+// forwardedFor returns the addresses recorded in the given header of the
+// given request, by the proxies it passed through, oldest first, without
+// their ports.  The header is either the RFC 7239 `Forwarded` header, or
+// `X-Forwarded-For`.
+//
+// Addresses which proxies chose to hide, such as "unknown", are returned
+// as they are, and aren't valid IPs.
+func forwardedFor(request *http.Request, header string) []string {
+	var out []string
+
+	if header == headerForwarded {
+		for _, value := range request.Header["Forwarded"] {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					eq := strings.Index(pair, "=")
+					if eq < 0 || !strings.EqualFold(strings.TrimSpace(pair[:eq]), "for") {
+						continue
+					}
+					address := strings.Trim(strings.TrimSpace(pair[eq+1:]), "\"")
+					out = append(out, stripPort(address))
+				}
+			}
+		}
+		return out
+	}
+
+	for _, value := range request.Header["X-Forwarded-For"] {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				out = append(out, stripPort(entry))
+			}
+		}
+	}
+	return out
+}
+
+// stripPort removes the port, if any, from the given address, along with
+// the brackets around an IPv6 literal.
+//
+//	1.2.3.4:80 -> 1.2.3.4     [2001:db8::1]:80 -> 2001:db8::1
+//	1.2.3.4    -> 1.2.3.4     2001:db8::1      -> 2001:db8::1
+func stripPort(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+}
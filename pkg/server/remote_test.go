@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRemoteIPUnixSocket ensures that the forwarding headers of requests
+// made over a unix-domain socket are believed only if our trusted proxies
+// include "unix", as any local user might be able to reach it.
+func TestRemoteIPUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatalf("failed to create a directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "svpn.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen upon %s: %s", path, err)
+	}
+
+	var trusted *Proxies
+	found := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, address := RemoteIP(r, trusted)
+		found <- address
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+		DisableKeepAlives: true,
+	}}
+
+	tests := []struct {
+		proxies  string
+		expected string
+	}{
+		{"127.0.0.0/8, ::1", ""},
+		{"127.0.0.0/8, ::1, unix", "203.0.113.5"},
+		{"UNIX", "203.0.113.5"},
+	}
+	for _, test := range tests {
+		trusted, err = ParseProxies(test.proxies, "")
+		if err != nil {
+			t.Fatalf("failed to parse %q: %s", test.proxies, err)
+		}
+
+		req, _ := http.NewRequest("GET", "http://vpn/", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.5")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make our request: %s", err)
+		}
+		res.Body.Close()
+
+		if address := <-found; address != test.expected {
+			t.Errorf("with proxies %q expected %q, got %q", test.proxies, test.expected, address)
+		}
+	}
+}
+
+// TestRemoteIPUntrusted ensures that the forwarding headers of requests
+// from other addresses are ignored.
+func TestRemoteIPUntrusted(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://vpn/", nil)
+	req.RemoteAddr = "198.51.100.7:4321"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+
+	trusted, _ := ParseProxies("127.0.0.0/8", "")
+	raw, address := RemoteIP(req, trusted)
+	if raw != "198.51.100.7" || address != "198.51.100.7" {
+		t.Errorf("expected the connecting address, got %q and %q", raw, address)
+	}
+}
+
+// TestRemoteIPSpoofed ensures that clients can't choose their address by
+// sending the forwarding header our proxy doesn't write, or by prefixing
+// the one it does.
+func TestRemoteIPSpoofed(t *testing.T) {
+	tests := []struct {
+		header    string
+		forwarded string
+		xff       string
+		expected  string
+	}{
+		// nginx appends to X-Forwarded-For, and passes Forwarded on.
+		{"", "for=203.0.113.99", "127.0.0.1, 198.51.100.7", "198.51.100.7"},
+		{"x-forwarded-for", "for=203.0.113.99", "198.51.100.7", "198.51.100.7"},
+		{"x-forwarded-for", "", "203.0.113.99, 198.51.100.7", "198.51.100.7"},
+
+		// A proxy which writes Forwarded passes X-Forwarded-For on.
+		{"forwarded", "for=198.51.100.7", "203.0.113.99", "198.51.100.7"},
+		{"forwarded", "for=203.0.113.99, for=\"[2001:db8::7]:4711\"", "", "2001:db8::7"},
+		{"forwarded", "for=203.0.113.99;proto=https, for=198.51.100.7", "", "198.51.100.7"},
+
+		// Without the header our proxy writes we have only its address.
+		{"forwarded", "", "203.0.113.99", "127.0.0.1"},
+	}
+
+	for _, test := range tests {
+		trusted, err := ParseProxies("127.0.0.0/8", test.header)
+		if err != nil {
+			t.Fatalf("failed to parse our proxies: %s", err)
+		}
+
+		req, _ := http.NewRequest("GET", "http://vpn/", nil)
+		req.RemoteAddr = "127.0.0.1:4321"
+		if test.forwarded != "" {
+			req.Header.Set("Forwarded", test.forwarded)
+		}
+		if test.xff != "" {
+			req.Header.Set("X-Forwarded-For", test.xff)
+		}
+
+		_, address := RemoteIP(req, trusted)
+		if address != test.expected {
+			t.Errorf("with %q, Forwarded %q, and X-Forwarded-For %q, expected %q, got %q", test.header, test.forwarded, test.xff, test.expected, address)
+		}
+	}
+}
+
+// TestParseProxies ensures that we only accept the headers we know.
+func TestParseProxies(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+		valid    bool
+	}{
+		{"", "x-forwarded-for", true},
+		{"X-Forwarded-For", "x-forwarded-for", true},
+		{" forwarded ", "forwarded", true},
+		{"x-real-ip", "", false},
+	}
+
+	for _, test := range tests {
+		trusted, err := ParseProxies("10.0.0.5", test.header)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result for %q: %v", test.header, err)
+			continue
+		}
+		if err == nil && trusted.Header != test.expected {
+			t.Errorf("expected %q for %q, got %q", test.expected, test.header, trusted.Header)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+// pkg/server/runstate.go contains our record of the changes we've made
+// to the host, so that if we crash the next run may clean up after us.
+//
+// If `run_file` is set, at the top-level of our configuration, we record
+// there the device of each network, the routes to its clients, the
+// firewall rules we added, and the leases we've given out.  The file is
+// removed when we shut down cleanly, so if it exists when we start we
+// crashed, and before creating anything we:
+//
+//   * Delete the devices left behind, unless they're persistent.
+//   * Delete the routes to our clients.
+//   * Remove the nftables table, or iptables rules, we added.
+//   * Remember the leases, so that clients get their addresses back.
+//
+// A run_file which belongs to a process which is still running is
+// refused, unless that process is the one we're upgrading from, in which
+// case we carry on from its record.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/skx/simple-vpn/pkg/firewall"
+)
+
+// RunState is the record of the changes we've made to the host.
+type RunState struct {
+	// PID is the process which made the changes, and Started is when
+	// it started.
+	PID     int
+	Started time.Time
+
+	// Networks holds the changes made for each network, by name.
+	Networks map[string]*NetworkRunState
+}
+
+// NetworkRunState is the record of the changes we've made to the host for
+// a single network.
+type NetworkRunState struct {
+	// Device is the name of the device of the network, and Persistent
+	// is true if it isn't ours to delete.
+	Device     string `json:",omitempty"`
+	Persistent bool   `json:",omitempty"`
+
+	// Routes holds the device each client's IP is routed to, by IP.
+	Routes map[string]string `json:",omitempty"`
+
+	// Table is the nftables table we added, if any, and IPTables holds
+	// the commands which remove the iptables rules we added.
+	Table    string     `json:",omitempty"`
+	IPTables [][]string `json:",omitempty"`
+
+	// Leases holds the IP we gave each client, by name.
+	Leases map[string]string `json:",omitempty"`
+}
+
+// runState records our changes to the host in our run_file.
+type runState struct {
+	// path is our run_file, which is empty if we don't keep a record.
+	path string
+
+	// state is our record, and recovered holds the leases we recovered
+	// from a run which crashed, by network.
+	state     RunState
+	recovered map[string]map[string]string
+
+	// mutex protects state, and recovered.
+	mutex sync.Mutex
+}
+
+// openRunState opens the given run_file, cleaning up after the run which
+// wrote it, if it crashed.  If we're upgrading from that run we carry on
+// from its record instead.
+func openRunState(path string, upgrading bool) (*runState, error) {
+	r := &runState{
+		path:      path,
+		state:     RunState{PID: os.Getpid(), Started: time.Now(), Networks: make(map[string]*NetworkRunState)},
+		recovered: make(map[string]map[string]string),
+	}
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, r.save()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read our run_file: %s", err.Error())
+	}
+
+	var previous RunState
+	err = json.Unmarshal(data, &previous)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse our run_file %s: %s", path, err.Error())
+	}
+
+	if upgrading {
+		for name, n := range previous.Networks {
+			r.state.Networks[name] = n
+		}
+		return r, r.save()
+	}
+	if previous.PID != os.Getpid() && processAlive(previous.PID) {
+		return nil, fmt.Errorf("the run_file %s belongs to process %d, which is still running; remove it if that process isn't another simple-vpn", path, previous.PID)
+	}
+
+	log.Printf("WARNING: Our previous run, process %d, didn't shut down cleanly, removing what it left behind", previous.PID)
+	for name, n := range previous.Networks {
+		n.cleanup()
+		if len(n.Leases) > 0 {
+			r.recovered[name] = n.Leases
+			r.state.Networks[name] = &NetworkRunState{Leases: n.Leases}
+		}
+	}
+	return r, r.save()
+}
+
+// processAlive returns true if the given process is running.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// cleanup removes the changes recorded for a network, ignoring those
+// which have already gone.
+func (n *NetworkRunState) cleanup() {
+	for ip, device := range n.Routes {
+		cleanupCommand("ip", "route", "del", ip, "dev", device)
+	}
+	if n.Device != "" && !n.Persistent {
+		cleanupCommand("ip", "link", "delete", "dev", n.Device)
+	}
+	if n.Table != "" {
+		err := firewall.New(n.Table, false).Remove()
+		if err != nil {
+			log.Printf("[S] %s", err.Error())
+		}
+	}
+	for _, args := range n.IPTables {
+		exitCommand{args: args, optional: true}.run()
+	}
+}
+
+// cleanupCommand runs the given command, if the thing it removes still
+// exists, which we judge by it succeeding.
+func cleanupCommand(args ...string) {
+	err := exec.Command(args[0], args[1:]...).Run()
+	if err == nil {
+		fmt.Printf("Removed leftover: '%s'\n", strings.Join(args, " "))
+	}
+}
+
+// save writes our record to our run_file.
+//
+// NOTE: The caller must hold our mutex, unless we've not been shared.
+func (r *runState) save() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(r.path, append(data, '\n'))
+}
+
+// change applies the given change to the record of the given network,
+// and saves it.  Failures are logged, as the record is only a safety-net.
+func (r *runState) change(network string, apply func(n *NetworkRunState)) {
+	if r == nil || r.path == "" {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	n := r.state.Networks[network]
+	if n == nil {
+		n = &NetworkRunState{}
+		r.state.Networks[network] = n
+	}
+	apply(n)
+
+	err := r.save()
+	if err != nil {
+		log.Printf("[S] Failed to update our run_file: %s", err.Error())
+	}
+}
+
+// setDevice records the device of the given network.
+func (r *runState) setDevice(network string, device string, persistent bool) {
+	r.change(network, func(n *NetworkRunState) {
+		n.Device = device
+		n.Persistent = persistent
+	})
+}
+
+// setFirewall records the nftables table, or the commands which remove
+// the iptables rules, we added for the given network.
+func (r *runState) setFirewall(network string, table string, iptables []exitCommand) {
+	r.change(network, func(n *NetworkRunState) {
+		n.Table = table
+		n.IPTables = nil
+		for _, cmd := range iptables {
+			n.IPTables = append(n.IPTables, cmd.args)
+		}
+	})
+}
+
+// addRoute records the route of a client's IP to its device.
+func (r *runState) addRoute(network string, ip string, device string) {
+	r.change(network, func(n *NetworkRunState) {
+		if n.Routes == nil {
+			n.Routes = make(map[string]string)
+		}
+		n.Routes[ip] = device
+	})
+}
+
+// removeRoute forgets the route of a client's IP, which went away along
+// with its device.
+func (r *runState) removeRoute(network string, ip string) {
+	r.change(network, func(n *NetworkRunState) {
+		delete(n.Routes, ip)
+	})
+}
+
+// setLease records the IP we gave the named client.
+func (r *runState) setLease(network string, name string, ip string) {
+	r.change(network, func(n *NetworkRunState) {
+		if n.Leases == nil {
+			n.Leases = make(map[string]string)
+		}
+		for other, addr := range n.Leases {
+			if addr == ip {
+				delete(n.Leases, other)
+			}
+		}
+		n.Leases[name] = ip
+	})
+}
+
+// recoveredLeases returns the leases we recovered for the given network,
+// from a run which crashed.
+func (r *runState) recoveredLeases(network string) map[string]string {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.recovered[network]
+}
+
+// close removes our run_file, once we've cleaned up after ourselves.
+func (r *runState) close() {
+	if r == nil || r.path == "" {
+		return
+	}
+	err := os.Remove(r.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[S] Failed to remove our run_file: %s", err.Error())
+	}
+}
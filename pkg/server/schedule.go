@@ -0,0 +1,86 @@
+// pkg/server/schedule.go contains the schedules which restrict the times
+// at which named clients may be connected.
+//
+// A client with a `schedule_NAME` is refused outside of its schedule, and
+// if it is connected when its schedule ends it is disconnected.  Like all
+// names, NAME is matched without regard to case.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/shared"
+)
+
+// scheduleInterval is how often we disconnect clients whose schedules
+// have ended.
+const scheduleInterval = time.Minute
+
+// loadSchedules parses the schedule of each client, which are in the
+// given `timezone`, or our local time.  They are keyed by the name of the
+// client in lower-case.
+func loadSchedules(cfg *config.Reader) (map[string]*shared.Schedule, error) {
+	zone := time.Local
+	if name := cfg.Get("timezone"); name != "" {
+		var err error
+		zone, err = time.LoadLocation(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %s", err.Error())
+		}
+	}
+
+	settings, err := namedSettings(cfg, "schedule_")
+	if err != nil {
+		return nil, err
+	}
+
+	schedules := make(map[string]*shared.Schedule)
+	for name, str := range settings {
+		s, err := shared.ParseSchedule(str, zone)
+		if err != nil {
+			return nil, fmt.Errorf("schedule_%s: %s", name, err.Error())
+		}
+		schedules[name] = s
+	}
+	return schedules, nil
+}
+
+// scheduled returns true if the named client may be connected now.
+func (p *Server) scheduled(name string) bool {
+	s := p.schedules[strings.ToLower(name)]
+	return s == nil || s.Allows(time.Now())
+}
+
+// enforceSchedules periodically disconnects the clients whose schedules
+// have ended, until our context is cancelled.
+func (p *Server) enforceSchedules() {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var expired []*shared.Socket
+		p.assignedMutex.Lock()
+		for _, client := range p.assigned {
+			if client != nil && client.socket != nil && !p.scheduled(client.name) {
+				log.Printf("[S] Disconnecting client %s, whose schedule has ended", client.name)
+				expired = append(expired, client.socket)
+			}
+		}
+		p.assignedMutex.Unlock()
+
+		for _, socket := range expired {
+			socket.Close()
+		}
+	}
+}
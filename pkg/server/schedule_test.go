@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skx/simple-vpn/config"
+)
+
+// TestScheduledCase ensures that clients are held to their schedule
+// however they capitalise their names.
+func TestScheduledCase(t *testing.T) {
+	tomorrow := time.Now().UTC().Add(24 * time.Hour).Weekday().String()[:3]
+
+	cfg, err := config.Parse("timezone = UTC\nschedule_contractor = " + tomorrow + "\n")
+	if err != nil {
+		t.Fatalf("failed to parse our configuration: %s", err)
+	}
+	schedules, err := loadSchedules(cfg)
+	if err != nil {
+		t.Fatalf("failed to load our schedules: %s", err)
+	}
+	p := &Server{Config: cfg, schedules: schedules}
+
+	for _, name := range []string{"contractor", "Contractor", "CONTRACTOR"} {
+		if p.scheduled(name) {
+			t.Errorf("expected %s to be outside of its schedule", name)
+		}
+	}
+	if !p.scheduled("employee") {
+		t.Errorf("expected a client without a schedule to be allowed")
+	}
+}
+
+// TestLoadSchedulesDuplicate ensures that two schedules for the same name,
+// in different cases, are refused rather than one silently winning.
+func TestLoadSchedulesDuplicate(t *testing.T) {
+	cfg, err := config.Parse("schedule_kiosk = Mon\nschedule_KIOSK = Mon-Sun\n")
+	if err != nil {
+		t.Fatalf("failed to parse our configuration: %s", err)
+	}
+	if _, err := loadSchedules(cfg); err == nil {
+		t.Errorf("expected duplicate schedules to be refused")
+	}
+}
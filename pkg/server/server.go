@@ -0,0 +1,2374 @@
+// pkg/server/server.go contains the core of the VPN-server
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/skx/simple-vpn/config"
+	"github.com/skx/simple-vpn/pkg/firewall"
+	"github.com/skx/simple-vpn/shared"
+	"github.com/songgao/water"
+)
+
+// connections is a structure to hold data about connected
+// clients
+type connection struct {
+	localIP  string
+	remoteIP string
+	rawIP    string
+	name     string
+
+	// socket is the connection to the client, once established.
+	socket *shared.Socket
+
+	// device is the name of the client's own device, if it has one.
+	device string
+
+	// connected is when the client connected.
+	connected time.Time
+
+	// routes and tags are the metadata the client sent us, which we
+	// pass on to its peers.
+	routes []string
+	tags   []string
+
+	// report is the most recent health-report the client sent us.
+	report *shared.Report
+
+	// offered is true once we've told the client about a new version.
+	offered bool
+
+	// limit is the rate-limit of the client's traffic.
+	limit *clientLimit
+
+	// candidates are the UDP addresses the client may be reached upon
+	// directly, if it has enabled p2p, and introduced records when we
+	// last introduced it to each peer.
+	candidates []string
+	introduced map[string]time.Time
+}
+
+// Server is a VPN-server, which serves one or more virtual networks.
+type Server struct {
+	// draining is non-zero if we're not accepting new clients.  It is
+	// accessed atomically.
+	draining int32
+
+	// assigned holds a record of IPs that are available/used.
+	assigned map[string]*connection
+
+	// assignedMutex to protect access to the same, and our leases.
+	assignedMutex sync.Mutex
+
+	// leases holds the IP most recently assigned to each named client,
+	// including those assigned by our HA-partner.
+	leases map[string]string
+
+	// links holds the clients of each server we're federated with.
+	links map[*shared.Socket][]string
+
+	// linksMutex protects access to the same.
+	linksMutex sync.Mutex
+
+	// MTU is the MTU of our networks, unless overridden by their
+	// configuration.
+	MTU int
+
+	// Host and Port are the address we listen upon, if the configuration
+	// file doesn't specify one.
+	Host string
+	Port int
+
+	// TrustProxies is true if we believe the forwarded headers of every
+	// connection, rather than just those from our `trusted_proxies`.
+	// This suits platforms, such as Kubernetes, where we're only
+	// reachable via their proxies, whose addresses aren't known.
+	TrustProxies bool
+
+	// AllowWeakKeys is true if we accept keys which are trivially weak,
+	// rather than refusing to start.
+	AllowWeakKeys bool
+
+	// FIPS is true if our TLS connections may only use FIPS-approved
+	// cipher suites.
+	FIPS bool
+
+	// RelayOnly is true if we switch traffic between our clients without
+	// creating any devices, so that we needn't run as root.
+	RelayOnly bool
+
+	// The configuration file
+	Config *config.Reader
+
+	// The subnet we are using
+	subnet string
+
+	// IP of the server, within the subnet
+	serverIP string
+
+	// The pool from which we allocate client IPs, within the subnet
+	pool   *net.IPNet
+	poolIP net.IP
+
+	// network is the name of the virtual network we're serving, which
+	// is "" for the network defined at the top-level of the
+	// configuration file.
+	network string
+
+	// path is the HTTP-path upon which this network is served.
+	path string
+
+	// groups contains the "[group NAME]" sections of our configuration.
+	groups []*config.Reader
+
+	// policies contains the parsed policy of each group.
+	policies map[string]*policy
+
+	// state holds the settings changed via our admin API.
+	state *runtimeState
+
+	// macs contains the source MACs each client is restricted to.
+	macs map[string][]shared.MacAddr
+
+	// gates are consulted about each connection, by its address.
+	gates []shared.Gate
+
+	// schedules contains the times at which each client may connect.
+	schedules map[string]*shared.Schedule
+
+	// sources contains the public networks each client may connect
+	// from, keyed by its name in lower-case.
+	sources map[string][]*net.IPNet
+
+	// exitCleanup holds the commands which remove the iptables rules
+	// we added as an exit node.
+	exitCleanup []exitCommand
+
+	// firewall holds the nftables rules we added as an exit node.
+	firewall *firewall.Ruleset
+
+	// trustedProxies are the reverse-proxies whose forwarding headers
+	// we believe.
+	trustedProxies *Proxies
+
+	// hub switches traffic between the clients of this network.
+	hub *shared.Hub
+
+	// framing is the framing of the traffic of this network.
+	framing shared.Framing
+
+	// announced holds the peers we last told our clients about, and
+	// announceTimer is pending while we collect changes to them.
+	announced     map[string]bool
+	announceTimer *time.Timer
+
+	// announceMutex protects the same, and dnsRecords, which holds the
+	// records we last wrote to our dns_file.
+	announceMutex sync.Mutex
+	dnsRecords    string
+
+	// filters are added to the hub of every network.
+	filters []shared.Filter
+
+	// plugin is our external plugin, if any.
+	plugin *plugin
+
+	// logMutex serializes writes to the logs of our clients.
+	logMutex sync.Mutex
+
+	// quality holds the quality of each client's link, by name, and
+	// qualityMutex protects it.
+	quality      map[string]*linkQuality
+	qualityMutex sync.Mutex
+
+	// inventory holds the inventory of our clients, by name, and
+	// inventoryMutex protects it.
+	inventory      map[string]*InventoryEntry
+	inventoryMutex sync.Mutex
+
+	// ws holds the settings of our websocket connections, and upgrader
+	// accepts them.
+	ws       shared.WebsocketOptions
+	upgrader *websocket.Upgrader
+
+	// tls is the crypto-policy of the TLS connections we make, and
+	// those of our admin API.
+	tls shared.TLSPolicy
+
+	// ctx is cancelled when the server shuts down, which stops the
+	// goroutines serving each client.
+	ctx context.Context
+
+	// events delivers the events of every network.
+	events *eventBus
+
+	// device is the device of this network.
+	device shared.TunDevice
+
+	// listeners are the listeners we accept connections upon, opened
+	// from the addresses listed in listenAddrs, and children are the
+	// networks we serve.  These are recorded so that we may upgrade.
+	listeners   []net.Listener
+	listenAddrs []string
+	children    []*Server
+
+	// stun is the socket of our STUN responder, if any, and stunPort
+	// the port we tell our clients it is upon.
+	stun     *net.UDPConn
+	stunPort int
+
+	// guard protects our listeners from floods of handshakes, and is
+	// shared by every network.
+	guard *handshakeGuard
+
+	// throttle limits the connections made by each source address, and
+	// is shared by every network.
+	throttle *connectionThrottle
+
+	// run records the changes we've made to the host, so that we may
+	// clean up after a crash, and is shared by every network.
+	run *runState
+
+	// handover records the process we've upgraded to, if any, and
+	// inherited holds what we inherited if we're that process.
+	handover  *handover
+	inherited *inheritance
+}
+
+// New creates a VPN-server, with the given configuration.
+func New(cfg *config.Reader) *Server {
+	return &Server{
+		Config:   cfg,
+		MTU:      1280,
+		Host:     "127.0.0.1",
+		Port:     9000,
+		events:   newEventBus(),
+		handover: &handover{},
+	}
+}
+
+// AddFilter adds a filter which is applied to the traffic received from
+// the clients of every network we serve, after any configured with the
+// `filter_` settings.
+//
+// This must be called before Run.
+func (p *Server) AddFilter(filter shared.Filter) {
+	p.filters = append(p.filters, filter)
+}
+
+// relayOnly returns true if we switch traffic between our clients without
+// creating any devices, either because we were told to, or because our
+// configuration says so.
+func (p *Server) relayOnly() bool {
+	return p.RelayOnly || p.Config.Get("relay_only") == "true"
+}
+
+// clientDevices returns true if we create a device for each client,
+// rather than switching all traffic via our own.
+func (p *Server) clientDevices() bool {
+	return p.Config.Get("client_devices") != "false"
+}
+
+// setupDevice creates our TAP device, unless we inherited it, and
+// raises it.  With IP framing we create a TUN device instead.
+func (p *Server) setupDevice() error {
+
+	//
+	// Create the tap-config
+	//
+	tapConfig := water.Config{
+		DeviceType: water.TAP,
+	}
+	if p.framing == shared.FramingIP {
+		tapConfig.DeviceType = water.TUN
+	}
+
+	//
+	// Set the name of the device appropriately.
+	//
+	// Default to `svpn` but allow the servers' configuration
+	// file to override, with a name or a template such as
+	// "svpn%d".
+	//
+	devName := p.Config.GetWithDefault("device", "svpn")
+	tapConfig.Name = devName
+
+	//
+	// Create the tap-device, unless we inherited it.
+	//
+	// A persistent device must have been created for us, but then
+	// we don't need CAP_NET_ADMIN to open it.
+	//
+	persistent := p.Config.Get("persistent_device") == "true"
+	p.device = p.inherited.device(devName)
+	if p.device == nil && persistent {
+		devices, err := shared.OpenPersistentDevice(tapConfig, devName, 1)
+		if err != nil {
+			return fmt.Errorf("failed to open TAP device: %s", err.Error())
+		}
+		p.device = devices[0]
+	}
+	if p.device == nil {
+		//
+		// Our device may be left over from a previous run, which
+		// crashed, in which case we may rename, or recreate, it.
+		//
+		collision, err := shared.ParseDeviceCollision(p.Config.Get("device_collision"))
+		if err != nil {
+			return err
+		}
+		name, note, err := shared.ChooseDeviceName(devName, collision)
+		if err != nil {
+			return fmt.Errorf("failed to create TAP device: %s", err.Error())
+		}
+		if note != "" {
+			log.Printf("WARNING: %s", note)
+		}
+		tapConfig.Name = name
+
+		devices, err := shared.OpenDevice(tapConfig, 1)
+		if err != nil {
+			return fmt.Errorf("failed to create TAP device: %s\nTo run without one launch the server with -relay-only", err.Error())
+		}
+		p.device = devices[0]
+	}
+	p.run.setDevice(p.network, p.device.Name(), persistent)
+
+	//
+	// Setup the server socket, with MTU, etc.
+	//
+	// If we can't then a persistent device may have been configured
+	// by its owner.
+	//
+	err := p.raiseNetworkDevice(p.device, p.MTU)
+	if err != nil && persistent {
+		fmt.Printf("Assuming the persistent device %s is already configured.\n", devName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error raising network device: %s", err.Error())
+	}
+	return nil
+}
+
+// deviceMAC returns the MAC address of our device, or the given default
+// if it has none.
+func (p *Server) deviceMAC(fallback shared.MacAddr) shared.MacAddr {
+	iface, err := net.InterfaceByName(p.device.Name())
+	if err != nil || len(iface.HardwareAddr) != 6 {
+		return fallback
+	}
+	var mac shared.MacAddr
+	copy(mac[:], iface.HardwareAddr)
+	return mac
+}
+
+// raiseNetworkDevice configures the link for the server.
+func (p *Server) raiseNetworkDevice(dev shared.TunDevice, mtu int) error {
+
+	//
+	// The MTU/Device as a string
+	//
+	mtuStr := fmt.Sprintf("%d", mtu)
+	devStr := dev.Name()
+
+	//
+	// The commands we're going to execute
+	//
+	cmds := [][]string{
+		{"ip", "link", "set", "dev", devStr, "up"},
+		{"ip", "link", "set", "mtu", mtuStr, "dev", devStr},
+	}
+
+	//
+	// For each command
+	//
+	for _, cmd := range cmds {
+
+		//
+		// Show what we're doing.
+		//
+		fmt.Printf("Running: '%s'\n", strings.Join(cmd, " "))
+
+		//
+		// Run the command
+		//
+		x := exec.Command(cmd[0], cmd[1:]...)
+		x.Stdout = os.Stdout
+		x.Stderr = os.Stderr
+		err := x.Run()
+		if err != nil {
+			fmt.Printf("Failed to run %s - %s\n",
+				strings.Join(cmd, " "), err.Error())
+
+			return err
+		}
+	}
+	return nil
+}
+
+// clientDeviceName returns the name of the device of the named client,
+// which is the given prefix followed by the client's name, truncated to
+// the length the kernel allows.  Characters which cannot appear in the
+// names of devices are replaced.
+func clientDeviceName(prefix string, name string) string {
+	dev := []byte(prefix + name)
+	for i, c := range dev {
+		if c <= ' ' || c >= 127 || c == '/' || c == ':' {
+			dev[i] = '-'
+		}
+	}
+	if len(dev) > 15 {
+		dev = dev[:15]
+	}
+	return string(dev)
+}
+
+// openClientDevice opens the device of the named client.
+//
+// If a `client_device_prefix` is configured the device is named after the
+// client, and labelled with its name, so that firewall rules may match it.
+// If that name is taken, perhaps by the previous connection of the same
+// client, we fall back to a name chosen by the kernel.
+func (p *Server) openClientDevice(name string) ([]shared.TunDevice, error) {
+	queues := p.Config.GetIntWithDefault("tun_queues", 1)
+
+	prefix := p.Config.Get("client_device_prefix")
+	if prefix != "" {
+		config := water.Config{DeviceType: water.TUN}
+		config.Name = clientDeviceName(prefix, name)
+
+		devices, err := shared.OpenDevice(config, queues)
+		if err == nil {
+			label := "simple-vpn client " + name
+			if p.network != "" {
+				label += " of " + p.network
+			}
+			err = exec.Command("ip", "link", "set", "dev", config.Name, "alias", label).Run()
+			if err != nil {
+				log.Printf("[S] Failed to label device %s: %s", config.Name, err.Error())
+			}
+			return devices, nil
+		}
+		log.Printf("[S] Cannot create device %s for %s, using another name: %s", config.Name, name, err.Error())
+	}
+
+	return shared.OpenDevice(water.Config{DeviceType: water.TUN}, queues)
+}
+
+// pickIP is a function which returns the IP address to use for the
+// specific connecting client.
+//
+// Generally we pick the next unused IP in our range, but we also
+// allow a hard-wired version via the configuriaton file.  Of course
+// the hard-wired IP might be in use ..
+func (p *Server) pickIP(name string, remote string, raw string, pool *net.IPNet) (string, error) {
+	p.assignedMutex.Lock()
+
+	//
+	// Get the fixed IP for this host, if set in the
+	// configuration-file.
+	//
+	fixed := p.fixedIP(name)
+
+	//
+	// If that worked, and the IP is free then use it.
+	//
+	if fixed != "" && p.assigned[fixed] == nil {
+
+		p.assigned[fixed] = &connection{name: name, localIP: fixed, remoteIP: remote, rawIP: raw}
+		p.recordLease(name, fixed)
+
+		p.assignedMutex.Unlock()
+		return fixed, nil
+	}
+
+	//
+	// If the client has connected before, to us or our HA-partner,
+	// then try to give it the same IP it had previously.
+	//
+	previous := p.leases[name]
+	if previous != "" && p.assigned[previous] == nil && pool.Contains(net.ParseIP(previous)) {
+
+		p.assigned[previous] = &connection{name: name, localIP: previous, remoteIP: remote, rawIP: raw}
+
+		p.assignedMutex.Unlock()
+		return previous, nil
+	}
+
+	//
+	// Otherwise we need to find the next free one.
+	//
+	// We prefer IPs which have never been leased, so that clients who
+	// reconnect can get their old address back, but if we run out we'll
+	// reuse those which belonged to clients who are now absent.
+	//
+	for pass := 0; pass < 2; pass++ {
+		for i := pool.IP.Mask(pool.Mask); pool.Contains(i); incIP(i) {
+
+			s := i.String()
+
+			// Skip the first IP.
+			if strings.HasSuffix(s, ".0") ||
+				strings.HasSuffix(s, ":") {
+				continue
+			}
+
+			if p.assigned[s] == nil && (pass == 1 || !p.leased(s)) {
+				p.assigned[s] = &connection{name: name, localIP: s, remoteIP: remote, rawIP: raw}
+				p.recordLease(name, s)
+				p.assignedMutex.Unlock()
+				return s, nil
+			}
+		}
+	}
+
+	p.assignedMutex.Unlock()
+	return "", fmt.Errorf("Out of IP addresses")
+}
+
+// incIP is used to increment the given IP object; it is used for iterating
+// over the CIDR range the server uses for clients.
+func incIP(ip net.IP) {
+	for j := len(ip) - 1; j >= 0; j-- {
+		ip[j]++
+		if ip[j] > 0 {
+			break
+		}
+	}
+}
+
+// setup prepares the virtual network described by our configuration,
+// creating its device and launching any background tasks.
+func (p *Server) setup() error {
+
+	//
+	// Each network has its own switch.
+	//
+	p.hub = shared.NewHub()
+	p.announced = make(map[string]bool)
+
+	//
+	// Our traffic is switched by MAC, unless we route it by IP.
+	//
+	framing, err := shared.ParseFraming(p.Config.Get("framing"))
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	p.framing = framing
+	p.hub.SetFraming(framing)
+
+	//
+	// Filter the traffic of our clients by the rules we've been
+	// configured with, and then by those we were given.  If our rules
+	// may be changed at runtime they're applied even if there are
+	// none yet.
+	//
+	err = p.loadState()
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	if p.mutable() || p.state.rules.Load().(rulesFilter).filter != nil {
+		p.hub.AddFilter(shared.FilterFunc(p.filterRules))
+	}
+	if p.plugin != nil && p.plugin.filter {
+		p.hub.AddFilter(p.plugin.filterFor(p.network))
+	}
+	for _, filter := range p.filters {
+		p.hub.AddFilter(filter)
+	}
+
+	//
+	// Frames for MACs we haven't learned are dropped, unless we've
+	// been asked to behave more like a real switch.
+	//
+	unknown, err := shared.ParseUnknownUnicast(p.Config.Get("unknown_unicast"))
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	p.hub.SetUnknownUnicast(unknown, time.Duration(p.Config.GetIntWithDefault("unknown_unicast_window", 2))*time.Second)
+
+	//
+	// The subnet could be changed by the configuration-file.
+	//
+	p.subnet = p.Config.GetWithDefault("subnet", "10.137.248.0/24")
+
+	//
+	// Ensure we have a key
+	//
+	if p.Config.Get("key") == "" {
+		return &shared.ConfigError{Err: fmt.Errorf("the configuration must define a shared-key\nPlease add 'key = ...', with the output of 'openssl rand -base64 32', or similar")}
+	}
+	err = p.checkKeys()
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Parse the list of reverse-proxies we trust.
+	//
+	proxies := p.Config.GetWithDefault("trusted_proxies", "127.0.0.0/8, ::1")
+	if p.TrustProxies {
+		proxies = "0.0.0.0/0, ::/0, unix"
+	}
+	p.trustedProxies, err = ParseProxies(proxies, p.Config.Get("proxy_header"))
+	if err != nil {
+		return &shared.ConfigError{Err: fmt.Errorf("failed to parse the trusted_proxies setting: %s", err.Error())}
+	}
+
+	//
+	// Configure our websocket connections, whose buffers default to
+	// holding a frame of our MTU.
+	//
+	p.ws, err = shared.LoadWebsocketOptions(p.Config.GetPrefixed("ws_"), p.MTU)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	p.upgrader = p.ws.Upgrader()
+
+	//
+	// Parse the subnet we live upon.
+	//
+	_, network, err := net.ParseCIDR(p.subnet)
+	if err != nil {
+		return &shared.ConfigError{Err: fmt.Errorf("failed to parse the CIDR range allocated to clients: %s", err.Error())}
+	}
+
+	//
+	// We allocate IPs from our pool, which is usually the whole
+	// subnet.  Federated servers share a subnet, but must each use
+	// a distinct pool within it.
+	//
+	p.poolIP, p.pool, err = net.ParseCIDR(p.Config.GetWithDefault("pool", p.subnet))
+	if err != nil {
+		return &shared.ConfigError{Err: fmt.Errorf("failed to parse the CIDR range of our pool: %s", err.Error())}
+	}
+	if !network.Contains(p.poolIP) {
+		return &shared.ConfigError{Err: fmt.Errorf("the pool %s is not within the subnet %s", p.pool.String(), p.subnet)}
+	}
+
+	//
+	// Parse the MAC-addresses each client is restricted to.
+	//
+	p.macs = make(map[string][]shared.MacAddr)
+	for name, list := range p.Config.GetPrefixed("macs_") {
+		for _, str := range strings.Split(list, ",") {
+			mac, err := shared.ParseMAC(strings.TrimSpace(str))
+			if err != nil {
+				return &shared.ConfigError{Err: fmt.Errorf("invalid MAC for %s: %s", name, err.Error())}
+			}
+			p.macs[name] = append(p.macs[name], mac)
+		}
+	}
+
+	//
+	// Parse the policies of our groups.
+	//
+	p.policies, err = loadPolicies(p.groups, network)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Fail now if our subnet conflicts with this host, or with our
+	// other settings.
+	//
+	err = p.checkSubnet(network)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	err = p.checkDNS()
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	err = p.checkHA()
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	ra, err := p.routerAdvertisement()
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Load the gates we consult about each connection, which come
+	// before those we were given.
+	//
+	gates, err := loadGates(p.Config)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	p.gates = append(gates, p.gates...)
+
+	//
+	// Parse the networks each client may connect from.
+	//
+	p.sources, err = loadSources(p.Config)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Parse the schedules of our clients, and disconnect those whose
+	// schedules end.
+	//
+	p.schedules, err = loadSchedules(p.Config)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	if len(p.schedules) > 0 {
+		go p.enforceSchedules()
+	}
+
+	//
+	// Here we used to mark every IP in the network range
+	// as being allocated.
+	//
+	// Instead we'll only claim the first, which will be the
+	// server IP.
+	//
+	// For each IP in the range we now mark the IP as free.
+	//
+	p.assigned = make(map[string]*connection)
+	p.leases = make(map[string]string)
+	p.quality = make(map[string]*linkQuality)
+	p.inventory = make(map[string]*InventoryEntry)
+	if p.inherited != nil {
+		for name, ip := range p.inherited.leases[p.network] {
+			p.leases[name] = ip
+		}
+	}
+	for name, ip := range p.run.recoveredLeases(p.network) {
+		p.leases[name] = ip
+	}
+	p.links = make(map[*shared.Socket][]string)
+	for i := p.poolIP.Mask(p.pool.Mask); p.pool.Contains(i) && p.serverIP == ""; incIP(i) {
+
+		s := i.String()
+
+		// Skip anything that ends in `.0`, or `:`.
+		if strings.HasSuffix(s, ".0") ||
+			strings.HasSuffix(s, ":") {
+			continue
+		}
+
+		//
+		// OK we've got the IP for the server
+		//
+		p.serverIP = s
+		p.assigned[s] = &connection{localIP: s, remoteIP: s, name: serverName, connected: p.inherited.connectedAt(p.network, serverName)}
+		fmt.Printf("VPN server has IP %s\n", p.serverIP)
+
+	}
+
+	//
+	// Our dns_file lists ourselves, until our clients join.
+	//
+	var local []string
+	for _, peer := range p.localPeers() {
+		local = append(local, shared.EncodePeer(peer))
+	}
+	p.announceMutex.Lock()
+	p.updateDNS(local)
+	p.announceMutex.Unlock()
+
+	//
+	// Answer pings to our IP ourselves, unless disabled.
+	//
+	if p.Config.Get("icmp_reply") != "false" {
+		p.hub.SetAddress(net.ParseIP(p.serverIP))
+	}
+
+	//
+	// Answer the ARP requests, and neighbour solicitations, for our IP
+	// ourselves, unless disabled, with the MAC of our device if we
+	// have one.
+	//
+	gatewayMAC := shared.GatewayMAC(net.ParseIP(p.serverIP))
+
+	//
+	// Are we using IPv6?
+	//
+	if strings.Contains(p.serverIP, ":") {
+		fmt.Printf("VPN server using IPv6.\n")
+	} else {
+		fmt.Printf("VPN server using IPv4.\n")
+	}
+
+	//
+	// If we're only relaying then we need no device, and port-forwards
+	// can't reach our clients.
+	//
+	if p.relayOnly() {
+		fmt.Printf("VPN server is relaying only, without a device.\n")
+		if len(p.Config.GetPrefixed("forward_")) > 0 {
+			return fmt.Errorf("port-forwards need a device, so cannot be used when relaying only")
+		}
+	} else {
+		err = p.setupDevice()
+		if err != nil {
+			return &shared.DeviceError{Err: err}
+		}
+		gatewayMAC = p.deviceMAC(gatewayMAC)
+
+		//
+		// Without per-client devices all traffic which isn't for
+		// another client goes via our own device.
+		//
+		if !p.clientDevices() {
+			fmt.Printf("VPN server is switching all traffic via %s.\n", p.device.Name())
+			p.hub.SetUplink(p.device)
+			go p.hub.ServeUplink(p.ctx)
+		}
+
+		//
+		// Launch any port-forwards which have been configured.
+		//
+		err = p.startForwards()
+		if err != nil {
+			return &shared.BindError{Err: fmt.Errorf("error setting up port-forwards: %s", err.Error())}
+		}
+	}
+
+	if p.Config.Get("arp_reply") != "false" {
+		p.hub.SetGateway(net.ParseIP(p.serverIP), gatewayMAC)
+	}
+
+	//
+	// Advertise our IPv6 prefix, from the same MAC, if we should.
+	//
+	if ra != nil {
+		fmt.Printf("VPN server is advertising the prefix %s.\n", ra.Prefix)
+		p.hub.SetRouterAdvertisement(ra, gatewayMAC)
+		go p.hub.ServeRouterAdvertisements(p.ctx)
+	}
+
+	//
+	// Route our clients' traffic beyond the VPN, if we should.
+	//
+	if p.exitNode() {
+		err = p.setupExit()
+		if err != nil {
+			return err
+		}
+	}
+
+	//
+	// Link with any servers we're federated with.
+	//
+	for _, endPoint := range strings.Split(p.Config.Get("federate"), ",") {
+		endPoint = strings.TrimSpace(endPoint)
+		if endPoint == "" {
+			continue
+		}
+		if p.federationKey() == "" {
+			return &shared.ConfigError{Err: fmt.Errorf("federating with %s requires a federation_key", endPoint)}
+		}
+		go p.federate(endPoint)
+	}
+
+	//
+	// If we're part of a hot-standby pair then we share our leases
+	// with our partner, and fetch theirs.
+	//
+	partner := p.Config.Get("ha_partner")
+	if partner != "" {
+		interval, err := p.interval("ha_interval", 5)
+		if err != nil {
+			return &shared.ConfigError{Err: err}
+		}
+		go p.syncLeases(partner, interval)
+	}
+
+	return nil
+}
+
+// networks returns the virtual networks described by our configuration
+// file.
+//
+// The top-level of the file describes a network, if it contains a key,
+// and each "[network NAME]" section describes another.  Each network is
+// configured solely by its own section.
+func (p *Server) networks() ([]*Server, error) {
+	var out []*Server
+
+	//
+	// Group policies apply to every network.
+	//
+	var groups []*config.Reader
+	for _, section := range p.Config.Sections {
+		if strings.HasPrefix(section.Name, "group ") {
+			groups = append(groups, section)
+		}
+	}
+
+	if p.Config.Get("key") != "" || len(groups) == len(p.Config.Sections) {
+		p.path = p.Config.GetWithDefault("path", "/")
+		p.groups = groups
+		out = append(out, p)
+	}
+
+	for _, section := range p.Config.Sections {
+		fields := strings.Fields(section.Name)
+		if len(fields) != 2 || (fields[0] != "network" && fields[0] != "group") {
+			return nil, fmt.Errorf("unknown section [%s]", section.Name)
+		}
+		if fields[0] == "group" {
+			continue
+		}
+		name := fields[1]
+
+		//
+		// Each network needs its own device, so we default to one
+		// named after the network.
+		//
+		if section.Get("device") == "" {
+			device := "svpn-" + name
+			if len(device) > 15 {
+				device = device[:15]
+			}
+			section.Settings["device"] = device
+		}
+
+		out = append(out, &Server{
+			MTU:           section.GetIntWithDefault("mtu", p.MTU),
+			TrustProxies:  p.TrustProxies,
+			AllowWeakKeys: p.AllowWeakKeys,
+			FIPS:          p.FIPS,
+			RelayOnly:     p.RelayOnly,
+			Config:        section,
+			network:       name,
+			path:          section.GetWithDefault("path", "/"),
+			groups:        groups,
+			events:        p.events,
+			filters:       p.filters,
+			gates:         p.gates,
+			plugin:        p.plugin,
+			handover:      p.handover,
+			guard:         p.guard,
+			throttle:      p.throttle,
+			run:           p.run,
+			inherited:     p.inherited,
+		})
+	}
+
+	return out, nil
+}
+
+// checkKeys refuses the keys of this network which are trivially weak,
+// unless we're allowed them, and warns of those which other processes
+// may see.
+func (p *Server) checkKeys() error {
+	settings := []string{"key", "reserved_key", "ha_key", "federation_key", "events_key", "exec_key"}
+	for name := range p.Config.GetPrefixed("key_") {
+		settings = append(settings, "key_"+name)
+	}
+
+	for _, setting := range settings {
+		key := p.Config.Get(setting)
+		if key == "" {
+			continue
+		}
+		if where := shared.KeyExposure(key); where != "" {
+			log.Printf("WARNING: The %s setting is visible in our %s, where other processes may read it", setting, where)
+		}
+
+		err := shared.CheckKey(key)
+		if err == nil {
+			continue
+		}
+		if !p.AllowWeakKeys {
+			return fmt.Errorf("the %s setting is a weak key, as %s\nChoose another, with 'openssl rand -base64 32', or start with -force", setting, err.Error())
+		}
+		log.Printf("WARNING: The %s setting is a weak key, as %s", setting, err.Error())
+	}
+	return nil
+}
+
+// keys returns each of the keys which may be presented to this network.
+func (p *Server) keys() []string {
+	keys := []string{p.Config.Get("key")}
+	if p.haKey() != "" {
+		keys = append(keys, p.haKey())
+	}
+	if p.federationKey() != "" {
+		keys = append(keys, p.federationKey())
+	}
+	if p.eventsKey() != "" {
+		keys = append(keys, p.eventsKey())
+	}
+	if p.execKey() != "" {
+		keys = append(keys, p.execKey())
+	}
+	return append(keys, p.reservedKeys()...)
+}
+
+// interval returns the named setting, a number of seconds which must be
+// positive, or the given default if it isn't set.
+func (p *Server) interval(name string, seconds int) (time.Duration, error) {
+	n := p.Config.GetIntWithDefault(name, seconds)
+	if n <= 0 {
+		return 0, fmt.Errorf("the %s setting must be a positive number of seconds, not %d", name, n)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// bearer returns true if the given request presented the given key, as
+// a bearer token, which keeps it out of the logs of proxies.  The empty
+// key is never presented.
+func bearer(request *http.Request, key string) bool {
+	want := []byte("Bearer " + key)
+	got := []byte(request.Header.Get("Authorization"))
+	return key != "" && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// serveNetwork is the HTTP-handler for a single virtual network.
+func (p *Server) serveNetwork(w http.ResponseWriter, r *http.Request) {
+	if p.haKey() != "" && strings.HasSuffix(r.URL.Path, "/ha/leases") {
+		p.throttle.protect(p.trustedProxies, p.serveLeases)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/events") {
+		p.throttle.protect(p.trustedProxies, p.serveEvents)(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/exec") {
+		p.throttle.protect(p.trustedProxies, p.serveExec)(w, r)
+		return
+	}
+	p.throttle.protect(p.trustedProxies, p.serveWs)(w, r)
+}
+
+// dispatch returns an HTTP-handler which routes each request to the
+// virtual network it is intended for.
+//
+// Networks are selected by their path, and if several share a path then
+// by the key which was presented.  If no network wants the request we
+// pass it to the given decoy, which makes us look like a normal site.
+func dispatch(networks []*Server, decoy http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+
+		var found *Server
+		for _, n := range networks {
+			prefix := strings.TrimSuffix(n.path, "/")
+			if r.URL.Path != n.path && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+				continue
+			}
+
+			if found == nil {
+				found = n
+			}
+			for _, k := range n.keys() {
+				if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+					n.serveNetwork(w, r)
+					return
+				}
+			}
+		}
+
+		//
+		// Nothing matched our key, so we pass the request to the
+		// first network with a matching path, which will reject it.
+		//
+		if found != nil {
+			found.serveNetwork(w, r)
+			return
+		}
+		decoy(w, r)
+	}
+}
+
+// Run serves our virtual networks, until the given context is cancelled
+// or we fail.
+func (p *Server) Run(ctx context.Context) error {
+
+	//
+	// If we were started by an upgrade we inherit our listeners,
+	// devices, and leases.
+	//
+	var err error
+	p.inherited, err = inherit()
+	if err != nil {
+		return err
+	}
+
+	//
+	// Load our plugin, which is shared by every network.
+	//
+	p.plugin, err = loadPlugin(p.Config)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Protect our listeners from floods of handshakes.
+	//
+	p.guard, err = newHandshakeGuard(p.Config)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Throttle the connections made by each source address.
+	//
+	p.throttle, err = newConnectionThrottle(p.Config)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Our periodic tasks need positive intervals, lest they spin.
+	//
+	macAge, err := p.interval("mac_age", 300)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	eventsInterval, err := p.interval("events_interval", 60)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	qualityInterval, err := p.interval("quality_interval", 60)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Clean up after our previous run, if it crashed, before we
+	// create anything.
+	//
+	p.run, err = openRunState(p.Config.Get("run_file"), p.inherited != nil)
+	if err != nil {
+		return err
+	}
+
+	//
+	// Find the virtual networks we're going to serve, and set up each.
+	//
+	networks, err := p.networks()
+	if err != nil {
+		return &shared.ConfigError{Err: fmt.Errorf("failed to parse configuration file %s", err.Error())}
+	}
+
+	//
+	// Our crypto-policy restricts the TLS connections of every
+	// network, and those of our admin API.
+	//
+	p.tls, err = shared.LoadTLSPolicy(p.Config.GetPrefixed("tls_"), p.FIPS)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+	if p.tls.Restricted() {
+		fmt.Printf("Restricting TLS to %s\n", p.tls)
+	}
+
+	//
+	// When we return every client is disconnected.
+	//
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	//
+	// Launch our plugin, and send it our events.
+	//
+	if p.plugin != nil {
+		p.plugin.mutex.Lock()
+		err = p.plugin.start()
+		p.plugin.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		defer p.plugin.stop()
+
+		events, unsubscribe := p.Subscribe()
+		defer unsubscribe()
+		go p.plugin.forward(ctx, events)
+	}
+
+	//
+	// Launch our STUN responder, if it is enabled.
+	//
+	stunPort := 0
+	if addr := p.Config.Get("stun"); addr != "" {
+		stunPort, err = p.serveSTUN(ctx, addr)
+		if err != nil {
+			return &shared.BindError{Err: err}
+		}
+	}
+
+	//
+	// When we shut down we remove any firewall rules we added, unless
+	// our successor is using them.
+	//
+	defer func() {
+		if p.upgradingNow() {
+			return
+		}
+		for _, n := range networks {
+			n.teardownExit()
+		}
+		p.run.close()
+	}()
+
+	for _, n := range networks {
+		if n.network != "" {
+			fmt.Printf("Configuring network %s\n", n.network)
+		}
+		n.ctx = ctx
+		n.stunPort = stunPort
+		n.tls = p.tls
+
+		err = n.setup()
+		if err != nil {
+			return err
+		}
+	}
+
+	//
+	// Forget MAC-addresses we've not seen for a while, so that they
+	// may move between clients.
+	//
+	go func() {
+		ticker := time.NewTicker(macAge / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, n := range networks {
+				n.hub.AgeMACTable(macAge)
+			}
+		}
+	}()
+
+	//
+	// Periodically report the traffic of each client, if anybody is
+	// interested.
+	//
+	go func() {
+		ticker := time.NewTicker(eventsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !p.events.active() {
+				continue
+			}
+			for _, n := range networks {
+				n.emitTraffic()
+			}
+		}
+	}()
+
+	//
+	// Periodically sample the quality of each client's link.
+	//
+	go func() {
+		ticker := time.NewTicker(qualityInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, n := range networks {
+				n.sampleQuality()
+			}
+		}
+	}()
+
+	//
+	// Launch our admin API, if it is enabled.
+	//
+	admin := p.Config.Get("admin")
+	var adminListener net.Listener
+	if admin != "" {
+		adminListener, err = p.serveAdmin(ctx, admin, networks)
+		if err != nil {
+			return &shared.BindError{Err: err}
+		}
+	}
+
+	//
+	// Open each of the addresses we're going to listen upon.
+	//
+	listeners, addrs, err := p.listen()
+	if err != nil {
+		return &shared.BindError{Err: fmt.Errorf("failed to launch our websocket-server: %s", err.Error())}
+	}
+	p.handover.mutex.Lock()
+	p.listeners = listeners
+	p.listenAddrs = addrs
+	if adminListener != nil {
+		p.listeners = append(p.listeners, adminListener)
+		p.listenAddrs = append(p.listenAddrs, adminPrefix+admin)
+	}
+	p.children = networks
+	p.handover.mutex.Unlock()
+
+	//
+	// Register ourselves in a service catalog, if we should.
+	//
+	deregister, err := p.startRegistration(networks)
+	if err != nil {
+		return err
+	}
+	defer deregister()
+
+	//
+	// Load our provisioning key, if we provision clients.
+	//
+	provisioning, err := p.provisioningKey()
+	if err != nil {
+		return err
+	}
+
+	//
+	// Requests which aren't for the VPN are passed to our decoy.
+	//
+	decoy, err := p.decoy(networks)
+	if err != nil {
+		return &shared.ConfigError{Err: err}
+	}
+
+	//
+	// Bind our handling-function, which routes requests to the
+	// appropriate network, alongside our health-checks, and our
+	// provisioning of clients.
+	//
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.guard.protect(dispatch(networks, decoy)))
+	mux.HandleFunc("/healthz", serveLive)
+	mux.HandleFunc("/readyz", p.serveReady(networks))
+	if provisioning != nil {
+		mux.HandleFunc("/provision", p.serveProvision(provisioning))
+	}
+	srv := &http.Server{Handler: mux}
+	p.guard.configure(srv)
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	//
+	// Now start the server, upon each listener.
+	//
+	// If any of them fails we're done.
+	//
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+
+	err = <-errs
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	//
+	// If we've upgraded then our listeners were closed, and we wait
+	// for our clients to move to our successor.
+	//
+	if p.upgradingNow() {
+		p.handOver()
+		return nil
+	}
+	return fmt.Errorf("failed to launch our websocket-server: %s", err.Error())
+}
+
+// listen opens each of the addresses the server should listen upon.
+//
+// These are taken from the `listen` setting in the configuration file,
+// which is a comma-separated list of "host:port" pairs, or unix-domain
+// sockets prefixed with "unix:".  If that is not set then we use the
+// host & port given on the command-line.
+//
+// We return the listeners, and the address each was opened from.
+func (p *Server) listen() ([]net.Listener, []string, error) {
+
+	addresses := strings.Split(p.Config.Get("listen"), ",")
+	if p.Config.Get("listen") == "" {
+		addresses = []string{net.JoinHostPort(p.Host, fmt.Sprintf("%d", p.Port))}
+	}
+
+	var listeners []net.Listener
+	var opened []string
+	for _, addr := range addresses {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		//
+		// If we were upgraded we use the listener we inherited.
+		//
+		if l := p.inherited.listener(addr); l != nil {
+			fmt.Printf("Inherited the listener on %s\n", addr)
+			listeners = append(listeners, l)
+			opened = append(opened, addr)
+			continue
+		}
+		spec := addr
+
+		//
+		// Explicit IPv4/IPv6 addresses are bound to only that family,
+		// so that "0.0.0.0" and "[::]" may be used together.
+		//
+		network := "tcp"
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				if ip.To4() != nil {
+					network = "tcp4"
+				} else {
+					network = "tcp6"
+				}
+			}
+		}
+
+		if strings.HasPrefix(addr, "unix:") {
+			network = "unix"
+			addr = strings.TrimPrefix(addr, "unix:")
+
+			// Remove any stale socket from a previous run.
+			os.Remove(addr)
+		}
+
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			for _, open := range listeners {
+				open.Close()
+			}
+			return nil, nil, err
+		}
+
+		if network == "unix" {
+			fmt.Printf("Launching the server on unix:%s\n", addr)
+		} else {
+			fmt.Printf("Launching the server on http://%s\n", addr)
+		}
+		listeners = append(listeners, l)
+		opened = append(opened, spec)
+	}
+
+	if len(listeners) == 0 {
+		return nil, nil, fmt.Errorf("no addresses to listen upon")
+	}
+	return listeners, opened, nil
+}
+
+// peerIP returns the VPN IP which has been assigned to the connected
+// client with the given name, if any.
+func (p *Server) peerIP(name string) string {
+	p.assignedMutex.Lock()
+	defer p.assignedMutex.Unlock()
+
+	for _, client := range p.assigned {
+		if client != nil && client.name == name {
+			return client.localIP
+		}
+	}
+	return ""
+}
+
+// startForwards launches each of the port-forwards defined in our
+// configuration file, which allow the services of connected clients
+// to be published upon the server.
+func (p *Server) startForwards() error {
+	forwards, err := shared.LoadForwards(p.Config.GetPrefixed("forward_"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range forwards {
+
+		//
+		// If we were upgraded then our predecessor might still be
+		// listening, until its clients have left, so we retry for a
+		// while.  Otherwise a forward which can't listen is fatal.
+		//
+		if p.inherited != nil {
+			go func(f *shared.Forward) {
+				for attempt := 0; ; attempt++ {
+					listener, err := f.Bind()
+					if err == nil {
+						err = f.Serve(listener, p.peerIP)
+					} else if attempt < 60 {
+						time.Sleep(time.Second)
+						continue
+					}
+					if err != nil {
+						log.Printf("[forward %s] %s", f.Name, err.Error())
+					}
+					return
+				}
+			}(f)
+			continue
+		}
+
+		listener, err := f.Bind()
+		if err != nil {
+			return fmt.Errorf("forward_%s: %s", f.Name, err.Error())
+		}
+		go func(f *shared.Forward) {
+			err := f.Serve(listener, p.peerIP)
+			if err != nil {
+				log.Printf("[forward %s] %s", f.Name, err.Error())
+			}
+		}(f)
+	}
+	return nil
+}
+
+// localPeers returns the list of clients connected to this server,
+// including ourselves.
+func (p *Server) localPeers() []shared.Peer {
+	var connected []shared.Peer
+
+	p.assignedMutex.Lock()
+	for _, client := range p.assigned {
+		if client == nil {
+			continue
+		}
+		peer := shared.Peer{
+			Name:      client.name,
+			IP:        client.localIP,
+			Connected: client.connected,
+			Routes:    client.routes,
+			Tags:      client.tags,
+		}
+		if client.localIP != p.serverIP {
+			peer.Remote = client.remoteIP
+		}
+		connected = append(connected, peer)
+	}
+	p.assignedMutex.Unlock()
+
+	return connected
+}
+
+// refreshPeers tells every host which is still connected, and any
+// federated servers, about changes to our peers.
+//
+// It is called when either a new client connects, or a host is reaped.
+func (p *Server) refreshPeers() {
+	p.federatePeers()
+	p.announcePeers()
+}
+
+// announcePeers schedules the broadcast of the changes to the list of
+// all peers, including those connected to our federated servers.
+//
+// Changes are collected for `peers_debounce` milliseconds, so a client
+// which reconnects quickly doesn't cause any update at all.
+func (p *Server) announcePeers() {
+	p.announceMutex.Lock()
+	defer p.announceMutex.Unlock()
+
+	if p.announceTimer != nil {
+		return
+	}
+	delay := time.Duration(p.Config.GetIntWithDefault("peers_debounce", 500)) * time.Millisecond
+	p.announceTimer = time.AfterFunc(delay, p.broadcastPeers)
+}
+
+// broadcastPeers sends the peers which have been added, and removed,
+// since our last broadcast to every host which is still connected.
+//
+// Each peer is sent as JSON, encoded by shared.EncodePeer.
+func (p *Server) broadcastPeers() {
+	p.announceMutex.Lock()
+	defer p.announceMutex.Unlock()
+	p.announceTimer = nil
+
+	var peers []string
+	for _, peer := range p.localPeers() {
+		peers = append(peers, shared.EncodePeer(peer))
+	}
+
+	peers = append(peers, p.federatedPeers()...)
+	current := make(map[string]bool)
+	var added, removed []string
+	for _, peer := range peers {
+		current[peer] = true
+		if !p.announced[peer] {
+			added = append(added, peer)
+		}
+	}
+	for peer := range p.announced {
+		if !current[peer] {
+			removed = append(removed, peer)
+		}
+	}
+	p.announced = current
+	p.updateDNS(peers)
+
+	//
+	// We're going to send an update
+	//
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	fmt.Printf("Updating each peer with the changed peers\n")
+	for _, e := range added {
+		fmt.Printf("\t+ %s\n", e)
+	}
+	for _, e := range removed {
+		fmt.Printf("\t- %s\n", e)
+	}
+
+	if len(removed) > 0 {
+		p.hub.BroadcastCommand("peer-removed", removed)
+	}
+	if len(added) > 0 {
+		p.hub.BroadcastCommand("peer-added", added)
+	}
+}
+
+// sendPeers sends the list of all peers to the given socket, which will
+// then be kept up to date with each change we announce.
+//
+// We send the current list, rather than that we last announced, so that
+// a client which joins while changes are pending isn't sent a stale one.
+func (p *Server) sendPeers(socket *shared.Socket) error {
+	peers := p.federatedPeers()
+	for _, peer := range p.localPeers() {
+		peers = append(peers, shared.EncodePeer(peer))
+	}
+	sort.Strings(peers)
+
+	return socket.SendCommand("update-peers", peers...)
+}
+
+// hookClient describes a connecting client to our `up` and `down` hooks,
+// which receive it as JSON upon STDIN, and in their environment.
+type hookClient struct {
+	// Name is the name of the client, and Network that of the network
+	// it joined.
+	Name    string
+	Network string
+
+	// InternalIP is the VPN IP of the client, ExternalIP the public IP
+	// it connected from, and RawIP the address which connected to us,
+	// which differs if it came via a proxy.
+	InternalIP string
+	ExternalIP string
+	RawIP      string
+
+	// Group is the group of the client, if any.
+	Group string `json:",omitempty"`
+
+	// MACs are the MAC-addresses the client is restricted to, if any.
+	MACs []string `json:",omitempty"`
+
+	// TLS is true if the client connected over TLS, to us or to our
+	// proxy.
+	TLS bool
+
+	// Device is the name of the client's device upon the server, if it
+	// has one.
+	Device string `json:",omitempty"`
+
+	// Version is the version of the client, if it told us.
+	Version string `json:",omitempty"`
+
+	// Routes and Tags are the metadata the client sent us.
+	Routes []string `json:",omitempty"`
+	Tags   []string `json:",omitempty"`
+
+	// Connected is when the client connected.
+	Connected time.Time
+}
+
+// env returns the environment passed to our hooks.
+func (h *hookClient) env() []string {
+	tls := "false"
+	if h.TLS {
+		tls = "true"
+	}
+	return []string{
+		"INTERNAL_IP=" + h.InternalIP,
+		"EXTERNAL_IP=" + h.ExternalIP,
+		"RAW_IP=" + h.RawIP,
+		"NAME=" + h.Name,
+		"NETWORK=" + h.Network,
+		"GROUP=" + h.Group,
+		"ASSIGNED_MAC=" + strings.Join(h.MACs, ","),
+		"TLS=" + tls,
+		"VERSION=" + h.Version,
+		"DEVICE=" + h.Device,
+	}
+}
+
+// runHook runs the hook-command with the given name, if one has been
+// configured, passing it the given client.
+func (p *Server) runHook(name string, client *hookClient) error {
+	stdin, err := json.Marshal(client)
+	if err != nil {
+		return err
+	}
+	hook := shared.Hook{
+		Name:    name,
+		Command: p.Config.Get(name),
+		Timeout: time.Duration(p.Config.GetIntWithDefault("hook_timeout", int(shared.DefaultHookTimeout/time.Second))) * time.Second,
+		Env:     client.env(),
+		Stdin:   stdin,
+	}
+	return hook.Run()
+}
+
+// viaTLS returns true if the given request was made over TLS, to us or
+// to one of the given trusted proxies, which tell us via the
+// X-Forwarded-Proto header.
+func viaTLS(request *http.Request, trusted *Proxies) bool {
+	if request.TLS != nil {
+		return true
+	}
+	if !fromProxy(request, remoteAddr(request), trusted) {
+		return false
+	}
+	return strings.EqualFold(request.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// loadSources parses the networks each client may connect from, keyed
+// by its name in lower-case.
+func loadSources(cfg *config.Reader) (map[string][]*net.IPNet, error) {
+	lists, err := namedSettings(cfg, "source_")
+	if err != nil {
+		return nil, err
+	}
+
+	sources := make(map[string][]*net.IPNet)
+	for name, list := range lists {
+		sources[name], err = shared.ParseNetworks(list)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source_%s: %s", name, err.Error())
+		}
+	}
+	return sources, nil
+}
+
+// allowedSource returns true if the named client may connect from the
+// given address, which it may from anywhere unless it has a `source_NAME`.
+func (p *Server) allowedSource(name string, remote string) bool {
+	sources, ok := p.sources[strings.ToLower(name)]
+	if !ok {
+		return true
+	}
+	ip := net.ParseIP(remote)
+	return ip != nil && shared.NetworksContain(sources, ip)
+}
+
+// serveWs is the handler which the VPN-clients will hit.
+//
+// When we get a new connection we ensure that the key matches
+// the one we have configured, and if so wire it up.
+//
+// We create a new TUN interface for each connecting client,
+// which is used to transfer data back & forth.
+//
+// We keep track of which clients have connected and ensure
+// that we cleanup when they exit.
+func (p *Server) serveWs(w http.ResponseWriter, r *http.Request) {
+
+	//
+	// Get the name of the remote-client
+	//
+	name := r.URL.Query().Get("name")
+
+	//
+	// Other servers may connect to us, to form a federated VPN.
+	//
+	if r.URL.Query().Get("federation") != "" {
+		p.serveFederation(w, r)
+		return
+	}
+
+	//
+	// Names appear in the peer-list of every client, so we refuse
+	// any which might break it, or their hooks.
+	//
+	err := validClientName(name)
+	if err != nil {
+		log.Printf("[S] Refused client: %s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Invalid name: " + err.Error()))
+		return
+	}
+
+	//
+	// Our gates may refuse connections from some addresses, before we
+	// look any further.
+	//
+	if len(p.gates) > 0 {
+		_, remote := RemoteIP(r, p.trustedProxies)
+		if p.gated(name, remote) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Refused"))
+			return
+		}
+	}
+
+	//
+	// Get the shared-key
+	//
+	key := r.URL.Query().Get("key")
+
+	//
+	// If the key doesn't match our own then we'll abort.  Reserved
+	// names must present their own key instead.
+	//
+	if want := p.clientKey(name); want == "" || want != key {
+		if _, ok := p.reserved(name); ok {
+			log.Printf("[S] Refused client %s, which claimed a reserved name without its key", name)
+		}
+		_, remote := RemoteIP(r, p.trustedProxies)
+		p.emit(EventAuthFailure, name, "", remote)
+
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Invalid/missing shared-secret"))
+		return
+	}
+
+	//
+	// Our plugin may refuse the client too.
+	//
+	if p.plugin != nil && p.plugin.auth {
+		_, remote := RemoteIP(r, p.trustedProxies)
+		allowed, reason := p.plugin.authorise(p.network, name, remote)
+		if !allowed {
+			log.Printf("[S] Plugin refused client %s: %s", name, reason)
+			p.emit(EventAuthFailure, name, "", remote)
+
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("403 - Refused"))
+			return
+		}
+	}
+
+	//
+	// Clients may be restricted to connecting from some networks, and
+	// if their key is used elsewhere it might have leaked.
+	//
+	if _, remote := RemoteIP(r, p.trustedProxies); !p.allowedSource(name, remote) {
+		var allowed []string
+		for _, network := range p.sources[strings.ToLower(name)] {
+			allowed = append(allowed, network.String())
+		}
+		log.Printf("[S] Refused client %s, connecting from %s outside of its source networks", name, remote)
+		p.events.emit(Event{Type: EventSourceMismatch, Network: p.network, Name: name, Remote: remote, Message: strings.Join(allowed, ", ")})
+
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Refused"))
+		return
+	}
+
+	//
+	// Clients with a schedule may only connect during it.
+	//
+	if !p.scheduled(name) {
+		_, remote := RemoteIP(r, p.trustedProxies)
+		log.Printf("[S] Refused client %s, outside of its schedule", name)
+		p.emit(EventAuthFailure, name, "", remote)
+
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - Outside of permitted hours"))
+		return
+	}
+
+	//
+	// If we're being drained for maintenance we don't accept new
+	// clients.
+	//
+	if p.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("503 - Not accepting new clients"))
+		return
+	}
+
+	//
+	// Probes only want to know that they could connect.
+	//
+	if r.URL.Query().Get("probe") != "" {
+		p.serveProbe(w, r)
+		return
+	}
+
+	//
+	// Clients tell us the framing of their device, and we can't route
+	// Ethernet frames by IP.  Older clients don't say, but their
+	// devices carry IP packets.
+	//
+	if p.framing == shared.FramingIP && r.URL.Query().Get("framing") == "ethernet" {
+		log.Printf("[S] Refused client %s, whose device carries Ethernet frames", name)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - This network routes IP packets, not Ethernet frames"))
+		return
+	}
+
+	//
+	// We may refuse a client whose name is already in use.
+	//
+	_, found := p.connectedNamed(name)
+	if found && p.rejectDuplicates() {
+		log.Printf("[S] Refused client %s, whose name is already in use", name)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409 - Name already in use"))
+		return
+	}
+
+	//
+	// We may refuse clients beyond our max_clients, unless they're
+	// replacing their own connection.
+	//
+	if !found && p.full() {
+		log.Printf("[S] Refused client %s, as we're serving max_clients already", name)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("503 - Too many clients"))
+		return
+	}
+
+	//
+	// Agree whether the client's frames are compressed, and
+	// encrypted.
+	//
+	upgrader, header, ciphers, err := p.negotiate(name, key, r)
+	if err != nil {
+		log.Printf("[S] Refused client %s: %s", name, err.Error())
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - " + err.Error()))
+		return
+	}
+
+	//
+	// Upgrade the websocket connection.
+	//
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		log.Printf("[S] Error upgrading to WS: %v", err)
+		return
+	}
+	p.ws.Configure(conn)
+
+	//
+	// Get the source of the connection.
+	//
+	raw, ip := RemoteIP(r, p.trustedProxies)
+	via := RemoteChain(r, p.trustedProxies)
+	if raw != ip || len(via) > 1 {
+		fmt.Printf("Connection from IP:%s [via %s]\n", ip, strings.Join(via, ", "))
+	} else {
+		fmt.Printf("Connection from IP:%s\n", ip)
+	}
+
+	//
+	// Assign an IP address for the connecting-client.
+	//
+	//
+	// If the client is in a group we use its policy.
+	//
+	pol := p.policyFor(name)
+	pool := p.pool
+	if pol != nil && pol.pool != nil {
+		pool = pol.pool
+	}
+
+	//
+	// A client which reconnects, before we've noticed that it went
+	// away, replaces its previous connection.
+	//
+	if previous, found := p.connectedNamed(name); found && previous != nil {
+		p.replaceClient(name, previous)
+	}
+
+	clientIP := ""
+	clientIP, err = p.pickIP(name, ip, raw, pool)
+	if err != nil {
+		conn.Close()
+		log.Printf("[S] Cannot connect new client: %s", err.Error())
+		return
+	}
+
+	//
+	// Record the metadata the client sent, which its peers will see.
+	// Routes which aren't valid networks are ignored.
+	//
+	var routes []string
+	var networks []*net.IPNet
+	for _, route := range shared.SplitList(r.URL.Query().Get("routes")) {
+		if _, network, err := net.ParseCIDR(route); err == nil {
+			routes = append(routes, route)
+
+			//
+			// We don't route our own IP to a client.
+			//
+			if !network.Contains(net.ParseIP(p.serverIP)) {
+				networks = append(networks, network)
+			}
+		}
+	}
+	hc := &hookClient{
+		Name:       name,
+		Network:    p.network,
+		InternalIP: clientIP,
+		ExternalIP: ip,
+		RawIP:      raw,
+		Group:      p.Config.Get("group_" + name),
+		MACs:       shared.SplitList(p.Config.Get("macs_" + name)),
+		TLS:        viaTLS(r, p.trustedProxies),
+		Version:    r.URL.Query().Get("version"),
+		Routes:     routes,
+		Tags:       shared.SplitList(r.URL.Query().Get("tags")),
+		Connected:  p.inherited.connectedAt(p.network, name),
+	}
+	p.assignedMutex.Lock()
+	if p.assigned[clientIP] != nil {
+		p.assigned[clientIP].connected = hc.Connected
+		p.assigned[clientIP].routes = hc.Routes
+		p.assigned[clientIP].tags = hc.Tags
+	}
+	p.assignedMutex.Unlock()
+
+	//
+	// Show what we found.
+	//
+	fmt.Printf("Client '%s' [IP:%s] assigned %s\n", name, ip, clientIP)
+
+	//
+	// Create an interface for the client, unless we're only relaying
+	// or we switch all traffic via our own device.
+	//
+	var queues []shared.TunDevice
+	if !p.relayOnly() && p.clientDevices() {
+		queues, err = p.openClientDevice(name)
+		if err != nil {
+			log.Printf("[S] Error creating new TUN: %v", err)
+			conn.Close()
+			return
+		}
+		hc.Device = queues[0].Name()
+		if p.exitNode() {
+			p.routeClient(hc.Device, clientIP)
+		}
+	}
+
+	//
+	// Our `up` hook is run in the background, so that a slow one
+	// doesn't delay the client, unless configured otherwise.  The
+	// `down` hook waits for it.
+	//
+	upDone := make(chan struct{})
+
+	//
+	// Setup a socket for this connection.
+	//
+	socket := shared.MakeSocket(clientIP, conn, nil,
+		//
+		// This is the reaper-function which is invoked
+		// when the client goes away, and will ensure
+		// that our IP-record is removed, such that
+		// we don't leak connected-counts (and also that
+		// we free up the IP that was previously assigned).
+		//
+		func(sock *shared.Socket, x string) {
+			p.assignedMutex.Lock()
+
+			// Only reap if we've not already done so.
+			reaped := false
+			if p.assigned[x] != nil {
+				log.Printf("Reaped dead-client with IP %s\n", x)
+				p.assigned[x] = nil
+				reaped = true
+			}
+
+			p.assignedMutex.Unlock()
+
+			if reaped && hc.Device != "" && p.exitNode() {
+				p.run.removeRoute(p.network, x)
+			}
+
+			//
+			// If we're upgrading the client is moving to our
+			// successor, so hasn't really gone away.
+			//
+			if p.upgradingNow() {
+				return
+			}
+
+			//
+			// Launch the "down" script, if we can.
+			//
+			if reaped {
+				<-upDone
+				err := p.runHook("down", hc)
+				if err != nil {
+					fmt.Printf("Failed to run down-script - %s\n", err.Error())
+				}
+				p.emit(EventPeerDisconnected, name, clientIP, ip)
+				p.seenInventory(name)
+			}
+
+			//
+			// Update our peers.
+			//
+			p.refreshPeers()
+		})
+
+	if ciphers != nil {
+		socket.SetCiphers(ciphers)
+	}
+	socket.SetHub(p.hub)
+	socket.SetBroadcastLimit(p.Config.GetIntWithDefault("broadcast_limit", 0))
+	socket.SetLoopDetection(p.Config.Get("drop_loops") == "true")
+	socket.SetMACLimit(p.Config.GetIntWithDefault("mac_limit", 1))
+	socket.SetQueueDepth(p.Config.GetIntWithDefault("queue_depth", shared.DefaultQueueDepth))
+	socket.SetClassify(p.classifyTraffic())
+	socket.SetMTU(p.MTU)
+	socket.SetFraming(p.framing, networks...)
+	commandLimit := p.Config.GetIntWithDefault("command_limit", 20)
+	socket.SetCommandLimit(commandLimit, commandLimit*10)
+	if allow := p.clientPolicy("allow_commands", name, p.Config.Get("allow_commands")); allow != "" {
+		socket.AllowCommands(shared.SplitList(allow))
+	}
+
+	//
+	// Clients may ask us to notice quickly that they've gone away,
+	// otherwise our own keepalive applies.
+	//
+	keepalive := r.URL.Query().Get("keepalive")
+	if keepalive == "" {
+		keepalive = p.clientPolicy("keepalive", name, p.Config.Get("keepalive"))
+	}
+	profile, err := shared.LookupKeepalive(keepalive)
+	if err != nil {
+		log.Printf("[S] Client %s: %s", name, err.Error())
+	} else {
+		socket.SetKeepaliveProfile(profile)
+	}
+	if macs, ok := p.macs[name]; ok {
+		socket.SetAllowedMACs(macs)
+	}
+	//
+	// The client's traffic may be limited to a rate, which may be
+	// changed while it is connected, and by the policy of its group.
+	//
+	var filters shared.Filters
+	var limit *clientLimit
+	if rate := p.clientRate(name); rate > 0 || p.mutable() {
+		limit = newClientLimit(rate)
+		filters = append(filters, limit)
+	}
+	if pol != nil {
+		if filter := pol.filter(p.serverIP); filter != nil {
+			filters = append(filters, filter)
+		}
+	}
+	if len(filters) > 0 {
+		socket.SetFilter(filters)
+	}
+	if len(queues) > 0 {
+		socket.SetInterface(queues[0], queues[1:]...)
+	}
+
+	p.assignedMutex.Lock()
+	if p.assigned[clientIP] != nil {
+		p.assigned[clientIP].socket = socket
+		p.assigned[clientIP].device = hc.Device
+		p.assigned[clientIP].limit = limit
+	}
+	p.assignedMutex.Unlock()
+
+	//
+	// When a new client connects to the server it will send
+	// a "refresh" command.
+	//
+	// The refresh command will send it the list of all
+	// known-connections, and tell the other peers about it.
+	//
+	// i.e. When host 3 joins the VPN host1 & host2 will be told
+	// about it.
+	//
+	// Each refresh is sent to every linked server, so a client may
+	// only ask for a few.
+	//
+	refreshLimit := shared.NewRateLimiter(1, 5)
+	socket.AddCommandHandler("refresh-peers", func(args []string) error {
+		if !refreshLimit.Allow(1) {
+			return fmt.Errorf("too many refreshes")
+		}
+		p.refreshPeers()
+		return p.sendPeers(socket)
+	})
+
+	//
+	// Clients periodically report upon their health.
+	//
+	socket.AddCommandHandler("report", func(args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected a single report")
+		}
+		report, err := shared.DecodeReport(args[0])
+		if err != nil {
+			return err
+		}
+		p.recordReport(clientIP, report)
+		return nil
+	})
+
+	//
+	// Clients may forward their warnings, and errors, to us.  These
+	// are limited so that a misbehaving client cannot fill our disk.
+	//
+	logLimit := shared.NewRateLimiter(5, 50)
+	socket.AddCommandHandler("log", func(args []string) error {
+		if logLimit.Allow(1) {
+			p.clientLog(name, strings.Join(args, "|"))
+		}
+		return nil
+	})
+
+	//
+	// Clients report the result of the actions we ask them to perform.
+	//
+	socket.AddCommandHandler("exec-result", func(args []string) error {
+		p.execResult(name, clientIP, args)
+		return nil
+	})
+
+	//
+	// Clients which are stopped say goodbye before they disconnect.
+	//
+	socket.AddCommandHandler("goodbye", func(args []string) error {
+		log.Printf("[S] Client %s said goodbye", name)
+		return nil
+	})
+
+	//
+	// Clients may change their MTU, and keepalive, while connected.
+	//
+	socket.AddCommandHandler("set-mtu", func(args []string) error {
+		return acceptMTU(name, hc.Device, socket, args)
+	})
+	socket.AddCommandHandler("set-keepalive", func(args []string) error {
+		return acceptKeepalive(name, socket, args)
+	})
+
+	//
+	// Clients may ask us to introduce them to each other, so that they
+	// can form direct paths.
+	//
+	p2pLimit := shared.NewRateLimiter(2, 20)
+	socket.AddCommandHandler("p2p-candidates", func(args []string) error {
+		return p.setCandidates(clientIP, args)
+	})
+	socket.AddCommandHandler("p2p-request", func(args []string) error {
+		if !p2pLimit.Allow(1) {
+			return fmt.Errorf("too many introductions")
+		}
+		return p.introduce(clientIP, args)
+	})
+
+	//
+	// Clients measure the path to each other via us, so we pass on
+	// their pings, and the answers.
+	//
+	pingLimit := shared.NewRateLimiter(10, 100)
+	for _, cmd := range []string{"p2p-ping", "p2p-pong"} {
+		cmd := cmd
+		socket.AddCommandHandler(cmd, func(args []string) error {
+			if !pingLimit.Allow(1) {
+				return fmt.Errorf("too many pings")
+			}
+			return p.relayPing(clientIP, cmd, args)
+		})
+	}
+
+	//
+	// Launch the "up" script, if we can.
+	//
+	up := func() {
+		defer close(upDone)
+		err := p.runHook("up", hc)
+		if err != nil {
+			fmt.Printf("Failed to run up-script - %s\n", err.Error())
+		}
+	}
+	if p.Config.Get("up_async") == "false" {
+		up()
+	} else {
+		go up()
+	}
+	p.events.emit(Event{Type: EventPeerConnected, Network: p.network, Name: name, IP: clientIP, Remote: ip, Via: via})
+	p.recordConnect(name)
+	p.recordInventory(name, clientIP, ip)
+
+	//
+	// Send the `init` command to the client, which will ensure that
+	// it configures itself.
+	//
+	// Arguments:
+	//
+	//    1.2.3.0/24 |  -> cidr-range of vpn
+	//    1.2.3.4    |  -> actual assigned IP
+	//    mtu        |  -> MTU
+	//    1.2.3.0    |  -> (internal) IP of VPN-server
+	//    routes     |  -> comma-separated extra routes, perhaps empty
+	//
+	// Anything else is sent as "key=value", which older clients
+	// ignore, after the routes so they're never mistaken for them:
+	//
+	//    framing=ip    -> "ethernet", or "ip"
+	//
+	args := []string{p.subnet, clientIP, fmt.Sprintf("%d", p.MTU), p.serverIP, ""}
+	if pol != nil && len(pol.routes) > 0 {
+		args[4] = strings.Join(pol.routes, ",")
+	}
+	args = append(args, "framing="+p.framing.String())
+
+	//
+	// Clients which may form direct paths are told where our STUN
+	// responder is, before they configure themselves.
+	//
+	if p.stunPort != 0 && p.p2pEnabled() && pol == nil {
+		socket.SendCommand("p2p-stun", fmt.Sprintf("%d", p.stunPort))
+	}
+
+	//
+	// Tell the client which of its commands we accept, now that all
+	// our handlers are in place.
+	//
+	socket.AdvertiseCommands()
+	socket.SendCommand("init", args...)
+
+	socket.Serve(p.ctx)
+	socket.Wait()
+}
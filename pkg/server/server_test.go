@@ -0,0 +1,84 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skx/simple-vpn/config"
+)
+
+// TestAllowedSource ensures that clients are held to their `source_NAME`
+// however they capitalise their names.
+func TestAllowedSource(t *testing.T) {
+	cfg, err := config.Parse("source_laptop = 203.0.113.0/24\nsource_Phone = 198.51.100.7\n")
+	if err != nil {
+		t.Fatalf("failed to parse our configuration: %s", err)
+	}
+	sources, err := loadSources(cfg)
+	if err != nil {
+		t.Fatalf("failed to load our sources: %s", err)
+	}
+	p := &Server{Config: cfg, sources: sources}
+
+	tests := []struct {
+		name     string
+		remote   string
+		expected bool
+	}{
+		{"laptop", "203.0.113.5", true},
+		{"laptop", "192.0.2.1", false},
+		{"Laptop", "192.0.2.1", false},
+		{"LAPTOP", "192.0.2.1", false},
+		{"LAPTOP", "203.0.113.5", true},
+		{"phone", "192.0.2.1", false},
+		{"PHONE", "198.51.100.7", true},
+		{"laptop", "", false},
+		{"desktop", "192.0.2.1", true},
+	}
+
+	for _, test := range tests {
+		if allowed := p.allowedSource(test.name, test.remote); allowed != test.expected {
+			t.Errorf("expected %s from %q to be allowed: %t, got %t", test.name, test.remote, test.expected, allowed)
+		}
+	}
+}
+
+// TestLoadSourcesDuplicate ensures that two sources for the same name,
+// in different cases, are refused rather than one silently winning.
+func TestLoadSourcesDuplicate(t *testing.T) {
+	cfg, err := config.Parse("source_laptop = 203.0.113.0/24\nsource_Laptop = 0.0.0.0/0\n")
+	if err != nil {
+		t.Fatalf("failed to parse our configuration: %s", err)
+	}
+	if _, err := loadSources(cfg); err == nil {
+		t.Errorf("expected duplicate sources to be refused")
+	}
+}
+
+// TestInterval ensures that the intervals of our periodic tasks must be
+// positive.
+func TestInterval(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected time.Duration
+		valid    bool
+	}{
+		{"", 60 * time.Second, true},
+		{"events_interval = 5\n", 5 * time.Second, true},
+		{"events_interval = 0\n", 0, false},
+		{"events_interval = -1\n", 0, false},
+	}
+
+	for _, test := range tests {
+		cfg, err := config.Parse(test.config)
+		if err != nil {
+			t.Fatalf("failed to parse our configuration: %s", err)
+		}
+		p := &Server{Config: cfg}
+
+		interval, err := p.interval("events_interval", 60)
+		if (err == nil) != test.valid || interval != test.expected {
+			t.Errorf("%q: expected %s, got %s, %v", test.config, test.expected, interval, err)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+// pkg/server/state.go contains the settings which may be changed at
+// runtime, via our admin API, rather than by editing our configuration
+// and restarting.
+//
+// Operators may add, and remove, the static lease of each client, the
+// rules which filter the traffic of our clients, and the rate to which
+// each client is limited.  Each change is persisted to our `state_file`,
+// which is loaded when we start, and overrides our configuration:
+//
+//   host_NAME = IP      -> Leases
+//   filter_N  = RULE    -> Rules
+//   rate_NAME = BYTES   -> Rates
+//
+// Changes can't be made unless a `state_file` is set, so that they are
+// never silently lost when we restart.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// State holds the settings of a network which were changed at runtime.
+type State struct {
+	// Leases holds the static IP of each client, by name.
+	Leases map[string]string
+
+	// Rules holds our filter rules, by number.
+	Rules map[string]string
+
+	// Rates holds the bytes per second each client may send, by name.
+	Rates map[string]int
+}
+
+// runtimeState holds our State, and applies it.
+type runtimeState struct {
+	// path is the file our state is persisted to, which is empty if
+	// our state may not be changed.
+	path string
+
+	// state is protected by the mutex.
+	state State
+	mutex sync.Mutex
+
+	// rules holds the shared.Filter which applies our configured, and
+	// runtime, rules, or nil if there are none.
+	rules atomic.Value
+}
+
+// rulesFilter wraps a filter, so that it may be stored in an atomic.Value
+// even if it is nil.
+type rulesFilter struct {
+	filter shared.Filter
+}
+
+// loadState loads our runtime state from our `state_file`, if it exists,
+// and compiles our filter rules.
+func (p *Server) loadState() error {
+	p.state = &runtimeState{path: p.Config.Get("state_file")}
+	p.state.state = State{}.copy()
+
+	if p.state.path != "" {
+		state, err := readState(p.state.path)
+		if err != nil {
+			return err
+		}
+		p.state.state = state
+	}
+	return p.compileRules(p.state.state.Rules)
+}
+
+// readState reads the state persisted to the given file, which is empty
+// if the file doesn't exist.
+func readState(path string) (State, error) {
+	var state State
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return state, fmt.Errorf("failed to read our state: %s", err.Error())
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return state, fmt.Errorf("failed to parse our state in %s: %s", path, err.Error())
+		}
+	}
+	return state.copy(), nil
+}
+
+// compileRules compiles our configured rules, overridden by the given
+// runtime rules, and applies them to the traffic of our clients.
+func (p *Server) compileRules(runtime map[string]string) error {
+	settings := p.Config.GetPrefixed("filter_")
+	for number, rule := range runtime {
+		settings[number] = rule
+	}
+	rules, err := shared.ParseRules(settings)
+	if err != nil {
+		return err
+	}
+	p.state.rules.Store(rulesFilter{filter: rules})
+	return nil
+}
+
+// filterRules applies our current rules to the given frame.
+func (p *Server) filterRules(frame *shared.Frame) shared.Verdict {
+	rules := p.state.rules.Load().(rulesFilter)
+	if rules.filter == nil {
+		return shared.Accept
+	}
+	return rules.filter.Filter(frame)
+}
+
+// mutable returns true if our state may be changed at runtime.
+func (p *Server) mutable() bool {
+	return p.state.path != ""
+}
+
+// saveState persists our state to our `state_file`.
+//
+// NOTE: The caller must hold the state's mutex.
+func (p *Server) saveState() error {
+	data, err := json.MarshalIndent(p.state.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeAtomic(p.state.path, append(data, '\n'))
+}
+
+// writeAtomic writes the given data to the given path, via a temporary
+// file in the same directory, which is renamed into place.  So a partial
+// file is never mistaken for a complete one.
+func writeAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".simple-vpn")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// copy returns a copy of the state, which may be changed independently.
+func (s State) copy() State {
+	out := State{Leases: map[string]string{}, Rules: map[string]string{}, Rates: map[string]int{}}
+	for name, ip := range s.Leases {
+		out.Leases[name] = ip
+	}
+	for number, rule := range s.Rules {
+		out.Rules[number] = rule
+	}
+	for name, rate := range s.Rates {
+		out.Rates[name] = rate
+	}
+	return out
+}
+
+// currentState returns a copy of our runtime state.
+func (p *Server) currentState() State {
+	p.state.mutex.Lock()
+	defer p.state.mutex.Unlock()
+	return p.state.state.copy()
+}
+
+// changeState applies the given change to a copy of our state, which
+// replaces our state, and is persisted, if the change succeeds.
+func (p *Server) changeState(change func(state *State) error) error {
+	if !p.mutable() {
+		return fmt.Errorf("no state_file is configured, so changes cannot be persisted")
+	}
+
+	p.state.mutex.Lock()
+	defer p.state.mutex.Unlock()
+
+	state := p.state.state.copy()
+	err := change(&state)
+	if err != nil {
+		return err
+	}
+
+	previous := p.state.state
+	p.state.state = state
+	err = p.saveState()
+	if err != nil {
+		p.state.state = previous
+		p.compileRules(previous.Rules)
+		return fmt.Errorf("failed to save our state: %s", err.Error())
+	}
+	return nil
+}
+
+// fixedIP returns the static IP of the named client, if it has one.
+func (p *Server) fixedIP(name string) string {
+	p.state.mutex.Lock()
+	ip, ok := p.state.state.Leases[name]
+	p.state.mutex.Unlock()
+
+	if ok {
+		return ip
+	}
+	return p.Config.Get("host_" + name)
+}
+
+// setLease gives the named client the given static IP, which it will be
+// assigned when it next connects.
+func (p *Server) setLease(name string, ip string) error {
+	if err := validClientName(name); err != nil {
+		return err
+	}
+	addr := net.ParseIP(ip)
+	_, subnet, err := net.ParseCIDR(p.subnet)
+	if addr == nil || err != nil || !subnet.Contains(addr) {
+		return fmt.Errorf("the lease %s is not an IP within the subnet %s", ip, p.subnet)
+	}
+	if addr.Equal(net.ParseIP(p.serverIP)) {
+		return fmt.Errorf("the lease %s is the IP of the server", ip)
+	}
+
+	return p.changeState(func(state *State) error {
+		for other, leased := range state.Leases {
+			if other != name && net.ParseIP(leased).Equal(addr) {
+				return fmt.Errorf("the IP %s is already leased to %s", ip, other)
+			}
+		}
+		state.Leases[name] = addr.String()
+		return nil
+	})
+}
+
+// removeLease removes the static IP the named client was given at
+// runtime.
+func (p *Server) removeLease(name string) error {
+	return p.changeState(func(state *State) error {
+		if _, ok := state.Leases[name]; !ok {
+			return fmt.Errorf("%s has no lease", name)
+		}
+		delete(state.Leases, name)
+		return nil
+	})
+}
+
+// setRule sets the filter rule with the given number, which applies to
+// the traffic of our clients at once.
+func (p *Server) setRule(number string, rule string) error {
+	if _, err := strconv.Atoi(number); err != nil {
+		return fmt.Errorf("rules must be numbered")
+	}
+	return p.changeState(func(state *State) error {
+		state.Rules[number] = rule
+		return p.compileRules(state.Rules)
+	})
+}
+
+// removeRule removes the filter rule with the given number, which was
+// set at runtime.
+func (p *Server) removeRule(number string) error {
+	return p.changeState(func(state *State) error {
+		if _, ok := state.Rules[number]; !ok {
+			return fmt.Errorf("there is no rule %s", number)
+		}
+		delete(state.Rules, number)
+		return p.compileRules(state.Rules)
+	})
+}
+
+// setRate limits the named client to sending the given number of bytes
+// per second, which applies at once if it is connected.  Zero removes
+// the limit.
+func (p *Server) setRate(name string, rate int) error {
+	if err := validClientName(name); err != nil {
+		return err
+	}
+	if rate < 0 {
+		return fmt.Errorf("the rate must not be negative")
+	}
+	err := p.changeState(func(state *State) error {
+		state.Rates[name] = rate
+		return nil
+	})
+	if err == nil {
+		p.applyRate(name)
+	}
+	return err
+}
+
+// removeRate removes the rate-limit the named client was given at
+// runtime.
+func (p *Server) removeRate(name string) error {
+	err := p.changeState(func(state *State) error {
+		if _, ok := state.Rates[name]; !ok {
+			return fmt.Errorf("%s has no rate-limit", name)
+		}
+		delete(state.Rates, name)
+		return nil
+	})
+	if err == nil {
+		p.applyRate(name)
+	}
+	return err
+}
+
+// clientRate returns the bytes per second the named client may send, or
+// zero if it isn't limited.
+func (p *Server) clientRate(name string) int {
+	p.state.mutex.Lock()
+	rate, ok := p.state.state.Rates[name]
+	p.state.mutex.Unlock()
+
+	if ok {
+		return rate
+	}
+	return p.Config.GetIntWithDefault("rate_"+name, 0)
+}
+
+// applyRate applies the current rate-limit of the named client, if it
+// is connected.
+func (p *Server) applyRate(name string) {
+	rate := p.clientRate(name)
+
+	p.assignedMutex.Lock()
+	defer p.assignedMutex.Unlock()
+
+	for _, client := range p.assigned {
+		if client != nil && client.name == name && client.limit != nil {
+			client.limit.set(rate)
+		}
+	}
+}
+
+// clientLimit limits the traffic a client sends to a rate, which may be
+// changed while it is connected.
+type clientLimit struct {
+	// rate is the bytes per second the client may send, or zero if it
+	// isn't limited.  It is accessed atomically.
+	rate    int64
+	limiter *shared.RateLimiter
+}
+
+// newClientLimit returns a limit of the given rate.
+func newClientLimit(rate int) *clientLimit {
+	l := &clientLimit{limiter: shared.NewRateLimiter(1, 1)}
+	l.set(rate)
+	return l
+}
+
+// set changes the rate of the limit.
+func (l *clientLimit) set(rate int) {
+	if rate > 0 {
+		l.limiter.SetRate(rate, rate)
+	}
+	atomic.StoreInt64(&l.rate, int64(rate))
+}
+
+// Filter drops the frames which exceed our rate.
+func (l *clientLimit) Filter(frame *shared.Frame) shared.Verdict {
+	if atomic.LoadInt64(&l.rate) > 0 && !l.limiter.Allow(len(frame.Data)) {
+		return shared.Drop
+	}
+	return shared.Accept
+}
@@ -0,0 +1,79 @@
+// pkg/server/stun.go contains our STUN responder.
+//
+// Clients which form direct paths to each other need to learn their
+// public address, and if `stun` is set we'll tell them, so they don't
+// depend upon a third-party STUN server.  Traffic between clients which
+// cannot form a direct path is relayed over their websockets, as usual.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// serveSTUN answers STUN requests upon the given address, until the
+// context is cancelled.  We return the port we're listening upon.
+func (p *Server) serveSTUN(ctx context.Context, addr string) (int, error) {
+	udp, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid STUN address %s: %s", addr, err.Error())
+	}
+
+	conn, err := net.ListenUDP("udp", udp)
+	if err == nil {
+		fmt.Printf("Launching the STUN responder on %s\n", addr)
+		go p.answerSTUN(ctx, conn)
+		return conn.LocalAddr().(*net.UDPAddr).Port, nil
+	}
+	if p.inherited == nil {
+		return 0, fmt.Errorf("failed to launch the STUN responder: %s", err.Error())
+	}
+
+	//
+	// If we were upgraded then our predecessor might still be
+	// listening, until it has handed over, so we retry for a while.
+	//
+	go func() {
+		for attempt := 0; attempt < 60; attempt++ {
+			time.Sleep(time.Second)
+			conn, err = net.ListenUDP("udp", udp)
+			if err == nil {
+				p.answerSTUN(ctx, conn)
+				return
+			}
+		}
+		log.Printf("[S] Failed to launch the STUN responder: %s", err.Error())
+	}()
+	return udp.Port, nil
+}
+
+// answerSTUN answers the binding requests received upon the given
+// socket, until it is closed or the context is cancelled.
+func (p *Server) answerSTUN(ctx context.Context, conn *net.UDPConn) {
+	p.handover.mutex.Lock()
+	p.stun = conn
+	p.handover.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		reply := shared.STUNResponse(buf[:n], from)
+		if reply != nil {
+			conn.WriteToUDP(reply, from)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// pkg/server/subnet.go contains the checks we make upon our subnet when
+// we start, so that mistakes fail at once with a specific message, rather
+// than as mysterious routing problems once clients connect.
+//
+// We check that:
+//
+//   * The subnet doesn't overlap the networks of this host's interfaces,
+//     other than our own device, unless we only relay.
+//   * The routes our groups give their members don't overlap the subnet.
+//   * Each static `host_NAME` IP lies within the subnet, isn't its first
+//     address, and isn't given to two clients.
+//   * Our pool holds at least `max_clients` addresses, besides our own.
+//
+// Clients beyond `max_clients`, if it is set, are refused.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// overlaps returns true if either of the given networks contains the
+// other.
+func overlaps(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// poolCapacity returns the number of addresses of the given pool which
+// we can give to clients, stopping once we've counted the given limit.
+func poolCapacity(pool *net.IPNet, limit int) int {
+	count := 0
+	for i := pool.IP.Mask(pool.Mask); pool.Contains(i) && count <= limit; incIP(i) {
+		s := i.String()
+		if strings.HasSuffix(s, ".0") || strings.HasSuffix(s, ":") {
+			continue
+		}
+		count++
+	}
+
+	//
+	// The first address is our own.
+	//
+	return count - 1
+}
+
+// checkSubnet checks the sanity of the given subnet, and of the settings
+// which relate to it.
+func (p *Server) checkSubnet(subnet *net.IPNet) error {
+
+	//
+	// Our subnet mustn't overlap the networks this host is already
+	// upon, or our traffic, or theirs, will be routed the wrong way.
+	//
+	if !p.relayOnly() {
+		device := p.Config.GetWithDefault("device", "svpn")
+		ifaces, err := net.Interfaces()
+		if err == nil {
+			for _, iface := range ifaces {
+				if shared.MatchesDeviceTemplate(device, iface.Name) {
+					continue
+				}
+				addrs, err := iface.Addrs()
+				if err != nil {
+					continue
+				}
+				for _, addr := range addrs {
+					ipnet, ok := addr.(*net.IPNet)
+					if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+						continue
+					}
+					network := &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+					if overlaps(subnet, network) {
+						return fmt.Errorf("the subnet %s overlaps the network %s of the interface %s", subnet, network, iface.Name)
+					}
+				}
+			}
+		}
+	}
+
+	//
+	// The routes our groups give their members are those beyond the
+	// VPN, so mustn't overlap it.
+	//
+	var groups []string
+	for name := range p.policies {
+		groups = append(groups, name)
+	}
+	sort.Strings(groups)
+	for _, name := range groups {
+		for _, route := range p.policies[name].routes {
+			_, network, err := net.ParseCIDR(route)
+			if err == nil && overlaps(subnet, network) {
+				return fmt.Errorf("group %s: the route %s overlaps the subnet %s", name, route, subnet)
+			}
+		}
+	}
+
+	//
+	// Static IPs must be within our subnet, and given to one client.
+	//
+	hosts := p.Config.GetPrefixed("host_")
+	var names []string
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	owners := make(map[string]string)
+	for _, name := range names {
+		ip := net.ParseIP(hosts[name])
+		if ip == nil {
+			return fmt.Errorf("host_%s: %q is not an IP address", name, hosts[name])
+		}
+		if !subnet.Contains(ip) {
+			return fmt.Errorf("host_%s: the IP %s is not within the subnet %s", name, ip, subnet)
+		}
+		if ip.Equal(subnet.IP) {
+			return fmt.Errorf("host_%s: the IP %s is the address of the subnet %s itself", name, ip, subnet)
+		}
+		if other, ok := owners[ip.String()]; ok {
+			return fmt.Errorf("host_%s: the IP %s is also given to %s", name, ip, other)
+		}
+		owners[ip.String()] = name
+	}
+
+	//
+	// Our pool must be large enough for the clients we expect.
+	//
+	max := p.Config.GetIntWithDefault("max_clients", 0)
+	if max < 0 {
+		return fmt.Errorf("the max_clients must not be negative")
+	}
+	if max > 0 {
+		if capacity := poolCapacity(p.pool, max); capacity < max {
+			return fmt.Errorf("the pool %s holds %d addresses for clients, which is fewer than max_clients %d", p.pool, capacity, max)
+		}
+	}
+	return nil
+}
+
+// full returns true if we're serving `max_clients` clients already.
+func (p *Server) full() bool {
+	max := p.Config.GetIntWithDefault("max_clients", 0)
+	return max > 0 && p.clientCount() >= max
+}
@@ -0,0 +1,279 @@
+// pkg/server/throttle.go contains our throttling of the connections made
+// by each source address, which stops a single host from hammering us
+// with attempts to guess a key, or to exhaust our devices.
+//
+// Each address has a leaky bucket, which each attempt to connect fills by
+// one, and which drains at a steady rate.  Attempts which would overflow
+// it are refused, and an address which keeps overflowing it may be banned
+// for a while.  These settings apply to every network, so are read from
+// the top-level of the configuration file:
+//
+//   throttle_rate  - The attempts each address may make per minute, or
+//                    zero to disable throttling.
+//   throttle_burst - The attempts each address may make at once.
+//   throttle_ban   - The seconds for which an address is banned, once it
+//                    has been refused `throttle_burst` times in a row, or
+//                    zero to never ban addresses automatically.
+//
+// Addresses may also be banned, and unbanned, with the admin API.  Bans
+// are held in memory, so are forgotten when we restart.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/skx/simple-vpn/config"
+)
+
+// throttleSweep is how often we forget the buckets which have drained.
+const throttleSweep = time.Minute
+
+// bucket is the leaky bucket of a single address.
+type bucket struct {
+	// level is the number of attempts in the bucket, as of last.
+	level float64
+	last  time.Time
+
+	// overflows is the number of attempts refused in a row.
+	overflows int
+}
+
+// Ban describes an address which may not connect, for the admin API.
+type Ban struct {
+	// Address is the banned address.
+	Address string
+
+	// Until is when the ban expires, or the zero time if it doesn't.
+	Until time.Time
+
+	// Reason describes why the address was banned.
+	Reason string
+}
+
+// connectionThrottle limits the attempts to connect made by each source
+// address.
+type connectionThrottle struct {
+	// rate is the attempts which drain from each bucket per second, and
+	// burst the capacity of each.
+	rate  float64
+	burst float64
+
+	// banFor is how long an address is banned for once it has
+	// overflowed its bucket too often, if at all.
+	banFor time.Duration
+
+	// buckets holds the bucket of each address, and swept is when we
+	// last removed those which had drained.
+	buckets map[string]*bucket
+	swept   time.Time
+
+	// bans holds the addresses which are banned.
+	bans map[string]Ban
+
+	// throttled counts the attempts we refused, by reason.
+	throttled map[string]uint64
+
+	// mutex protects buckets, swept, bans, and throttled.
+	mutex sync.Mutex
+}
+
+// newConnectionThrottle returns the throttle configured by the given
+// settings.
+func newConnectionThrottle(cfg *config.Reader) (*connectionThrottle, error) {
+	rate := cfg.GetIntWithDefault("throttle_rate", 60)
+	burst := cfg.GetIntWithDefault("throttle_burst", 20)
+	ban := cfg.GetIntWithDefault("throttle_ban", 0)
+	if rate < 0 || burst < 1 || ban < 0 {
+		return nil, fmt.Errorf("the throttle_rate, and throttle_ban, must not be negative, and the throttle_burst must be at least 1")
+	}
+
+	return &connectionThrottle{
+		rate:      float64(rate) / 60,
+		burst:     float64(burst),
+		banFor:    time.Duration(ban) * time.Second,
+		buckets:   make(map[string]*bucket),
+		swept:     time.Now(),
+		bans:      make(map[string]Ban),
+		throttled: make(map[string]uint64),
+	}, nil
+}
+
+// protect wraps the given handler, so that attempts to connect from each
+// address, found behind the given trusted proxies, are throttled.
+func (t *connectionThrottle) protect(trusted *Proxies, next http.HandlerFunc) http.HandlerFunc {
+	if t == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, remote := RemoteIP(r, trusted)
+		if remote == "" {
+			next(w, r)
+			return
+		}
+		wait, reason := t.allow(remote, time.Now())
+		if reason == "" {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "429 - Too many connections", http.StatusTooManyRequests)
+	}
+}
+
+// allow records an attempt to connect from the given address, at the
+// given time.  If it is refused we return the reason, and how long the
+// address should wait before trying again.
+func (t *connectionThrottle) allow(remote string, now time.Time) (time.Duration, string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if ban, ok := t.bans[remote]; ok {
+		if ban.Until.IsZero() || now.Before(ban.Until) {
+			t.throttled["banned"]++
+			if ban.Until.IsZero() {
+				return throttleSweep, "banned"
+			}
+			return ban.Until.Sub(now), "banned"
+		}
+		delete(t.bans, remote)
+		log.Printf("[S] throttle event=unban remote=%s reason=expired", remote)
+	}
+
+	if t.rate == 0 {
+		return 0, ""
+	}
+	t.sweep(now)
+
+	b, ok := t.buckets[remote]
+	if !ok {
+		b = &bucket{last: now}
+		t.buckets[remote] = b
+	}
+	b.level = math.Max(0, b.level-now.Sub(b.last).Seconds()*t.rate)
+	b.last = now
+
+	if b.level+1 <= t.burst {
+		b.level++
+		b.overflows = 0
+		return 0, ""
+	}
+
+	b.overflows++
+	t.throttled["rate"]++
+	wait := time.Duration((b.level + 1 - t.burst) / t.rate * float64(time.Second))
+	log.Printf("[S] throttle event=refused remote=%s overflows=%d level=%.1f burst=%.0f", remote, b.overflows, b.level, t.burst)
+
+	if t.banFor > 0 && float64(b.overflows) >= t.burst {
+		t.bans[remote] = Ban{Address: remote, Until: now.Add(t.banFor), Reason: "throttled"}
+		delete(t.buckets, remote)
+		log.Printf("[S] throttle event=ban remote=%s overflows=%d duration=%s", remote, b.overflows, t.banFor)
+		return t.banFor, "banned"
+	}
+	return wait, "rate"
+}
+
+// sweep forgets the buckets which have drained, so that we don't grow
+// without bound.  The caller must hold our mutex.
+func (t *connectionThrottle) sweep(now time.Time) {
+	if now.Sub(t.swept) < throttleSweep {
+		return
+	}
+	t.swept = now
+
+	for remote, b := range t.buckets {
+		if b.level-now.Sub(b.last).Seconds()*t.rate <= 0 {
+			delete(t.buckets, remote)
+		}
+	}
+}
+
+// banAddress bans the given address for the given duration, or for ever
+// if that is zero.
+func (t *connectionThrottle) banAddress(address string, duration time.Duration, reason string) error {
+	ip := net.ParseIP(stripPort(address))
+	if ip == nil {
+		return fmt.Errorf("'%s' is not an IP address", address)
+	}
+	if duration < 0 {
+		return fmt.Errorf("the duration must not be negative")
+	}
+	if reason == "" {
+		reason = "admin"
+	}
+
+	ban := Ban{Address: ip.String(), Reason: reason}
+	if duration > 0 {
+		ban.Until = time.Now().Add(duration)
+	}
+
+	t.mutex.Lock()
+	t.bans[ban.Address] = ban
+	delete(t.buckets, ban.Address)
+	t.mutex.Unlock()
+
+	log.Printf("[S] throttle event=ban remote=%s duration=%s reason=%q", ban.Address, duration, reason)
+	return nil
+}
+
+// unbanAddress removes the ban of the given address.
+func (t *connectionThrottle) unbanAddress(address string) error {
+	ip := net.ParseIP(stripPort(address))
+	if ip == nil {
+		return fmt.Errorf("'%s' is not an IP address", address)
+	}
+
+	t.mutex.Lock()
+	_, ok := t.bans[ip.String()]
+	delete(t.bans, ip.String())
+	t.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%s is not banned", ip.String())
+	}
+	log.Printf("[S] throttle event=unban remote=%s reason=admin", ip.String())
+	return nil
+}
+
+// banList returns the addresses which are banned, sorted by address.
+func (t *connectionThrottle) banList() []Ban {
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	out := make([]Ban, 0)
+	for _, ban := range t.bans {
+		if ban.Until.IsZero() || now.Before(ban.Until) {
+			out = append(out, ban)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Address < out[j].Address
+	})
+	return out
+}
+
+// stats returns the number of addresses which are banned, and a copy of
+// the counts of the attempts we refused, by reason.
+func (t *connectionThrottle) stats() (int, map[string]uint64) {
+	bans := len(t.banList())
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	throttled := make(map[string]uint64)
+	for reason, count := range t.throttled {
+		throttled[reason] = count
+	}
+	return bans, throttled
+}
@@ -0,0 +1,108 @@
+// pkg/server/tune.go contains our renegotiation of the MTU, and
+// keepalive, of each client while it is connected, which allows them to
+// be tuned without the client reconnecting.
+//
+// Either we, or the client, may propose a change, which the other side
+// applies before replying.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// setDeviceMTU sets the MTU of the named device, if the client has one of
+// its own.  Clients which share our device send frames of any size over
+// their connection, so there is nothing for us to change.
+func setDeviceMTU(device string, mtu int) error {
+	if device == "" {
+		return nil
+	}
+	out, err := exec.Command("ip", "link", "set", "dev", device, "mtu", strconv.Itoa(mtu)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to set the MTU of %s: %s %s", device, err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// acceptMTU applies the MTU the named client proposed, to its device, and
+// its socket.
+func acceptMTU(name string, device string, socket *shared.Socket, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected an MTU")
+	}
+	mtu, err := shared.ParseMTU(args[0])
+	if err != nil {
+		return err
+	}
+	err = setDeviceMTU(device, mtu)
+	if err != nil {
+		return err
+	}
+	socket.SetMTU(mtu)
+	log.Printf("[S] Client %s changed its MTU to %d", name, mtu)
+	return nil
+}
+
+// acceptKeepalive applies the keepalive the named client proposed, to
+// its socket.
+func acceptKeepalive(name string, socket *shared.Socket, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a keepalive")
+	}
+	keepalive, err := shared.ParseKeepalive(args[0])
+	if err != nil {
+		return err
+	}
+	socket.SetKeepalive(keepalive)
+	log.Printf("[S] Client %s changed its keepalive to %s", name, keepalive)
+	return nil
+}
+
+// tune proposes the given MTU, and keepalive, to the given client, either
+// of which may be empty, and applies them once it has accepted.
+func (p *Server) tune(client connection, mtuStr string, keepaliveStr string) error {
+	var mtu int
+	var err error
+	if mtuStr != "" {
+		mtu, err = shared.ParseMTU(mtuStr)
+		if err != nil {
+			return err
+		}
+	}
+	if keepaliveStr != "" {
+		_, err = shared.ParseKeepalive(keepaliveStr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if mtuStr != "" {
+		err = client.socket.Request("set-mtu", mtuStr)
+		if err != nil {
+			return err
+		}
+		err = setDeviceMTU(client.device, mtu)
+		if err != nil {
+			return err
+		}
+		client.socket.SetMTU(mtu)
+		log.Printf("[S] Changed the MTU of client %s to %d", client.name, mtu)
+	}
+	if keepaliveStr != "" {
+		err = client.socket.Request("set-keepalive", keepaliveStr)
+		if err != nil {
+			return err
+		}
+		keepalive, _ := shared.ParseKeepalive(keepaliveStr)
+		client.socket.SetKeepalive(keepalive)
+		log.Printf("[S] Changed the keepalive of client %s to %s", client.name, keepalive)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+// pkg/server/update.go contains our notification of clients which run
+// an old version, so that a fleet of remote devices may be kept current.
+//
+// When a client reports a version other than `update_version` we tell it
+// where the new version may be downloaded from, `update_url`, in which
+// "{version}", "{os}", and "{arch}" are replaced with those of the new
+// version, and of the client.  Each client is treated according to the
+// `update` policy, which may be set for each client, or group, so that
+// an upgrade may be staged:
+//
+//	update         = notify    (the client logs that it may upgrade)
+//	update_canary  = install   (the client downloads, and installs, it)
+//	update_legacy  = off       (the client isn't told)
+//
+// Clients only install the new version if it was signed by the key they
+// trust, see `update_fingerprint` in their configuration.
+
+package server
+
+import (
+	"log"
+	"strings"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// updatePolicy returns how the named client should be told about a new
+// version, which is one of "notify", "install", or "off".
+func (p *Server) updatePolicy(name string) string {
+	fallback := p.Config.GetWithDefault("update", "notify")
+	if pol := p.policyFor(name); pol != nil && pol.update != "" {
+		fallback = pol.update
+	}
+	return p.clientPolicy("update", name, fallback)
+}
+
+// offerUpdate tells the client with the given IP about our new version,
+// if the report it sent shows it runs another, and it hasn't been told
+// since it connected.
+func (p *Server) offerUpdate(ip string, report shared.Report) {
+	version := p.Config.Get("update_version")
+	url := p.Config.Get("update_url")
+	if version == "" || url == "" || report.Version == "" || report.Version == version {
+		return
+	}
+
+	p.assignedMutex.Lock()
+	client := p.assigned[ip]
+	if client == nil || client.socket == nil || client.offered {
+		p.assignedMutex.Unlock()
+		return
+	}
+	client.offered = true
+	name := client.name
+	socket := client.socket
+	p.assignedMutex.Unlock()
+
+	mode := p.updatePolicy(name)
+	if mode != "notify" && mode != "install" {
+		return
+	}
+
+	url = strings.NewReplacer("{version}", version, "{os}", report.OS, "{arch}", report.Arch).Replace(url)
+	log.Printf("[S] Client %s runs version %s, offering it %s to %s", name, report.Version, version, mode)
+
+	err := socket.SendCommand("update", version, url, mode)
+	if err != nil {
+		log.Printf("[S] Failed to offer %s version %s: %s", name, version, err.Error())
+	}
+}
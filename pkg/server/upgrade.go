@@ -0,0 +1,324 @@
+// pkg/server/upgrade.go contains our support for upgrading the server
+// without disrupting the VPN.
+//
+// When Upgrade is called, typically upon SIGUSR2, we start a new copy of
+// our binary and pass it our listening sockets, our devices, and the
+// leases of our clients.  The new process accepts connections at once,
+// and we stop doing so.
+//
+// We then ask each of our clients to reconnect.  They'll be given the
+// same IP by the new process, so keep their devices and routes, and once
+// they've all left, or `upgrade_grace` seconds have passed, we're done.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/skx/simple-vpn/shared"
+)
+
+// upgradeEnv is set in the environment of the process we upgrade to.
+const upgradeEnv = "SIMPLE_VPN_UPGRADE"
+
+// upgradeState describes what we pass to the process we upgrade to.
+//
+// The state itself is written to the first inherited descriptor, and is
+// followed by a descriptor for each listener, and then for each device,
+// in the order given.
+type upgradeState struct {
+	// Listeners are the addresses of our listeners.
+	Listeners []string
+
+	// Devices are the names of our devices.
+	Devices []string
+
+	// Leases holds the leases of each network, by name.
+	Leases map[string]map[string]string
+
+	// Connected holds the time each client of each network connected,
+	// including the server itself, so that their peers see no change.
+	Connected map[string]map[string]time.Time
+}
+
+// handover records the process we've upgraded to, and is shared by each
+// of our networks.
+type handover struct {
+	// successor is the process we upgraded to, if any.
+	successor *os.Process
+
+	// mutex protects the same.
+	mutex sync.Mutex
+}
+
+// inheritance holds what we inherited from the process we upgraded
+// from.
+type inheritance struct {
+	listeners map[string]net.Listener
+	devices   map[string]shared.TunDevice
+	leases    map[string]map[string]string
+	connected map[string]map[string]time.Time
+
+	// mutex protects the same.
+	mutex sync.Mutex
+}
+
+// inherit returns what our parent passed to us, if we were started by
+// an upgrade, or nil otherwise.
+func inherit() (*inheritance, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+
+	var state upgradeState
+	f := os.NewFile(3, "upgrade-state")
+	err := json.NewDecoder(f).Decode(&state)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the state of the process we're upgrading from: %s", err.Error())
+	}
+
+	in := &inheritance{
+		listeners: make(map[string]net.Listener),
+		devices:   make(map[string]shared.TunDevice),
+		leases:    state.Leases,
+		connected: state.Connected,
+	}
+
+	fd := uintptr(4)
+	for _, addr := range state.Listeners {
+		f := os.NewFile(fd, addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit the listener for %s: %s", addr, err.Error())
+		}
+		in.listeners[addr] = l
+		fd++
+	}
+	for _, name := range state.Devices {
+		in.devices[name] = shared.NewFileDevice(os.NewFile(fd, name), name)
+		fd++
+	}
+
+	fmt.Printf("Upgraded, with %d inherited listeners, and %d devices\n", len(in.listeners), len(in.devices))
+	return in, nil
+}
+
+// listener returns the inherited listener for the given address, if any.
+func (in *inheritance) listener(addr string) net.Listener {
+	if in == nil {
+		return nil
+	}
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	l := in.listeners[addr]
+	delete(in.listeners, addr)
+	return l
+}
+
+// device returns the inherited device with the given name, or which
+// matches the given template, if any.
+func (in *inheritance) device(name string) shared.TunDevice {
+	if in == nil {
+		return nil
+	}
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	for inherited, dev := range in.devices {
+		if shared.MatchesDeviceTemplate(name, inherited) {
+			delete(in.devices, inherited)
+			return dev
+		}
+	}
+	return nil
+}
+
+// connectedAt returns the time the named client of the given network
+// connected to our predecessor, if it did, or otherwise the current time.
+func (in *inheritance) connectedAt(network string, name string) time.Time {
+	if in == nil {
+		return time.Now()
+	}
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+
+	when, ok := in.connected[network][name]
+	if !ok {
+		return time.Now()
+	}
+	delete(in.connected[network], name)
+	return when
+}
+
+// upgradingNow returns true if we've upgraded, and are waiting for our
+// clients to leave.
+func (p *Server) upgradingNow() bool {
+	p.handover.mutex.Lock()
+	defer p.handover.mutex.Unlock()
+
+	return p.handover.successor != nil
+}
+
+// Successor returns the process we upgraded to, if any.  Once Run has
+// returned the caller may wish to wait for it.
+func (p *Server) Successor() *os.Process {
+	p.handover.mutex.Lock()
+	defer p.handover.mutex.Unlock()
+
+	return p.handover.successor
+}
+
+// Upgrade starts a new copy of our binary, with the same arguments, and
+// hands our clients over to it.  Run returns once our clients have left.
+func (p *Server) Upgrade() error {
+	p.handover.mutex.Lock()
+	defer p.handover.mutex.Unlock()
+
+	if p.handover.successor != nil {
+		return fmt.Errorf("we've already upgraded")
+	}
+	if p.listeners == nil {
+		return fmt.Errorf("the server is not running")
+	}
+
+	state := upgradeState{
+		Leases:    make(map[string]map[string]string),
+		Connected: make(map[string]map[string]time.Time),
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	//
+	// Our listeners are passed first.  Once we have copies of them
+	// we stop accepting connections, which will queue for our
+	// successor instead.
+	//
+	for i, l := range p.listeners {
+		var f *os.File
+		var err error
+		switch l := l.(type) {
+		case *net.TCPListener:
+			f, err = l.File()
+		case *net.UnixListener:
+			l.SetUnlinkOnClose(false)
+			f, err = l.File()
+		default:
+			err = fmt.Errorf("unsupported listener")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to pass on the listener for %s: %s", p.listenAddrs[i], err.Error())
+		}
+		files = append(files, f)
+		state.Listeners = append(state.Listeners, p.listenAddrs[i])
+	}
+
+	//
+	// Then the devices, and leases, of each network.
+	//
+	for _, n := range p.children {
+		if n.device != nil {
+			f, ok := shared.DeviceFile(n.device)
+			if !ok {
+				return fmt.Errorf("failed to pass on the device %s", n.device.Name())
+			}
+			files = append(files, f)
+			state.Devices = append(state.Devices, n.device.Name())
+		}
+
+		leases := make(map[string]string)
+		connected := make(map[string]time.Time)
+		n.assignedMutex.Lock()
+		for name, ip := range n.leases {
+			leases[name] = ip
+		}
+		for _, client := range n.assigned {
+			if client != nil {
+				connected[client.name] = client.connected
+			}
+		}
+		n.assignedMutex.Unlock()
+		state.Leases[n.network] = leases
+		state.Connected[n.network] = connected
+	}
+
+	//
+	// Launch our successor, and send it our state.
+	//
+	binary, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(binary, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeEnv+"=1")
+	cmd.ExtraFiles = append([]*os.File{r}, files...)
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("failed to launch %s: %s", binary, err.Error())
+	}
+	json.NewEncoder(w).Encode(state)
+	w.Close()
+
+	log.Printf("Upgrading to process %d", cmd.Process.Pid)
+	p.handover.successor = cmd.Process
+
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	if p.stun != nil {
+		p.stun.Close()
+	}
+	return nil
+}
+
+// handOver asks the clients of each of our networks to reconnect, to our
+// successor, and waits until they've done so, or `upgrade_grace` seconds
+// have passed.
+func (p *Server) handOver() {
+	for _, n := range p.children {
+		n.hub.BroadcastCommand("reconnect", []string{"now"})
+	}
+
+	grace := time.Duration(p.Config.GetIntWithDefault("upgrade_grace", 30)) * time.Second
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		remaining := 0
+		for _, n := range p.children {
+			n.assignedMutex.Lock()
+			for _, client := range n.assigned {
+				if client != nil && client.socket != nil {
+					remaining++
+				}
+			}
+			n.assignedMutex.Unlock()
+		}
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	log.Printf("Gave up waiting for clients to reconnect")
+}
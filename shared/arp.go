@@ -0,0 +1,171 @@
+// shared/arp.go contains our responder for the neighbour resolution of
+// the server's VPN IP.
+//
+// Clients whose devices carry Ethernet frames resolve the MAC of their
+// gateway, via ARP or IPv6 neighbour solicitations, before they can send
+// it anything.  The server answers those within the data path, so that
+// the gateway is always reachable, even if the server's own device hasn't
+// been given its address.
+
+package shared
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// The Ethernet types, and ICMPv6 message-types, we handle.
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	icmpv6NeighbourSolicitation  = 135
+	icmpv6NeighbourAdvertisement = 136
+)
+
+// GatewayMAC returns the MAC address we answer for the given IP, if the
+// server has no device of its own.  It is locally administered, and
+// derived from the IP, so it remains the same across restarts.
+func GatewayMAC(ip net.IP) MacAddr {
+	mac := MacAddr{0x02, 0x73, 0x76}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	if len(ip) >= 3 {
+		copy(mac[3:], ip[len(ip)-3:])
+	}
+	return mac
+}
+
+// etherType returns the type of the given Ethernet frame, or zero if
+// it is too short to have one.
+func etherType(frame []byte) uint16 {
+	if len(frame) < 14 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(frame[12:14])
+}
+
+// NeighbourReply returns the reply to the given Ethernet frame, if it is
+// an ARP request, or IPv6 neighbour solicitation, for the given IP.  The
+// reply says that the IP belongs to the given MAC.  Otherwise it returns
+// nil.
+func NeighbourReply(frame []byte, ip net.IP, mac MacAddr) []byte {
+	switch etherType(frame) {
+	case etherTypeARP:
+		return arpReply(frame, ip, mac)
+	case etherTypeIPv6:
+		return neighbourAdvertisement(frame, ip, mac)
+	}
+	return nil
+}
+
+// arpReply returns the reply to the given ARP request for the given IP.
+func arpReply(frame []byte, ip net.IP, mac MacAddr) []byte {
+	ip = ip.To4()
+	if ip == nil || len(frame) < 42 {
+		return nil
+	}
+
+	//
+	// We only answer requests for the IPv4 address of Ethernet hosts.
+	//
+	arp := frame[14:]
+	if binary.BigEndian.Uint16(arp[0:2]) != 1 || binary.BigEndian.Uint16(arp[2:4]) != etherTypeIPv4 ||
+		arp[4] != 6 || arp[5] != 4 || binary.BigEndian.Uint16(arp[6:8]) != 1 {
+		return nil
+	}
+	if !net.IP(arp[24:28]).Equal(ip) {
+		return nil
+	}
+
+	reply := make([]byte, 42)
+	copy(reply[0:6], frame[6:12])
+	copy(reply[6:12], mac[:])
+	binary.BigEndian.PutUint16(reply[12:14], etherTypeARP)
+
+	out := reply[14:]
+	copy(out[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(out[6:8], 2)
+	copy(out[8:14], mac[:])
+	copy(out[14:18], ip)
+	copy(out[18:24], arp[8:14])
+	copy(out[24:28], arp[14:18])
+	return reply
+}
+
+// solicitedTarget returns the target of the given Ethernet frame, if it
+// is an IPv6 neighbour solicitation, or nil otherwise.
+func solicitedTarget(frame []byte) net.IP {
+	if etherType(frame) != etherTypeIPv6 || len(frame) < 14+40+24 {
+		return nil
+	}
+
+	packet := frame[14:]
+	if packet[0]>>4 != 6 || packet[6] != 58 || packet[40] != icmpv6NeighbourSolicitation {
+		return nil
+	}
+	if 40+int(binary.BigEndian.Uint16(packet[4:6])) > len(packet) {
+		return nil
+	}
+	return net.IP(packet[48:64])
+}
+
+// neighbourAdvertisement returns the reply to the given IPv6 neighbour
+// solicitation for the given IP.
+func neighbourAdvertisement(frame []byte, ip net.IP, mac MacAddr) []byte {
+	if ip.To4() != nil {
+		return nil
+	}
+	target := solicitedTarget(frame)
+	if target == nil || !target.Equal(ip) {
+		return nil
+	}
+	packet := frame[14:]
+
+	//
+	// Solicitations from hosts which don't yet have an address are
+	// answered to all nodes, and aren't marked as solicited.
+	//
+	src := net.IP(packet[8:24])
+	dest := src
+	flags := byte(0x60)
+	if src.IsUnspecified() {
+		dest = net.ParseIP("ff02::1")
+		flags = 0x20
+	}
+
+	reply := make([]byte, 14+40+32)
+	copy(reply[0:6], frame[6:12])
+	copy(reply[6:12], mac[:])
+	binary.BigEndian.PutUint16(reply[12:14], etherTypeIPv6)
+
+	out := reply[14:]
+	out[0] = 0x60
+	binary.BigEndian.PutUint16(out[4:6], 32)
+	out[6] = 58
+	out[7] = 255
+	copy(out[8:24], ip.To16())
+	copy(out[24:40], dest.To16())
+
+	icmp := out[40:]
+	icmp[0] = icmpv6NeighbourAdvertisement
+	icmp[4] = flags
+	copy(icmp[8:24], ip.To16())
+
+	//
+	// The target link-layer address option.
+	//
+	icmp[24] = 2
+	icmp[25] = 1
+	copy(icmp[26:32], mac[:])
+
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(out[i])<<8 | uint32(out[i+1])
+	}
+	sum += uint32(len(icmp)) + 58
+	binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, sum))
+	return reply
+}
@@ -0,0 +1,20 @@
+// shared/bind_linux.go contains our support for binding sockets to a
+// network device, so that their traffic leaves via a chosen uplink.
+
+package shared
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// BindToDevice binds the socket with the given file-descriptor to the
+// named device, so that its traffic is only sent, and received, upon it.
+func BindToDevice(fd uintptr, device string) error {
+	err := unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, device)
+	if err != nil {
+		return fmt.Errorf("failed to bind to the device %s: %s", device, err.Error())
+	}
+	return nil
+}
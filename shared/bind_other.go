@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+// shared/bind_other.go contains the stub of our support for binding
+// sockets to a network device, which only exists upon Linux.
+
+package shared
+
+import "errors"
+
+// BindToDevice returns an error, as binding sockets to a device is only
+// supported upon Linux.
+func BindToDevice(fd uintptr, device string) error {
+	return errors.New("binding to a device is only supported upon Linux")
+}
@@ -0,0 +1,84 @@
+// shared/buffer.go contains a pool of frame-buffers.
+//
+// Allocating a fresh buffer for every frame we relay generates a lot of
+// garbage at high packet-rates, so instead we recycle them.  A buffer
+// belongs to whoever took it from the pool until they return it, and
+// nothing may keep a reference to it after that.
+
+package shared
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// FrameSize is the size of our largest buffers, which is large enough for
+// any frame we'll send or receive.
+const FrameSize = 65536
+
+// frameClasses are the sizes of the buffers we pool, smallest first.  Most
+// frames fit in the smallest, which holds an Ethernet frame at the usual
+// MTUs, so the frames waiting in the queue of a slow client pin little
+// more memory than their contents.
+var frameClasses = []int{2048, 16384, FrameSize}
+
+// errFrameTooLarge is returned by readFrame if a frame won't fit in
+// the buffer it was given.
+var errFrameTooLarge = errors.New("frame too large")
+
+// framePools holds our unused buffers, with one pool for each of our
+// frameClasses.
+var framePools = func() []*sync.Pool {
+	var pools []*sync.Pool
+	for _, size := range frameClasses {
+		size := size
+		pools = append(pools, &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		})
+	}
+	return pools
+}()
+
+// getFrame takes a buffer which holds at least the given number of bytes
+// from our pools.  It may be no larger than FrameSize.
+func getFrame(size int) *[]byte {
+	for i, class := range frameClasses {
+		if size <= class {
+			return framePools[i].Get().(*[]byte)
+		}
+	}
+	return framePools[len(framePools)-1].Get().(*[]byte)
+}
+
+// putFrame returns a buffer to the pool of its size.
+func putFrame(buf *[]byte) {
+	for i, class := range frameClasses {
+		if len(*buf) == class {
+			framePools[i].Put(buf)
+			return
+		}
+	}
+}
+
+// readFrame reads the whole of a websocket message into the given
+// buffer, returning the number of bytes read.
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for {
+		if n == len(buf) {
+			return n, errFrameTooLarge
+		}
+		m, err := r.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// shared/capabilities.go contains the advertisement of the in-band
+// commands each side of a socket accepts.
+//
+// Each side may restrict the commands it accepts to an allow-list, and
+// tells the other which it accepts via the `capabilities` command.  We
+// don't send a command the other side has told us it won't accept, and
+// refuse those we don't accept ourselves, so that as our protocol grows
+// neither side is surprised by a command it doesn't understand.
+//
+// Older peers don't advertise their commands, in which case we assume
+// that they accept everything, as they always have.
+
+package shared
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// capabilitiesCommand is the command we advertise our commands with,
+// which is always accepted.
+const capabilitiesCommand = "capabilities"
+
+// AllowCommands restricts the in-band commands we accept to those given,
+// rather than every command we have a handler for.  Others are refused.
+//
+// This must be called before Serve.
+func (s *Socket) AllowCommands(commands []string) {
+	s.allowed = make(map[string]bool)
+	for _, command := range commands {
+		s.allowed[command] = true
+	}
+}
+
+// accepts returns true if we accept the given command.
+func (s *Socket) accepts(command string) bool {
+	if command == capabilitiesCommand {
+		return true
+	}
+	if s.handlers[command] == nil {
+		return false
+	}
+	return s.allowed == nil || s.allowed[command]
+}
+
+// Commands returns the in-band commands we accept, sorted by name.
+func (s *Socket) Commands() []string {
+	var out []string
+	for command := range s.handlers {
+		if s.accepts(command) {
+			out = append(out, command)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// AdvertiseCommands tells the other side which in-band commands we
+// accept.  It should be called once all our handlers have been added.
+func (s *Socket) AdvertiseCommands() error {
+	return s.SendCommand(capabilitiesCommand, strings.Join(s.Commands(), ","))
+}
+
+// setPeerCommands records the commands the other side told us that it
+// accepts.
+func (s *Socket) setPeerCommands(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a list of commands")
+	}
+	commands := make(map[string]bool)
+	for _, command := range SplitList(args[0]) {
+		commands[command] = true
+	}
+
+	s.peerMutex.Lock()
+	s.peerCommands = commands
+	s.peerMutex.Unlock()
+	return nil
+}
+
+// PeerAccepts returns true if the other side accepts the given command,
+// or hasn't told us which commands it accepts.
+func (s *Socket) PeerAccepts(command string) bool {
+	s.peerMutex.Lock()
+	defer s.peerMutex.Unlock()
+	return s.peerCommands == nil || s.peerCommands[command] || command == capabilitiesCommand
+}
+
+// PeerCommands returns the commands the other side told us that it
+// accepts, sorted by name, or nil if it hasn't.
+func (s *Socket) PeerCommands() []string {
+	s.peerMutex.Lock()
+	defer s.peerMutex.Unlock()
+
+	if s.peerCommands == nil {
+		return nil
+	}
+	out := []string{}
+	for command := range s.peerCommands {
+		out = append(out, command)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,140 @@
+// shared/cipher.go contains our application-layer encryption of frames.
+//
+// Connections are normally protected by TLS alone, but that may end at a
+// proxy, or CDN, which we don't trust to see our traffic.  Clients may
+// therefore ask for their frames to be encrypted too, with keys derived
+// from the shared key, and a nonce chosen by each side for the connection.
+// If the client, and server, agree to a hybrid key exchange, see kex.go,
+// its secret is mixed into the keys too.
+//
+// Each direction has its own key, and the messages sent in it are
+// numbered, which gives the nonce of each.  Websockets deliver messages
+// reliably, and in order, so the numbers needn't be sent.
+
+package shared
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+const (
+	// FrameCipher is the name of the cipher we encrypt frames with.
+	FrameCipher = "aes-256-gcm"
+
+	// CipherHeader, and NonceHeader, are the headers with which the
+	// server accepts a request for encryption, and gives its nonce.
+	CipherHeader = "X-Simple-Vpn-Cipher"
+	NonceHeader  = "X-Simple-Vpn-Nonce"
+
+	// HybridKeyExchange is the name of our hybrid key exchange, and
+	// KeyExchangeHeader is the header with which the server replies to
+	// the client's offer of it.
+	HybridKeyExchange = "x25519-mlkem768"
+	KeyExchangeHeader = "X-Simple-Vpn-Key-Exchange"
+)
+
+// errDecrypt is returned when a message can't be decrypted.
+var errDecrypt = errors.New("failed to decrypt a message")
+
+// Ciphers encrypt the messages of one connection.
+type Ciphers struct {
+	send cipher.AEAD
+	recv cipher.AEAD
+
+	// sent, and received, count the messages in each direction.
+	sent     uint64
+	received uint64
+
+	// sendNonce, and recvNonce, hold the nonces of the messages being
+	// sealed, and opened.
+	sendNonce []byte
+	recvNonce []byte
+}
+
+// NewNonce returns a random nonce, for the setup of a connection.
+func NewNonce() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// NewCiphers returns the ciphers of a connection authenticated with the
+// given key, upon which the client, and server, chose the given nonces,
+// and agreed the given secret, if they made a key exchange.  The server
+// and client each send with the key the other receives with.
+func NewCiphers(key string, secret []byte, clientNonce string, serverNonce string, server bool) (*Ciphers, error) {
+	for _, nonce := range []string{clientNonce, serverNonce} {
+		raw, err := hex.DecodeString(nonce)
+		if err != nil || len(raw) < 16 {
+			return nil, fmt.Errorf("invalid nonce %q", nonce)
+		}
+	}
+
+	toServer, err := frameAEAD(key, secret, "client "+clientNonce+" "+serverNonce)
+	if err != nil {
+		return nil, err
+	}
+	toClient, err := frameAEAD(key, secret, "server "+clientNonce+" "+serverNonce)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Ciphers{send: toServer, recv: toClient}
+	if server {
+		c.send, c.recv = toClient, toServer
+	}
+	c.sendNonce = make([]byte, c.send.NonceSize())
+	c.recvNonce = make([]byte, c.recv.NonceSize())
+	return c, nil
+}
+
+// frameAEAD returns the cipher whose key is derived from the given key,
+// secret, and label.
+func frameAEAD(key string, secret []byte, label string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("simple-vpn frames " + label))
+	mac.Write(secret)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal appends the encryption of the next message we send to dst.  It
+// must not be called concurrently.
+func (c *Ciphers) seal(dst []byte, msg []byte) []byte {
+	binary.BigEndian.PutUint64(c.sendNonce[len(c.sendNonce)-8:], c.sent)
+	c.sent++
+	return c.send.Seal(dst, c.sendNonce, msg, nil)
+}
+
+// overhead returns the number of bytes sealing adds to each message,
+// which is zero if we have no ciphers.
+func (c *Ciphers) overhead() int {
+	if c == nil {
+		return 0
+	}
+	return c.send.Overhead()
+}
+
+// open decrypts the next message we received, in place, returning the
+// plaintext.  It must not be called concurrently.
+func (c *Ciphers) open(msg []byte) ([]byte, error) {
+	binary.BigEndian.PutUint64(c.recvNonce[len(c.recvNonce)-8:], c.received)
+	c.received++
+	out, err := c.recv.Open(msg[:0], c.recvNonce, msg, nil)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return out, nil
+}
@@ -0,0 +1,133 @@
+// shared/classify.go contains the counting of a socket's traffic by its
+// protocol, and port, which shows what is using the bandwidth of the VPN
+// without capturing packets.
+
+package shared
+
+import (
+	"sort"
+	"sync"
+)
+
+// maxClassPorts is the number of ports whose traffic we count, for each
+// socket.  Traffic upon others is counted only by its protocol.
+const maxClassPorts = 256
+
+// TrafficClass is the traffic of one protocol, or of one port of a
+// protocol.
+type TrafficClass struct {
+	// Protocol is one of tcp, udp, icmp, or other.
+	Protocol string
+
+	// Port is the lower of the source, and destination, ports, which
+	// is usually that of the service, or 0 for the whole protocol.
+	Port int `json:",omitempty"`
+
+	// Packets, and Bytes, are the traffic sent, and received.
+	Packets uint64
+	Bytes   uint64
+}
+
+// classes counts the traffic of a socket.
+type classes struct {
+	protocols map[string]*TrafficClass
+	ports     map[int]*TrafficClass
+	mutex     sync.Mutex
+}
+
+// newClasses returns counters with nothing counted.
+func newClasses() *classes {
+	return &classes{
+		protocols: make(map[string]*TrafficClass),
+		ports:     make(map[int]*TrafficClass),
+	}
+}
+
+// classify returns the protocol of the given packet, the number we
+// count it by, and its port, if it has one.
+func classify(packet []byte) (string, int, int) {
+	proto, offset := -1, 0
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		proto, offset = int(packet[9]), int(packet[0]&0x0f)*4
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		proto, offset = int(packet[6]), 40
+	}
+
+	switch proto {
+	case 6, 17:
+		name := "tcp"
+		if proto == 17 {
+			name = "udp"
+		}
+		if len(packet) < offset+4 {
+			return name, proto, 0
+		}
+		src := int(packet[offset])<<8 | int(packet[offset+1])
+		dst := int(packet[offset+2])<<8 | int(packet[offset+3])
+		if src < dst {
+			return name, proto, src
+		}
+		return name, proto, dst
+	case 1, 58:
+		return "icmp", proto, 0
+	}
+	return "other", proto, 0
+}
+
+// count counts the given packet.
+func (c *classes) count(packet []byte) {
+	name, proto, port := classify(packet)
+	size := uint64(len(packet))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	class := c.protocols[name]
+	if class == nil {
+		class = &TrafficClass{Protocol: name}
+		c.protocols[name] = class
+	}
+	class.Packets++
+	class.Bytes += size
+
+	if port == 0 {
+		return
+	}
+	key := proto<<16 | port
+	class = c.ports[key]
+	if class == nil {
+		if len(c.ports) >= maxClassPorts {
+			return
+		}
+		class = &TrafficClass{Protocol: name, Port: port}
+		c.ports[key] = class
+	}
+	class.Packets++
+	class.Bytes += size
+}
+
+// snapshot returns the traffic of each protocol, and of the given number
+// of ports which carried the most bytes.
+func (c *classes) snapshot(top int) ([]TrafficClass, []TrafficClass) {
+	c.mutex.Lock()
+	var protocols, ports []TrafficClass
+	for _, class := range c.protocols {
+		protocols = append(protocols, *class)
+	}
+	for _, class := range c.ports {
+		ports = append(ports, *class)
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(protocols, func(i, j int) bool {
+		return protocols[i].Protocol < protocols[j].Protocol
+	})
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Bytes > ports[j].Bytes
+	})
+	if len(ports) > top {
+		ports = ports[:top]
+	}
+	return protocols, ports
+}
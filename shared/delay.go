@@ -0,0 +1,154 @@
+// shared/delay.go contains our estimates of the one-way delays of a
+// connection, and their jitter.
+//
+// Our pings carry the time at which they were sent, and ask the other
+// side to echo it along with the time at which it received them.  With
+// those we split each round-trip into the delay of each direction.  Our
+// clocks needn't agree: we assume that the fastest round-trip we've seen
+// recently was symmetric, which gives us the offset between them.  The
+// jitter of each direction, being the mean difference between successive
+// delays as RFC 3550 computes it, doesn't depend upon the offset at all.
+//
+// Older peers echo our pings unchanged, in which case we only measure the
+// round-trip time.
+
+package shared
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pingEcho is appended to the time in our pings, to ask the other side
+// to echo it with the time at which it received the ping.
+const pingEcho = "echo"
+
+// delayBaseline is how long we trust the clock offset we derived from our
+// fastest round-trip, before we derive it afresh, so that drifting clocks
+// are followed.
+const delayBaseline = 10 * time.Minute
+
+// Delays holds our estimates of the one-way delays of a connection, and
+// their jitter.
+type Delays struct {
+	// Tx is the delay of the messages we send, and Rx of those we
+	// receive.
+	Tx time.Duration
+	Rx time.Duration
+
+	// TxJitter, and RxJitter, are the mean variations of the same.
+	TxJitter time.Duration
+	RxJitter time.Duration
+}
+
+// delayEstimator derives our Delays from the timestamps of our pongs.
+type delayEstimator struct {
+	mutex sync.Mutex
+
+	// measured is true once we've had a pong with timestamps.
+	measured bool
+
+	// minRTT is the fastest round-trip since baseline, from which we
+	// derived the offset of the other side's clock from ours.
+	minRTT   int64
+	offset   int64
+	baseline time.Time
+
+	// tx, and rx, are the raw delays of the previous pong, including
+	// the offset.
+	tx int64
+	rx int64
+
+	delays Delays
+}
+
+// pingPayload returns the payload of a ping sent at the given time.
+func pingPayload(sent int64) string {
+	return strconv.FormatInt(sent, 10) + " " + pingEcho
+}
+
+// pongPayload returns our answer to a ping with the given payload, which
+// we received at the given time.  Pings which don't ask for the time are
+// echoed unchanged.
+func pongPayload(ping string, received int64) string {
+	fields := strings.Fields(ping)
+	if len(fields) != 2 || fields[1] != pingEcho {
+		return ping
+	}
+	return fields[0] + " " + strconv.FormatInt(received, 10)
+}
+
+// parsePong returns the time at which the ping answered by a pong with
+// the given payload was sent, and the time at which the other side
+// received it, which is zero if it didn't say.
+func parsePong(pong string) (sent int64, echoed int64, err error) {
+	fields := strings.Fields(pong)
+	if len(fields) == 0 {
+		return 0, 0, strconv.ErrSyntax
+	}
+	sent, err = strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(fields) == 2 {
+		echoed, _ = strconv.ParseInt(fields[1], 10, 64)
+	}
+	return sent, echoed, nil
+}
+
+// sample updates our estimates with a pong, which answered a ping sent
+// at the given time, and was received by the other side at echoed, by
+// its clock, and by us at received.
+func (d *delayEstimator) sample(sent int64, echoed int64, received int64) {
+	rtt := received - sent
+	if echoed == 0 || rtt < 0 {
+		return
+	}
+	tx := echoed - sent
+	rx := received - echoed
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	if !d.measured || rtt <= d.minRTT || now.Sub(d.baseline) > delayBaseline {
+		d.minRTT = rtt
+		d.offset = (tx - rx) / 2
+		d.baseline = now
+	}
+
+	if d.measured {
+		d.delays.TxJitter += (time.Duration(abs64(tx-d.tx)) - d.delays.TxJitter) / 16
+		d.delays.RxJitter += (time.Duration(abs64(rx-d.rx)) - d.delays.RxJitter) / 16
+	}
+	d.tx, d.rx = tx, rx
+	d.measured = true
+
+	d.delays.Tx = time.Duration(max64(tx-d.offset, 0))
+	d.delays.Rx = time.Duration(max64(rx+d.offset, 0))
+}
+
+// get returns our estimates, and whether we've made any.
+func (d *delayEstimator) get() (Delays, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.delays, d.measured
+}
+
+// abs64 returns the absolute value of the given number.
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// max64 returns the larger of the given numbers.
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,187 @@
+// shared/device.go contains the interface of our network devices, and
+// an in-memory implementation of it.
+//
+// Sockets read, and write, packets via a TunDevice rather than directly
+// via the water-library, so that tests may use a MemoryDevice instead of
+// a real device, and so that other backends may be added.
+
+package shared
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/songgao/water"
+)
+
+// TunDevice is the interface of a network device, or of one queue of a
+// device opened with several.
+//
+// Each call to Read returns a single packet, and each call to Write
+// sends one.
+type TunDevice interface {
+	io.ReadWriteCloser
+
+	// Name returns the name of the device.
+	Name() string
+}
+
+// The devices of the water-library are our default implementation.
+var _ TunDevice = &water.Interface{}
+
+// MemoryDevice is a TunDevice which exists only in memory.
+//
+// Packets given to Inject are returned by Read, as if the kernel had
+// sent them, and packets passed to Write may be received from Written.
+type MemoryDevice struct {
+	name string
+	in   chan []byte
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+// NewMemoryDevice creates a MemoryDevice with the given name, which
+// buffers up to depth packets in each direction.
+func NewMemoryDevice(name string, depth int) *MemoryDevice {
+	return &MemoryDevice{
+		name: name,
+		in:   make(chan []byte, depth),
+		out:  make(chan []byte, depth),
+		done: make(chan struct{}),
+	}
+}
+
+// Name returns the name of the device.
+func (d *MemoryDevice) Name() string {
+	return d.name
+}
+
+// Read returns the next packet given to Inject, blocking until there is
+// one, or until the device is closed.
+func (d *MemoryDevice) Read(p []byte) (int, error) {
+	select {
+	case packet := <-d.in:
+		return copy(p, packet), nil
+	case <-d.done:
+		return 0, io.EOF
+	}
+}
+
+// Write sends a packet, which may be received from Written.  It blocks
+// if the buffer is full, until the packet is received, or the device is
+// closed.
+func (d *MemoryDevice) Write(p []byte) (int, error) {
+	packet := make([]byte, len(p))
+	copy(packet, p)
+
+	select {
+	case d.out <- packet:
+		return len(p), nil
+	case <-d.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+// Close closes the device, waking any blocked readers, or writers.
+func (d *MemoryDevice) Close() error {
+	d.once.Do(func() {
+		close(d.done)
+	})
+	return nil
+}
+
+// Inject queues a packet to be returned by Read.  It blocks if the
+// buffer is full, until the packet is read, or the device is closed.
+func (d *MemoryDevice) Inject(packet []byte) error {
+	select {
+	case d.in <- packet:
+		return nil
+	case <-d.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// Written returns the channel upon which the packets passed to Write are
+// delivered.
+func (d *MemoryDevice) Written() <-chan []byte {
+	return d.out
+}
+
+// deadliner is implemented by devices whose reads may be interrupted.
+type deadliner interface {
+	SetReadDeadline(time.Time) error
+}
+
+// readDeadliner returns the means of interrupting reads from the given
+// device, if it has one.
+func readDeadliner(dev TunDevice) deadliner {
+	if iface, ok := dev.(*water.Interface); ok {
+		d, _ := iface.ReadWriteCloser.(deadliner)
+		return d
+	}
+	d, _ := dev.(deadliner)
+	return d
+}
+
+// keptDevice is a device which isn't closed along with its socket.
+type keptDevice struct {
+	TunDevice
+}
+
+// Close interrupts any pending read, rather than closing the device.
+func (k keptDevice) Close() error {
+	if d := readDeadliner(k.TunDevice); d != nil {
+		d.SetReadDeadline(time.Now())
+	}
+	return nil
+}
+
+// KeepOpen wraps the given device such that closing the wrapper doesn't
+// close the device, but only wakes the socket reading from it.  This
+// allows the device, and its routes, to be used by the socket of a new
+// connection.
+//
+// Devices which don't support read-deadlines cannot be woken, so their
+// reader only notices once the next packet arrives.
+func KeepOpen(dev TunDevice) TunDevice {
+	if d := readDeadliner(dev); d != nil {
+		d.SetReadDeadline(time.Time{})
+	}
+	return keptDevice{dev}
+}
+
+// FileDevice is a TunDevice which was opened elsewhere, such as one which
+// was inherited from our parent process.
+type FileDevice struct {
+	*os.File
+	name string
+}
+
+// NewFileDevice returns a TunDevice for the given file, which must be an
+// open device of the given name.
+func NewFileDevice(file *os.File, name string) *FileDevice {
+	dev := &FileDevice{File: file, name: name}
+	closeOnExec(dev)
+	return dev
+}
+
+// Name returns the name of the device.
+func (f *FileDevice) Name() string {
+	return f.name
+}
+
+// DeviceFile returns the file which underlies the given device, if it has
+// one, such that it may be passed to another process.
+func DeviceFile(dev TunDevice) (*os.File, bool) {
+	switch d := dev.(type) {
+	case *water.Interface:
+		f, ok := d.ReadWriteCloser.(*os.File)
+		return f, ok
+	case *FileDevice:
+		return d.File, true
+	}
+	return nil, false
+}
@@ -0,0 +1,135 @@
+// shared/devname.go contains our choice of the names of our devices.
+//
+// A device may be named by a template, such as "svpn%d", in which case we
+// use the first free name it describes.  A device which is named outright
+// may already exist, perhaps left behind by a previous run which crashed,
+// or created by another process, so we may use another name instead, or
+// delete the existing device and create it afresh.
+
+package shared
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// MaxDeviceName is the longest name a device may have upon Linux.
+const MaxDeviceName = 15
+
+// DeviceCollision describes what we do when the device we'd create
+// already exists.
+type DeviceCollision string
+
+const (
+	// CollisionFail refuses to continue.
+	CollisionFail DeviceCollision = "fail"
+
+	// CollisionRename uses the first free name, made by appending a
+	// number to the configured one.
+	CollisionRename DeviceCollision = "rename"
+
+	// CollisionRecreate deletes the existing device, and creates it
+	// afresh.
+	CollisionRecreate DeviceCollision = "recreate"
+)
+
+// ParseDeviceCollision parses the given setting, which defaults to
+// renaming our device.
+func ParseDeviceCollision(value string) (DeviceCollision, error) {
+	switch DeviceCollision(value) {
+	case "":
+		return CollisionRename, nil
+	case CollisionFail, CollisionRename, CollisionRecreate:
+		return DeviceCollision(value), nil
+	}
+	return "", fmt.Errorf("the device_collision must be one of 'fail', 'rename', or 'recreate', not '%s'", value)
+}
+
+// IsDeviceTemplate returns true if the given name of a device is a
+// template, such as "svpn%d".
+func IsDeviceTemplate(name string) bool {
+	return strings.Contains(name, "%d")
+}
+
+// MatchesDeviceTemplate returns true if the given name is one the given
+// template describes.
+func MatchesDeviceTemplate(template string, name string) bool {
+	i := strings.Index(template, "%d")
+	if i < 0 {
+		return template == name
+	}
+	prefix, suffix := template[:i], template[i+2:]
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) <= len(prefix)+len(suffix) {
+		return false
+	}
+	_, err := strconv.ParseUint(name[len(prefix):len(name)-len(suffix)], 10, 16)
+	return err == nil
+}
+
+// DeviceExists returns true if a device with the given name exists.
+func DeviceExists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// FreeDeviceName returns the first name described by the given template,
+// counting from the given number, which isn't used by a device.
+func FreeDeviceName(template string, first int) (string, error) {
+	if strings.Count(template, "%d") != 1 || strings.Count(template, "%") != 1 {
+		return "", fmt.Errorf("the device name %q must contain %%d once, and no other %%", template)
+	}
+	for i := first; i < first+256; i++ {
+		name := strings.Replace(template, "%d", strconv.Itoa(i), 1)
+		if len(name) > MaxDeviceName {
+			break
+		}
+		if !DeviceExists(name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no free device name matches %q", template)
+}
+
+// ChooseDeviceName returns the name of the device we should create, for
+// the given configured name, or template, handling any existing device of
+// that name as given.  It returns a note describing what we did, if the
+// name was in use, for the caller to log.
+func ChooseDeviceName(name string, collision DeviceCollision) (string, string, error) {
+	if IsDeviceTemplate(name) {
+		chosen, err := FreeDeviceName(name, 0)
+		return chosen, "", err
+	}
+	if len(name) > MaxDeviceName {
+		return "", "", fmt.Errorf("the device name %q is longer than %d characters", name, MaxDeviceName)
+	}
+	if !DeviceExists(name) {
+		return name, "", nil
+	}
+
+	switch collision {
+	case CollisionRecreate:
+		out, err := exec.Command("ip", "link", "delete", "dev", name).CombinedOutput()
+		if err != nil {
+			return "", "", fmt.Errorf("the device %s exists, and we failed to delete it: %s %s", name, err.Error(), strings.TrimSpace(string(out)))
+		}
+		return name, fmt.Sprintf("The device %s already existed, perhaps from a previous run, so was deleted and created afresh", name), nil
+	case CollisionRename:
+		//
+		// Keep within the limit upon the length of names, by
+		// shortening the configured one if we must.
+		//
+		base := name
+		if len(base) > MaxDeviceName-3 {
+			base = base[:MaxDeviceName-3]
+		}
+		chosen, err := FreeDeviceName(strings.Replace(base, "%", "", -1)+"%d", 1)
+		if err != nil {
+			return "", "", err
+		}
+		return chosen, fmt.Sprintf("The device %s already exists, perhaps from a previous run, so we're using %s instead", name, chosen), nil
+	}
+	return "", "", fmt.Errorf("the device %s already exists, perhaps from a previous run; delete it, or set device_collision to 'rename', or 'recreate'", name)
+}
@@ -0,0 +1,35 @@
+// shared/errors.go contains the kinds of error which stop the client, or
+// server, from starting, so that each may exit with its own status.
+
+package shared
+
+// ConfigError is returned when our configuration is missing, or invalid.
+type ConfigError struct {
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+// DeviceError is returned when we fail to create, or configure, our
+// device.
+type DeviceError struct {
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *DeviceError) Error() string {
+	return e.Err.Error()
+}
+
+// BindError is returned when we fail to listen upon an address.
+type BindError struct {
+	Err error
+}
+
+// Error returns a description of the error.
+func (e *BindError) Error() string {
+	return e.Err.Error()
+}
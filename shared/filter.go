@@ -0,0 +1,299 @@
+// shared/filter.go contains our packet-filtering support.
+//
+// A filter is invoked upon every frame received over a socket, before it
+// is switched, and may accept, drop, or rewrite it.  Filters may be set
+// upon a single socket, or upon a hub, where they apply to every socket.
+//
+// We also implement a simple rule-language, for filters defined in our
+// configuration files, such as:
+//
+//    filter_1 = drop from 10.137.248.0/25 to 10.137.248.128/25 proto tcp port 22
+//    filter_2 = accept proto icmp
+//
+// Rules are tried in numerical order, and the first which matches a
+// frame decides its fate.  Frames which match no rule are accepted.
+
+package shared
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Verdict is the decision a filter makes about a frame.
+type Verdict int
+
+const (
+	// Accept passes the frame on.
+	Accept Verdict = iota
+
+	// Drop discards the frame.
+	Drop
+)
+
+// Frame is a frame which is being filtered.
+type Frame struct {
+	// Source is the socket which received the frame.
+	Source *Socket
+
+	// Dest is the destination of the frame, if it is an IP packet.
+	Dest net.IP
+
+	// Data holds the frame itself.  A filter may replace it, to
+	// rewrite the frame, but must not modify it in place.
+	Data []byte
+}
+
+// Filter is the interface of a packet-filter.
+type Filter interface {
+	Filter(frame *Frame) Verdict
+}
+
+// FilterFunc allows a function to be used as a Filter.
+type FilterFunc func(frame *Frame) Verdict
+
+// Filter invokes the function.
+func (f FilterFunc) Filter(frame *Frame) Verdict {
+	return f(frame)
+}
+
+// Filters is a list of filters, which are invoked in order until one
+// drops the frame.
+type Filters []Filter
+
+// Filter invokes each of our filters.
+func (f Filters) Filter(frame *Frame) Verdict {
+	for _, filter := range f {
+		if filter.Filter(frame) == Drop {
+			return Drop
+		}
+	}
+	return Accept
+}
+
+// protocols maps the protocol-names our rules accept to their numbers.
+var protocols = map[string]int{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+}
+
+// rule is a single rule of our rule-language.
+type rule struct {
+	verdict Verdict
+	from    []*net.IPNet
+	to      []*net.IPNet
+	proto   int
+	port    int
+}
+
+// protocol returns the protocol of an IP packet, and the offset of its
+// payload, following the extension headers of IPv6 packets to the header
+// of the upper-layer protocol.  The protocol is -1 if the packet isn't one
+// we understand, and the offset is -1 if the payload doesn't begin with
+// the upper-layer header, as with fragments other than the first.
+//
+// We return false if the headers are truncated, so we can't tell what the
+// packet holds.
+func protocol(packet []byte) (int, int, bool) {
+	switch packet[0] >> 4 {
+	case 4:
+		offset := int(packet[0]&0x0f) * 4
+		if len(packet) < 20 || offset < 20 || len(packet) < offset {
+			return -1, -1, false
+		}
+		if packet[6]&0x1f != 0 || packet[7] != 0 {
+			return int(packet[9]), -1, true
+		}
+		return int(packet[9]), offset, true
+	case 6:
+		if len(packet) < 40 {
+			return -1, -1, false
+		}
+		proto, offset := int(packet[6]), 40
+		for {
+			switch proto {
+			case 0, 43, 60:
+				// Hop-by-hop, routing, and destination options.
+				if len(packet) < offset+8 {
+					return -1, -1, false
+				}
+				proto, offset = int(packet[offset]), offset+(int(packet[offset+1])+1)*8
+			case 51:
+				// The authentication header counts in 32-bit words.
+				if len(packet) < offset+8 {
+					return -1, -1, false
+				}
+				proto, offset = int(packet[offset]), offset+(int(packet[offset+1])+2)*4
+			case 44:
+				// Only the first fragment holds the upper-layer header.
+				if len(packet) < offset+8 {
+					return -1, -1, false
+				}
+				first := packet[offset+2] == 0 && packet[offset+3]&0xf8 == 0
+				proto, offset = int(packet[offset]), offset+8
+				if !first {
+					return proto, -1, true
+				}
+			default:
+				if len(packet) < offset {
+					return -1, -1, false
+				}
+				return proto, offset, true
+			}
+		}
+	}
+	return -1, -1, true
+}
+
+// matches returns true if the rule matches the given packet.
+func (r *rule) matches(packet []byte) bool {
+	if r.from == nil && r.to == nil && r.proto == 0 {
+		return true
+	}
+
+	src := GetSrcIP(packet)
+	dst := GetDestIP(packet)
+	if src == nil || dst == nil {
+		return false
+	}
+	if r.from != nil && !NetworksContain(r.from, src) {
+		return false
+	}
+	if r.to != nil && !NetworksContain(r.to, dst) {
+		return false
+	}
+	if r.proto == 0 {
+		return true
+	}
+
+	proto, offset, _ := protocol(packet)
+	if proto != r.proto {
+		return false
+	}
+	if r.port == 0 {
+		return true
+	}
+	if offset < 0 || len(packet) < offset+4 {
+		return false
+	}
+	return int(packet[offset+2])<<8|int(packet[offset+3]) == r.port
+}
+
+// parseRule parses a single rule.
+func parseRule(text string) (*rule, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+
+	r := &rule{}
+	switch fields[0] {
+	case "accept":
+		r.verdict = Accept
+	case "drop":
+		r.verdict = Drop
+	default:
+		return nil, fmt.Errorf("unknown action '%s'", fields[0])
+	}
+
+	fields = fields[1:]
+	for len(fields) > 0 {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("missing value for '%s'", fields[0])
+		}
+		key, value := fields[0], fields[1]
+		fields = fields[2:]
+
+		switch key {
+		case "from", "to":
+			networks, err := ParseNetworks(value)
+			if err != nil {
+				return nil, err
+			}
+			if len(networks) == 0 {
+				return nil, fmt.Errorf("missing value for '%s'", key)
+			}
+			if key == "from" {
+				r.from = networks
+			} else {
+				r.to = networks
+			}
+		case "proto":
+			proto, ok := protocols[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown protocol '%s'", value)
+			}
+			r.proto = proto
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid port '%s'", value)
+			}
+			r.port = port
+		default:
+			return nil, fmt.Errorf("unknown keyword '%s'", key)
+		}
+	}
+
+	if r.port != 0 && r.proto != protocols["tcp"] && r.proto != protocols["udp"] {
+		return nil, fmt.Errorf("a port may only be used with tcp, or udp")
+	}
+	return r, nil
+}
+
+// ParseRules parses the rules defined in the given settings, returning
+// a Filter which applies them, or nil if there are none.
+//
+// The settings are expected to be the result of looking up the
+// `filter_` prefix in a configuration file, and are keyed by number.
+func ParseRules(settings map[string]string) (Filter, error) {
+	var numbers []int
+	for key := range settings {
+		n, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("filter_%s: rules must be numbered", key)
+		}
+		numbers = append(numbers, n)
+	}
+	if len(numbers) == 0 {
+		return nil, nil
+	}
+	sort.Ints(numbers)
+
+	var rules []*rule
+	inspect := false
+	for _, n := range numbers {
+		r, err := parseRule(settings[strconv.Itoa(n)])
+		if err != nil {
+			return nil, fmt.Errorf("filter_%d: %s", n, err.Error())
+		}
+		rules = append(rules, r)
+		inspect = inspect || r.proto != 0
+	}
+
+	return FilterFunc(func(frame *Frame) Verdict {
+		if len(frame.Data) < 1 {
+			return Accept
+		}
+
+		//
+		// If our rules look at protocols, or ports, then packets whose
+		// headers we can't follow might be hiding either, so are
+		// dropped rather than let past the rules.
+		//
+		if _, _, ok := protocol(frame.Data); inspect && !ok {
+			return Drop
+		}
+		for _, r := range rules {
+			if r.matches(frame.Data) {
+				return r.verdict
+			}
+		}
+		return Accept
+	}), nil
+}
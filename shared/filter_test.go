@@ -0,0 +1,102 @@
+package shared
+
+import (
+	"testing"
+)
+
+// ipv6Packet returns an IPv6 packet from 2001:db8::1 to 2001:db8::2, with
+// the given next-header, and payload.
+func ipv6Packet(next byte, payload []byte) []byte {
+	packet := make([]byte, 40, 40+len(payload))
+	packet[0] = 0x60
+	packet[4], packet[5] = byte(len(payload)>>8), byte(len(payload))
+	packet[6] = next
+	packet[7] = 64
+	packet[8], packet[9], packet[23] = 0x20, 0x01, 1
+	packet[24], packet[25], packet[39] = 0x20, 0x01, 2
+	return append(packet, payload...)
+}
+
+// tcpHeader returns the start of a TCP header, to the given port.
+func tcpHeader(port int) []byte {
+	return []byte{0x30, 0x39, byte(port >> 8), byte(port), 0, 0, 0, 0}
+}
+
+// TestParseRule tests the parsing of our rule-language.
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		valid bool
+	}{
+		{"accept", true},
+		{"drop proto tcp port 22", true},
+		{"drop from 10.0.0.0/8 to 2001:db8::/32 proto udp port 53", true},
+		{"accept proto icmpv6", true},
+		{"", false},
+		{"reject proto tcp", false},
+		{"drop proto", false},
+		{"drop proto sctp", false},
+		{"drop proto tcp port 0", false},
+		{"drop proto tcp port 65536", false},
+		{"drop proto icmp port 22", false},
+		{"drop port 22", false},
+		{"drop from 10.0.0.300", false},
+		{"drop via 10.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseRule(test.rule)
+		if (err == nil) != test.valid {
+			t.Errorf("unexpected result parsing %q: %v", test.rule, err)
+		}
+	}
+}
+
+// TestFilterExtensionHeaders ensures that the extension headers of IPv6
+// packets don't hide their protocol, or ports, from our rules.
+func TestFilterExtensionHeaders(t *testing.T) {
+	filter, err := ParseRules(map[string]string{"1": "drop proto tcp port 22"})
+	if err != nil {
+		t.Fatalf("failed to parse our rules: %s", err)
+	}
+
+	options := []byte{6, 0, 1, 4, 0, 0, 0, 0}
+	tests := []struct {
+		name     string
+		packet   []byte
+		expected Verdict
+	}{
+		{"plain", ipv6Packet(6, tcpHeader(22)), Drop},
+		{"other port", ipv6Packet(6, tcpHeader(80)), Accept},
+		{"hop-by-hop", ipv6Packet(0, append(options, tcpHeader(22)...)), Drop},
+		{"destination options", ipv6Packet(60, append(options, tcpHeader(22)...)), Drop},
+		{"routing", ipv6Packet(43, append(options, tcpHeader(22)...)), Drop},
+		{"chained", ipv6Packet(0, append([]byte{60, 0, 1, 4, 0, 0, 0, 0}, append(options, tcpHeader(22)...)...)), Drop},
+		{"longer options", ipv6Packet(0, append([]byte{6, 1, 1, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, tcpHeader(22)...)), Drop},
+		{"authentication", ipv6Packet(51, append([]byte{6, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, tcpHeader(22)...)), Drop},
+		{"first fragment", ipv6Packet(44, append([]byte{6, 0, 0, 1, 0, 0, 0, 1}, tcpHeader(22)...)), Drop},
+		{"later fragment", ipv6Packet(44, append([]byte{6, 0, 0, 8, 0, 0, 0, 1}, tcpHeader(22)...)), Accept},
+		{"udp", ipv6Packet(0, append([]byte{17, 0, 1, 4, 0, 0, 0, 0}, tcpHeader(22)...)), Accept},
+		{"truncated", ipv6Packet(0, []byte{6, 0, 1, 4}), Drop},
+		{"overlong", ipv6Packet(0, append([]byte{6, 4, 1, 4, 0, 0, 0, 0}, tcpHeader(22)...)), Drop},
+	}
+
+	for _, test := range tests {
+		verdict := filter.Filter(&Frame{Data: test.packet})
+		if verdict != test.expected {
+			t.Errorf("%s: expected verdict %d, got %d", test.name, test.expected, verdict)
+		}
+	}
+}
+
+// TestFilterUninspected ensures that rules which don't look at protocols
+// don't drop packets whose headers we can't follow.
+func TestFilterUninspected(t *testing.T) {
+	filter, err := ParseRules(map[string]string{"1": "drop from 10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("failed to parse our rules: %s", err)
+	}
+	if verdict := filter.Filter(&Frame{Data: ipv6Packet(0, []byte{6, 0})}); verdict != Accept {
+		t.Errorf("expected a truncated packet to be accepted, got %d", verdict)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build fips
+// +build fips
+
+// shared/fips.go is built with the "fips" tag, which restricts our TLS
+// connections to the FIPS-approved cipher suites, whatever our flags.
+
+package shared
+
+// FIPSBuild is true if we were built with the "fips" tag.
+const FIPSBuild = true
@@ -0,0 +1,10 @@
+//go:build !fips
+// +build !fips
+
+// shared/fips_other.go is built without the "fips" tag, so FIPS mode is
+// only enabled by the -fips flag.
+
+package shared
+
+// FIPSBuild is true if we were built with the "fips" tag.
+const FIPSBuild = false
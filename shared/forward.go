@@ -0,0 +1,193 @@
+// shared/forward.go contains our port-forwarding support.
+//
+// A forward listens upon a TCP address and proxies each connection
+// it accepts to a destination which is reached over the VPN.  Since the
+// destination is addressed by its VPN IP the traffic travels over the
+// existing tunnel, and needs no special handling by the socket code.
+//
+// Forwards are configured as "listen -> target", for example:
+//
+//    0.0.0.0:8443 -> frodo:443
+//
+// The host-part of the target may be an IP address, or the name of
+// a connected peer which will be resolved at connection-time.
+
+package shared
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Resolver converts the name of a peer into its VPN IP address,
+// returning the empty string if the peer is unknown.
+type Resolver func(name string) string
+
+// Forward holds the details of a single port-forward.
+type Forward struct {
+	// Name is the name of this forward, used for logging.
+	Name string
+
+	// Listen is the local address we accept connections upon.
+	Listen string
+
+	// Host is the destination host, either an IP or a peer-name.
+	Host string
+
+	// Port is the destination port.
+	Port string
+
+	// Allow contains the networks which may connect to us.  If it is
+	// empty then all sources are permitted.
+	Allow []*net.IPNet
+}
+
+// ParseForward parses a forward of the form "listen -> target", along
+// with an optional comma-separated list of CIDR ranges which are
+// permitted to connect.
+func ParseForward(name string, spec string, allow string) (*Forward, error) {
+
+	parts := strings.Split(spec, "->")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("forward %s: expected 'listen -> target', got '%s'", name, spec)
+	}
+
+	f := &Forward{Name: name, Listen: strings.TrimSpace(parts[0])}
+
+	if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+		return nil, fmt.Errorf("forward %s: invalid listen address: %s", name, err.Error())
+	}
+
+	var err error
+	f.Host, f.Port, err = net.SplitHostPort(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, fmt.Errorf("forward %s: invalid target: %s", name, err.Error())
+	}
+
+	f.Allow, err = ParseNetworks(allow)
+	if err != nil {
+		return nil, fmt.Errorf("forward %s: invalid allow entry: %s", name, err.Error())
+	}
+
+	return f, nil
+}
+
+// Permitted returns true if the given remote address may use this forward.
+func (f *Forward) Permitted(addr net.Addr) bool {
+	if len(f.Allow) == 0 {
+		return true
+	}
+
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	return NetworksContain(f.Allow, tcp.IP)
+}
+
+// Bind opens the listener upon which Serve accepts connections, so that
+// a forward which can't listen may be reported before we start.
+func (f *Forward) Bind() (net.Listener, error) {
+	return net.Listen("tcp", f.Listen)
+}
+
+// Serve accepts connections upon the given listener, which was opened by
+// Bind, and proxies each to the target.
+//
+// It only returns if we fail to accept connections, and closes the
+// listener when it does.
+func (f *Forward) Serve(listener net.Listener, resolve Resolver) error {
+	defer listener.Close()
+
+	log.Printf("[forward %s] Listening on %s for %s", f.Name, f.Listen,
+		net.JoinHostPort(f.Host, f.Port))
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go f.handle(conn, resolve)
+	}
+}
+
+// handle proxies a single connection to the target.
+func (f *Forward) handle(conn net.Conn, resolve Resolver) {
+	defer conn.Close()
+
+	if !f.Permitted(conn.RemoteAddr()) {
+		log.Printf("[forward %s] Rejected connection from %s", f.Name, conn.RemoteAddr())
+		return
+	}
+
+	//
+	// If the host isn't an IP then it is the name of a peer.
+	//
+	host := f.Host
+	if net.ParseIP(host) == nil {
+		host = ""
+		if resolve != nil {
+			host = resolve(f.Host)
+		}
+		if host == "" {
+			log.Printf("[forward %s] Unknown peer %s", f.Name, f.Host)
+			return
+		}
+	}
+
+	target, err := net.Dial("tcp", net.JoinHostPort(host, f.Port))
+	if err != nil {
+		log.Printf("[forward %s] Error connecting to target: %v", f.Name, err)
+		return
+	}
+	defer target.Close()
+
+	//
+	// Copy in both directions, until one side is done.
+	//
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(target, conn)
+		if tcp, ok := target.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, target)
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	wg.Wait()
+}
+
+// LoadForwards parses the forwards defined in the given settings.
+//
+// The settings are expected to be the result of looking up the
+// `forward_` prefix in a configuration file, such that "web" would
+// hold the forward, and "web_allow" the optional access-list.
+func LoadForwards(settings map[string]string) ([]*Forward, error) {
+	var out []*Forward
+
+	for name, spec := range settings {
+		if strings.HasSuffix(name, "_allow") {
+			continue
+		}
+
+		f, err := ParseForward(name, spec, settings[name+"_allow"])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
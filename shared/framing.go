@@ -0,0 +1,177 @@
+// shared/framing.go contains our support for the framing of the traffic
+// we carry, which is agreed by the server and each client.
+//
+// With Ethernet framing our hub switches frames by their MAC addresses,
+// which it learns.  With IP framing, which matches the TUN devices of our
+// clients, it routes packets by their destination IPs instead, using a
+// table of the VPN IP of each socket, and the networks it advertises.
+
+package shared
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// Framing is the framing of the traffic we carry.
+type Framing int
+
+// The framings we support.
+const (
+	// FramingEthernet carries Ethernet frames, which are switched by
+	// their MAC addresses.
+	FramingEthernet Framing = iota
+
+	// FramingIP carries IPv4, and IPv6, packets, which are routed by
+	// their IP addresses.
+	FramingIP
+)
+
+// ParseFraming parses the name of a framing, which is "ethernet" or
+// "ip".  The empty string is Ethernet, which is what older servers use.
+func ParseFraming(str string) (Framing, error) {
+	switch str {
+	case "", "ethernet":
+		return FramingEthernet, nil
+	case "ip":
+		return FramingIP, nil
+	}
+	return FramingEthernet, fmt.Errorf("unknown framing '%s', expected ethernet or ip", str)
+}
+
+// String returns the name of the framing.
+func (f Framing) String() string {
+	if f == FramingIP {
+		return "ip"
+	}
+	return "ethernet"
+}
+
+// l3Route is an entry in the routing table of our hub.
+type l3Route struct {
+	network *net.IPNet
+	sock    *Socket
+}
+
+// l3Table holds the routes of our hub, with the most specific first.
+//
+// Tables are never modified once published, so they may be read without
+// locking, like our macTable.
+type l3Table []l3Route
+
+// SetFraming sets the framing of the traffic we switch.  With IP framing
+// we route packets by their destination IP, rather than their MAC.
+//
+// This must be called before any socket is served.
+func (h *Hub) SetFraming(framing Framing) {
+	h.framing = framing
+}
+
+// SetFraming sets the framing of the traffic we carry.  With IP framing
+// our hub routes the packets sent to our VPN IP, and to the given
+// networks, to us.
+//
+// This must be called before Serve, or from one of our command-handlers,
+// which run upon the goroutine that reads our packets.
+func (s *Socket) SetFraming(framing Framing, networks ...*net.IPNet) {
+	s.framing = framing
+	s.networks = networks
+}
+
+// routes returns our current l3Table.
+func (h *Hub) routes() l3Table {
+	table, _ := h.l3.Load().(l3Table)
+	return table
+}
+
+// FindSocketByIP finds the socket to which we route the given IP, which
+// is the one with the most specific route to it.
+func (h *Hub) FindSocketByIP(ip net.IP) *Socket {
+	for _, route := range h.routes() {
+		if route.network.Contains(ip) {
+			return route.sock
+		}
+	}
+	return nil
+}
+
+// addRoutes adds the routes of the given socket, which are its VPN IP,
+// and the networks it advertises, to our table.
+func (h *Hub) addRoutes(s *Socket) {
+	var networks []*net.IPNet
+	if ip := net.ParseIP(s.clientIP); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	networks = append(networks, s.networks...)
+
+	h.l3Lock.Lock()
+	defer h.l3Lock.Unlock()
+
+	table := append(l3Table{}, h.routes()...)
+	for _, network := range networks {
+		table = append(table, l3Route{network: network, sock: s})
+	}
+	sort.SliceStable(table, func(i, j int) bool {
+		a, _ := table[i].network.Mask.Size()
+		b, _ := table[j].network.Mask.Size()
+		return a > b
+	})
+	h.l3.Store(table)
+}
+
+// removeRoutes removes the routes of the given socket from our table.
+func (h *Hub) removeRoutes(s *Socket) {
+	h.l3Lock.Lock()
+	defer h.l3Lock.Unlock()
+
+	var table l3Table
+	for _, route := range h.routes() {
+		if route.sock != s {
+			table = append(table, route)
+		}
+	}
+	h.l3.Store(table)
+}
+
+// isBroadcast returns true if the given IP is a multicast, or the limited
+// broadcast, address.
+func isBroadcast(ip net.IP) bool {
+	return ip.IsMulticast() || ip.Equal(net.IPv4bcast)
+}
+
+// routeIP routes the given packet, received over our socket, by its
+// destination IP.  It returns false if no other socket claimed it, in
+// which case it should be sent to our uplink, or interface.
+func (s *Socket) routeIP(msg []byte) bool {
+	dest := GetDestIP(msg)
+	if dest == nil {
+		return false
+	}
+
+	//
+	// Multicast and broadcast packets are sent to everybody, unless
+	// this client is sending too many, and to the server too.
+	//
+	if isBroadcast(dest) {
+		if s.broadcasts != nil && !s.broadcasts.Allow(1) {
+			s.dropped("broadcast rate exceeded")
+			return true
+		}
+		s.hub.BroadcastMessage(websocket.BinaryMessage, msg, s)
+		return false
+	}
+
+	sd := s.hub.FindSocketByIP(dest)
+	if sd == nil || sd == s {
+		return false
+	}
+	sd.WriteMessage(websocket.BinaryMessage, msg)
+	return true
+}
@@ -0,0 +1,97 @@
+// shared/gate.go contains our connection-gating support.
+//
+// A gate is consulted about each connection to the server, by the public
+// address it came from, before it is upgraded to a websocket.  It may
+// accept the connection, flag it as suspicious, or reject it.  Gates may
+// look up the country of the address, or its reputation.
+
+package shared
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// GateVerdict is the decision a gate makes about a connection.
+type GateVerdict int
+
+const (
+	// GateAccept allows the connection.
+	GateAccept GateVerdict = iota
+
+	// GateFlag allows the connection, but reports it.
+	GateFlag
+
+	// GateReject refuses the connection.
+	GateReject
+)
+
+// ParseGateVerdict parses the name of a verdict, which is "accept",
+// "flag", or "reject".
+func ParseGateVerdict(str string) (GateVerdict, error) {
+	switch str {
+	case "accept":
+		return GateAccept, nil
+	case "flag":
+		return GateFlag, nil
+	case "reject":
+		return GateReject, nil
+	}
+	return GateAccept, fmt.Errorf("unknown verdict '%s'", str)
+}
+
+// Gate is the interface of a connection-gate.
+//
+// Check returns the verdict upon a connection from the given address,
+// along with the reason for it, if it was flagged or rejected.
+type Gate interface {
+	Check(remote net.IP) (GateVerdict, string)
+}
+
+// GateFunc allows a function to be used as a Gate.
+type GateFunc func(remote net.IP) (GateVerdict, string)
+
+// Check invokes the function.
+func (f GateFunc) Check(remote net.IP) (GateVerdict, string) {
+	return f(remote)
+}
+
+// LoadBlocklist returns a gate which gives the given verdict upon
+// connections from any of the addresses listed in the named file.
+//
+// The file contains one IP, or CIDR range, per line, and lines which
+// are blank or begin with "#" are ignored.
+func LoadBlocklist(path string, verdict GateVerdict) (Gate, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var blocked []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		ent := strings.TrimSpace(scanner.Text())
+		if ent == "" || strings.HasPrefix(ent, "#") {
+			continue
+		}
+		networks, err := ParseNetworks(ent)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+		blocked = append(blocked, networks...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return GateFunc(func(remote net.IP) (GateVerdict, string) {
+		if NetworksContain(blocked, remote) {
+			return verdict, "listed in " + path
+		}
+		return GateAccept, ""
+	}), nil
+}
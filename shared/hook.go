@@ -0,0 +1,147 @@
+// shared/hook.go contains the code to run the user-supplied hook
+// scripts, such as `up`, `down`, and `peers`.
+//
+// Hooks are run in their own process-group, with a timeout, such that
+// a hanging script cannot block us forever.  Their output is captured
+// and sent to our log.
+
+package shared
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultHookTimeout is the time a hook may run for, if the
+// configuration file doesn't specify otherwise.
+const DefaultHookTimeout = 30 * time.Second
+
+// hookOutputGrace is how long we wait for the rest of a hook's output,
+// once it has exited.  Children it left running in the background may
+// hold its output open for far longer, so we don't wait for them.
+const hookOutputGrace = time.Second
+
+// Hook describes a user-supplied command to be executed.
+type Hook struct {
+	// Name is the name of the hook, used for logging.
+	Name string
+
+	// Command is the command to run, along with any arguments,
+	// separated by whitespace.
+	Command string
+
+	// Timeout is the time after which the hook is killed.
+	Timeout time.Duration
+
+	// Env contains additional "KEY=value" environment variables.
+	Env []string
+
+	// Stdin is the data to send to the hook on STDIN, if any.
+	Stdin []byte
+}
+
+// Run executes the hook, and waits for it to complete.
+//
+// If the hook doesn't complete within its timeout its process-group
+// is killed, and an error is returned.
+func (h *Hook) Run() error {
+	args := strings.Fields(h.Command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), h.Env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if h.Stdin != nil {
+		cmd.Stdin = bytes.NewReader(h.Stdin)
+	}
+
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
+		return err
+	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return err
+	}
+
+	//
+	// Log the output of the hook, line by line.
+	//
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go h.logOutput(&wg, "stdout", stdout)
+	go h.logOutput(&wg, "stderr", stderr)
+
+	//
+	// Kill the whole process-group if it runs for too long.
+	//
+	var expired int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&expired, 1)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+
+	err = cmd.Wait()
+	timer.Stop()
+
+	//
+	// We're done once the hook itself has exited, whatever it left
+	// behind, so we only wait briefly for the rest of its output.
+	//
+	logged := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(hookOutputGrace):
+	}
+	stdout.Close()
+	stderr.Close()
+
+	if atomic.LoadInt32(&expired) == 1 {
+		return fmt.Errorf("%s timed out after %s", h.Command, timeout)
+	}
+	return err
+}
+
+// logOutput sends each line of the given reader to our log.
+func (h *Hook) logOutput(wg *sync.WaitGroup, name string, r io.Reader) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		log.Printf("[hook %s] %s: %s", h.Name, name, scanner.Text())
+	}
+}
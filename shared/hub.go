@@ -0,0 +1,398 @@
+// shared/hub.go contains our virtual switch.
+//
+// A hub relays traffic between the sockets which are registered with it,
+// by MAC address.  The server creates one hub for each virtual network it
+// serves, so traffic never passes from one network to another.
+
+package shared
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// macTable maps each MAC address we've learned to its entry.
+//
+// Tables are never modified once published, so they may be read without
+// locking.  Changes are made to a copy, which then replaces the original.
+type macTable map[MacAddr]*macEntry
+
+// macEntry records which socket a MAC address belongs to, and when we
+// last saw it.
+type macEntry struct {
+	// seen is accessed atomically, so must be 64-bit aligned.
+	seen int64
+
+	sock *Socket
+}
+
+// Hub holds the state of a virtual switch.
+type Hub struct {
+	// unknown holds our policy for frames sent to MACs we haven't
+	// learned.  It contains counters which are accessed atomically,
+	// so must be 64-bit aligned.
+	unknown unknownUnicast
+
+	// table holds our current macTable.
+	table atomic.Value
+
+	// macLock serializes changes to the table, and the MACs of each
+	// socket.
+	macLock sync.Mutex
+
+	// sockets holds each socket registered with us, as a []*Socket
+	// which is replaced rather than modified.
+	sockets atomic.Value
+
+	// socketsLock serializes changes to the same.
+	socketsLock sync.Mutex
+
+	// filters are applied to the frames received from every socket.
+	filters Filters
+
+	// address is the IP for which we answer pings, if any.
+	address net.IP
+
+	// gateway is the IP for which we answer ARP requests, and
+	// neighbour solicitations, with gatewayMAC.
+	gateway    net.IP
+	gatewayMAC MacAddr
+
+	// ra holds the router advertisements we send, if any, from raIP,
+	// which is the link-local address of raMAC.
+	ra    *RouterAdvertisement
+	raIP  net.IP
+	raMAC MacAddr
+
+	// uplink is the device which receives the frames no socket claims,
+	// if any.
+	uplink TunDevice
+
+	// framing is the framing of the traffic we switch, and l3 holds
+	// our l3Table, for IP framing.  l3Lock serializes changes to it.
+	framing Framing
+	l3      atomic.Value
+	l3Lock  sync.Mutex
+
+	// neighbourTable holds our current neighbourTable, of the IPv6
+	// addresses of our clients, and neighbourLock serializes changes
+	// to it.
+	neighbourTable atomic.Value
+	neighbourLock  sync.Mutex
+}
+
+// NewHub creates a new, empty, hub.
+func NewHub() *Hub {
+	h := &Hub{}
+	h.table.Store(macTable{})
+	h.sockets.Store([]*Socket{})
+	h.neighbourTable.Store(neighbourTable{})
+	return h
+}
+
+// AddFilter adds a filter which is applied to the frames received from
+// every socket registered with us, after the filter of the socket
+// itself.  Filters are invoked in the order they were added.
+//
+// This must be called before any socket is served.
+func (h *Hub) AddFilter(filter Filter) {
+	h.filters = append(h.filters, filter)
+}
+
+// SetAddress sets the IP for which we answer pings, which is that of
+// the server.  The replies are sent from within the data path, so they
+// work even if the kernel isn't routing traffic to the server's device.
+//
+// This must be called before any socket is served.
+func (h *Hub) SetAddress(ip net.IP) {
+	h.address = ip
+}
+
+// SetGateway sets the IP for which we answer ARP requests, and IPv6
+// neighbour solicitations, which is that of the server, and the MAC we
+// answer with.  That should be the MAC of the server's device, if it has
+// one, or GatewayMAC otherwise.
+//
+// This must be called before any socket is served.
+func (h *Hub) SetGateway(ip net.IP, mac MacAddr) {
+	h.gateway = ip
+	h.gatewayMAC = mac
+}
+
+// SetUplink sets the device which receives the frames that aren't for
+// one of our sockets, such as those for the server itself, in place of
+// the devices of each socket.  Use ServeUplink to switch the frames read
+// from it.
+//
+// This must be called before any socket is served.
+func (h *Hub) SetUplink(dev TunDevice) {
+	h.uplink = dev
+}
+
+// ServeUplink reads frames from our uplink, and passes each to the socket
+// which owns its destination MAC, or to every socket if it isn't unicast.
+// With IP framing we pass packets to the socket which has a route to
+// their destination IP instead.
+//
+// It runs until the given context is cancelled, but doesn't close the
+// uplink.
+func (h *Hub) ServeUplink(ctx context.Context) {
+	dev := KeepOpen(h.uplink)
+	go func() {
+		<-ctx.Done()
+		dev.Close()
+	}()
+
+	packet := make([]byte, FrameSize)
+	for {
+		n, err := dev.Read(packet)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("[S] Error reading packet from %s: %v", h.uplink.Name(), err)
+			return
+		}
+		if h.framing == FramingIP {
+			dest := GetDestIP(packet[:n])
+			if dest == nil {
+				continue
+			}
+			if isBroadcast(dest) {
+				h.BroadcastMessage(websocket.BinaryMessage, packet[:n], nil)
+			} else if sd := h.FindSocketByIP(dest); sd != nil {
+				sd.WriteMessage(websocket.BinaryMessage, packet[:n])
+			}
+			continue
+		}
+		if n < 14 {
+			continue
+		}
+
+		//
+		// While we advertise ourselves as the router nobody else
+		// may, and solicitations for the IPv6 addresses of our
+		// clients are answered on their behalf.
+		//
+		if h.rogueAdvertisement(packet[:n]) {
+			continue
+		}
+		if reply := h.proxyNeighbour(nil, packet[:n]); reply != nil {
+			h.uplink.Write(reply)
+			continue
+		}
+
+		dest := GetDestMAC(packet[:n])
+		if !MACIsUnicast(dest) {
+			h.BroadcastMessage(websocket.BinaryMessage, packet[:n], nil)
+			continue
+		}
+		if sd := h.FindSocketByMAC(dest); sd != nil {
+			sd.WriteMessage(websocket.BinaryMessage, packet[:n])
+		} else {
+			h.sendUnknown(packet[:n], dest, nil)
+		}
+	}
+}
+
+// Filtered returns true if we have any filters.
+func (h *Hub) Filtered() bool {
+	return len(h.filters) > 0
+}
+
+// filter applies our filters to the given frame.
+func (h *Hub) filter(frame *Frame) Verdict {
+	return h.filters.Filter(frame)
+}
+
+// macs returns our current macTable.
+func (h *Hub) macs() macTable {
+	return h.table.Load().(macTable)
+}
+
+// update replaces our macTable with a modified copy.  The caller must
+// hold macLock.
+func (h *Hub) update(fn func(table macTable)) {
+	old := h.macs()
+	table := make(macTable, len(old)+1)
+	for mac, entry := range old {
+		table[mac] = entry
+	}
+	fn(table)
+	h.table.Store(table)
+}
+
+// FindSocketByMAC finds the correct socket, by looking for the
+// specified MAC address.
+func (h *Hub) FindSocketByMAC(mac MacAddr) *Socket {
+	entry := h.macs()[mac]
+	if entry == nil {
+		return nil
+	}
+	return entry.sock
+}
+
+// targets returns each of our sockets.
+func (h *Hub) targets() []*Socket {
+	return h.sockets.Load().([]*Socket)
+}
+
+// BroadcastMessage sends the given data over all sockets, except the
+// one specified.
+//
+// Binary frames are added to the queue of each socket, which all share
+// a single copy of the data.
+func (h *Hub) BroadcastMessage(msgType int, data []byte, skip *Socket) {
+	targets := h.targets()
+
+	if msgType != websocket.BinaryMessage || len(data) > FrameSize {
+		for _, v := range targets {
+			if v != skip {
+				v.WriteMessage(msgType, data)
+			}
+		}
+		return
+	}
+
+	//
+	// The frame holds one reference for each target, and one for
+	// ourselves, so it isn't recycled while we're still sending it.
+	//
+	f := newFrame(data, len(targets)+1)
+	for _, v := range targets {
+		if v == skip {
+			f.release()
+			continue
+		}
+		v.enqueue(f)
+	}
+	f.release()
+}
+
+// BroadcastCommand sends the given command over all sockets.
+func (h *Hub) BroadcastCommand(command string, args []string) {
+	for _, v := range h.targets() {
+		v.SendCommand(command, args...)
+	}
+}
+
+// learn records that the given MAC address belongs to the socket.
+//
+// We never take over a MAC which another socket has learned, which
+// prevents clients from hijacking each other's traffic, and if the
+// socket has learned too many MACs we forget the one we saw least
+// recently.
+func (h *Hub) learn(s *Socket, mac MacAddr) {
+	now := time.Now().UnixNano()
+
+	//
+	// The common case is a MAC we've already learned, which we can
+	// handle without locking.
+	//
+	entry := h.macs()[mac]
+	if entry != nil {
+		if entry.sock == s {
+			atomic.StoreInt64(&entry.seen, now)
+		}
+		return
+	}
+
+	h.macLock.Lock()
+	defer h.macLock.Unlock()
+
+	learnt := false
+	h.update(func(table macTable) {
+		if table[mac] != nil {
+			return
+		}
+
+		if len(s.macs) >= s.maxMACs {
+			var oldest MacAddr
+			var seen int64
+			for m, e := range s.macs {
+				t := atomic.LoadInt64(&e.seen)
+				if seen == 0 || t < seen {
+					oldest, seen = m, t
+				}
+			}
+			delete(s.macs, oldest)
+			delete(table, oldest)
+		}
+
+		entry := &macEntry{seen: now, sock: s}
+		s.macs[mac] = entry
+		table[mac] = entry
+		learnt = true
+	})
+	if learnt {
+		h.learned(s, mac)
+	}
+}
+
+// AgeMACTable forgets each MAC address which hasn't been seen within
+// the given duration, such that it may be learned by another socket,
+// along with the IPv6 addresses we've learned for them.
+func (h *Hub) AgeMACTable(maxAge time.Duration) {
+	h.macLock.Lock()
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+	h.update(func(table macTable) {
+		for mac, entry := range table {
+			if atomic.LoadInt64(&entry.seen) < cutoff {
+				delete(entry.sock.macs, mac)
+				delete(table, mac)
+			}
+		}
+	})
+	h.macLock.Unlock()
+
+	h.ageNeighbours(maxAge)
+}
+
+// register adds the given socket to the hub.
+func (h *Hub) register(s *Socket) {
+	h.socketsLock.Lock()
+	defer h.socketsLock.Unlock()
+
+	old := h.targets()
+	sockets := make([]*Socket, 0, len(old)+1)
+	sockets = append(sockets, old...)
+	h.sockets.Store(append(sockets, s))
+
+	if h.framing == FramingIP {
+		h.addRoutes(s)
+	}
+}
+
+// unregister removes the given socket, and its MAC addresses, from
+// the hub.
+func (h *Hub) unregister(s *Socket) {
+	h.macLock.Lock()
+	h.update(func(table macTable) {
+		for mac := range s.macs {
+			delete(table, mac)
+			delete(s.macs, mac)
+		}
+	})
+	h.macLock.Unlock()
+	if h.framing == FramingIP {
+		h.removeRoutes(s)
+	}
+
+	h.socketsLock.Lock()
+	defer h.socketsLock.Unlock()
+
+	old := h.targets()
+	sockets := make([]*Socket, 0, len(old))
+	for _, v := range old {
+		if v != s {
+			sockets = append(sockets, v)
+		}
+	}
+	h.sockets.Store(sockets)
+}
@@ -0,0 +1,110 @@
+// shared/icmp.go contains our ICMP responder.
+//
+// The server answers pings addressed to its own VPN IP within the data
+// path, so that clients may ping their gateway to test the tunnel even
+// if the kernel of the server isn't routing to its device.
+
+package shared
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ICMP message-types we handle.
+const (
+	icmpEchoRequest   = 8
+	icmpEchoReply     = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// checksum returns the internet checksum of the given data, starting
+// from the given partial sum.
+func checksum(data []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// EchoReply returns the reply to the given packet, if it is an ICMP, or
+// ICMPv6, echo request addressed to the given IP.  Otherwise it returns
+// nil.
+func EchoReply(packet []byte, ip net.IP) []byte {
+	dest := GetDestIP(packet)
+	if dest == nil || !dest.Equal(ip) {
+		return nil
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		hlen := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if hlen < 20 || total > len(packet) || total < hlen+8 {
+			return nil
+		}
+		if packet[9] != 1 || packet[hlen] != icmpEchoRequest {
+			return nil
+		}
+
+		//
+		// Fragments are beyond us.
+		//
+		if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+			return nil
+		}
+
+		reply := make([]byte, total)
+		copy(reply, packet[:total])
+		copy(reply[12:16], packet[16:20])
+		copy(reply[16:20], packet[12:16])
+		reply[8] = 64
+		reply[10], reply[11] = 0, 0
+		binary.BigEndian.PutUint16(reply[10:12], checksum(reply[:hlen], 0))
+
+		icmp := reply[hlen:]
+		icmp[0] = icmpEchoReply
+		icmp[2], icmp[3] = 0, 0
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, 0))
+		return reply
+
+	case 6:
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if total > len(packet) || total < 48 {
+			return nil
+		}
+		if packet[6] != 58 || packet[40] != icmpv6EchoRequest {
+			return nil
+		}
+
+		reply := make([]byte, total)
+		copy(reply, packet[:total])
+		copy(reply[8:24], packet[24:40])
+		copy(reply[24:40], packet[8:24])
+		reply[7] = 64
+
+		icmp := reply[40:]
+		icmp[0] = icmpv6EchoReply
+		icmp[2], icmp[3] = 0, 0
+
+		//
+		// The checksum covers a pseudo-header, of the addresses,
+		// length, and next-header.
+		//
+		var sum uint32
+		for i := 8; i < 40; i += 2 {
+			sum += uint32(reply[i])<<8 | uint32(reply[i+1])
+		}
+		sum += uint32(len(icmp)) + 58
+		binary.BigEndian.PutUint16(icmp[2:4], checksum(icmp, sum))
+		return reply
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+// shared/keepalive.go contains the named profiles of the `keepalive`
+// setting, which decide how quickly each side notices that the other
+// has gone away.
+
+package shared
+
+import (
+	"fmt"
+	"time"
+)
+
+// KeepaliveProfile is how often we ping the other side of a connection,
+// and how long we may go without hearing from it before we close the
+// connection.
+type KeepaliveProfile struct {
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// KeepaliveProfiles are the profiles which may be chosen by name.  The
+// fast profile notices a dead connection within a couple of seconds,
+// which suits VoIP, at the cost of more pings.
+var KeepaliveProfiles = map[string]KeepaliveProfile{
+	"fast":   {Interval: 500 * time.Millisecond, Timeout: 2 * time.Second},
+	"normal": {Interval: DefaultKeepalive / 2, Timeout: DefaultKeepalive},
+	"slow":   {Interval: time.Minute, Timeout: 3 * time.Minute},
+}
+
+// LookupKeepalive returns the named profile, or the normal one if the
+// name is empty.
+func LookupKeepalive(name string) (KeepaliveProfile, error) {
+	if name == "" {
+		name = "normal"
+	}
+	profile, ok := KeepaliveProfiles[name]
+	if !ok {
+		return profile, fmt.Errorf("unknown keepalive %q, expected fast, normal, or slow", name)
+	}
+	return profile, nil
+}
@@ -0,0 +1,125 @@
+//go:build go1.24
+// +build go1.24
+
+// shared/kex.go contains our hybrid key exchange, which combines X25519
+// with ML-KEM-768 (the standardised form of Kyber), such that the keys of
+// our encrypted frames remain secret unless both are broken.
+//
+// Without it the keys are derived from the shared key alone, so anybody
+// who records a connection, and later learns the key, may decrypt it.  With
+// it each connection mixes in a fresh secret, which a recording can't
+// reveal even to a future quantum computer.
+//
+// It requires Go 1.24, for crypto/mlkem, and is unavailable otherwise, see
+// kex_other.go.
+
+package shared
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeyExchangeSupported is true if we were built with our hybrid key
+// exchange.
+const KeyExchangeSupported = true
+
+// KeyExchange is the client's half of a hybrid key exchange.
+type KeyExchange struct {
+	x25519 *ecdh.PrivateKey
+	mlkem  *mlkem.DecapsulationKey768
+
+	// offer is the public half, which we send to the server.
+	offer []byte
+}
+
+// NewKeyExchange begins a hybrid key exchange, with fresh keys.
+func NewKeyExchange() (*KeyExchange, error) {
+	x, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, err
+	}
+
+	offer := append(x.PublicKey().Bytes(), m.EncapsulationKey().Bytes()...)
+	return &KeyExchange{x25519: x, mlkem: m, offer: offer}, nil
+}
+
+// Offer returns the public half of our key exchange, encoded for sending
+// to the server.
+func (k *KeyExchange) Offer() string {
+	return base64.RawURLEncoding.EncodeToString(k.offer)
+}
+
+// Finish completes our key exchange with the server's encoded reply, and
+// returns the secret we now share.
+func (k *KeyExchange) Finish(encoded string) ([]byte, error) {
+	reply, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(reply) != 32+mlkem.CiphertextSize768 {
+		return nil, fmt.Errorf("malformed key exchange")
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(reply[:32])
+	if err != nil {
+		return nil, fmt.Errorf("malformed key exchange: %s", err.Error())
+	}
+	x, err := k.x25519.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	m, err := k.mlkem.Decapsulate(reply[32:])
+	if err != nil {
+		return nil, err
+	}
+	return hybridSecret(x, m, k.offer, reply), nil
+}
+
+// AcceptKeyExchange completes the key exchange a client offered, returning
+// our encoded reply, and the secret we now share.
+func AcceptKeyExchange(encoded string) (string, []byte, error) {
+	offer, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(offer) != 32+mlkem.EncapsulationKeySize768 {
+		return "", nil, fmt.Errorf("malformed key exchange")
+	}
+
+	peer, err := ecdh.X25519().NewPublicKey(offer[:32])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed key exchange: %s", err.Error())
+	}
+	encapsulation, err := mlkem.NewEncapsulationKey768(offer[32:])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed key exchange: %s", err.Error())
+	}
+
+	ours, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	x, err := ours.ECDH(peer)
+	if err != nil {
+		return "", nil, err
+	}
+	m, ciphertext := encapsulation.Encapsulate()
+
+	reply := append(ours.PublicKey().Bytes(), ciphertext...)
+	return base64.RawURLEncoding.EncodeToString(reply), hybridSecret(x, m, offer, reply), nil
+}
+
+// hybridSecret combines the secrets of X25519, and ML-KEM, along with the
+// messages exchanged, so that the result is bound to this exchange.
+func hybridSecret(x []byte, m []byte, offer []byte, reply []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("simple-vpn " + HybridKeyExchange))
+	h.Write(m)
+	h.Write(x)
+	h.Write(offer)
+	h.Write(reply)
+	return h.Sum(nil)
+}
@@ -0,0 +1,39 @@
+//go:build !go1.24
+// +build !go1.24
+
+// shared/kex_other.go contains the stubs of our hybrid key exchange, which
+// requires Go 1.24.
+
+package shared
+
+import "errors"
+
+// KeyExchangeSupported is true if we were built with our hybrid key
+// exchange.
+const KeyExchangeSupported = false
+
+// errNoKeyExchange is returned as we've no hybrid key exchange.
+var errNoKeyExchange = errors.New("the " + HybridKeyExchange + " key exchange requires a build with Go 1.24, or later")
+
+// KeyExchange is the client's half of a hybrid key exchange.
+type KeyExchange struct{}
+
+// NewKeyExchange returns an error, as we've no hybrid key exchange.
+func NewKeyExchange() (*KeyExchange, error) {
+	return nil, errNoKeyExchange
+}
+
+// Offer returns the public half of our key exchange.
+func (k *KeyExchange) Offer() string {
+	return ""
+}
+
+// Finish returns an error, as we've no hybrid key exchange.
+func (k *KeyExchange) Finish(encoded string) ([]byte, error) {
+	return nil, errNoKeyExchange
+}
+
+// AcceptKeyExchange returns an error, as we've no hybrid key exchange.
+func AcceptKeyExchange(encoded string) (string, []byte, error) {
+	return "", nil, errNoKeyExchange
+}
@@ -0,0 +1,98 @@
+// shared/key.go contains the checks of the shared-keys we're configured
+// with, so that trivially weak keys, or the key of our sample
+// configuration-files, are refused rather than silently used.
+//
+// We can't know how a key was chosen, so these only catch the obvious:
+// keys which are short, repetitive, sequential, or well-known.
+
+package shared
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// MinKeyLength is the length of the shortest key we accept.
+const MinKeyLength = 16
+
+// minKeyBits is the least entropy we accept a key to have, as estimated
+// from the frequency of its characters.
+const minKeyBits = 48
+
+// wellKnownKeys are keys which are published, and so are no secret.
+var wellKnownKeys = []string{
+	"Iequa[oogho5reiNgoo7ci4ruho~r#%fdsflj30-1l;alj1.>SDF£LK!",
+	"changeme",
+	"password",
+	"secret",
+}
+
+// CheckKey returns an error describing why the given key is weak, if it
+// is.
+func CheckKey(key string) error {
+	for _, known := range wellKnownKeys {
+		if strings.EqualFold(key, known) {
+			return fmt.Errorf("it is the well-known key %q", key)
+		}
+	}
+
+	runes := []rune(key)
+	if len(runes) < MinKeyLength {
+		return fmt.Errorf("it is shorter than %d characters", MinKeyLength)
+	}
+	if bits := keyBits(runes); bits < minKeyBits {
+		return fmt.Errorf("it is too predictable, with only %d bits of entropy", int(bits))
+	}
+
+	//
+	// Runs such as "0123456789abcdef" have plenty of distinct
+	// characters, but are no secret.
+	//
+	steps := 0
+	for i := 1; i < len(runes); i++ {
+		if step := runes[i] - runes[i-1]; step == 1 || step == -1 {
+			steps++
+		}
+	}
+	if steps*4 >= (len(runes)-1)*3 {
+		return fmt.Errorf("it is mostly a sequence of characters")
+	}
+	return nil
+}
+
+// keyBits estimates the entropy of the given key, from the frequency of
+// each of its characters.
+func keyBits(runes []rune) float64 {
+	counts := make(map[rune]int)
+	for _, r := range runes {
+		counts[r]++
+	}
+
+	bits := 0.0
+	for _, n := range counts {
+		p := float64(n) / float64(len(runes))
+		bits -= p * math.Log2(p)
+	}
+	return bits * float64(len(runes))
+}
+
+// KeyExposure returns where the given key may be seen by other processes,
+// such as our command-line, or environment, or "" if it isn't.
+func KeyExposure(key string) string {
+	if key == "" {
+		return ""
+	}
+	for _, arg := range os.Args[1:] {
+		if strings.Contains(arg, key) {
+			return "command-line"
+		}
+	}
+	for _, env := range os.Environ() {
+		if i := strings.Index(env, "="); i >= 0 && strings.Contains(env[i+1:], key) {
+			return "environment"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,39 @@
+// shared/name.go contains the validation of the names clients connect
+// with.
+//
+// Names are embedded within the peer-lists sent to every client, and so
+// in their hosts-files, the environment of their hooks, and the names of
+// files and settings upon the server.  We restrict them to the characters
+// of a hostname, so that none of those can be broken by a crafted name.
+
+package shared
+
+import "fmt"
+
+// MaxNameLength is the longest name a client may connect with, which is
+// the longest label a hostname may contain.
+const MaxNameLength = 63
+
+// ValidName returns an error if the given name isn't one a client may
+// connect with.
+//
+// Names may contain letters, digits, "-", "_", and ".", but mustn't
+// begin with "-" or ".".
+func ValidName(name string) error {
+	if name == "" {
+		return fmt.Errorf("the name is empty")
+	}
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("the name is longer than %d characters", MaxNameLength)
+	}
+	if name[0] == '-' || name[0] == '.' {
+		return fmt.Errorf("the name %q begins with %q", name, rune(name[0]))
+	}
+	for _, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			continue
+		}
+		return fmt.Errorf("the name %q contains the character %q", name, r)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// shared/ndp.go contains our handling of IPv6 neighbour discovery between
+// the clients of a hub.
+//
+// A host resolves the MAC of an IPv6 address by multicasting a neighbour
+// solicitation, which would otherwise reach every client.  We learn the
+// IPv6 addresses of each client from the frames it sends, and answer the
+// solicitations for those we know on its behalf, so that unicast between
+// clients never relies upon flooding.  Solicitations for addresses we
+// haven't learned are still sent to everybody, so that their owner may
+// answer, and we learn the address from that answer.
+
+package shared
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// maxNeighbours is the number of IPv6 addresses a hub will learn.  Those
+// beyond it are resolved by flooding, as if we hadn't learned them.
+const maxNeighbours = 4096
+
+// neighbourTable maps each IPv6 address we've learned to its entry.
+//
+// Like our macTable it is never modified once published, so it may be
+// read without locking.
+type neighbourTable map[[16]byte]*neighbourEntry
+
+// neighbourEntry records the MAC an IPv6 address belongs to, and when we
+// last saw it.
+type neighbourEntry struct {
+	// seen is accessed atomically, so must be 64-bit aligned.
+	seen int64
+
+	mac MacAddr
+}
+
+// neighbours returns our current neighbourTable.
+func (h *Hub) neighbours() neighbourTable {
+	return h.neighbourTable.Load().(neighbourTable)
+}
+
+// updateNeighbours replaces our neighbourTable with a modified copy.  The
+// caller must hold neighbourLock.
+func (h *Hub) updateNeighbours(fn func(table neighbourTable)) {
+	old := h.neighbours()
+	table := make(neighbourTable, len(old)+1)
+	for ip, entry := range old {
+		table[ip] = entry
+	}
+	fn(table)
+	h.neighbourTable.Store(table)
+}
+
+// learnNeighbour records that the source IP of the given Ethernet frame,
+// which was received from the socket, belongs to its source MAC.
+//
+// We only learn addresses from the socket which owns the MAC, and never
+// take over an address which belongs to the MAC of another socket, so
+// clients can't redirect each other's traffic.
+func (h *Hub) learnNeighbour(s *Socket, frame []byte) {
+	if etherType(frame) != etherTypeIPv6 || len(frame) < 14+40 || frame[14]>>4 != 6 {
+		return
+	}
+	ip := net.IP(frame[22:38])
+	if ip.IsUnspecified() || ip.IsMulticast() || ip.Equal(h.gateway) {
+		return
+	}
+	mac := GetSrcMAC(frame)
+	if h.FindSocketByMAC(mac) != s {
+		return
+	}
+
+	var key [16]byte
+	copy(key[:], ip)
+	now := time.Now().UnixNano()
+
+	//
+	// The common case is an address we've already learned, which we
+	// can handle without locking.
+	//
+	entry := h.neighbours()[key]
+	if entry != nil && entry.mac == mac {
+		atomic.StoreInt64(&entry.seen, now)
+		return
+	}
+
+	h.neighbourLock.Lock()
+	defer h.neighbourLock.Unlock()
+
+	h.updateNeighbours(func(table neighbourTable) {
+		entry := table[key]
+		if entry == nil && len(table) >= maxNeighbours {
+			return
+		}
+		if entry != nil && entry.mac != mac {
+			owner := h.FindSocketByMAC(entry.mac)
+			if owner != nil && owner != s {
+				return
+			}
+		}
+		table[key] = &neighbourEntry{seen: now, mac: mac}
+	})
+}
+
+// FindNeighbour returns the MAC which owns the given IPv6 address, and
+// the socket which owns that MAC, if we've learned them both.
+func (h *Hub) FindNeighbour(ip net.IP) (MacAddr, *Socket) {
+	var key [16]byte
+	copy(key[:], ip.To16())
+
+	entry := h.neighbours()[key]
+	if entry == nil {
+		return MacAddr{}, nil
+	}
+	return entry.mac, h.FindSocketByMAC(entry.mac)
+}
+
+// proxyNeighbour returns our answer to the given Ethernet frame, if it is
+// a multicast neighbour solicitation, for an address we've learned, which
+// was received from a socket other than the one which owns it.  The
+// source is nil for frames read from our uplink.
+//
+// Solicitations sent to a unicast MAC are left for their destination to
+// answer, as they confirm that it is still reachable.
+func (h *Hub) proxyNeighbour(source *Socket, frame []byte) []byte {
+	target := solicitedTarget(frame)
+	if target == nil || MACIsUnicast(GetDestMAC(frame)) {
+		return nil
+	}
+	mac, owner := h.FindNeighbour(target)
+	if owner == nil || owner == source {
+		return nil
+	}
+	return neighbourAdvertisement(frame, target, mac)
+}
+
+// ageNeighbours forgets each IPv6 address which hasn't been seen within
+// the given duration, or whose MAC we've forgotten.
+func (h *Hub) ageNeighbours(maxAge time.Duration) {
+	h.neighbourLock.Lock()
+	defer h.neighbourLock.Unlock()
+
+	cutoff := time.Now().Add(-maxAge).UnixNano()
+	h.updateNeighbours(func(table neighbourTable) {
+		for ip, entry := range table {
+			if atomic.LoadInt64(&entry.seen) < cutoff || h.FindSocketByMAC(entry.mac) == nil {
+				delete(table, ip)
+			}
+		}
+	})
+}
@@ -0,0 +1,77 @@
+// shared/netns_linux.go contains our support for network namespaces,
+// which allows a client to serve a container from outside it.
+
+package shared
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// NetnsPath returns the path of the given network namespace, which may be
+// the name of one created by `ip netns add`, the PID of a process within
+// it, or a path.
+func NetnsPath(spec string) string {
+	if strings.Contains(spec, "/") {
+		return spec
+	}
+	if _, err := strconv.Atoi(spec); err == nil {
+		return filepath.Join("/proc", spec, "ns", "net")
+	}
+	return filepath.Join("/var/run/netns", spec)
+}
+
+// setns moves the current thread into the given network namespace.
+func setns(ns *os.File) error {
+	return unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET)
+}
+
+// InNetns invokes the given function within the network namespace at the
+// given path.  Devices it creates, and commands it runs, are created and
+// run within that namespace.
+func InNetns(path string, fn func() error) error {
+	target, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open the network namespace %s: %s", path, err.Error())
+	}
+	defer target.Close()
+
+	//
+	// Namespaces belong to threads, so we use a goroutine which is
+	// locked to its own.  If we cannot restore its namespace it stays
+	// locked, and the thread is discarded when the goroutine exits.
+	//
+	errs := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errs <- err
+			return
+		}
+		defer current.Close()
+
+		err = setns(target)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errs <- fmt.Errorf("failed to enter the network namespace %s: %s", path, err.Error())
+			return
+		}
+
+		err = fn()
+		if setns(current) == nil {
+			runtime.UnlockOSThread()
+		}
+		errs <- err
+	}()
+	return <-errs
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+// shared/netns_other.go contains the stubs of our support for network
+// namespaces, which only exist upon Linux.
+
+package shared
+
+import "errors"
+
+// NetnsPath returns the path of the given network namespace.
+func NetnsPath(spec string) string {
+	return spec
+}
+
+// InNetns returns an error, as network namespaces are only supported
+// upon Linux.
+func InNetns(path string, fn func() error) error {
+	return errors.New("network namespaces are only supported upon Linux")
+}
@@ -0,0 +1,83 @@
+// shared/peer.go contains the description of a peer, as sent by the
+// server to each client in the peer-list.
+
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Peer describes a client which is connected to the VPN.
+type Peer struct {
+	// Name is the name of the client.
+	Name string
+
+	// IP is the VPN IP of the client.
+	IP string
+
+	// Remote is the public IP the client connected from.
+	Remote string `json:",omitempty"`
+
+	// Connected is when the client connected.
+	Connected time.Time
+
+	// Routes are the networks the client advertises, as reachable
+	// via it.
+	Routes []string `json:",omitempty"`
+
+	// Tags are the freeform tags the client was configured with.
+	Tags []string `json:",omitempty"`
+}
+
+// encodeArg encodes the given value as JSON, for sending as the argument
+// of an in-band command.
+//
+// Since the arguments of commands are separated by "|" we escape that
+// character, which may only appear within strings.
+func encodeArg(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return strings.Replace(string(data), "|", `\u007c`, -1)
+}
+
+// EncodePeer encodes the given peer, for sending as the argument of an
+// in-band command.
+func EncodePeer(peer Peer) string {
+	return encodeArg(peer)
+}
+
+// DecodePeer decodes a peer which was encoded by EncodePeer.
+//
+// Older servers sent only "IP[TAB]NAME", which we still understand.
+func DecodePeer(str string) (Peer, error) {
+	var peer Peer
+
+	if !strings.HasPrefix(str, "{") {
+		out := strings.Split(str, "\t")
+		if len(out) != 2 {
+			return peer, fmt.Errorf("malformed peer '%s'", str)
+		}
+		return Peer{IP: out[0], Name: out[1]}, nil
+	}
+
+	err := json.Unmarshal([]byte(str), &peer)
+	if err != nil {
+		return peer, fmt.Errorf("malformed peer '%s': %s", str, err.Error())
+	}
+	return peer, nil
+}
+
+// SplitList splits a comma-separated list, ignoring empty entries and
+// surrounding whitespace.
+func SplitList(list string) []string {
+	var out []string
+	for _, ent := range strings.Split(list, ",") {
+		ent = strings.TrimSpace(ent)
+		if ent != "" {
+			out = append(out, ent)
+		}
+	}
+	return out
+}
@@ -0,0 +1,248 @@
+// shared/ra.go contains our IPv6 router advertisements.
+//
+// A hub may advertise an IPv6 prefix to its clients, along with the flags
+// which tell them whether to use DHCPv6, and the DNS servers and search
+// domains of RFC 8106, so that hosts on the far side of a TAP device may
+// configure themselves without knowing anything of our control channel.
+//
+// We advertise periodically to every client, answer router solicitations
+// at once, and answer the neighbour solicitations for the link-local
+// address we advertise from.  While we advertise, the advertisements of
+// our clients are dropped, so that none can take over the others' routes.
+
+package shared
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The ICMPv6 message-types of router discovery.
+const (
+	icmpv6RouterSolicitation  = 133
+	icmpv6RouterAdvertisement = 134
+)
+
+// The lifetimes of the prefix we advertise.
+const (
+	prefixValidLifetime     = 24 * time.Hour
+	prefixPreferredLifetime = 4 * time.Hour
+)
+
+// RouterAdvertisement describes the router advertisements a hub sends.
+type RouterAdvertisement struct {
+	// Prefix is advertised as on-link, and for autoconfiguration if it
+	// is a /64.
+	Prefix *net.IPNet
+
+	// Managed, and Other, set the flags of the same names, which tell
+	// hosts to use DHCPv6 for their addresses, or for other settings.
+	Managed bool
+	Other   bool
+
+	// Lifetime is how long hosts may use us as their default router,
+	// which is zero if they shouldn't.
+	Lifetime time.Duration
+
+	// MTU is the MTU of the link, if it is non-zero.
+	MTU int
+
+	// DNS holds the recursive DNS servers, and Search the search
+	// domains, we advertise, if any.
+	DNS    []net.IP
+	Search []string
+
+	// Interval is how often we advertise to every client.
+	Interval time.Duration
+}
+
+// LinkLocal returns the IPv6 link-local address derived from the given
+// MAC, in the modified EUI-64 format.
+func LinkLocal(mac MacAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	ip[8] = mac[0] ^ 0x02
+	ip[9], ip[10] = mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	return ip
+}
+
+// SetRouterAdvertisement sets the advertisements we send, from the
+// link-local address of the given MAC.  Use ServeRouterAdvertisements to
+// send them periodically.
+//
+// This must be called before any socket is served.
+func (h *Hub) SetRouterAdvertisement(ra *RouterAdvertisement, mac MacAddr) {
+	h.ra = ra
+	h.raMAC = mac
+	h.raIP = LinkLocal(mac)
+}
+
+// ServeRouterAdvertisements sends our advertisement to every socket, at
+// our interval, until the given context is cancelled.
+func (h *Hub) ServeRouterAdvertisements(ctx context.Context) {
+	ticker := time.NewTicker(h.ra.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			frame := h.advertisement(MacAddr{0x33, 0x33, 0, 0, 0, 1}, net.ParseIP("ff02::1"))
+			h.BroadcastMessage(websocket.BinaryMessage, frame, nil)
+		}
+	}
+}
+
+// routerReply returns our answer to the given Ethernet frame, if it is a
+// router solicitation, or a neighbour solicitation for the address we
+// advertise from.  Otherwise it returns nil.
+func (h *Hub) routerReply(frame []byte) []byte {
+	if h.ra == nil {
+		return nil
+	}
+	if reply := neighbourAdvertisement(frame, h.raIP, h.raMAC); reply != nil {
+		return reply
+	}
+	if icmpv6Type(frame) != icmpv6RouterSolicitation {
+		return nil
+	}
+
+	//
+	// Solicitations from hosts which don't yet have an address are
+	// answered to all nodes.
+	//
+	src := net.IP(frame[22:38])
+	if src.IsUnspecified() {
+		src = net.ParseIP("ff02::1")
+	}
+	return h.advertisement(GetSrcMAC(frame), src)
+}
+
+// rogueAdvertisement returns true if the given Ethernet frame is a router
+// advertisement, which we drop from our clients while we advertise.
+func (h *Hub) rogueAdvertisement(frame []byte) bool {
+	return h.ra != nil && icmpv6Type(frame) == icmpv6RouterAdvertisement
+}
+
+// icmpv6Type returns the ICMPv6 message-type of the given Ethernet frame,
+// or zero if it doesn't hold an ICMPv6 message.
+//
+// We don't follow extension headers, as neighbour, and router, discovery
+// messages never have them.
+func icmpv6Type(frame []byte) byte {
+	if etherType(frame) != etherTypeIPv6 || len(frame) < 14+40+4 {
+		return 0
+	}
+	packet := frame[14:]
+	if packet[0]>>4 != 6 || packet[6] != 58 {
+		return 0
+	}
+	return packet[40]
+}
+
+// advertisement returns our router advertisement, addressed to the given
+// MAC, and IP.
+func (h *Hub) advertisement(mac MacAddr, dest net.IP) []byte {
+	ra := h.ra
+
+	icmp := make([]byte, 16, 128)
+	icmp[0] = icmpv6RouterAdvertisement
+	icmp[4] = 64
+	if ra.Managed {
+		icmp[5] |= 0x80
+	}
+	if ra.Other {
+		icmp[5] |= 0x40
+	}
+	binary.BigEndian.PutUint16(icmp[6:8], uint16(ra.Lifetime/time.Second))
+
+	//
+	// The source link-layer address option.
+	//
+	icmp = append(icmp, 1, 1)
+	icmp = append(icmp, h.raMAC[:]...)
+
+	if ra.MTU > 0 {
+		option := make([]byte, 8)
+		option[0], option[1] = 5, 1
+		binary.BigEndian.PutUint32(option[4:8], uint32(ra.MTU))
+		icmp = append(icmp, option...)
+	}
+
+	if ra.Prefix != nil {
+		ones, _ := ra.Prefix.Mask.Size()
+		option := make([]byte, 32)
+		option[0], option[1] = 3, 4
+		option[2] = byte(ones)
+		option[3] = 0x80
+		if ones == 64 {
+			option[3] |= 0x40
+		}
+		binary.BigEndian.PutUint32(option[4:8], uint32(prefixValidLifetime/time.Second))
+		binary.BigEndian.PutUint32(option[8:12], uint32(prefixPreferredLifetime/time.Second))
+		copy(option[16:32], ra.Prefix.IP.Mask(ra.Prefix.Mask).To16())
+		icmp = append(icmp, option...)
+	}
+
+	//
+	// Our DNS settings remain valid for three of our intervals, as
+	// RFC 8106 suggests, so a lost advertisement or two is harmless.
+	//
+	lifetime := uint32(3 * ra.Interval / time.Second)
+	if len(ra.DNS) > 0 {
+		option := make([]byte, 8, 8+16*len(ra.DNS))
+		option[0], option[1] = 25, byte(1+2*len(ra.DNS))
+		binary.BigEndian.PutUint32(option[4:8], lifetime)
+		for _, ip := range ra.DNS {
+			option = append(option, ip.To16()...)
+		}
+		icmp = append(icmp, option...)
+	}
+	if len(ra.Search) > 0 {
+		option := make([]byte, 8)
+		option[0] = 31
+		binary.BigEndian.PutUint32(option[4:8], lifetime)
+		for _, domain := range ra.Search {
+			for _, label := range strings.Split(strings.Trim(domain, "."), ".") {
+				option = append(option, byte(len(label)))
+				option = append(option, label...)
+			}
+			option = append(option, 0)
+		}
+		for len(option)%8 != 0 {
+			option = append(option, 0)
+		}
+		option[1] = byte(len(option) / 8)
+		icmp = append(icmp, option...)
+	}
+
+	frame := make([]byte, 14+40+len(icmp))
+	copy(frame[0:6], mac[:])
+	copy(frame[6:12], h.raMAC[:])
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv6)
+
+	out := frame[14:]
+	out[0] = 0x60
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(icmp)))
+	out[6] = 58
+	out[7] = 255
+	copy(out[8:24], h.raIP)
+	copy(out[24:40], dest.To16())
+	copy(out[40:], icmp)
+
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(out[i])<<8 | uint32(out[i+1])
+	}
+	sum += uint32(len(icmp)) + 58
+	binary.BigEndian.PutUint16(out[42:44], checksum(out[40:], sum))
+	return frame
+}
@@ -0,0 +1,66 @@
+// shared/ratelimit.go contains a simple token-bucket rate-limiter.
+
+package shared
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token-bucket, which allows a number of events, or
+// bytes, per second with a given burst.
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// NewRateLimiter creates a rate-limiter which allows `rate` tokens per
+// second, with bursts of up to `burst` tokens.
+func NewRateLimiter(rate int, burst int) *RateLimiter {
+	if burst < rate {
+		burst = rate
+	}
+	return &RateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the rate, and burst, of the rate-limiter.
+func (r *RateLimiter) SetRate(rate int, burst int) {
+	if burst < rate {
+		burst = rate
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rate = float64(rate)
+	r.burst = float64(burst)
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+}
+
+// Allow returns true if `n` tokens are available, and consumes them.
+func (r *RateLimiter) Allow(n int) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	if r.tokens < float64(n) {
+		return false
+	}
+	r.tokens -= float64(n)
+	return true
+}
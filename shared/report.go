@@ -0,0 +1,59 @@
+// shared/report.go contains the health-report which each client
+// periodically sends to the server.
+
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Report describes the health of a client.
+type Report struct {
+	// Version is the version of the client.
+	Version string
+
+	// OS and Arch describe the platform of the client.
+	OS   string
+	Arch string
+
+	// Hostname is the hostname of the client, and Addresses are the
+	// addresses of its network interfaces, other than its VPN device.
+	Hostname  string   `json:",omitempty"`
+	Addresses []string `json:",omitempty"`
+
+	// TLS describes the parameters negotiated for the client's
+	// connection, such as "TLS 1.2, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	// if it used TLS.  This is as seen by the client, so describes
+	// any proxy in front of us.
+	TLS string `json:",omitempty"`
+
+	// RTT is the round-trip time to the server, in milliseconds, as
+	// measured by the client.
+	RTT float64
+
+	// Stats are the traffic-counters of the client's connection.
+	Stats Stats
+
+	// RxErrors and TxErrors are the error-counters of the client's
+	// device, where the platform reports them.
+	RxErrors uint64
+	TxErrors uint64
+}
+
+// EncodeReport encodes the given report, for sending as the argument of
+// an in-band command.
+func EncodeReport(report Report) string {
+	return encodeArg(report)
+}
+
+// DecodeReport decodes a report which was encoded by EncodeReport.
+func DecodeReport(str string) (Report, error) {
+	var report Report
+
+	err := json.Unmarshal([]byte(str), &report)
+	if err != nil {
+		return report, fmt.Errorf("malformed report '%s': %s", str, err.Error())
+	}
+	return report, nil
+}
@@ -0,0 +1,85 @@
+// shared/sanity.go contains the checks we make upon the packets we
+// receive from the other side, before we write them to our device, so
+// that garbage from a buggy, or hostile, peer goes no further.
+
+package shared
+
+import "encoding/binary"
+
+// The reasons for which CheckPacket rejects a packet.
+const (
+	DropEmpty     = "empty packet"
+	DropVersion   = "unknown IP version"
+	DropTruncated = "truncated packet"
+	DropHeader    = "malformed header"
+	DropMTU       = "exceeds MTU"
+)
+
+// CheckPacket returns the reason the given packet, which has the given
+// framing, is malformed, or the empty string if it isn't.
+//
+// The packet must be a complete IPv4, or IPv6, packet, and if `mtu` is
+// non-zero mustn't be larger than it.  Ethernet frames are accepted if
+// they carry such a packet, or an ARP message.
+//
+// The framing is never guessed from the packet, as the first octet of an
+// Ethernet frame may look like the version of an IP packet.
+func CheckPacket(packet []byte, framing Framing, mtu int) string {
+	if framing == FramingIP {
+		return checkIP(packet, mtu)
+	}
+
+	if len(packet) == 0 {
+		return DropEmpty
+	}
+	if len(packet) < 14 {
+		return DropTruncated
+	}
+	switch etherType(packet) {
+	case etherTypeARP:
+		if len(packet) < 42 {
+			return DropTruncated
+		}
+		return ""
+	case etherTypeIPv4, etherTypeIPv6:
+		return checkIP(packet[14:], mtu)
+	}
+	return DropVersion
+}
+
+// checkIP returns the reason the given IP packet is malformed, or the
+// empty string if it isn't.
+func checkIP(packet []byte, mtu int) string {
+	if len(packet) == 0 {
+		return DropEmpty
+	}
+	if mtu > 0 && len(packet) > mtu {
+		return DropMTU
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < 20 {
+			return DropTruncated
+		}
+		hlen := int(packet[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(packet[2:4]))
+		if hlen < 20 || total < hlen {
+			return DropHeader
+		}
+		if total > len(packet) {
+			return DropTruncated
+		}
+	case 6:
+		if len(packet) < 40 {
+			return DropTruncated
+		}
+		total := 40 + int(binary.BigEndian.Uint16(packet[4:6]))
+		if total > len(packet) {
+			return DropTruncated
+		}
+	default:
+		return DropVersion
+	}
+	return ""
+}
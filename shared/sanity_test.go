@@ -0,0 +1,67 @@
+package shared
+
+import (
+	"testing"
+)
+
+// ethernetFrame returns an Ethernet frame, to the given MAC, carrying the
+// given protocol and payload.
+func ethernetFrame(dest MacAddr, proto uint16, payload []byte) []byte {
+	frame := make([]byte, 14, 14+len(payload))
+	copy(frame[0:6], dest[:])
+	copy(frame[6:12], []byte{0x02, 0, 0, 0, 0, 1})
+	frame[12], frame[13] = byte(proto>>8), byte(proto)
+	return append(frame, payload...)
+}
+
+// TestCheckPacket tests the checks we make upon packets, in each framing.
+func TestCheckPacket(t *testing.T) {
+	ipv4 := []byte{0x45, 0, 0, 20, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	ipv6 := ipv6Packet(6, tcpHeader(22))
+	arp := make([]byte, 28)
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		framing  Framing
+		expected string
+	}{
+		{"ipv4", ipv4, FramingIP, ""},
+		{"ipv6", ipv6, FramingIP, ""},
+		{"empty", nil, FramingIP, DropEmpty},
+		{"version", []byte{0x50, 0, 0, 0}, FramingIP, DropVersion},
+		{"truncated ipv4", ipv4[:19], FramingIP, DropTruncated},
+		{"truncated ipv6", ipv6[:44], FramingIP, DropTruncated},
+		{"bad header", append([]byte{0x44}, ipv4[1:]...), FramingIP, DropHeader},
+		{"ethernet in ip", ethernetFrame(MacAddr{0x42, 0, 0, 0, 0, 2}, etherTypeIPv4, ipv4), FramingIP, DropHeader},
+
+		// Destination MACs which begin like IP packets aren't.
+		{"ethernet ipv4", ethernetFrame(MacAddr{0x42, 0, 0, 0, 0, 2}, etherTypeIPv4, ipv4), FramingEthernet, ""},
+		{"ethernet ipv6", ethernetFrame(MacAddr{0x62, 0, 0, 0, 0, 2}, etherTypeIPv6, ipv6), FramingEthernet, ""},
+		{"ethernet arp", ethernetFrame(MacAddr{0x46, 0, 0, 0, 0, 2}, etherTypeARP, arp), FramingEthernet, ""},
+		{"ethernet broadcast", ethernetFrame(MacAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, etherTypeARP, arp), FramingEthernet, ""},
+		{"ethernet truncated arp", ethernetFrame(MacAddr{0x42, 0, 0, 0, 0, 2}, etherTypeARP, arp[:10]), FramingEthernet, DropTruncated},
+		{"ethernet truncated ipv4", ethernetFrame(MacAddr{0x02, 0, 0, 0, 0, 2}, etherTypeIPv4, ipv4[:19]), FramingEthernet, DropTruncated},
+		{"ethernet unknown", ethernetFrame(MacAddr{0x02, 0, 0, 0, 0, 2}, 0x88cc, arp), FramingEthernet, DropVersion},
+		{"ethernet short", []byte{0x42, 0, 0}, FramingEthernet, DropTruncated},
+		{"ethernet empty", nil, FramingEthernet, DropEmpty},
+	}
+
+	for _, test := range tests {
+		if reason := CheckPacket(test.packet, test.framing, 0); reason != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, reason)
+		}
+	}
+}
+
+// TestCheckPacketMTU ensures that packets larger than the MTU are dropped,
+// without counting the Ethernet header.
+func TestCheckPacketMTU(t *testing.T) {
+	packet := ipv6Packet(6, make([]byte, 100))
+	if reason := CheckPacket(packet, FramingIP, 139); reason != DropMTU {
+		t.Errorf("expected %q, got %q", DropMTU, reason)
+	}
+	if reason := CheckPacket(ethernetFrame(MacAddr{0x42, 0, 0, 0, 0, 2}, etherTypeIPv6, packet), FramingEthernet, 140); reason != "" {
+		t.Errorf("expected the frame to be accepted, got %q", reason)
+	}
+}
@@ -0,0 +1,151 @@
+// shared/schedule.go contains the schedules which restrict the times at
+// which clients may be connected.
+
+package shared
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays maps the names of the days to their numbers.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// window is a period of time, upon some days of the week.
+type window struct {
+	// days are the days the window starts upon.
+	days [7]bool
+
+	// start and end are minutes since midnight.  If end isn't after
+	// start then the window runs past midnight.
+	start int
+	end   int
+}
+
+// Schedule is a list of windows, in a given timezone, during which
+// something is allowed.
+type Schedule struct {
+	windows []window
+	zone    *time.Location
+}
+
+// parseDays parses a day, such as "Mon", or a range of days, such as
+// "Mon-Fri", which may wrap around the end of the week.
+func parseDays(str string) ([7]bool, error) {
+	var days [7]bool
+
+	if strings.ToLower(str) == "daily" {
+		str = "Mon-Sun"
+	}
+	fields := strings.SplitN(strings.ToLower(str), "-", 2)
+	first, ok := weekdays[fields[0]]
+	if !ok {
+		return days, fmt.Errorf("unknown day '%s'", fields[0])
+	}
+	last := first
+	if len(fields) == 2 {
+		last, ok = weekdays[fields[1]]
+		if !ok {
+			return days, fmt.Errorf("unknown day '%s'", fields[1])
+		}
+	}
+
+	for day := first; ; day = (day + 1) % 7 {
+		days[day] = true
+		if day == last {
+			break
+		}
+	}
+	return days, nil
+}
+
+// parseClock parses a time of day, such as "08:30", into minutes since
+// midnight.  We allow "24:00", for the end of a window.
+func parseClock(str string) (int, error) {
+	var hour, minute int
+	_, err := fmt.Sscanf(str, "%d:%d", &hour, &minute)
+	if err != nil || len(str) < 4 || len(str) > 5 || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time '%s'", str)
+	}
+	return hour*60 + minute, nil
+}
+
+// ParseSchedule parses a comma-separated list of windows, each of which
+// is a day, or range of days, optionally followed by a range of times,
+// such as "Mon-Fri 08:00-18:00, Sat 10:00-12:00".  A window without
+// times lasts all day, and one whose end is before its start runs past
+// midnight.
+//
+// The times are those of the given zone.
+func ParseSchedule(str string, zone *time.Location) (*Schedule, error) {
+	s := &Schedule{zone: zone}
+
+	for _, ent := range SplitList(str) {
+		fields := strings.Fields(ent)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("invalid window '%s'", ent)
+		}
+
+		w := window{end: 24 * 60}
+		var err error
+		w.days, err = parseDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 2 {
+			times := strings.SplitN(fields[1], "-", 2)
+			if len(times) != 2 {
+				return nil, fmt.Errorf("invalid times '%s'", fields[1])
+			}
+			w.start, err = parseClock(times[0])
+			if err != nil {
+				return nil, err
+			}
+			w.end, err = parseClock(times[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.windows = append(s.windows, w)
+	}
+
+	if len(s.windows) == 0 {
+		return nil, fmt.Errorf("the schedule is empty")
+	}
+	return s, nil
+}
+
+// Allows returns true if the given time is within one of our windows.
+func (s *Schedule) Allows(t time.Time) bool {
+	t = t.In(s.zone)
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	now := t.Hour()*60 + t.Minute()
+
+	for _, w := range s.windows {
+		if w.end > w.start {
+			if w.days[day] && now >= w.start && now < w.end {
+				return true
+			}
+			continue
+		}
+
+		//
+		// The window runs past midnight, so may have started today,
+		// or yesterday.
+		//
+		if (w.days[day] && now >= w.start) || (w.days[yesterday] && now < w.end) {
+			return true
+		}
+	}
+	return false
+}
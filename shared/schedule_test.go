@@ -0,0 +1,104 @@
+package shared
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParseSchedule tests the schedules we accept, and those we refuse.
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		valid    bool
+	}{
+		{"Mon-Fri 08:00-18:00", true},
+		{"Mon-Fri 08:00-18:00, Sat 10:00-12:00", true},
+		{"daily", true},
+		{"DAILY 22:00-06:00", true},
+		{"Fri-Mon", true},
+		{"mon 00:00-24:00", true},
+		{"", false},
+		{"Xyz", false},
+		{"Mon-Xyz", false},
+		{"Mon 08:00", false},
+		{"Mon 25:00-26:00", false},
+		{"Mon 08:60-09:00", false},
+		{"Mon 8-9", false},
+		{"Mon 08:00-18:00 Tue", false},
+	}
+
+	for _, test := range tests {
+		_, err := ParseSchedule(test.schedule, time.UTC)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error %s", test.schedule, err.Error())
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.schedule)
+		}
+	}
+}
+
+// TestScheduleAllows tests the times our schedules allow, including those
+// of windows which wrap around the end of the week, or run past midnight.
+func TestScheduleAllows(t *testing.T) {
+
+	// 2026-10-12 is a Monday.
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, 12+day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		schedule string
+		time     time.Time
+		allowed  bool
+	}{
+		{"Mon-Fri 08:00-18:00", at(0, 8, 0), true},
+		{"Mon-Fri 08:00-18:00", at(0, 17, 59), true},
+		{"Mon-Fri 08:00-18:00", at(0, 18, 0), false},
+		{"Mon-Fri 08:00-18:00", at(0, 7, 59), false},
+		{"Mon-Fri 08:00-18:00", at(5, 12, 0), false},
+		{"Mon-Fri 08:00-18:00, Sat 10:00-12:00", at(5, 11, 0), true},
+		{"daily", at(6, 23, 59), true},
+
+		// Ranges of days may wrap around the end of the week.
+		{"Fri-Mon", at(6, 12, 0), true},
+		{"Fri-Mon", at(1, 12, 0), false},
+
+		// Windows which run past midnight are allowed the next morning,
+		// even upon days they don't start.
+		{"Mon 22:00-06:00", at(0, 23, 0), true},
+		{"Mon 22:00-06:00", at(1, 5, 59), true},
+		{"Mon 22:00-06:00", at(1, 6, 0), false},
+		{"Mon 22:00-06:00", at(1, 23, 0), false},
+		{"Mon 22:00-06:00", at(0, 5, 0), false},
+		{"Sun 22:00-06:00", at(0, 1, 0), true},
+	}
+
+	for _, test := range tests {
+		s, err := ParseSchedule(test.schedule, time.UTC)
+		if err != nil {
+			t.Fatalf("%q: unexpected error %s", test.schedule, err.Error())
+		}
+		if s.Allows(test.time) != test.allowed {
+			t.Errorf("%q at %s: expected %v", test.schedule, test.time.Format(time.RFC1123), test.allowed)
+		}
+	}
+}
+
+// TestScheduleZone ensures that the times of a schedule are those of its
+// zone, rather than of the time we're given.
+func TestScheduleZone(t *testing.T) {
+	zone := time.FixedZone("UTC+10", 10*60*60)
+	s, err := ParseSchedule("Mon 08:00-09:00", zone)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err.Error())
+	}
+
+	// 22:30 on Sunday, UTC, is 08:30 on Monday in our zone.
+	if !s.Allows(time.Date(2026, 10, 11, 22, 30, 0, 0, time.UTC)) {
+		t.Errorf("expected the window to be in our zone")
+	}
+	if s.Allows(time.Date(2026, 10, 12, 8, 30, 0, 0, time.UTC)) {
+		t.Errorf("expected the window not to be in UTC")
+	}
+}
@@ -4,110 +4,424 @@
 // When a client connects to the VPN server their local tun device
 // is one end of the socket, and the WS-connection is the other.
 //
-// For the server we have an array of such things, and we handle
-// traffic by sending to the "correct" socket by MAC address - except
-// in the case of IPv6 where we broadcast.
+// For the server we have an array of such things, registered with a
+// Hub, and we handle traffic by sending to the "correct" socket by MAC
+// address, for IPv4 and IPv6 alike.  With IP framing, see framing.go,
+// packets are routed by their destination IP instead, IPv6 included.
 //
-// IPv6 behaviour could, and should, be improved.  But handling router
-// advertisements, neighbour solicitations, etc, is hard.  Better to
-// keep it simple.  Keep it secret.  Keep it safe.
+// IPv6 neighbour solicitations for the addresses of other clients are
+// answered by the hub on their behalf, see ndp.go, rather than being
+// broadcast, and the hub may advertise itself as the router, see ra.go.
 
 package shared
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/songgao/water"
 )
 
 // Type of reaping function
-type reap func(Socket, string)
+type reap func(*Socket, string)
 
 var lastCommandID uint64
 
-var defaultMac = [6]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+// CommandHandler is the signature of a function which can be
+// triggered via a command over our websocket connection.
+// We use if for `init`.
+type CommandHandler func(args []string) error
 
-var macTable = make(map[MacAddr]*Socket)
+// Stats holds the traffic counters of a socket.
+type Stats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	TxBytes   uint64
+	TxPackets uint64
+	Dropped   uint64
+	TxDropped uint64
 
-var macLock sync.RWMutex
-var allSockets = make(map[*Socket]*Socket)
-var allSocketsLock sync.RWMutex
+	// Pings is the number of pings we've sent, and MissedPongs the
+	// number which weren't answered before we sent the next.
+	Pings       uint64
+	MissedPongs uint64
 
-// FindSocketByMAC finds the correct socket, by looking for the
-// specified MAC address.
-func FindSocketByMAC(mac MacAddr) *Socket {
-	macLock.RLock()
-	defer macLock.RUnlock()
-	return macTable[mac]
+	// Drops counts the packets received over the socket which we
+	// dropped, by the reason we dropped them.
+	Drops map[string]uint64 `json:",omitempty"`
 }
 
-// BroadcastMessage sends the given data over all sockets.
-func BroadcastMessage(msgType int, data []byte, skip *Socket) {
-	allSocketsLock.RLock()
-	targetList := make([]*Socket, 0)
-	for _, v := range allSockets {
-		if v == skip {
-			continue
-		}
-		targetList = append(targetList, v)
-	}
-	allSocketsLock.RUnlock()
+// DefaultKeepalive is how long a socket may go without hearing from the
+// other side before it is closed, unless SetKeepalive is used.  We ping
+// the other side twice in that time.
+const DefaultKeepalive = 30 * time.Second
 
-	for _, v := range targetList {
-		v.WriteMessage(msgType, data)
-	}
+// requestTimeout is how long Request waits for a reply.
+const requestTimeout = 10 * time.Second
+
+// DefaultQueueDepth is the number of frames which may be waiting to be
+// sent over a socket, unless SetQueueDepth is used.
+const DefaultQueueDepth = 256
+
+// frame is an outgoing frame, held in a pooled buffer.
+//
+// A broadcast frame is shared by the queue of each socket it is sent
+// to, so the buffer is only returned to the pool once every one of them
+// has released it.
+type frame struct {
+	refs int32
+	buf  *[]byte
+	n    int
 }
 
-// CommandHandler is the signature of a function which can be
-// triggered via a command over our websocket connection.
-// We use if for `init`.
-type CommandHandler func(args []string) error
+// newFrame copies the given data into a frame, which must be released
+// the given number of times.
+func newFrame(data []byte, refs int) *frame {
+	buf := getFrame(len(data))
+	return &frame{refs: int32(refs), buf: buf, n: copy(*buf, data)}
+}
+
+// release drops a reference to the frame.
+func (f *frame) release() {
+	if atomic.AddInt32(&f.refs, -1) == 0 {
+		putFrame(f.buf)
+	}
+}
 
 // Socket holds state about our connection.
 type Socket struct {
+	// These are accessed atomically, so must be 64-bit aligned.
+	stats     Stats
+	rtt       int64
+	keepalive int64
+	interval  int64
+
+	// delays holds our estimates of our one-way delays.
+	delays delayEstimator
+
+	// stopping is non-zero once we're shutting down, after which we
+	// no longer read our interface.  It is accessed atomically.
+	stopping int32
+
+	// mtu is the largest packet we'll accept from the other side, or
+	// zero if we don't check.  It is accessed atomically.
+	mtu int32
+
+	// framing is the framing of the traffic we carry, and networks
+	// those we advertise, for which our hub routes packets to us.
+	framing  Framing
+	networks []*net.IPNet
+
+	// drops counts the packets we've dropped by reason.
+	drops      map[string]uint64
+	dropsMutex sync.Mutex
+
 	clientIP      string
+	hub           *Hub
 	conn          *websocket.Conn
-	iface         *water.Interface
+	iface         TunDevice
+	queues        []TunDevice
+	writers       []chan *frame
+	reading       bool
 	writeLock     *sync.Mutex
 	wg            *sync.WaitGroup
 	handlers      map[string]CommandHandler
-	closechan     chan bool
-	closechanopen bool
-	mac           MacAddr
+	ctx           context.Context
+	cancel        context.CancelFunc
+	queue         chan *frame
+	macs          map[MacAddr]*macEntry
+	maxMACs       int
+	allowedMACs   map[MacAddr]bool
 	reaper        reap
-	reaped        bool
+	reapOnce      sync.Once
+	filter        Filter
+	direct        func([]byte) bool
+	broadcasts    *RateLimiter
+	dropLoops     bool
+	lastDropLog   time.Time
+	unloggedDrops int
+
+	// commands limits the rate of the in-band commands we'll run, and
+	// refusals counts those we've refused since we last logged them.
+	commands       *RateLimiter
+	lastRefusalLog time.Time
+	refusals       int
+
+	// classes counts our traffic by protocol, and port, if enabled.
+	classes *classes
+
+	// ciphers encrypt our messages, if we've agreed to, and sealed is
+	// the buffer each is encrypted into before it's sent.
+	ciphers *Ciphers
+	sealed  []byte
+
+	// pending holds the channels which receive the replies to our
+	// requests, by command ID.
+	pending      map[string]chan string
+	pendingMutex sync.Mutex
+
+	// allowed holds the commands we accept, if restricted, and
+	// peerCommands those the other side accepts, if it told us.
+	allowed      map[string]bool
+	peerCommands map[string]bool
+	peerMutex    sync.Mutex
 }
 
 // MakeSocket is our constructor.  It ties a websocket connection to
 // an interface connection.
-func MakeSocket(clientIP string, conn *websocket.Conn, iface *water.Interface, fn reap) *Socket {
-	return &Socket{
-		clientIP:      clientIP,
-		conn:          conn,
-		iface:         iface,
-		writeLock:     &sync.Mutex{},
-		wg:            &sync.WaitGroup{},
-		handlers:      make(map[string]CommandHandler),
-		closechan:     make(chan bool),
-		closechanopen: true,
-		mac:           defaultMac,
-		reaper:        fn,
+func MakeSocket(clientIP string, conn *websocket.Conn, iface TunDevice, fn reap) *Socket {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Socket{
+		clientIP:  clientIP,
+		conn:      conn,
+		iface:     iface,
+		writeLock: &sync.Mutex{},
+		wg:        &sync.WaitGroup{},
+		handlers:  make(map[string]CommandHandler),
+		ctx:       ctx,
+		cancel:    cancel,
+		queue:     make(chan *frame, DefaultQueueDepth),
+		macs:      make(map[MacAddr]*macEntry),
+		maxMACs:   1,
+		reaper:    fn,
+		keepalive: int64(DefaultKeepalive),
+		interval:  int64(DefaultKeepalive / 2),
+		pending:   make(map[string]chan string),
+	}
+	s.handlers[capabilitiesCommand] = s.setPeerCommands
+	return s
+}
+
+// SetKeepalive sets how long we may go without hearing from the other
+// side before we close the connection, which we ping twice in that time.
+// It may be changed at any time.
+func (s *Socket) SetKeepalive(keepalive time.Duration) {
+	s.SetKeepaliveProfile(KeepaliveProfile{Interval: keepalive / 2, Timeout: keepalive})
+}
+
+// SetKeepaliveProfile sets how often we ping the other side, and how long
+// we may go without hearing from it.  It may be changed at any time.
+func (s *Socket) SetKeepaliveProfile(profile KeepaliveProfile) {
+	atomic.StoreInt64(&s.interval, int64(profile.Interval))
+	atomic.StoreInt64(&s.keepalive, int64(profile.Timeout))
+}
+
+// Keepalive returns how long we may go without hearing from the other
+// side.
+func (s *Socket) Keepalive() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.keepalive))
+}
+
+// SetCiphers causes our messages to be encrypted with the given ciphers,
+// which must be set before we serve our connection.
+func (s *Socket) SetCiphers(ciphers *Ciphers) {
+	s.ciphers = ciphers
+}
+
+// SetHub sets the hub this socket is registered with, which will relay
+// the traffic we receive to other sockets.  Sockets without a hub, such
+// as that of a client, only pass traffic to their interface.
+//
+// This must be called before Serve.
+func (s *Socket) SetHub(hub *Hub) {
+	s.hub = hub
+}
+
+// SetQueueDepth sets the number of frames which may be waiting to be
+// sent over the socket.  If a client cannot keep up we drop the oldest
+// waiting frame, rather than stalling the sender.
+//
+// This must be called before Serve.
+func (s *Socket) SetQueueDepth(depth int) {
+	if depth > 0 {
+		s.queue = make(chan *frame, depth)
 	}
 }
 
+// SetClassify enables the counting of our traffic by its protocol, and
+// port, which is reported by Classes.
+//
+// This must be called before Serve.
+func (s *Socket) SetClassify(enabled bool) {
+	s.classes = nil
+	if enabled {
+		s.classes = newClasses()
+	}
+}
+
+// Classes returns our traffic for each protocol, and for the given number
+// of ports which carried the most bytes, if we're counting it.
+func (s *Socket) Classes(top int) ([]TrafficClass, []TrafficClass) {
+	if s.classes == nil {
+		return nil, nil
+	}
+	return s.classes.snapshot(top)
+}
+
+// SetFilter sets the filter which decides whether each frame we
+// receive should be passed on, dropped, or rewritten.  It is invoked
+// before any filters of our hub.
+//
+// This must be called before Serve.
+func (s *Socket) SetFilter(filter Filter) {
+	s.filter = filter
+}
+
+// SetDirect sets a function which is offered each packet read from our
+// interface before it is sent over the websocket.  If it returns true
+// the packet has been sent by other means, such as a direct path to a
+// peer, and we don't send it ourselves.
+//
+// This must be called before SetInterface.
+func (s *Socket) SetDirect(fn func(packet []byte) bool) {
+	s.direct = fn
+}
+
+// SetBroadcastLimit limits the number of broadcast, or multicast,
+// frames per second which we'll relay from this socket.  Excess frames
+// are dropped, which prevents one client from flooding every peer.
+//
+// This must be called before Serve.
+func (s *Socket) SetBroadcastLimit(perSecond int) {
+	if perSecond > 0 {
+		s.broadcasts = NewRateLimiter(perSecond, perSecond)
+	}
+}
+
+// SetCommandLimit limits the number of in-band commands per second which
+// we'll run for the remote end, with bursts of up to `burst` commands.
+// Excess commands are refused, which prevents one misbehaving host from
+// making us do an unbounded amount of work on its behalf.
+//
+// This must be called before Serve.
+func (s *Socket) SetCommandLimit(perSecond int, burst int) {
+	if perSecond > 0 {
+		s.commands = NewRateLimiter(perSecond, burst)
+	}
+}
+
+// refused records that we've refused an in-band command, because the
+// remote end has sent too many, and logs that we have done so at most
+// every ten seconds.
+func (s *Socket) refused(command string) {
+	s.refusals++
+	if time.Since(s.lastRefusalLog) < 10*time.Second {
+		return
+	}
+	log.Printf("[%s] Refused %d in-band command(s), most recently %s: too many commands", s.clientIP, s.refusals, command)
+	s.lastRefusalLog = time.Now()
+	s.refusals = 0
+}
+
+// SetMTU sets the largest packet we'll accept from the other side, which
+// should be the MTU we've agreed with it.  Larger packets are dropped,
+// along with those which are malformed.  Zero disables the check of
+// their size.
+//
+// This may be called at any time.
+func (s *Socket) SetMTU(mtu int) {
+	atomic.StoreInt32(&s.mtu, int32(mtu))
+}
+
+// SetLoopDetection enables the dropping of frames whose source MAC has
+// been learned from a different socket, which indicates that they've
+// looped back to us via a bridged client.
+//
+// This must be called before Serve.
+func (s *Socket) SetLoopDetection(enabled bool) {
+	s.dropLoops = enabled
+}
+
+// dropped records that we dropped a packet received over the socket.
+//
+// The reason is logged, but at most every ten seconds, so an offending
+// client cannot flood our logs too.
+func (s *Socket) dropped(reason string) {
+	atomic.AddUint64(&s.stats.Dropped, 1)
+	s.dropsMutex.Lock()
+	if s.drops == nil {
+		s.drops = make(map[string]uint64)
+	}
+	s.drops[reason]++
+	s.dropsMutex.Unlock()
+
+	s.unloggedDrops++
+	if time.Since(s.lastDropLog) < 10*time.Second {
+		return
+	}
+	log.Printf("[%s] Dropped %d packet(s): %s", s.clientIP, s.unloggedDrops, reason)
+	s.lastDropLog = time.Now()
+	s.unloggedDrops = 0
+}
+
 // AddCommandHandler binds a function-name to a handler, which is
 // used in our websocket connection.
 func (s *Socket) AddCommandHandler(command string, handler CommandHandler) {
 	s.handlers[command] = handler
 }
 
+// Stats returns a copy of the traffic counters for this socket.
+//
+// Rx refers to packets received over the websocket, and Tx to those
+// we've sent over it.
+func (s *Socket) Stats() Stats {
+	var drops map[string]uint64
+	s.dropsMutex.Lock()
+	if len(s.drops) > 0 {
+		drops = make(map[string]uint64, len(s.drops))
+		for reason, count := range s.drops {
+			drops[reason] = count
+		}
+	}
+	s.dropsMutex.Unlock()
+
+	return Stats{
+		RxBytes:   atomic.LoadUint64(&s.stats.RxBytes),
+		RxPackets: atomic.LoadUint64(&s.stats.RxPackets),
+		TxBytes:   atomic.LoadUint64(&s.stats.TxBytes),
+		TxPackets: atomic.LoadUint64(&s.stats.TxPackets),
+		Dropped:   atomic.LoadUint64(&s.stats.Dropped),
+		TxDropped: atomic.LoadUint64(&s.stats.TxDropped),
+
+		Pings:       atomic.LoadUint64(&s.stats.Pings),
+		MissedPongs: atomic.LoadUint64(&s.stats.MissedPongs),
+
+		Drops: drops,
+	}
+}
+
+// ClientIP returns the IP address of the client of this socket.
+func (s *Socket) ClientIP() string {
+	return s.clientIP
+}
+
+// RTT returns the most recently measured round-trip time of our
+// websocket connection, or zero if no measurement has been made.
+func (s *Socket) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// Delays returns our most recent estimates of the one-way delays of our
+// websocket connection, and their jitter.  We return false if the other
+// side doesn't tell us when it receives our pings, so we've made none.
+func (s *Socket) Delays() (Delays, bool) {
+	return s.delays.get()
+}
+
+// Done returns a channel which is closed once our socket is closed.
+func (s *Socket) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
 // Wait waits for our socket to be done.
 func (s *Socket) Wait() {
 	s.wg.Wait()
@@ -119,38 +433,161 @@ func (s *Socket) rawSendCommand(commandID string, command string, args ...string
 		[]byte(fmt.Sprintf("%s|%s|%s", commandID, command, strings.Join(args, "|"))))
 }
 
-// SendCommand sends a "command" over our websocket link
+// SendCommand sends a "command" over our websocket link, unless the other
+// side has told us that it doesn't accept it.
 func (s *Socket) SendCommand(command string, args ...string) error {
+	if !s.PeerAccepts(command) {
+		return fmt.Errorf("the other side doesn't accept the %s command", command)
+	}
 	return s.rawSendCommand(fmt.Sprintf("%d", atomic.AddUint64(&lastCommandID, 1)), command, args...)
 }
 
-// BroadcastCommand sends the given data over all sockets.
-func (s *Socket) BroadcastCommand(command string, args []string) error {
-	allSocketsLock.RLock()
-	targetList := make([]*Socket, 0)
-	for _, v := range allSockets {
-		targetList = append(targetList, v)
+// Request sends a "command" over our websocket link, and waits for the
+// other side to reply, returning an error if it failed, or refused.
+//
+// Commands are handled one at a time, so this must not be called by a
+// CommandHandler.
+func (s *Socket) Request(command string, args ...string) error {
+	if !s.PeerAccepts(command) {
+		return fmt.Errorf("the other side doesn't accept the %s command", command)
 	}
-	allSocketsLock.RUnlock()
+	id := fmt.Sprintf("%d", atomic.AddUint64(&lastCommandID, 1))
+	reply := make(chan string, 1)
+
+	s.pendingMutex.Lock()
+	s.pending[id] = reply
+	s.pendingMutex.Unlock()
+	defer func() {
+		s.pendingMutex.Lock()
+		delete(s.pending, id)
+		s.pendingMutex.Unlock()
+	}()
 
-	for _, v := range targetList {
-		v.SendCommand(command, args...)
+	err := s.rawSendCommand(id, command, args...)
+	if err != nil {
+		return err
 	}
+
+	select {
+	case result := <-reply:
+		if result != "true" {
+			return fmt.Errorf("the %s command was refused", command)
+		}
+		return nil
+	case <-time.After(requestTimeout):
+		return fmt.Errorf("the %s command timed out", command)
+	case <-s.ctx.Done():
+		return fmt.Errorf("the connection closed")
+	}
+}
+
+// BroadcastCommand sends the given command over all sockets which are
+// registered with our hub.
+func (s *Socket) BroadcastCommand(command string, args []string) error {
+	if s.hub == nil {
+		return s.SendCommand(command, args...)
+	}
+
+	s.hub.BroadcastCommand(command, args)
 	return nil
 }
 
 // WriteMessage sends data over our socket.
+//
+// Binary frames are queued, to be sent by our writer, so a slow client
+// doesn't stall the sender.  Other messages are sent immediately.
+//
+// The data is not retained once we return, so the caller may reuse it.
 func (s *Socket) WriteMessage(msgType int, data []byte) error {
+	if msgType == websocket.BinaryMessage && len(data) <= FrameSize {
+		s.enqueue(newFrame(data, 1))
+		return nil
+	}
+	return s.writeNow(msgType, data)
+}
+
+// writeNow sends data over our socket, closing it on failure.
+//
+// Binary frames which the other side couldn't read, once sealed, are
+// dropped before we seal them, since sealing them would leave the nonces
+// of our ciphers out of step with those of the other side.
+func (s *Socket) writeNow(msgType int, data []byte) error {
 	s.writeLock.Lock()
+	if msgType == websocket.BinaryMessage && len(data)+s.ciphers.overhead() > FrameSize {
+		s.writeLock.Unlock()
+		atomic.AddUint64(&s.stats.TxDropped, 1)
+		return errFrameTooLarge
+	}
+	if s.ciphers != nil && (msgType == websocket.BinaryMessage || msgType == websocket.TextMessage) {
+		s.sealed = s.ciphers.seal(s.sealed[:0], data)
+		data = s.sealed
+
+		//
+		// Text messages must remain text.
+		//
+		if msgType == websocket.TextMessage {
+			data = []byte(base64.StdEncoding.EncodeToString(data))
+		}
+	}
 	err := s.conn.WriteMessage(msgType, data)
 	s.writeLock.Unlock()
 	if err != nil {
-		log.Printf("[%s] Error writing packet to WS: %v", s.clientIP, err)
+		if s.ctx.Err() == nil {
+			log.Printf("[%s] Error writing packet to WS: %v", s.clientIP, err)
+		}
 		s.Close()
 	}
 	return err
 }
 
+// enqueue adds a frame to our queue, dropping the oldest waiting frame
+// if it is full.
+func (s *Socket) enqueue(f *frame) {
+	for {
+		select {
+		case s.queue <- f:
+			return
+		default:
+		}
+
+		select {
+		case old := <-s.queue:
+			old.release()
+			atomic.AddUint64(&s.stats.TxDropped, 1)
+		default:
+		}
+	}
+}
+
+// serveQueue sends the frames in our queue, until we're closed.
+func (s *Socket) serveQueue() {
+	s.wg.Add(1)
+	go func() {
+		defer s.closeDone()
+
+		for {
+			select {
+			case f := <-s.queue:
+				if s.classes != nil {
+					s.classes.count((*f.buf)[:f.n])
+				}
+				err := s.writeNow(websocket.BinaryMessage, (*f.buf)[:f.n])
+				f.release()
+				if err == errFrameTooLarge {
+					continue
+				}
+				if err != nil {
+					return
+				}
+				atomic.AddUint64(&s.stats.TxBytes, uint64(f.n))
+				atomic.AddUint64(&s.stats.TxPackets, 1)
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
 // closeDown closes a websocket and interface.
 // It invokes the call-back "reap" function too.
 func (s *Socket) closeDone() {
@@ -160,17 +597,18 @@ func (s *Socket) closeDone() {
 	// If we have a reap-function.
 	//  and we've not invoked it already
 	// Then do so.
-	if s.reaper != nil && s.reaped == false {
-		// invoke
-		s.reaper(*s, s.clientIP)
-
-		// avoid repeats.
-		s.reaped = true
+	if s.reaper != nil {
+		s.reapOnce.Do(func() {
+			s.reaper(s, s.clientIP)
+		})
 	}
 }
 
 // SetInterface sets the given network-interface to be associated with us.
-func (s *Socket) SetInterface(iface *water.Interface) error {
+//
+// If the interface was opened with more than one queue the others may be
+// given too, and each is read by its own goroutine.
+func (s *Socket) SetInterface(iface TunDevice, queues ...TunDevice) error {
 	s.writeLock.Lock()
 	defer s.writeLock.Unlock()
 
@@ -178,87 +616,366 @@ func (s *Socket) SetInterface(iface *water.Interface) error {
 		return errors.New("cannot re-define interface. Already set")
 	}
 	s.iface = iface
+	s.queues = queues
 	s.tryServeIfaceRead()
 	return nil
 }
 
-// setMACFrom updates the MAC-address for this socket, unless already set.
-func (s *Socket) setMACFrom(msg []byte) {
+// setMACFrom learns the source MAC-address of the given frame, such
+// that traffic for it will be sent to us.
+//
+// We never take over a MAC which another socket has learned, which
+// prevents clients from hijacking each other's traffic, and if we've
+// learned too many MACs we forget the one we saw least recently.
+//
+// We return false if the frame should be dropped, because its source
+// is not one of the MACs this socket has been restricted to.
+func (s *Socket) setMACFrom(msg []byte) bool {
 	srcMac := GetSrcMAC(msg)
-	if !MACIsUnicast(srcMac) || srcMac == s.mac {
-		return
+	if s.allowedMACs != nil && !s.allowedMACs[srcMac] {
+		return false
 	}
+	if MACIsUnicast(srcMac) {
+		s.hub.learn(s, srcMac)
+	}
+	return true
+}
 
-	macLock.Lock()
-	defer macLock.Unlock()
-	if s.mac != defaultMac {
-		delete(macTable, s.mac)
+// SetMACLimit sets the maximum number of MAC-addresses we'll learn
+// for this socket, which defaults to one.
+//
+// This must be called before Serve.
+func (s *Socket) SetMACLimit(limit int) {
+	if limit > 0 {
+		s.maxMACs = limit
+	}
+}
+
+// SetAllowedMACs restricts the source MAC-addresses which may appear
+// in frames received over this socket.  Other frames are dropped.
+//
+// This must be called before Serve.
+func (s *Socket) SetAllowedMACs(macs []MacAddr) {
+	s.allowedMACs = make(map[MacAddr]bool)
+	for _, mac := range macs {
+		s.allowedMACs[mac] = true
 	}
-	s.mac = srcMac
-	macTable[srcMac] = s
 }
 
-// Close closes our interface and websocket.
+// Close closes our interface and websocket, cancelling each of the
+// goroutines which serve them.
 func (s *Socket) Close() {
 	s.writeLock.Lock()
 	defer s.writeLock.Unlock()
+	s.cancel()
 	s.conn.Close()
 	if s.iface != nil {
 		s.iface.Close()
 	}
-	if s.closechanopen {
-		s.closechanopen = false
-		close(s.closechan)
+	for _, queue := range s.queues {
+		queue.Close()
 	}
-	if s.mac != defaultMac {
-		macLock.Lock()
-		delete(macTable, s.mac)
-		s.mac = defaultMac
-		macLock.Unlock()
+	if s.hub != nil {
+		s.hub.unregister(s)
+	}
+}
+
+// Shutdown closes our connection gracefully.  We stop reading our
+// interface, wait for up to the given time for the frames we've queued
+// to be sent, tell the other side goodbye, and close.
+func (s *Socket) Shutdown(timeout time.Duration) {
+	atomic.StoreInt32(&s.stopping, 1)
+
+	deadline := time.Now().Add(timeout)
+	for len(s.queue) > 0 && s.ctx.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
 	}
 
-	allSocketsLock.Lock()
-	delete(allSockets, s)
-	allSocketsLock.Unlock()
+	if s.ctx.Err() == nil {
+		s.SendCommand("goodbye")
+		s.writeNow(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "goodbye"))
+	}
+	s.Close()
 }
 
-// tryServeIfaceRead handles reading from our interface
+// tryServeIfaceRead handles reading from our interface, and each of
+// its queues.
 func (s *Socket) tryServeIfaceRead() {
-	if s.iface == nil {
+	if s.iface == nil || s.reading {
+		return
+	}
+	s.reading = true
+
+	for _, iface := range append([]TunDevice{s.iface}, s.queues...) {
+		s.serveIfaceRead(iface)
+	}
+
+	//
+	// With several queues each is written by its own goroutine too,
+	// so that writing to one doesn't hold up the others.
+	//
+	if len(s.queues) > 0 {
+		var writers []chan *frame
+		for _, iface := range append([]TunDevice{s.iface}, s.queues...) {
+			writer := make(chan *frame, cap(s.queue))
+			writers = append(writers, writer)
+			s.serveIfaceWrite(iface, writer)
+		}
+		s.writers = writers
+	}
+}
+
+// serveIfaceWrite writes the frames sent to the given channel to the
+// given interface, until we're closed.
+func (s *Socket) serveIfaceWrite(iface TunDevice, writer chan *frame) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			select {
+			case f := <-writer:
+				iface.Write((*f.buf)[:f.n])
+				f.release()
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// writeIface writes the given frame to our interface.  If it has several
+// queues the frame is passed to the writer of one of them, chosen by its
+// flow, so the frames of each flow remain in order.
+func (s *Socket) writeIface(msg []byte) {
+	if s.writers == nil {
+		s.iface.Write(msg)
 		return
 	}
 
+	f := newFrame(msg, 1)
+	select {
+	case s.writers[FlowHash(msg)%uint32(len(s.writers))] <- f:
+	default:
+		f.release()
+		s.dropped("interface queue full")
+	}
+}
+
+// serveIfaceRead reads packets from the given interface, and sends
+// them over our websocket.
+func (s *Socket) serveIfaceRead(iface TunDevice) {
 	s.wg.Add(1)
 	go func() {
 		defer s.closeDone()
 
-		packet := make([]byte, 2000)
+		packet := make([]byte, FrameSize)
 
 		for {
-			n, err := s.iface.Read(packet)
+			n, err := iface.Read(packet)
+			if s.ctx.Err() != nil {
+				return
+			}
 			if err != nil {
 				log.Printf("[%s] Error reading packet from tun: %v", s.clientIP, err)
 				return
 			}
 
-			err = s.WriteMessage(websocket.BinaryMessage, packet[:n])
-			if err != nil {
-				return
+			if atomic.LoadInt32(&s.stopping) != 0 {
+				continue
+			}
+			if s.direct != nil && s.direct(packet[:n]) {
+				continue
 			}
+			s.WriteMessage(websocket.BinaryMessage, packet[:n])
 		}
 	}()
 }
 
-// Serve is the main-driver which never returns
-// Handle proxying data back and forth..
-func (s *Socket) Serve(ipv6 bool) {
+// relay passes on a frame we've received over the websocket, to the
+// appropriate sockets of our hub, and to our interface.
+//
+// The frame is not retained once we return.
+func (s *Socket) relay(msg []byte) {
+	atomic.AddUint64(&s.stats.RxBytes, uint64(len(msg)))
+	atomic.AddUint64(&s.stats.RxPackets, 1)
+	if s.classes != nil {
+		s.classes.count(msg)
+	}
+
+	//
+	// Give our filters the chance to drop, or rewrite, the frame.
+	//
+	if s.filter != nil || (s.hub != nil && s.hub.Filtered()) {
+		frame := &Frame{Source: s, Dest: GetDestIP(msg), Data: msg}
+		if s.filter != nil && s.filter.Filter(frame) == Drop {
+			s.dropped("rejected by filter")
+			return
+		}
+		if s.hub != nil && s.hub.filter(frame) == Drop {
+			s.dropped("rejected by filter")
+			return
+		}
+		msg = frame.Data
+	}
+
+	//
+	// Router solicitations, the neighbour resolution of the server's
+	// IP, and pings to it, are answered here.
+	//
+	if s.hub != nil && s.framing == FramingEthernet {
+		if s.hub.rogueAdvertisement(msg) {
+			s.dropped("router advertisement from client")
+			return
+		}
+		reply := s.hub.routerReply(msg)
+		if reply != nil {
+			s.WriteMessage(websocket.BinaryMessage, reply)
+			return
+		}
+	}
+	if s.hub != nil && s.hub.gateway != nil && s.framing == FramingEthernet {
+		reply := NeighbourReply(msg, s.hub.gateway, s.hub.gatewayMAC)
+		if reply != nil {
+			s.WriteMessage(websocket.BinaryMessage, reply)
+			return
+		}
+	}
+	if s.hub != nil && s.hub.address != nil {
+		reply := EchoReply(msg, s.hub.address)
+		if reply != nil {
+			s.WriteMessage(websocket.BinaryMessage, reply)
+			return
+		}
+	}
+
+	var unknown *MacAddr
+	if s.hub != nil && s.framing == FramingIP {
+
+		//
+		// IP packets are routed by their destination.
+		//
+		if s.routeIP(msg) {
+			return
+		}
+	} else if s.hub != nil && len(msg) >= 14 {
+
+		//
+		// If the source is a MAC we've learned from another
+		// socket then the frame has looped back to us, via a
+		// bridged client.
+		//
+		if s.dropLoops {
+			owner := s.hub.FindSocketByMAC(GetSrcMAC(msg))
+			if owner != nil && owner != s {
+				s.dropped("forwarding loop detected")
+				return
+			}
+		}
+
+		//
+		// Look at the packet-data to get the src/dsg.
+		//
+		if !s.setMACFrom(msg) {
+			s.dropped("source MAC not permitted")
+			return
+		}
+
+		//
+		// Learn the IPv6 address of the sender, and answer the
+		// solicitations for the addresses of other clients on
+		// their behalf, rather than flooding them.
+		//
+		s.hub.learnNeighbour(s, msg)
+		if reply := s.hub.proxyNeighbour(s, msg); reply != nil {
+			s.WriteMessage(websocket.BinaryMessage, reply)
+			return
+		}
+		dest := GetDestMAC(msg)
+
+		//
+		// Is this unicast traffic?
+		//
+		isUnicast := MACIsUnicast(dest)
+
+		//
+		// If unicast - sending to one destination - then
+		// lookup the socket and send it there.
+		//
+		var sd *Socket
+		if isUnicast {
+
+			//
+			// If we find the destination, then send it.
+			//
+			sd = s.hub.FindSocketByMAC(dest)
+			if sd != nil {
+				sd.WriteMessage(websocket.BinaryMessage, msg)
+				return
+			}
+			unknown = &dest
+		} else {
+			//
+			// OK multicast/broadcast.
+			//
+			// Send to everybody, unless this client
+			// is sending too many.
+			//
+			if s.broadcasts != nil && !s.broadcasts.Allow(1) {
+				s.dropped("broadcast rate exceeded")
+				return
+			}
+			s.hub.BroadcastMessage(websocket.BinaryMessage, msg, s)
+		}
+	}
+
+	//
+	// Anything else goes to the uplink of our hub, if it has one,
+	// otherwise to our own interface.
+	//
+	if s.hub != nil && s.hub.uplink != nil {
+		s.hub.uplink.Write(msg)
+		return
+	}
+	if s.iface == nil {
+		//
+		// Without anywhere else to send it a frame for a MAC
+		// we haven't learned is subject to our hub's policy.
+		//
+		if unknown != nil {
+			s.hub.sendUnknown(msg, *unknown, s)
+		}
+		return
+	}
+	s.writeIface(msg)
+}
+
+// Serve is the main-driver, which launches the goroutines that proxy
+// data back and forth.
+//
+// They run until the socket is closed, or the given context is
+// cancelled.  Use Wait to wait for them to finish.
+func (s *Socket) Serve(ctx context.Context) {
 	s.writeLock.Lock()
 	defer s.writeLock.Unlock()
 	s.tryServeIfaceRead()
+	s.serveQueue()
 
-	allSocketsLock.Lock()
-	allSockets[s] = s
-	allSocketsLock.Unlock()
+	//
+	// Reads from the websocket, and interface, block - so when we're
+	// cancelled we must close them to wake our goroutines.
+	//
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.ctx.Done():
+		}
+	}()
+
+	if s.hub != nil {
+		s.hub.register(s)
+	}
 
 	s.wg.Add(1)
 	go func() {
@@ -268,9 +985,12 @@ func (s *Socket) Serve(ipv6 bool) {
 			//
 			// Read message over the WS connection,
 			//
-			msgType, msg, err := s.conn.ReadMessage()
+			msgType, reader, err := s.conn.NextReader()
+			if s.ctx.Err() != nil {
+				return
+			}
 			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 					log.Printf("[%s] Error reading packet from WS: %v\n", s.clientIP, err)
 				}
 				return
@@ -285,65 +1005,58 @@ func (s *Socket) Serve(ipv6 bool) {
 			//
 			if msgType == websocket.BinaryMessage {
 
-				if len(msg) >= 14 {
-
-					//
-					// IPv4 traffic involves routing "correctly".
-					//
-					if ipv6 == false {
-
-						//
-						// Look at the packet-data to get the src/dsg.
-						//
-						s.setMACFrom(msg)
-						dest := GetDestMAC(msg)
-
-						//
-						// Is this unicast traffic?
-						//
-						isUnicast := MACIsUnicast(dest)
-
-						//
-						// If unicast - sending to one destination - then
-						// lookup the socket and send it there.
-						//
-						var sd *Socket
-						if isUnicast {
-
-							//
-							// If we find the destination, then send it.
-							//
-							sd = FindSocketByMAC(dest)
-							if sd != nil {
-								sd.WriteMessage(websocket.BinaryMessage, msg)
-								continue
-							}
-						} else {
-							//
-							// OK multicast/broadcast.
-							//
-							// Send to everybody.
-							//
-							BroadcastMessage(websocket.BinaryMessage, msg, s)
-						}
-					} else {
-
-						//
-						// IPv6 traffic is just broadcast as-is.
-						//
-						BroadcastMessage(websocket.BinaryMessage, msg, s)
+				buf := getFrame(FrameSize)
+				n, err := readFrame(reader, *buf)
+				if err == errFrameTooLarge {
+					putFrame(buf)
+					s.dropped("oversized frame")
+					continue
+				}
+				if err != nil {
+					putFrame(buf)
+					log.Printf("[%s] Error reading packet from WS: %v\n", s.clientIP, err)
+					return
+				}
+
+				msg := (*buf)[:n]
+				if s.ciphers != nil {
+					msg, err = s.ciphers.open(msg)
+					if err != nil {
+						putFrame(buf)
+						log.Printf("[%s] Error reading packet from WS: %v\n", s.clientIP, err)
+						return
 					}
 				}
 
-				if s.iface == nil {
+				if reason := CheckPacket(msg, s.framing, int(atomic.LoadInt32(&s.mtu))); reason != "" {
+					putFrame(buf)
+					s.dropped(reason)
 					continue
 				}
-				s.iface.Write(msg)
+
+				s.relay(msg)
+				putFrame(buf)
 
 			} else if msgType == websocket.TextMessage {
 
 				// in-band messages over the WS link
 
+				msg, err := ioutil.ReadAll(reader)
+				if err != nil {
+					log.Printf("[%s] Error reading command from WS: %v\n", s.clientIP, err)
+					return
+				}
+				if s.ciphers != nil {
+					msg, err = base64.StdEncoding.DecodeString(string(msg))
+					if err == nil {
+						msg, err = s.ciphers.open(msg)
+					}
+					if err != nil {
+						log.Printf("[%s] Error reading command from WS: %v\n", s.clientIP, errDecrypt)
+						return
+					}
+				}
+
 				str := strings.Split(string(msg), "|")
 				if len(str) < 2 {
 					log.Printf("[%s] Invalid in-band command structure", s.clientIP)
@@ -358,12 +1071,25 @@ func (s *Socket) Serve(ipv6 bool) {
 						commandResult = str[2]
 					}
 					log.Printf("[%s] Got command reply ID %s: %s", s.clientIP, commandID, commandResult)
+					s.pendingMutex.Lock()
+					if reply, ok := s.pending[commandID]; ok {
+						reply <- commandResult
+					}
+					s.pendingMutex.Unlock()
+					continue
+				}
+
+				if s.commands != nil && !s.commands.Allow(1) {
+					s.refused(commandName)
+					s.rawSendCommand(commandID, "reply", "false")
 					continue
 				}
 
 				handler := s.handlers[commandName]
 				if handler == nil {
 					err = errors.New("Unknown command")
+				} else if !s.accepts(commandName) {
+					err = errors.New("Command not permitted")
 				} else {
 					err = handler(str[2:])
 				}
@@ -376,30 +1102,65 @@ func (s *Socket) Serve(ipv6 bool) {
 		}
 	}()
 
-	timeout := time.Duration(30) * time.Second
-
-	lastResponse := time.Now()
+	//
+	// Our pings contain the time at which they were sent, so when
+	// the pong arrives we can calculate the round-trip time, and the
+	// time at which the other side received them, if it tells us,
+	// from which we estimate the delay of each direction.
+	//
+	// We do the same for the other side's pings.
+	//
+	var lastResponse int64
+	atomic.StoreInt64(&lastResponse, time.Now().UnixNano())
 	s.conn.SetPongHandler(func(msg string) error {
-		lastResponse = time.Now()
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&lastResponse, now)
+		sent, echoed, err := parsePong(msg)
+		if err == nil {
+			atomic.StoreInt64(&s.rtt, now-sent)
+			s.delays.sample(sent, echoed, now)
+		}
 		return nil
 	})
+	s.conn.SetPingHandler(func(msg string) error {
+		pong := pongPayload(msg, time.Now().UnixNano())
+		err := s.conn.WriteControl(websocket.PongMessage, []byte(pong), time.Now().Add(time.Second))
+		if err == websocket.ErrCloseSent {
+			return nil
+		}
+		if e, ok := err.(net.Error); ok && e.Temporary() {
+			return nil
+		}
+		return err
+	})
 
 	s.wg.Add(1)
 	go func() {
 		defer s.closeDone()
 
+		//
+		// We count the pings which went unanswered until the next,
+		// which measures the quality of the link.
+		//
+		var lastPing int64
 		for {
 			select {
-			case <-time.After(timeout / 2):
-				if time.Now().Sub(lastResponse) > timeout {
+			case <-time.After(time.Duration(atomic.LoadInt64(&s.interval))):
+				response := atomic.LoadInt64(&lastResponse)
+				if time.Now().Sub(time.Unix(0, response)) > s.Keepalive() {
 					log.Printf("[%s] Ping timeout", s.clientIP)
 					return
 				}
-				err := s.WriteMessage(websocket.PingMessage, []byte{})
+				if lastPing != 0 && response < lastPing {
+					atomic.AddUint64(&s.stats.MissedPongs, 1)
+				}
+				lastPing = time.Now().UnixNano()
+				err := s.WriteMessage(websocket.PingMessage, []byte(pingPayload(lastPing)))
 				if err != nil {
 					return
 				}
-			case <-s.closechan:
+				atomic.AddUint64(&s.stats.Pings, 1)
+			case <-s.ctx.Done():
 				return
 			}
 		}
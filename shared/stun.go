@@ -0,0 +1,145 @@
+// shared/stun.go contains a minimal implementation of STUN, RFC 5389,
+// which clients use to learn the public address of their UDP socket, so
+// that their peers may reach them directly.
+//
+// We implement both sides, so the server can answer its own clients.
+
+package shared
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// The STUN message-types, and attributes, we use.
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMappedAddress   = 0x0001
+	stunXorMappedAddr   = 0x0020
+	stunMagicCookie     = 0x2112A442
+	stunHeaderSize      = 20
+)
+
+// IsSTUN returns true if the given packet looks like a STUN message,
+// which allows them to share a socket with other traffic.
+func IsSTUN(packet []byte) bool {
+	return len(packet) >= stunHeaderSize &&
+		packet[0]&0xC0 == 0 &&
+		binary.BigEndian.Uint32(packet[4:8]) == stunMagicCookie
+}
+
+// STUNRequest returns a binding request, with a random transaction ID.
+func STUNRequest() []byte {
+	msg := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	rand.Read(msg[8:20])
+	return msg
+}
+
+// ParseSTUNResponse returns the address reported by a binding response
+// to the given request.
+func ParseSTUNResponse(request []byte, response []byte) (*net.UDPAddr, error) {
+	if !IsSTUN(response) || binary.BigEndian.Uint16(response[0:2]) != stunBindingResponse {
+		return nil, errors.New("not a STUN binding response")
+	}
+	if string(response[8:20]) != string(request[8:20]) {
+		return nil, errors.New("STUN response to a different request")
+	}
+
+	length := int(binary.BigEndian.Uint16(response[2:4]))
+	if len(response) < stunHeaderSize+length {
+		return nil, errors.New("truncated STUN response")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := response[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		kind := binary.BigEndian.Uint16(attrs[0:2])
+		size := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if len(attrs) < 4+size {
+			break
+		}
+		value := attrs[4 : 4+size]
+
+		switch kind {
+		case stunXorMappedAddr:
+			if addr := parseSTUNAddress(value, response[4:20]); addr != nil {
+				return addr, nil
+			}
+		case stunMappedAddress:
+			mapped = parseSTUNAddress(value, nil)
+		}
+
+		// Attributes are padded to a multiple of four bytes.
+		attrs = attrs[4+(size+3)&^3:]
+	}
+	if mapped != nil {
+		return mapped, nil
+	}
+	return nil, errors.New("STUN response without an address")
+}
+
+// parseSTUNAddress parses a (XOR-)MAPPED-ADDRESS attribute.  If the
+// given key is non-nil the address is XORed with it, which is the magic
+// cookie followed by the transaction ID.
+func parseSTUNAddress(value []byte, key []byte) *net.UDPAddr {
+	if len(value) < 4 {
+		return nil
+	}
+
+	size := 0
+	switch value[1] {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	}
+	if size == 0 || len(value) < 4+size {
+		return nil
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if key != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= key[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
+
+// STUNResponse returns the response to the given binding request, which
+// was received from the given address, or nil if it isn't one.
+func STUNResponse(request []byte, from *net.UDPAddr) []byte {
+	if !IsSTUN(request) || binary.BigEndian.Uint16(request[0:2]) != stunBindingRequest {
+		return nil
+	}
+
+	//
+	// We send a single XOR-MAPPED-ADDRESS attribute.
+	//
+	family, ip := byte(1), from.IP.To4()
+	if ip == nil {
+		family, ip = 2, from.IP.To16()
+	}
+	attr := make([]byte, 8+len(ip))
+	binary.BigEndian.PutUint16(attr[0:2], stunXorMappedAddr)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(4+len(ip)))
+	attr[5] = family
+	binary.BigEndian.PutUint16(attr[6:8], uint16(from.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		attr[8+i] = ip[i] ^ request[4+i]
+	}
+
+	msg := make([]byte, stunHeaderSize, stunHeaderSize+len(attr))
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingResponse)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(attr)))
+	copy(msg[4:20], request[4:20])
+	return append(msg, attr...)
+}
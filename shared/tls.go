@@ -0,0 +1,243 @@
+// shared/tls.go contains our TLS policy, which restricts the versions,
+// and cipher suites, of the TLS connections we make, and accept.
+//
+// By default we use those of the Go runtime.  Deployments which must
+// comply with a crypto-policy may set:
+//
+//   tls_min_version = 1.2
+//   tls_ciphers     = TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, ...
+//
+// In FIPS mode, which is enabled by the -fips flag, or by building with
+// the "fips" tag, only the FIPS-approved cipher suites of TLS 1.2 may be
+// used.  The cipher suites of TLS 1.3 cannot be restricted, so it is
+// disabled in that mode.
+
+package shared
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tlsVersionNames maps TLS versions to their names.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsMinVersions maps the values of `tls_min_version` to TLS versions.
+var tlsMinVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuite describes a cipher suite we may be configured to use.
+type cipherSuite struct {
+	id   uint16
+	name string
+
+	// fips is true if the suite is approved for use in FIPS mode.
+	fips bool
+
+	// tls13 is true if the suite is only used by TLS 1.3, whose suites
+	// cannot be configured.
+	tls13 bool
+}
+
+// cipherSuites are the cipher suites we know, in our order of
+// preference.
+var cipherSuites = []cipherSuite{
+	{id: tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, name: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", fips: true},
+	{id: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, name: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", fips: true},
+	{id: tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, name: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384", fips: true},
+	{id: tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, name: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", fips: true},
+	{id: tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, name: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305"},
+	{id: tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, name: "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305"},
+	{id: tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, name: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA"},
+	{id: tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA, name: "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"},
+	{id: tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA, name: "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA"},
+	{id: tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA, name: "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA"},
+	{id: tls.TLS_RSA_WITH_AES_128_GCM_SHA256, name: "TLS_RSA_WITH_AES_128_GCM_SHA256"},
+	{id: tls.TLS_RSA_WITH_AES_256_GCM_SHA384, name: "TLS_RSA_WITH_AES_256_GCM_SHA384"},
+	{id: tls.TLS_RSA_WITH_AES_128_CBC_SHA, name: "TLS_RSA_WITH_AES_128_CBC_SHA"},
+	{id: tls.TLS_RSA_WITH_AES_256_CBC_SHA, name: "TLS_RSA_WITH_AES_256_CBC_SHA"},
+	{id: tls.TLS_AES_128_GCM_SHA256, name: "TLS_AES_128_GCM_SHA256", tls13: true},
+	{id: tls.TLS_AES_256_GCM_SHA384, name: "TLS_AES_256_GCM_SHA384", tls13: true},
+	{id: tls.TLS_CHACHA20_POLY1305_SHA256, name: "TLS_CHACHA20_POLY1305_SHA256", tls13: true},
+}
+
+// TLSPolicy restricts the TLS connections we make, and accept.  The zero
+// value uses the defaults of the Go runtime.
+type TLSPolicy struct {
+	// FIPS is true if we only use FIPS-approved cipher suites.
+	FIPS bool
+
+	// MinVersion, and MaxVersion, are the versions of TLS we accept,
+	// or zero for the defaults.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// CipherSuites are the TLS 1.2 cipher suites we accept, or empty
+	// for the defaults.
+	CipherSuites []uint16
+}
+
+// LoadTLSPolicy parses the TLS settings in the given map.
+//
+// The settings are expected to be the result of looking up the `tls_`
+// prefix in a configuration file.  If fips is true, or we were built with
+// the "fips" tag, we're restricted to the FIPS-approved cipher suites.
+func LoadTLSPolicy(settings map[string]string, fips bool) (TLSPolicy, error) {
+	out := TLSPolicy{FIPS: fips || FIPSBuild}
+
+	if min := settings["min_version"]; min != "" {
+		version, ok := tlsMinVersions[min]
+		if !ok {
+			return out, fmt.Errorf("invalid tls_min_version %s, it should be 1.2, or 1.3", min)
+		}
+		out.MinVersion = version
+	}
+
+	for _, name := range strings.Split(settings["ciphers"], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		suite, ok := lookupCipherSuite(name)
+		if !ok {
+			return out, fmt.Errorf("unknown cipher suite %s in tls_ciphers", name)
+		}
+		if suite.tls13 {
+			return out, fmt.Errorf("the cipher suite %s is used by TLS 1.3, whose suites cannot be configured", suite.name)
+		}
+		if out.FIPS && !suite.fips {
+			return out, fmt.Errorf("the cipher suite %s is not approved for use in FIPS mode", suite.name)
+		}
+		out.CipherSuites = append(out.CipherSuites, suite.id)
+	}
+
+	if out.FIPS {
+		if out.MinVersion == tls.VersionTLS13 {
+			return out, fmt.Errorf("tls_min_version cannot be 1.3 in FIPS mode, as the cipher suites of TLS 1.3 cannot be restricted")
+		}
+		out.MinVersion = tls.VersionTLS12
+		out.MaxVersion = tls.VersionTLS12
+		if len(out.CipherSuites) == 0 {
+			for _, suite := range cipherSuites {
+				if suite.fips {
+					out.CipherSuites = append(out.CipherSuites, suite.id)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// lookupCipherSuite returns the cipher suite with the given name, which
+// is matched without regard to case.
+func lookupCipherSuite(name string) (cipherSuite, bool) {
+	for _, suite := range cipherSuites {
+		if strings.EqualFold(suite.name, name) {
+			return suite, true
+		}
+	}
+	return cipherSuite{}, false
+}
+
+// Apply restricts the given TLS configuration to our policy, creating one
+// if it is nil, and returns it.
+func (t TLSPolicy) Apply(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if t.MinVersion != 0 {
+		config.MinVersion = t.MinVersion
+	}
+	if t.MaxVersion != 0 {
+		config.MaxVersion = t.MaxVersion
+	}
+	if len(t.CipherSuites) > 0 {
+		config.CipherSuites = t.CipherSuites
+	}
+	return config
+}
+
+// HTTPClient returns an HTTP client which uses our policy, with the given
+// timeout.
+func (t TLSPolicy) HTTPClient(timeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     t.Apply(nil),
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// Restricted returns true if our policy differs from the defaults of the
+// Go runtime.
+func (t TLSPolicy) Restricted() bool {
+	return t.FIPS || t.MinVersion != 0 || len(t.CipherSuites) > 0
+}
+
+// MinVersionName returns the name of the oldest version of TLS we accept.
+func (t TLSPolicy) MinVersionName() string {
+	if t.MinVersion == 0 {
+		return "default"
+	}
+	return TLSVersionName(t.MinVersion)
+}
+
+// CipherSuiteNames returns the names of the cipher suites we accept, or
+// nil if we use the defaults.
+func (t TLSPolicy) CipherSuiteNames() []string {
+	var out []string
+	for _, id := range t.CipherSuites {
+		out = append(out, CipherSuiteName(id))
+	}
+	return out
+}
+
+// String describes our policy, for logging.
+func (t TLSPolicy) String() string {
+	out := "minimum version " + t.MinVersionName()
+	if t.MaxVersion != 0 {
+		out += ", maximum version " + TLSVersionName(t.MaxVersion)
+	}
+	if len(t.CipherSuites) > 0 {
+		out += ", cipher suites " + strings.Join(t.CipherSuiteNames(), " ")
+	}
+	if t.FIPS {
+		out += " (FIPS mode)"
+	}
+	return out
+}
+
+// TLSVersionName returns the name of the given TLS version.
+func TLSVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// CipherSuiteName returns the name of the given cipher suite.
+func CipherSuiteName(id uint16) string {
+	for _, suite := range cipherSuites {
+		if suite.id == id {
+			return suite.name
+		}
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
+
+// DescribeTLS describes the parameters negotiated for a TLS connection,
+// such as "TLS 1.2, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+func DescribeTLS(state tls.ConnectionState) string {
+	return TLSVersionName(state.Version) + ", " + CipherSuiteName(state.CipherSuite)
+}
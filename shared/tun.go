@@ -0,0 +1,90 @@
+// shared/tun.go contains code for opening our TUN, and TAP, devices.
+//
+// A device may be opened with several queues, each of which is a
+// separate file-descriptor.  The kernel spreads the packets it sends
+// over them by flow, so reading them in parallel means high-throughput
+// traffic isn't limited by one system-call per packet.
+
+package shared
+
+import (
+	"fmt"
+	"net"
+	"os/user"
+	"syscall"
+
+	"github.com/songgao/water"
+)
+
+// closeOnExec ensures the given device isn't inherited by the processes
+// we launch, such as our hooks, which would keep it open.
+func closeOnExec(dev TunDevice) {
+	f, ok := DeviceFile(dev)
+	if !ok {
+		return
+	}
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+	conn.Control(func(fd uintptr) {
+		syscall.CloseOnExec(int(fd))
+	})
+}
+
+// OpenDevice opens a device with the given configuration and number of
+// queues, returning each queue.
+func OpenDevice(config water.Config, queues int) ([]TunDevice, error) {
+	if queues <= 1 {
+		iface, err := water.New(config)
+		if err != nil {
+			return nil, err
+		}
+		closeOnExec(iface)
+		return []TunDevice{iface}, nil
+	}
+
+	if !setMultiQueue(&config) {
+		return nil, fmt.Errorf("multiple queues are not supported upon this platform")
+	}
+
+	var out []TunDevice
+	for i := 0; i < queues; i++ {
+		iface, err := water.New(config)
+		if err != nil {
+			for _, open := range out {
+				open.Close()
+			}
+			return nil, err
+		}
+
+		//
+		// Subsequent queues must attach to the same device.
+		//
+		setName(&config, iface.Name())
+		closeOnExec(iface)
+		out = append(out, iface)
+	}
+	return out, nil
+}
+
+// OpenPersistentDevice opens the existing device of the given name, with
+// the given configuration and number of queues.
+//
+// Devices created with `ip tuntap add ... user NAME` persist until they're
+// deleted, and may be opened by that user without CAP_NET_ADMIN.
+func OpenPersistentDevice(config water.Config, name string, queues int) ([]TunDevice, error) {
+	if _, err := net.InterfaceByName(name); err != nil {
+		mode := "tun"
+		if config.DeviceType == water.TAP {
+			mode = "tap"
+		}
+		owner := "USER"
+		if u, err := user.Current(); err == nil {
+			owner = u.Username
+		}
+		return nil, fmt.Errorf("the persistent device %s doesn't exist, create it with 'ip tuntap add dev %s mode %s user %s'", name, name, mode, owner)
+	}
+	setName(&config, name)
+	return OpenDevice(config, queues)
+}
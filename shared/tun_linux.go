@@ -0,0 +1,16 @@
+// shared/tun_linux.go contains the Linux-specific device settings.
+
+package shared
+
+import "github.com/songgao/water"
+
+// setMultiQueue enables the use of multiple queues.
+func setMultiQueue(config *water.Config) bool {
+	config.MultiQueue = true
+	return true
+}
+
+// setName sets the name of the device to open.
+func setName(config *water.Config, name string) {
+	config.Name = name
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+// shared/tun_other.go contains the device settings for other platforms.
+
+package shared
+
+import "github.com/songgao/water"
+
+// setMultiQueue enables the use of multiple queues, which is only
+// supported upon Linux.
+func setMultiQueue(config *water.Config) bool {
+	return false
+}
+
+// setName sets the name of the device to open.
+func setName(config *water.Config, name string) {
+}
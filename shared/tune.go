@@ -0,0 +1,46 @@
+// shared/tune.go contains the settings of a connection which may be
+// changed while it is established, via the "set-mtu", and
+// "set-keepalive", commands.
+//
+// Either side may propose a change, which the other applies before
+// replying.  The proposer only applies the change itself once it has
+// been accepted, so that both sides agree.
+
+package shared
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// MinMTU, and MaxMTU, bound the MTUs which may be proposed.
+	MinMTU = 576
+	MaxMTU = 9000
+
+	// MinKeepalive, and MaxKeepalive, bound the keepalives which may
+	// be proposed.
+	MinKeepalive = 5 * time.Second
+	MaxKeepalive = time.Hour
+)
+
+// ParseMTU parses, and checks, a proposed MTU.
+func ParseMTU(str string) (int, error) {
+	mtu, err := strconv.Atoi(str)
+	if err != nil || mtu < MinMTU || mtu > MaxMTU {
+		return 0, fmt.Errorf("invalid MTU %q, expected %d-%d", str, MinMTU, MaxMTU)
+	}
+	return mtu, nil
+}
+
+// ParseKeepalive parses, and checks, a proposed keepalive, which is
+// given in seconds.
+func ParseKeepalive(str string) (time.Duration, error) {
+	secs, err := strconv.Atoi(str)
+	keepalive := time.Duration(secs) * time.Second
+	if err != nil || keepalive < MinKeepalive || keepalive > MaxKeepalive {
+		return 0, fmt.Errorf("invalid keepalive %q, expected %d-%d seconds", str, int(MinKeepalive/time.Second), int(MaxKeepalive/time.Second))
+	}
+	return keepalive, nil
+}
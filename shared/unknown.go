@@ -0,0 +1,206 @@
+// shared/unknown.go contains our handling of frames sent to a unicast MAC
+// address which our hub hasn't learned.
+//
+// By default they are dropped, and counted.  Bridged setups may prefer
+// that we behave like a real switch, either flooding them to every socket
+// until the destination answers, or holding them briefly in the hope that
+// it will.  In either case we only wait for the given window, so frames to
+// a host which has gone away don't flood our clients forever.
+
+package shared
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// UnknownUnicast is our policy for frames sent to a unicast MAC address
+// which we haven't learned.
+type UnknownUnicast int
+
+// The policies for frames sent to unknown MACs.
+const (
+	// DropUnknown drops them.
+	DropUnknown UnknownUnicast = iota
+
+	// FloodUnknown sends them to every socket, for the window after
+	// the first, and drops them thereafter.
+	FloodUnknown
+
+	// QueueUnknown holds them for up to the window, and sends them to
+	// the socket which owns their destination if it's learned by then.
+	QueueUnknown
+)
+
+// unknownHoldDown is how long we remember a MAC we've stopped flooding
+// to, before we'll flood to it again.
+const unknownHoldDown = time.Minute
+
+// maxQueuedFrames is the number of frames we'll hold for each unknown
+// MAC, and maxUnknownMACs the number of MACs we'll flood to, or hold
+// frames for, at once.
+const (
+	maxQueuedFrames = 16
+	maxUnknownMACs  = 256
+)
+
+// ParseUnknownUnicast parses the name of a policy for frames sent to
+// unknown MACs, which is one of "drop", "flood", or "queue".
+func ParseUnknownUnicast(str string) (UnknownUnicast, error) {
+	switch str {
+	case "", "drop":
+		return DropUnknown, nil
+	case "flood":
+		return FloodUnknown, nil
+	case "queue":
+		return QueueUnknown, nil
+	}
+	return DropUnknown, fmt.Errorf("unknown policy for unknown unicast frames '%s', expected drop, flood, or queue", str)
+}
+
+// UnknownUnicastStats counts the frames we've seen sent to unknown MACs,
+// by what we did with them.
+type UnknownUnicastStats struct {
+	Dropped   uint64
+	Flooded   uint64
+	Queued    uint64
+	Delivered uint64
+}
+
+// queuedFrames holds the frames we're holding for an unknown MAC.
+type queuedFrames struct {
+	since  time.Time
+	frames [][]byte
+}
+
+// unknownUnicast holds the state of our policy.
+type unknownUnicast struct {
+	// stats are accessed atomically, so must be 64-bit aligned.
+	stats UnknownUnicastStats
+
+	policy UnknownUnicast
+	window time.Duration
+
+	// flooding holds when we began flooding to each unknown MAC, and
+	// queued the frames we're holding for each.
+	flooding map[MacAddr]time.Time
+	queued   map[MacAddr]*queuedFrames
+	mutex    sync.Mutex
+}
+
+// SetUnknownUnicast sets our policy for frames sent to unicast MACs which
+// we haven't learned, and the window for which we flood, or hold, them.
+//
+// This must be called before any socket is served.
+func (h *Hub) SetUnknownUnicast(policy UnknownUnicast, window time.Duration) {
+	h.unknown.policy = policy
+	h.unknown.window = window
+	h.unknown.flooding = make(map[MacAddr]time.Time)
+	h.unknown.queued = make(map[MacAddr]*queuedFrames)
+}
+
+// UnknownUnicast returns the counts of the frames we've seen sent to
+// unknown MACs.
+func (h *Hub) UnknownUnicast() UnknownUnicastStats {
+	u := &h.unknown
+	return UnknownUnicastStats{
+		Dropped:   atomic.LoadUint64(&u.stats.Dropped),
+		Flooded:   atomic.LoadUint64(&u.stats.Flooded),
+		Queued:    atomic.LoadUint64(&u.stats.Queued),
+		Delivered: atomic.LoadUint64(&u.stats.Delivered),
+	}
+}
+
+// sendUnknown applies our policy to the given frame, which was sent to
+// the given MAC, which we haven't learned.  The frame isn't flooded back
+// to the socket it came from, if any.
+func (h *Hub) sendUnknown(data []byte, dest MacAddr, skip *Socket) {
+	u := &h.unknown
+	if u.policy == DropUnknown {
+		atomic.AddUint64(&u.stats.Dropped, 1)
+		return
+	}
+
+	now := time.Now()
+	u.mutex.Lock()
+	u.expire(now)
+
+	if u.policy == FloodUnknown {
+		first, ok := u.flooding[dest]
+		if !ok && len(u.flooding) < maxUnknownMACs {
+			first, ok = now, true
+			u.flooding[dest] = first
+		}
+		u.mutex.Unlock()
+
+		if !ok || now.Sub(first) > u.window {
+			atomic.AddUint64(&u.stats.Dropped, 1)
+			return
+		}
+		atomic.AddUint64(&u.stats.Flooded, 1)
+		h.BroadcastMessage(websocket.BinaryMessage, data, skip)
+		return
+	}
+
+	q := u.queued[dest]
+	if q == nil && len(u.queued) < maxUnknownMACs {
+		q = &queuedFrames{since: now}
+		u.queued[dest] = q
+	}
+	if q == nil || len(q.frames) >= maxQueuedFrames {
+		u.mutex.Unlock()
+		atomic.AddUint64(&u.stats.Dropped, 1)
+		return
+	}
+	q.frames = append(q.frames, append([]byte(nil), data...))
+	u.mutex.Unlock()
+	atomic.AddUint64(&u.stats.Queued, 1)
+}
+
+// learned is invoked when we learn that the given MAC belongs to the
+// given socket.  We stop flooding to it, and send it any frames we've
+// been holding for it.
+func (h *Hub) learned(s *Socket, mac MacAddr) {
+	u := &h.unknown
+	if u.policy == DropUnknown {
+		return
+	}
+
+	u.mutex.Lock()
+	delete(u.flooding, mac)
+	q := u.queued[mac]
+	delete(u.queued, mac)
+	u.mutex.Unlock()
+
+	if q == nil {
+		return
+	}
+	if time.Since(q.since) > u.window {
+		atomic.AddUint64(&u.stats.Dropped, uint64(len(q.frames)))
+		return
+	}
+	for _, frame := range q.frames {
+		s.WriteMessage(websocket.BinaryMessage, frame)
+	}
+	atomic.AddUint64(&u.stats.Delivered, uint64(len(q.frames)))
+}
+
+// expire forgets the MACs we've stopped flooding to, and drops the frames
+// we've held for too long.  The caller must hold our mutex.
+func (u *unknownUnicast) expire(now time.Time) {
+	for mac, first := range u.flooding {
+		if now.Sub(first) > u.window+unknownHoldDown {
+			delete(u.flooding, mac)
+		}
+	}
+	for mac, q := range u.queued {
+		if now.Sub(q.since) > u.window {
+			atomic.AddUint64(&u.stats.Dropped, uint64(len(q.frames)))
+			delete(u.queued, mac)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package shared
 
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
 // MacAddr stores a MAC address.
 type MacAddr [6]byte
 
@@ -17,7 +23,139 @@ func GetDestMAC(packet []byte) MacAddr {
 	return mac
 }
 
+// ParseMAC parses a MAC address, such as "aa:bb:cc:dd:ee:ff".
+func ParseMAC(str string) (MacAddr, error) {
+	var mac MacAddr
+
+	hw, err := net.ParseMAC(str)
+	if err != nil {
+		return mac, err
+	}
+	if len(hw) != len(mac) {
+		return mac, fmt.Errorf("%s is not an ethernet MAC address", str)
+	}
+	copy(mac[:], hw)
+	return mac, nil
+}
+
 // MACIsUnicast returns true if the MAC address is a unicast address.
 func MACIsUnicast(mac MacAddr) bool {
 	return (mac[0] & 1) == 0
 }
+
+// GetSrcIP retrieves the source address of an IPv4, or IPv6, packet.
+// It returns nil if the packet is neither, or is truncated.
+func GetSrcIP(packet []byte) net.IP {
+	if len(packet) < 1 {
+		return nil
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= 20 {
+			return net.IP(packet[12:16])
+		}
+	case 6:
+		if len(packet) >= 40 {
+			return net.IP(packet[8:24])
+		}
+	}
+	return nil
+}
+
+// GetDestIP retrieves the destination address of an IPv4, or IPv6,
+// packet.  It returns nil if the packet is neither, or is truncated.
+func GetDestIP(packet []byte) net.IP {
+	if len(packet) < 1 {
+		return nil
+	}
+
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) >= 20 {
+			return net.IP(packet[16:20])
+		}
+	case 6:
+		if len(packet) >= 40 {
+			return net.IP(packet[24:40])
+		}
+	}
+	return nil
+}
+
+// FlowHash returns a hash of the flow the given packet belongs to, from
+// its addresses, protocol, and ports, such that every packet of a flow
+// has the same hash.  Other frames are hashed by their first bytes.
+func FlowHash(packet []byte) uint32 {
+	key := packet
+	if len(key) > 14 {
+		key = key[:14]
+	}
+
+	var ports []byte
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		key = packet[9:20]
+		ihl := int(packet[0]&0x0f) * 4
+		if (packet[9] == 6 || packet[9] == 17) && len(packet) >= ihl+4 {
+			ports = packet[ihl : ihl+4]
+		}
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		key = packet[6:40]
+		if (packet[6] == 6 || packet[6] == 17) && len(packet) >= 44 {
+			ports = packet[40:44]
+		}
+	}
+
+	//
+	// FNV-1a, without allocating.
+	//
+	hash := uint32(2166136261)
+	for _, b := range key {
+		hash = (hash ^ uint32(b)) * 16777619
+	}
+	for _, b := range ports {
+		hash = (hash ^ uint32(b)) * 16777619
+	}
+	return hash
+}
+
+// ParseNetworks parses a comma-separated list of IP addresses and CIDR
+// ranges.  Bare IP addresses are treated as a range containing only
+// that single address.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var out []*net.IPNet
+
+	for _, ent := range strings.Split(list, ",") {
+		ent = strings.TrimSpace(ent)
+		if ent == "" {
+			continue
+		}
+
+		if !strings.Contains(ent, "/") {
+			if strings.Contains(ent, ":") {
+				ent += "/128"
+			} else {
+				ent += "/32"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(ent)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, network)
+	}
+	return out, nil
+}
+
+// NetworksContain returns true if the given IP is within any of the
+// specified networks.
+func NetworksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+// shared/websocket.go contains the tunable settings of our websocket
+// connections, and how we dial them.
+
+package shared
+
+import (
+	"compress/flate"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// CookieHeader is the header with which a server, which requires a cookie
+// before it handles our handshake, gives us one.
+const CookieHeader = "X-Simple-Vpn-Cookie"
+
+// WebsocketOptions holds the settings of our websocket connections.
+type WebsocketOptions struct {
+	// ReadBufferSize and WriteBufferSize are the sizes of the I/O
+	// buffers of each connection, in bytes.  Zero uses the defaults
+	// of the websocket library.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// BufferPool shares write-buffers between connections, such that
+	// idle connections don't hold one.
+	BufferPool bool
+
+	// Compression enables per-message compression.
+	Compression bool
+
+	// CompressionLevel is the flate level used when compressing.
+	CompressionLevel int
+}
+
+// LoadWebsocketOptions parses the websocket settings in the given map.
+//
+// The settings are expected to be the result of looking up the `ws_`
+// prefix in a configuration file.  If an MTU is given then the buffers
+// default to being large enough to hold a frame of that size, with room
+// for an Ethernet header and the websocket framing.
+func LoadWebsocketOptions(settings map[string]string, mtu int) (WebsocketOptions, error) {
+	var err error
+	out := WebsocketOptions{CompressionLevel: flate.BestSpeed}
+
+	if mtu > 0 {
+		out.ReadBufferSize = mtu + 28
+		out.WriteBufferSize = mtu + 28
+	}
+
+	ints := map[string]*int{
+		"read_buffer":       &out.ReadBufferSize,
+		"write_buffer":      &out.WriteBufferSize,
+		"compression_level": &out.CompressionLevel,
+	}
+	for name, dest := range ints {
+		if settings[name] == "" {
+			continue
+		}
+		*dest, err = strconv.Atoi(settings[name])
+		if err != nil {
+			return out, fmt.Errorf("invalid ws_%s: %s", name, err.Error())
+		}
+	}
+
+	out.BufferPool = settings["buffer_pool"] == "true"
+	out.Compression = settings["compression"] == "true"
+
+	if out.CompressionLevel < flate.HuffmanOnly || out.CompressionLevel > flate.BestCompression {
+		return out, fmt.Errorf("invalid ws_compression_level: %d", out.CompressionLevel)
+	}
+	return out, nil
+}
+
+// pool returns the write-buffer pool to use, if any.
+func (o WebsocketOptions) pool() websocket.BufferPool {
+	if o.BufferPool {
+		return &sync.Pool{}
+	}
+	return nil
+}
+
+// Upgrader returns an Upgrader which uses our settings.
+func (o WebsocketOptions) Upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    o.ReadBufferSize,
+		WriteBufferSize:   o.WriteBufferSize,
+		WriteBufferPool:   o.pool(),
+		EnableCompression: o.Compression,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+	}
+}
+
+// Dialer returns a Dialer which uses our settings.
+func (o WebsocketOptions) Dialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	dialer.ReadBufferSize = o.ReadBufferSize
+	dialer.WriteBufferSize = o.WriteBufferSize
+	dialer.WriteBufferPool = o.pool()
+	dialer.EnableCompression = o.Compression
+	return &dialer
+}
+
+// Configure applies our settings to a connection which has been made
+// with our Upgrader, or Dialer.
+func (o WebsocketOptions) Configure(conn *websocket.Conn) {
+	if o.Compression {
+		conn.EnableWriteCompression(true)
+		conn.SetCompressionLevel(o.CompressionLevel)
+	}
+}
+
+// Dial connects to the given websocket URI, with the given dialer.
+//
+// A server which is protecting itself from floods of handshakes may refuse
+// ours until we present a cookie, which proves that we receive its replies.
+// If it gives us one we repeat our handshake, with it.
+func Dial(dialer *websocket.Dialer, uri string, headers http.Header) (*websocket.Conn, *http.Response, error) {
+	conn, resp, err := dialer.Dial(uri, headers)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusPreconditionRequired {
+		return conn, resp, err
+	}
+	cookie := resp.Header.Get(CookieHeader)
+	if cookie == "" {
+		return conn, resp, err
+	}
+
+	if strings.Contains(uri, "?") {
+		uri += "&"
+	} else {
+		uri += "?"
+	}
+	return dialer.Dial(uri+"cookie="+url.QueryEscape(cookie), headers)
+}